@@ -6,6 +6,7 @@ import (
 	"io"
 	"math/rand"
 	"net"
+	"sort"
 	"sync"
 	"syscall"
 	"time"
@@ -91,7 +92,9 @@ func (tp topicPartition) String() string {
 }
 
 type BrokerConf struct {
-	// Kafka client ID.
+	// Kafka client ID. It is sent in the header of every request made by
+	// the broker and its connections, unless the request sets its own, and
+	// brokers include it in their request logs.
 	ClientID string
 
 	// LeaderRetryLimit limits the number of connection attempts to a single
@@ -122,6 +125,15 @@ type BrokerConf struct {
 	// Default is 10 seconds.
 	DialTimeout time.Duration
 
+	// Resolve is called with the host name of a broker every time a new
+	// connection to it is dialed, and the returned addresses are tried in
+	// order. It allows following brokers whose IP addresses change, without
+	// relying on caching done by the system resolver. Use net.LookupHost to
+	// resolve with the Go resolver.
+	//
+	// Default is nil, which means the address is dialed as is.
+	Resolve ResolveFunc
+
 	// DialRetryLimit limits the number of connection attempts to every node in
 	// cluster before failing. Use DialRetryWait to control the wait time
 	// between retries.
@@ -151,6 +163,17 @@ type BrokerConf struct {
 	// Defaults to 0 which means disabled.
 	MetadataRefreshFrequency time.Duration
 
+	// MetadataFetchBrokers is the number of brokers metadata is requested
+	// from concurrently on every refresh. Responses are reconciled, preferring
+	// the view of brokers reporting a valid controller, which protects
+	// against a single broker having stale or partial metadata while the
+	// cluster changes. Only metadata responses of version 1 and above report
+	// the controller, see APIVersions. Of version 0 responses, those listing
+	// more brokers are preferred.
+	//
+	// Defaults to 1, which asks one broker at a time.
+	MetadataFetchBrokers int
+
 	// ConnectionLimit sets a limit on how many outstanding connections may exist to a
 	// single broker. This limit is for all connections except Metadata fetches which are exempted
 	// but separately limited to one per cluster. That is, the maximum number of connections per
@@ -168,6 +191,178 @@ type BrokerConf struct {
 	//
 	// Default is 200ms.
 	IdleConnectionWait time.Duration
+
+	// MaxRequestSize and MaxSocketRequestSize both limit the size of a single
+	// encoded produce request, mirroring two limits of the broker that fail
+	// differently. Both are checked before the request is sent, the socket
+	// limit first, so with the defaults only MaxRequestSize is ever hit.
+	//
+	// MaxRequestSize should match the message.max.bytes setting of the
+	// cluster. The broker answers larger requests with an error, keeping
+	// the connection open. Requests exceeding it are rejected with
+	// ErrMessageTooLarge instead of being sent.
+	//
+	// Default is 1MB. Set to 0 to disable the check.
+	MaxRequestSize int
+
+	// MaxSocketRequestSize should match the socket.request.max.bytes
+	// setting of the cluster. The broker drops connections sending larger
+	// requests instead of answering them, so requests exceeding it are
+	// rejected with *RequestTooLargeError, which reports the size and the
+	// limit. It only matters if MaxRequestSize is disabled or set above it.
+	//
+	// Default is 100MB. Set to 0 to disable the check.
+	MaxSocketRequestSize int
+
+	// MaxInFlightProduceBytes limits the size of produce requests sent with
+	// a connection that are still waiting for their acks. Once exceeded,
+	// producing with the connection blocks until earlier requests are
+	// acked, which gives bursting producers back-pressure instead of
+	// queueing requests without bound. Single request larger than the limit
+	// is sent once no other one is waiting for acks. Requests without acks
+	// are not accounted.
+	//
+	// Default is 0, which means no limit.
+	MaxInFlightProduceBytes int64
+
+	// MaxResponseSize limits the size of a single response read from a
+	// broker. Connection receiving a larger response is closed with
+	// proto.ResponseSizeError instead of allocating memory for it, which
+	// protects against corrupted or malicious size prefixes.
+	//
+	// Default is 100MB. Set to 0 to disable the check.
+	MaxResponseSize int32
+
+	// SkipOversizedResponses makes connections discard a response larger
+	// than MaxResponseSize, failing only the request it answers with
+	// proto.ResponseSizeError, and keep reading the following responses.
+	// Without it, the connection is closed, failing all requests in flight.
+	//
+	// Default is false.
+	SkipOversizedResponses bool
+
+	// ReadTimeout limits the time waiting for the response to any request,
+	// after which the request fails with ErrReadTimeout. Fetch requests are
+	// always given at least their MaxWaitTime plus one second, so that long
+	// polling does not time out.
+	//
+	// Default is 0, which means no limit.
+	ReadTimeout time.Duration
+
+	// WriteTimeout limits the time writing a single request to the broker,
+	// which exceeds it when it stops accepting data. Request that does not
+	// fit fails with ErrWriteTimeout, and the connection is closed.
+	//
+	// Default is 0, which means no limit.
+	WriteTimeout time.Duration
+
+	// SocketReadTimeout limits the time a connection with requests in
+	// flight waits for any response to arrive, detecting brokers that
+	// stopped responding. Once exceeded, the connection is closed and all
+	// its requests in flight fail with ErrSocketReadTimeout. Idle
+	// connections are not affected. It must be larger than MaxWaitTime of
+	// fetch requests.
+	//
+	// Default is 0, which means no limit.
+	SocketReadTimeout time.Duration
+
+	// StrictCorrelationIDs makes connections treat a response to a request
+	// that was never sent as a fatal protocol error, closing the connection
+	// with ErrProtocolDesync, instead of logging and dropping the response.
+	// Responses arriving after the request timed out are always dropped.
+	//
+	// Default is false.
+	StrictCorrelationIDs bool
+
+	// Compression is applied to all produce requests sent without
+	// compression, including those of producers configured with
+	// proto.CompressionNone. Produce requests fail with
+	// ErrUnsupportedCompression if the codec is not supported.
+	//
+	// Default is proto.CompressionNone.
+	Compression proto.Compression
+
+	// Clock measures read timeouts and the age of connections. Tests may
+	// replace it to advance time without sleeping.
+	//
+	// Default is nil, which means RealClock.
+	Clock Clock
+
+	// ReadBufferSize is the size of the buffer responses of every connection
+	// are read through. Larger buffer means fewer reads of big fetch
+	// responses, at the cost of memory used by every connection.
+	//
+	// Default is 64KB.
+	ReadBufferSize int
+
+	// ExpectedInFlight is a hint of how many requests every connection is
+	// expected to have in flight at once. Responses are awaited in maps
+	// sized for that many requests up front, so that they do not need to
+	// grow under burst load.
+	//
+	// Default is 0, which means no sizing.
+	ExpectedInFlight int
+
+	// APIVersions pins the version of requests of given API kinds, such as
+	// proto.FetchReqKind, sent by all connections, overriding the versions
+	// requested by consumers, producers and other callers. It can be used to
+	// work around brokers misbehaving with specific versions. Only Produce,
+	// Fetch, Metadata and OffsetFetch requests are versioned. Pinning a
+	// version that the broker, or the request being sent, does not support
+	// is the caller's responsibility.
+	//
+	// Default is nil, which pins no versions.
+	APIVersions map[int16]int16
+
+	// AllowedAPIKeys limits the kinds of requests connections send, such as
+	// proto.FetchReqKind, to those mapped to true. Other requests fail with
+	// ErrAPIKeyForbidden without being written. It is a client side guard
+	// for tools that must never issue some requests, independent of broker
+	// ACLs. Allowing proto.APIVersionsReqKind and the SASL requests is up
+	// to the caller.
+	//
+	// Default is nil, which allows all requests.
+	AllowedAPIKeys map[int16]bool
+
+	// StaleFetch sets what fetches do with partitions for which the broker
+	// returned only messages older than the requested offset, which are
+	// dropped. See StaleFetchPolicy.
+	//
+	// Default is StaleFetchIgnore, which returns them without messages and
+	// without error.
+	StaleFetch StaleFetchPolicy
+
+	// TraceSeparator separates trace IDs embedded in client IDs of requests
+	// with TraceClientID from the client ID. Connections log the trace ID of
+	// every request carrying one, together with its correlation ID, so that
+	// it can be matched with the request logs of the broker, which contain
+	// the client ID.
+	//
+	// Default is empty, which disables logging trace IDs.
+	TraceSeparator string
+
+	// DowngradeVersions enables retrying Produce, Fetch and Metadata requests
+	// rejected with proto.ErrUnsupportedVersion using lower versions, as long
+	// as the broker supports them. Every new connection asks the broker for
+	// the versions it supports with an ApiVersions request, which brokers
+	// older than 0.10 do not understand.
+	//
+	// Default is false.
+	DowngradeVersions bool
+
+	// SASL is the mechanism used to authenticate every new connection. Each
+	// step of the authentication must complete within DialTimeout, otherwise
+	// the connection is closed and ErrAuthTimeout returned.
+	//
+	// Default is nil, which disables authentication.
+	SASL SASLMechanism
+
+	// OnWire is called with the raw bytes of every request and response of
+	// every connection, which helps diagnosing protocol issues. See
+	// WireHook.
+	//
+	// Default is nil, which disables the hook.
+	OnWire WireHook
 }
 
 func NewBrokerConf(clientID string) BrokerConf {
@@ -181,8 +376,13 @@ func NewBrokerConf(clientID string) BrokerConf {
 		LeaderRetryWait:          500 * time.Millisecond,
 		MetadataRefreshTimeout:   30 * time.Second,
 		MetadataRefreshFrequency: 0,
+		MetadataFetchBrokers:     1,
 		ConnectionLimit:          10,
 		IdleConnectionWait:       200 * time.Millisecond,
+		MaxRequestSize:           1024 * 1024,
+		MaxSocketRequestSize:     100 * 1024 * 1024,
+		MaxResponseSize:          100 * 1024 * 1024,
+		ReadBufferSize:           64 * 1024,
 	}
 }
 
@@ -197,7 +397,9 @@ type Broker struct {
 }
 
 // Dial connects to any node from a given list of kafka addresses and after
-// successful metadata fetch, returns broker.
+// successful metadata fetch, returns broker. If metadata could not be fetched
+// within DialRetryLimit tries, the error of the last try is returned wrapped,
+// which is *DialError if none of the addresses could be dialed.
 //
 // The returned broker is not initially connected to any kafka node.
 func Dial(nodeAddresses []string, conf BrokerConf) (*Broker, error) {
@@ -216,6 +418,7 @@ func Dial(nodeAddresses []string, conf BrokerConf) (*Broker, error) {
 
 	// Attempt to connect to the cluster but we want to do this with backoff and make sure we
 	// don't exceed the limits
+	var lastErr error
 	retry := &backoff.Backoff{Min: conf.DialRetryWait, Jitter: true}
 	for try := 0; try < conf.DialRetryLimit; try++ {
 		if try > 0 {
@@ -237,11 +440,16 @@ func Dial(nodeAddresses []string, conf BrokerConf) (*Broker, error) {
 				return broker, nil
 			}
 			log.Errorf("cannot fetch metadata: %s", err)
+			lastErr = err
 		case <-time.After(conf.DialTimeout):
 			log.Error("timeout fetching metadata")
+			lastErr = errors.New("timeout fetching metadata")
 		}
 	}
-	return nil, errors.New("cannot connect (exhausted retries)")
+	if lastErr == nil {
+		return nil, errors.New("cannot connect (exhausted retries)")
+	}
+	return nil, fmt.Errorf("cannot connect (exhausted retries): %w", lastErr)
 }
 
 // Close closes the broker and all active kafka nodes connections.
@@ -367,8 +575,10 @@ func (b *Broker) leaderConnection(topic string, partition int32) (*connection, e
 }
 
 // coordinatorConnection returns connection to offset coordinator for given group. May
-// return proto.ErrNoCoordinator if we are unable to find a broker to talk to. May also
-// return other errors (connection errors, ErrNoTopic, etc).
+// return proto.ErrNoCoordinator if we are unable to find a broker to talk to. Errors
+// returned by the broker looking up the coordinator, such as
+// proto.ErrCoordinatorLoadInProgress, are returned as they are. May also return other
+// errors (connection errors, ErrNoTopic, etc).
 //
 // NOTE: this function returns a connection and it is the caller's responsibility to ensure
 // that this connection is eventually returned to the pool with Idle.
@@ -377,11 +587,14 @@ func (b *Broker) coordinatorConnection(consumerGroup string) (*connection, error
 	resp, err := b.getGroupCoordinator(consumerGroup)
 	if err != nil {
 		log.Warningf("coordinatorConnection: failed to discover coordinator: %s", err)
+		if _, ok := err.(*proto.KafkaError); ok {
+			return nil, err
+		}
 		return nil, proto.ErrNoCoordinator
 	}
 
 	// Now get connection to actual coordinator
-	addr := fmt.Sprintf("%s:%d", resp.CoordinatorHost, resp.CoordinatorPort)
+	addr := normalizeBrokerAddr(resp.CoordinatorHost, resp.CoordinatorPort)
 	conn, err := b.conns.GetConnectionByAddr(addr)
 	if err != nil {
 		log.Errorf("coordinatorConnection: failed to reach node %d at %s: %s",
@@ -471,7 +684,7 @@ offsetRetryLoop:
 
 		resp, err := conn.Offset(req)
 		if err != nil {
-			if _, ok := err.(*net.OpError); ok || err == io.EOF || err == syscall.EPIPE {
+			if _, ok := err.(*net.OpError); ok || err == io.EOF || err == ErrBrokerDisconnected || err == syscall.EPIPE {
 				log.Debugf("connection died while sending message to %s:%d: %s",
 					topic, partition, err)
 				conn.Close()
@@ -490,15 +703,11 @@ offsetRetryLoop:
 				}
 				resErr = p.Err
 
-				switch p.Err {
-				case proto.ErrLeaderNotAvailable, proto.ErrNotLeaderForPartition,
-					proto.ErrBrokerNotAvailable:
+				if isLeaderMoved(p.Err) {
 					// Failover happened, so we probably need to talk to a different broker. Let's
 					// kick off a metadata refresh.
-					log.Debugf("cannot fetch offset: %s", p.Err)
-					if err := b.metadata.Refresh(); err != nil {
-						log.Debugf("cannot refresh metadata: %s", err)
-					}
+					resErr = leaderMoved(topic, partition, p.Err, b.metadata.Refresh)
+					log.Debugf("cannot fetch offset: %s", resErr)
 					continue offsetRetryLoop
 				}
 
@@ -528,16 +737,92 @@ func (b *Broker) OffsetLatest(topic string, partition int32) (int64, error) {
 	return b.offset(topic, partition, -1)
 }
 
+// OffsetDelete deletes offsets committed by the consumer group for given
+// partitions of every topic, sending the request to the coordinator of the
+// group. Error is returned if the request failed as a whole, otherwise every
+// partition is reported with its own error in the response. Offsets of topics
+// the group is still subscribed to cannot be deleted, which is reported with
+// proto.ErrGroupSubscribedToTopic.
+func (b *Broker) OffsetDelete(consumerGroup string, topicPartitions map[string][]int32) (*proto.OffsetDeleteResp, error) {
+	req := &proto.OffsetDeleteReq{
+		ClientID:      b.conf.ClientID,
+		ConsumerGroup: consumerGroup,
+	}
+	for topic, partitions := range topicPartitions {
+		req.Topics = append(req.Topics, proto.OffsetDeleteReqTopic{
+			Name:       topic,
+			Partitions: partitions,
+		})
+	}
+	sort.Slice(req.Topics, func(i, j int) bool { return req.Topics[i].Name < req.Topics[j].Name })
+
+	conn, err := b.coordinatorConnection(consumerGroup)
+	if err != nil {
+		return nil, err
+	}
+	defer func(lconn *connection) { go b.conns.Idle(lconn) }(conn)
+
+	resp, err := conn.OffsetDelete(req)
+	if err != nil {
+		if isConnectionError(err) {
+			_ = conn.Close()
+		}
+		return nil, err
+	}
+	if resp.Err != nil {
+		return nil, resp.Err
+	}
+	return resp, nil
+}
+
 type ProducerConf struct {
 	// Compression method to use, defaulting to proto.CompressionNone.
 	Compression proto.Compression
 
+	// CompressionLevel controls the gzip compression level, from
+	// gzip.NoCompression to gzip.BestCompression. Only used when Compression
+	// is set to proto.CompressionGzip and CompressionLevelSet is true.
+	CompressionLevel int
+
+	// CompressionLevelSet tells whether CompressionLevel should be used.
+	// Defaults to false, which means gzip.DefaultCompression.
+	CompressionLevelSet bool
+
+	// MinCompressSize is the smallest uncompressed size of messages, in
+	// bytes, that are compressed. Smaller batches are sent uncompressed
+	// regardless of Compression. Set to 0 to compress every batch.
+	//
+	// Defaults to 64.
+	MinCompressSize int
+
+	// RequestVersion is the version of produce requests, from 0 to 2. Use 2
+	// to send message timestamps, in which case messages without a timestamp
+	// are sent with the current time, which is not set on the messages of
+	// the caller. Timestamps set by the caller are sent
+	// as create time and preserved, which allows replaying messages with
+	// their original timestamps, unless the topic uses log append time. The
+	// broker then overrides them, which is logged as a warning.
+	//
+	// Defaults to 0.
+	RequestVersion int16
+
+	// TimestampTypes sets the timestamp type of messages produced to given
+	// topics, which should match their message.timestamp.type, so that
+	// replayed messages keep the meaning of their timestamps. Timestamp
+	// types other than proto.TimestampCreateTime require RequestVersion 2.
+	//
+	// Defaults to nil, which produces all messages with create time.
+	TimestampTypes map[string]proto.TimestampType
+
 	// Timeout of single produce request. By default, 5 seconds.
 	RequestTimeout time.Duration
 
 	// Message ACK configuration. Use proto.RequiredAcksAll to require all
 	// servers to write, proto.RequiredAcksLocal to wait only for leader node
 	// answer or proto.RequiredAcksNone to not wait for any response.
+	// With proto.RequiredAcksNone, producing succeeds once the request is
+	// written to the connection, so messages can be lost without any error
+	// being reported, and the returned offset is always 0.
 	// Setting this to any other, greater than zero value will make producer to
 	// wait for given number of servers to confirm write before returning.
 	RequiredAcks int16
@@ -557,11 +842,12 @@ type ProducerConf struct {
 // NewProducerConf returns a default producer configuration.
 func NewProducerConf() ProducerConf {
 	return ProducerConf{
-		Compression:    proto.CompressionNone,
-		RequestTimeout: 5 * time.Second,
-		RequiredAcks:   proto.RequiredAcksAll,
-		RetryLimit:     10,
-		RetryWait:      200 * time.Millisecond,
+		Compression:     proto.CompressionNone,
+		MinCompressSize: 64,
+		RequestTimeout:  5 * time.Second,
+		RequiredAcks:    proto.RequiredAcksAll,
+		RetryLimit:      10,
+		RetryWait:       200 * time.Millisecond,
 	}
 }
 
@@ -586,6 +872,16 @@ func (b *Broker) Producer(conf ProducerConf) Producer {
 // RetryLimit and RetryWait attributes.
 //
 // Upon a successful call, the message's Offset field is updated.
+//
+// If the broker is no longer the leader of the partition, metadata is
+// refreshed and *ErrLeaderMoved returned, so that the messages can be produced
+// again to the new leader.
+//
+// Calling Produce without messages sends a produce request listing the topic
+// without any partitions, which writes nothing. It still round-trips to the
+// leader of the partition, so it can be used to check that the leader accepts
+// produce requests of the client, and returns any error reported by it. The
+// wait for the response is bounded by ReadTimeout of the broker configuration.
 func (p *producer) Produce(
 	topic string, partition int32, messages ...*proto.Message) (offset int64, err error) {
 
@@ -596,12 +892,21 @@ func (p *producer) Produce(
 		for i, msg := range messages {
 			msg.Offset = int64(i) + offset
 		}
-	case io.EOF, syscall.EPIPE:
+	case io.EOF, ErrBrokerDisconnected, syscall.EPIPE:
 		// Connection dying / network issues won't be fixed by a metadata refresh.
+	case ErrMessageTooLarge:
+		// Request was never sent, there is nothing wrong with the metadata.
 	default:
-		// Try to refresh metadata in the background, in case the produce failed due to stale
-		// leadership information.
-		go p.broker.metadata.Refresh()
+		switch err.(type) {
+		case *RequestTooLargeError:
+			// Request was never sent, there is nothing wrong with the metadata.
+		case *ErrLeaderMoved:
+			// Metadata was already refreshed.
+		default:
+			// Try to refresh metadata in the background, in case the produce failed due to stale
+			// leadership information.
+			go p.broker.metadata.Refresh()
+		}
 	}
 	return offset, err
 }
@@ -616,27 +921,56 @@ func (p *producer) produce(
 	}
 	defer func(lconn *connection) { go p.broker.conns.Idle(lconn) }(conn)
 
+	var explicitTimestamps bool
+	if p.conf.RequestVersion >= 2 {
+		// messages of the caller are left as they are, those without
+		// timestamp are sent as copies carrying the current time
+		now := time.Now()
+		stamped := make([]*proto.Message, len(messages))
+		for i, msg := range messages {
+			if msg.Timestamp.IsZero() {
+				withTime := *msg
+				withTime.Timestamp = now
+				msg = &withTime
+			} else {
+				explicitTimestamps = true
+			}
+			stamped[i] = msg
+		}
+		messages = stamped
+	}
+
+	partitions := []proto.ProduceReqPartition{
+		{
+			ID:            partition,
+			Messages:      messages,
+			TimestampType: p.conf.TimestampTypes[topic],
+		},
+	}
+	if len(messages) == 0 {
+		// no-op request, empty message set could be rejected as invalid
+		partitions = nil
+	}
 	req := proto.ProduceReq{
-		ClientID:     p.broker.conf.ClientID,
-		Compression:  p.conf.Compression,
-		RequiredAcks: p.conf.RequiredAcks,
-		Timeout:      p.conf.RequestTimeout,
+		ClientID:            p.broker.conf.ClientID,
+		Compression:         p.conf.Compression,
+		CompressionLevel:    p.conf.CompressionLevel,
+		CompressionLevelSet: p.conf.CompressionLevelSet,
+		MinCompressSize:     p.conf.MinCompressSize,
+		RequiredAcks:        p.conf.RequiredAcks,
+		Timeout:             p.conf.RequestTimeout,
+		Version:             p.conf.RequestVersion,
 		Topics: []proto.ProduceReqTopic{
 			{
-				Name: topic,
-				Partitions: []proto.ProduceReqPartition{
-					{
-						ID:       partition,
-						Messages: messages,
-					},
-				},
+				Name:       topic,
+				Partitions: partitions,
 			},
 		},
 	}
 
 	resp, err := conn.Produce(&req)
 	if err != nil {
-		if _, ok := err.(*net.OpError); ok || err == io.EOF || err == syscall.EPIPE {
+		if _, ok := err.(*net.OpError); ok || err == io.EOF || err == ErrBrokerDisconnected || err == syscall.EPIPE {
 			// Connection is broken, so should be closed, but the error is
 			// still valid and should be returned so that retry mechanism have
 			// chance to react.
@@ -652,6 +986,20 @@ func (p *producer) produce(
 		return 0, err
 	}
 
+	refresh := p.broker.metadata.Refresh
+
+	// Nothing was written, the response can only report errors
+	if len(messages) == 0 {
+		for _, t := range resp.Topics {
+			for _, p := range t.Partitions {
+				if p.Err != nil {
+					return 0, leaderMoved(topic, partition, p.Err, refresh)
+				}
+			}
+		}
+		return 0, nil
+	}
+
 	// Presently we only handle producing to a single topic/partition so return it as
 	// soon as we've found it
 	for _, t := range resp.Topics {
@@ -662,7 +1010,13 @@ func (p *producer) produce(
 				continue
 			}
 
-			return p.Offset, p.Err
+			// Broker returns the append time only if it replaced message
+			// timestamps with it.
+			if explicitTimestamps && !p.Timestamp.IsZero() {
+				log.Warningf("%s:%d uses log append time, message timestamps were overridden",
+					topic, partition)
+			}
+			return p.Offset, leaderMoved(topic, partition, p.Err, refresh)
 		}
 	}
 
@@ -698,7 +1052,8 @@ type ConsumerConf struct {
 	RetryWait time.Duration
 
 	// RetryErrLimit limits the number of retry attempts when an error is
-	// encountered.
+	// encountered. If the leader of the partition keeps moving until the
+	// limit is reached, *ErrLeaderMoved is returned.
 	//
 	// Default is 10.
 	RetryErrLimit int
@@ -720,6 +1075,22 @@ type ConsumerConf struct {
 	// Default is 2000000 bytes.
 	MaxFetchSize int32
 
+	// AdaptiveFetchSize makes the consumer adjust the maximum size of data
+	// fetched to the throughput of the partition, starting at MaxFetchSize.
+	// It is doubled after a response that is nearly full, and halved after a
+	// response that is mostly empty, within MinAdaptiveFetchSize and
+	// MaxAdaptiveFetchSize.
+	//
+	// Default is false, which always fetches MaxFetchSize.
+	AdaptiveFetchSize bool
+
+	// MinAdaptiveFetchSize and MaxAdaptiveFetchSize bound the maximum size of
+	// data fetched when AdaptiveFetchSize is set.
+	//
+	// Default is 64KB and 16MB.
+	MinAdaptiveFetchSize int32
+	MaxAdaptiveFetchSize int32
+
 	// Consumer cursor starting point. Set to StartOffsetNewest to receive only
 	// newly created messages or StartOffsetOldest to read everything. Assign
 	// any offset value to manually set cursor -- consuming starts with the
@@ -727,6 +1098,13 @@ type ConsumerConf struct {
 	//
 	// Default is StartOffsetOldest.
 	StartOffset int64
+
+	// RequestVersion is the version of fetch requests, from 0 to 7. Use 2 or
+	// above to receive message timestamps. Use 7 to fetch using incremental
+	// fetch sessions, which are maintained per connection.
+	//
+	// Default is 0.
+	RequestVersion int16
 }
 
 // NewConsumerConf returns the default consumer configuration.
@@ -742,6 +1120,9 @@ func NewConsumerConf(topic string, partition int32) ConsumerConf {
 		MinFetchSize:   1,
 		MaxFetchSize:   2000000,
 		StartOffset:    StartOffsetOldest,
+
+		MinAdaptiveFetchSize: 64 * 1024,
+		MaxAdaptiveFetchSize: 16 * 1024 * 1024,
 	}
 }
 
@@ -755,6 +1136,8 @@ type consumer struct {
 	mu     *sync.Mutex
 	offset int64 // offset of next NOT consumed message
 	msgbuf []*proto.Message
+	// fetchSize is set if the fetch size adapts to the responses.
+	fetchSize *adaptiveFetchSize
 }
 
 // Consumer creates a new consumer instance, bound to the broker.
@@ -794,6 +1177,10 @@ func (b *Broker) consumer(conf ConsumerConf) (*consumer, error) {
 		msgbuf: make([]*proto.Message, 0),
 		offset: offset,
 	}
+	if conf.AdaptiveFetchSize {
+		c.fetchSize = newAdaptiveFetchSize(conf.MaxFetchSize,
+			conf.MinAdaptiveFetchSize, conf.MaxAdaptiveFetchSize)
+	}
 	return c, nil
 }
 
@@ -867,10 +1254,15 @@ func (c *consumer) ConsumeBatch() ([]*proto.Message, error) {
 // retry sending fetch request. Retry behaviour can be configured with
 // RetryErrLimit and RetryErrWait consumer configuration attributes.
 func (c *consumer) fetch() ([]*proto.Message, error) {
+	maxBytes := c.conf.MaxFetchSize
+	if c.fetchSize != nil {
+		maxBytes = c.fetchSize.size
+	}
 	req := proto.FetchReq{
 		ClientID:    c.broker.conf.ClientID,
 		MaxWaitTime: c.conf.RequestTimeout,
 		MinBytes:    c.conf.MinFetchSize,
+		Version:     c.conf.RequestVersion,
 		Topics: []proto.FetchReqTopic{
 			{
 				Name: c.conf.Topic,
@@ -878,7 +1270,7 @@ func (c *consumer) fetch() ([]*proto.Message, error) {
 					{
 						ID:          c.conf.Partition,
 						FetchOffset: c.offset,
-						MaxBytes:    c.conf.MaxFetchSize,
+						MaxBytes:    maxBytes,
 					},
 				},
 			},
@@ -902,7 +1294,7 @@ consumeRetryLoop:
 
 		resp, err := conn.Fetch(&req)
 		resErr = err
-		if _, ok := err.(*net.OpError); ok || err == io.EOF || err == syscall.EPIPE {
+		if _, ok := err.(*net.OpError); ok || err == io.EOF || err == ErrBrokerDisconnected || err == syscall.EPIPE {
 			log.Debugf("connection died while fetching messages from %s:%d: %s",
 				c.conf.Topic, c.conf.Partition, err)
 			conn.Close()
@@ -924,17 +1316,21 @@ consumeRetryLoop:
 					continue
 				}
 
-				switch p.Err {
-				case proto.ErrLeaderNotAvailable, proto.ErrNotLeaderForPartition,
-					proto.ErrBrokerNotAvailable:
+				if isLeaderMoved(p.Err) {
 					// Failover happened, so we probably need to talk to a different broker. Let's
 					// kick off a metadata refresh.
-					log.Debugf("cannot fetch messages (try %d): %s", retry, p.Err)
-					if err := c.broker.metadata.Refresh(); err != nil {
-						log.Debugf("cannot refresh metadata: %s", err)
-					}
+					resErr = leaderMoved(c.conf.Topic, c.conf.Partition, p.Err, c.broker.metadata.Refresh)
+					log.Debugf("cannot fetch messages (try %d): %s", try, resErr)
 					continue consumeRetryLoop
 				}
+				if c.fetchSize != nil && p.Err == nil {
+					c.fetchSize.update(p.Messages)
+				}
+				if p.Err == nil && len(p.Messages) == 0 && len(p.ControlRecords) != 0 {
+					// transaction markers are never returned as messages,
+					// so move past them instead of fetching them again
+					c.offset = p.ControlRecords[len(p.ControlRecords)-1].Offset + 1
+				}
 				return p.Messages, p.Err
 			}
 		}
@@ -953,6 +1349,16 @@ type OffsetCoordinatorConf struct {
 	// RetryErrWait controls wait duration between retries after failed fetch
 	// request. By default 500ms.
 	RetryErrWait time.Duration
+
+	// GenerationID and MemberID identify the consumer group member
+	// committing offsets. When set, the broker rejects commits sent after the
+	// group has rebalanced with proto.ErrIllegalGeneration or
+	// proto.ErrUnknownMemberID, so that a stale member cannot overwrite
+	// offsets committed by the current one. Such commits are not retried.
+	//
+	// By default MemberID is empty and commits are not fenced.
+	GenerationID int32
+	MemberID     string
 }
 
 // NewOffsetCoordinatorConf returns default OffsetCoordinator configuration.
@@ -982,6 +1388,21 @@ func (b *Broker) OffsetCoordinator(conf OffsetCoordinatorConf) (OffsetCoordinato
 	return c, nil
 }
 
+// CommitConsumed commits, for given consumer group, the offset following the
+// last consumed message of given partition, which is the offset consumption
+// should continue from after restart. Use it instead of committing the offset
+// of the last consumed message, which would then be consumed twice.
+// Offset coordinator with default configuration is used for committing.
+func (b *Broker) CommitConsumed(
+	group string, topic string, partition int32, lastConsumedOffset int64, metadata string) error {
+
+	c := &offsetCoordinator{
+		broker: b,
+		conf:   NewOffsetCoordinatorConf(group),
+	}
+	return c.commit(topic, partition, lastConsumedOffset+1, metadata)
+}
+
 // Commit is saving offset information for given topic and partition.
 //
 // Commit can retry saving offset information on common errors. This behaviour
@@ -1003,6 +1424,7 @@ func (c *offsetCoordinator) commit(
 	topic string, partition int32, offset int64, metadata string) (resErr error) {
 
 	retry := &backoff.Backoff{Min: c.conf.RetryErrWait, Jitter: true}
+attempts:
 	for try := 0; try < c.conf.RetryErrLimit; try++ {
 		if try != 0 {
 			time.Sleep(retry.Duration())
@@ -1020,6 +1442,8 @@ func (c *offsetCoordinator) commit(
 		resp, err := conn.OffsetCommit(&proto.OffsetCommitReq{
 			ClientID:      c.broker.conf.ClientID,
 			ConsumerGroup: c.conf.ConsumerGroup,
+			GenerationID:  c.conf.GenerationID,
+			MemberID:      c.conf.MemberID,
 			Topics: []proto.OffsetCommitReqTopic{
 				{
 					Name: topic,
@@ -1031,7 +1455,7 @@ func (c *offsetCoordinator) commit(
 		})
 		resErr = err
 
-		if _, ok := err.(*net.OpError); ok || err == io.EOF || err == syscall.EPIPE {
+		if _, ok := err.(*net.OpError); ok || err == io.EOF || err == ErrBrokerDisconnected || err == syscall.EPIPE {
 			log.Debugf("connection died while committing on %s:%d for %s: %s",
 				topic, partition, c.conf.ConsumerGroup, err)
 			conn.Close()
@@ -1045,6 +1469,18 @@ func (c *offsetCoordinator) commit(
 							t.Name, p.ID)
 						continue
 					}
+					switch p.Err {
+					case proto.ErrIllegalGeneration, proto.ErrUnknownMemberID:
+						log.Warningf("commit on %s:%d for %s fenced (generation %d, member %q): %s",
+							topic, partition, c.conf.ConsumerGroup, c.conf.GenerationID, c.conf.MemberID, p.Err)
+					}
+					// coordinator is looked up again by the next attempt
+					if isCoordinatorErr(p.Err) {
+						log.Warningf("commit on %s:%d for %s failed, retrying: %s",
+							topic, partition, c.conf.ConsumerGroup, p.Err)
+						resErr = p.Err
+						continue attempts
+					}
 					return p.Err
 				}
 			}
@@ -1065,6 +1501,7 @@ func (c *offsetCoordinator) Offset(
 	offset int64, metadata string, resErr error) {
 
 	retry := &backoff.Backoff{Min: c.conf.RetryErrWait, Jitter: true}
+attempts:
 	for try := 0; try < c.conf.RetryErrLimit; try++ {
 		if try != 0 {
 			time.Sleep(retry.Duration())
@@ -1091,12 +1528,22 @@ func (c *offsetCoordinator) Offset(
 		resErr = err
 
 		switch err {
-		case io.EOF, syscall.EPIPE:
+		case io.EOF, ErrBrokerDisconnected, syscall.EPIPE:
 			log.Debugf("connection died while fetching offsets on %s:%d for %s: %s",
 				topic, partition, c.conf.ConsumerGroup, err)
 			conn.Close()
 
 		case nil:
+			// versions 2 and above report errors of the whole group
+			if isCoordinatorErr(resp.Err) {
+				log.Warningf("offset fetch for %s failed, retrying: %s",
+					c.conf.ConsumerGroup, resp.Err)
+				resErr = resp.Err
+				continue attempts
+			}
+			if resp.Err != nil {
+				return 0, "", resp.Err
+			}
 			for _, t := range resp.Topics {
 				for _, p := range t.Partitions {
 					if t.Name != topic || p.ID != partition {
@@ -1105,6 +1552,13 @@ func (c *offsetCoordinator) Offset(
 						continue
 					}
 
+					// coordinator is looked up again by the next attempt
+					if isCoordinatorErr(p.Err) {
+						log.Warningf("offset fetch on %s:%d for %s failed, retrying: %s",
+							topic, partition, c.conf.ConsumerGroup, p.Err)
+						resErr = p.Err
+						continue attempts
+					}
 					if p.Err != nil {
 						return 0, "", p.Err
 					}
@@ -1118,6 +1572,17 @@ func (c *offsetCoordinator) Offset(
 	return 0, "", resErr
 }
 
+// isCoordinatorErr returns whether given error means that the coordinator is
+// still loading, or is not the coordinator of the group, so that the request
+// can be retried once the coordinator is looked up again.
+func isCoordinatorErr(err error) bool {
+	kerr, ok := err.(*proto.KafkaError)
+	if !ok {
+		return false
+	}
+	return kerr == proto.ErrCoordinatorLoadInProgress || proto.RequiresCoordinatorRefresh(int16(kerr.Errno()))
+}
+
 // rndIntn adds locking around accessing the random number generator. This is required because
 // Go doesn't provide locking within the rand.Rand object.
 func rndIntn(n int) int {
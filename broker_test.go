@@ -1,7 +1,9 @@
 package kafka
 
 import (
+	"errors"
 	"fmt"
+	"net"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -135,6 +137,28 @@ func (s *BrokerSuite) TestDialWithInvalidAddress(c *C) {
 	broker.Close()
 }
 
+func (s *BrokerSuite) TestDialRefusedAddresses(c *C) {
+	// reserve addresses nobody listens on
+	var refusing []string
+	for i := 0; i < 2; i++ {
+		closed, err := net.Listen("tcp", "127.0.0.1:0")
+		c.Assert(err, IsNil)
+		refusing = append(refusing, closed.Addr().String())
+		_ = closed.Close()
+	}
+
+	conf := s.newTestBrokerConf("tester")
+	conf.DialRetryLimit = 1
+	_, err := Dial(refusing, conf)
+	var dialErr *DialError
+	c.Assert(errors.As(err, &dialErr), Equals, true)
+	c.Assert(dialErr.Addrs, HasLen, 2)
+	c.Assert(dialErr.Errs, HasLen, 2)
+	for _, addr := range refusing {
+		c.Assert(strings.Contains(err.Error(), addr), Equals, true)
+	}
+}
+
 func (s *BrokerSuite) TestDialWithNoAddress(c *C) {
 	srv := NewServer()
 	srv.Start()
@@ -240,6 +264,257 @@ func (s *BrokerSuite) TestProducer(c *C) {
 	}
 }
 
+func (s *BrokerSuite) TestProducerNoMessages(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	srv.Handle(MetadataRequest, NewMetadataHandler(srv, false).Handler())
+
+	var mu sync.Mutex
+	var respErr error
+	var requests []*proto.ProduceReq
+	answer := true
+	srv.Handle(ProduceRequest, func(request Serializable) Serializable {
+		req := request.(*proto.ProduceReq)
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, req)
+		if !answer {
+			return nil
+		}
+		resp := &proto.ProduceResp{
+			CorrelationID: req.CorrelationID,
+			Topics:        []proto.ProduceRespTopic{{Name: "test"}},
+		}
+		if respErr != nil {
+			resp.Topics[0].Partitions = []proto.ProduceRespPartition{
+				{ID: 0, Err: respErr, Offset: -1},
+			}
+		}
+		return resp
+	})
+
+	conf := s.newTestBrokerConf("tester")
+	conf.ReadTimeout = 100 * time.Millisecond
+	broker, err := Dial([]string{srv.Address()}, conf)
+	c.Assert(err, IsNil)
+	defer broker.Close()
+
+	producer := broker.Producer(NewProducerConf())
+	offset, err := producer.Produce("test", 0)
+	c.Assert(err, IsNil)
+	c.Assert(offset, Equals, int64(0))
+
+	mu.Lock()
+	c.Assert(requests, HasLen, 1)
+	c.Assert(requests[0].Topics, HasLen, 1)
+	c.Assert(requests[0].Topics[0].Name, Equals, "test")
+	c.Assert(requests[0].Topics[0].Partitions, HasLen, 0)
+	respErr = proto.ErrAuthorizationFailed
+	mu.Unlock()
+
+	_, err = producer.Produce("test", 0)
+	c.Assert(err, Equals, proto.ErrAuthorizationFailed)
+
+	// broker ignoring the request does not block the producer
+	mu.Lock()
+	answer = false
+	mu.Unlock()
+	_, err = producer.Produce("test", 0)
+	c.Assert(err, Equals, ErrReadTimeout)
+}
+
+func (s *BrokerSuite) TestProducerTimestamps(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	srv.Handle(MetadataRequest, NewMetadataHandler(srv, false).Handler())
+
+	broker, err := Dial([]string{srv.Address()}, s.newTestBrokerConf("tester"))
+	c.Assert(err, IsNil)
+	defer broker.Close()
+
+	explicit := time.Unix(1500000000, 0)
+	var timestamps []time.Time
+	srv.Handle(ProduceRequest, func(request Serializable) Serializable {
+		req := request.(*proto.ProduceReq)
+		for _, msg := range req.Topics[0].Partitions[0].Messages {
+			timestamps = append(timestamps, msg.Timestamp)
+		}
+		return &proto.ProduceResp{
+			CorrelationID: req.CorrelationID,
+			Version:       req.Version,
+			Topics: []proto.ProduceRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.ProduceRespPartition{
+						{ID: 0, Offset: 5},
+					},
+				},
+			},
+		}
+	})
+
+	prodConf := NewProducerConf()
+	prodConf.RequestVersion = 2
+	producer := broker.Producer(prodConf)
+	before := time.Now().Truncate(time.Millisecond)
+	dflt := &proto.Message{Value: []byte("default")}
+	offset, err := producer.Produce("test", 0,
+		&proto.Message{Value: []byte("explicit"), Timestamp: explicit},
+		dflt)
+	c.Assert(err, IsNil)
+	c.Assert(offset, Equals, int64(5))
+	// message of the caller gets its offset, but not the default timestamp
+	c.Assert(dflt.Offset, Equals, int64(6))
+	c.Assert(dflt.Timestamp.IsZero(), Equals, true)
+	c.Assert(timestamps, HasLen, 2)
+	c.Assert(timestamps[0].Equal(explicit), Equals, true)
+	if timestamps[1].Before(before) || timestamps[1].After(time.Now()) {
+		c.Fatalf("expected current time as default timestamp, got %s", timestamps[1])
+	}
+}
+
+func (s *BrokerSuite) TestProducerTimestampRoundTrip(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	srv.Handle(MetadataRequest, NewMetadataHandler(srv, false).Handler())
+
+	var stored []*proto.Message
+	srv.Handle(ProduceRequest, func(request Serializable) Serializable {
+		req := request.(*proto.ProduceReq)
+		for _, msg := range req.Topics[0].Partitions[0].Messages {
+			msg.Offset = int64(len(stored))
+			stored = append(stored, msg)
+		}
+		return &proto.ProduceResp{
+			CorrelationID: req.CorrelationID,
+			Version:       req.Version,
+			Topics: []proto.ProduceRespTopic{
+				{
+					Name:       "test",
+					Partitions: []proto.ProduceRespPartition{{ID: 0}},
+				},
+			},
+		}
+	})
+	srv.Handle(FetchRequest, func(request Serializable) Serializable {
+		req := request.(*proto.FetchReq)
+		return &proto.FetchResp{
+			CorrelationID: req.CorrelationID,
+			Version:       req.Version,
+			Topics: []proto.FetchRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.FetchRespPartition{
+						{ID: 0, TipOffset: int64(len(stored)), Messages: stored},
+					},
+				},
+			},
+		}
+	})
+
+	broker, err := Dial([]string{srv.Address()}, s.newTestBrokerConf("tester"))
+	c.Assert(err, IsNil)
+	defer broker.Close()
+
+	prodConf := NewProducerConf()
+	prodConf.RequestVersion = 2
+	original := time.Unix(1400000000, 123000000)
+	_, err = broker.Producer(prodConf).Produce("test", 0,
+		&proto.Message{Value: []byte("replayed"), Timestamp: original})
+	c.Assert(err, IsNil)
+
+	consConf := NewConsumerConf("test", 0)
+	consConf.RequestVersion = 2
+	consConf.StartOffset = 0
+	consumer, err := broker.Consumer(consConf)
+	c.Assert(err, IsNil)
+	msg, err := consumer.Consume()
+	c.Assert(err, IsNil)
+	c.Assert(string(msg.Value), Equals, "replayed")
+	c.Assert(msg.Timestamp.Equal(original), Equals, true)
+	c.Assert(msg.TimestampType, Equals, proto.TimestampCreateTime)
+}
+
+func (s *BrokerSuite) TestProducerMaxRequestSize(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	srv.Handle(MetadataRequest, NewMetadataHandler(srv, false).Handler())
+
+	conf := s.newTestBrokerConf("tester")
+	conf.MaxRequestSize = 1024
+	broker, err := Dial([]string{srv.Address()}, conf)
+	c.Assert(err, IsNil)
+	defer broker.Close()
+
+	produced := 0
+	srv.Handle(ProduceRequest, func(request Serializable) Serializable {
+		req := request.(*proto.ProduceReq)
+		produced++
+		return &proto.ProduceResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.ProduceRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.ProduceRespPartition{
+						{ID: 0, Offset: 5},
+					},
+				},
+			},
+		}
+	})
+
+	producer := broker.Producer(NewProducerConf())
+	_, err = producer.Produce("test", 0,
+		&proto.Message{Value: []byte(strings.Repeat("x", 2048))})
+	c.Assert(err, Equals, ErrMessageTooLarge)
+	c.Assert(produced, Equals, 0)
+
+	offset, err := producer.Produce("test", 0, &proto.Message{Value: []byte("small")})
+	c.Assert(err, IsNil)
+	c.Assert(offset, Equals, int64(5))
+	c.Assert(produced, Equals, 1)
+}
+
+func (s *BrokerSuite) TestProducerMaxSocketRequestSize(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	srv.Handle(MetadataRequest, NewMetadataHandler(srv, false).Handler())
+
+	conf := s.newTestBrokerConf("tester")
+	conf.MaxRequestSize = 0
+	conf.MaxSocketRequestSize = 1024
+	broker, err := Dial([]string{srv.Address()}, conf)
+	c.Assert(err, IsNil)
+	defer broker.Close()
+
+	produced := 0
+	srv.Handle(ProduceRequest, func(request Serializable) Serializable {
+		produced++
+		return nil
+	})
+
+	producer := broker.Producer(NewProducerConf())
+	_, err = producer.Produce("test", 0,
+		&proto.Message{Value: []byte(strings.Repeat("x", 2048))})
+	rerr, ok := err.(*RequestTooLargeError)
+	if !ok {
+		c.Fatalf("expected request too large error, got %#v", err)
+	}
+	c.Assert(rerr.Limit, Equals, 1024)
+	c.Assert(rerr.Size > 2048, Equals, true)
+	c.Assert(produced, Equals, 0)
+}
+
 func (s *BrokerSuite) TestProducerWithNoAck(c *C) {
 	srv := NewServer()
 	srv.Start()
@@ -443,6 +718,87 @@ func (s *BrokerSuite) TestProduceWhileLeaderChange(c *C) {
 	c.Assert(prod2Calls, Equals, 1)
 }
 
+func (s *BrokerSuite) TestConsumerAdaptiveFetchSize(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	srv.Handle(MetadataRequest, NewMetadataHandler(srv, false).Handler())
+
+	var mu sync.Mutex
+	var maxBytes []int32
+	// value sizes of messages returned by following fetches, zero for no
+	// messages
+	valueSizes := []int{900, 1900, 3900, 0, 0, 0, 0}
+	srv.Handle(FetchRequest, func(request Serializable) Serializable {
+		req := request.(*proto.FetchReq)
+		p := req.Topics[0].Partitions[0]
+		mu.Lock()
+		defer mu.Unlock()
+		maxBytes = append(maxBytes, p.MaxBytes)
+		var messages []*proto.Message
+		if len(valueSizes) != 0 {
+			if size := valueSizes[0]; size > 0 {
+				messages = []*proto.Message{
+					{Offset: p.FetchOffset, Value: make([]byte, size)},
+				}
+			}
+			valueSizes = valueSizes[1:]
+		}
+		return &proto.FetchResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.FetchRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.FetchRespPartition{
+						{ID: 0, TipOffset: 100, Messages: messages},
+					},
+				},
+			},
+		}
+	})
+
+	broker, err := Dial([]string{srv.Address()}, s.newTestBrokerConf("tester"))
+	c.Assert(err, IsNil)
+	defer broker.Close()
+
+	conf := NewConsumerConf("test", 0)
+	conf.StartOffset = 0
+	conf.RetryLimit = 3
+	conf.RetryWait = time.Millisecond
+	conf.MaxFetchSize = 1000
+	conf.AdaptiveFetchSize = true
+	conf.MinAdaptiveFetchSize = 300
+	conf.MaxAdaptiveFetchSize = 4000
+	consumer, err := broker.Consumer(conf)
+	c.Assert(err, IsNil)
+
+	for i := 0; i < 3; i++ {
+		_, err := consumer.Consume()
+		c.Assert(err, IsNil)
+	}
+	_, err = consumer.Consume()
+	c.Assert(err, Equals, ErrNoData)
+
+	mu.Lock()
+	defer mu.Unlock()
+	c.Assert(maxBytes, DeepEquals, []int32{
+		// full responses
+		1000, 2000, 4000,
+		// empty responses
+		4000, 2000, 1000, 500,
+	})
+
+	// size does not drop below the minimum
+	maxBytes = nil
+	valueSizes = []int{0}
+	mu.Unlock()
+	_, err = consumer.Consume()
+	c.Assert(err, Equals, ErrNoData)
+	mu.Lock()
+	c.Assert(maxBytes, DeepEquals, []int32{300, 300, 300, 300})
+}
+
 func (s *BrokerSuite) TestConsumer(c *C) {
 	srv := NewServer()
 	srv.Start()
@@ -1898,6 +2254,108 @@ func (s *BrokerSuite) TestConsumerBrokenPipe(c *C) {
 	c.Assert(err, IsNil)
 }
 
+func (s *BrokerSuite) TestCommitConsumed(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	srv.Handle(MetadataRequest, NewMetadataHandler(srv, false).Handler())
+	srv.Handle(GroupCoordinatorRequest, func(request Serializable) Serializable {
+		req := request.(*proto.GroupCoordinatorReq)
+		host, port := srv.HostPort()
+		return &proto.GroupCoordinatorResp{
+			CorrelationID:   req.CorrelationID,
+			CoordinatorID:   1,
+			CoordinatorHost: host,
+			CoordinatorPort: int32(port),
+		}
+	})
+	commits := make(chan *proto.OffsetCommitReq, 1)
+	srv.Handle(OffsetCommitRequest, func(request Serializable) Serializable {
+		req := request.(*proto.OffsetCommitReq)
+		commits <- req
+		return &proto.OffsetCommitResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.OffsetCommitRespTopic{
+				{
+					Name:       "first-topic",
+					Partitions: []proto.OffsetCommitRespPartition{{ID: 3}},
+				},
+			},
+		}
+	})
+
+	broker, err := Dial([]string{srv.Address()}, s.newTestBrokerConf("tester"))
+	c.Assert(err, IsNil)
+	defer broker.Close()
+
+	err = broker.CommitConsumed("test-group", "first-topic", 3, 41, "meta")
+	c.Assert(err, IsNil)
+
+	req := <-commits
+	c.Assert(req.ConsumerGroup, Equals, "test-group")
+	c.Assert(req.Topics[0].Name, Equals, "first-topic")
+	part := req.Topics[0].Partitions[0]
+	c.Assert(part.ID, Equals, int32(3))
+	c.Assert(part.Offset, Equals, int64(42))
+	c.Assert(part.Metadata, Equals, "meta")
+}
+
+func (s *BrokerSuite) TestOffsetCoordinatorFencedCommit(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	srv.Handle(MetadataRequest, NewMetadataHandler(srv, false).Handler())
+	srv.Handle(GroupCoordinatorRequest, func(request Serializable) Serializable {
+		req := request.(*proto.GroupCoordinatorReq)
+		host, port := srv.HostPort()
+		return &proto.GroupCoordinatorResp{
+			CorrelationID:   req.CorrelationID,
+			CoordinatorID:   1,
+			CoordinatorHost: host,
+			CoordinatorPort: int32(port),
+		}
+	})
+	commits := 0
+	srv.Handle(OffsetCommitRequest, func(request Serializable) Serializable {
+		req := request.(*proto.OffsetCommitReq)
+		commits++
+		c.Assert(req.MemberID, Equals, "member-1")
+		var err error
+		if req.GenerationID != 3 {
+			err = proto.ErrIllegalGeneration
+		}
+		return &proto.OffsetCommitResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.OffsetCommitRespTopic{
+				{
+					Name:       "first-topic",
+					Partitions: []proto.OffsetCommitRespPartition{{ID: 0, Err: err}},
+				},
+			},
+		}
+	})
+
+	broker, err := Dial([]string{srv.Address()}, s.newTestBrokerConf("tester"))
+	c.Assert(err, IsNil)
+	defer broker.Close()
+
+	conf := NewOffsetCoordinatorConf("test-group")
+	conf.GenerationID = 2
+	conf.MemberID = "member-1"
+	coordinator, err := broker.OffsetCoordinator(conf)
+	c.Assert(err, IsNil)
+	c.Assert(coordinator.Commit("first-topic", 0, 10), Equals, proto.ErrIllegalGeneration)
+	c.Assert(commits, Equals, 1)
+
+	conf.GenerationID = 3
+	coordinator, err = broker.OffsetCoordinator(conf)
+	c.Assert(err, IsNil)
+	c.Assert(coordinator.Commit("first-topic", 0, 10), IsNil)
+	c.Assert(commits, Equals, 2)
+}
+
 func (s *BrokerSuite) TestOffsetCoordinator(c *C) {
 	srv := NewServer()
 	srv.Start()
@@ -2012,6 +2470,102 @@ func (s *BrokerSuite) TestOffsetCoordinatorNoCoordinatorError(c *C) {
 	c.Assert(err, Equals, proto.ErrNoCoordinator)
 }
 
+func (s *BrokerSuite) TestOffsetCoordinatorRetryCoordinatorErrors(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	var mu sync.Mutex
+	lookups := 0
+	var lookupErr error = proto.ErrCoordinatorLoadInProgress
+	// errors returned by the coordinator, in order
+	var commitErrs, fetchErrs []error
+
+	srv.Handle(MetadataRequest, NewMetadataHandler(srv, false).Handler())
+	srv.Handle(GroupCoordinatorRequest, func(request Serializable) Serializable {
+		req := request.(*proto.GroupCoordinatorReq)
+		mu.Lock()
+		defer mu.Unlock()
+		lookups++
+		host, port := srv.HostPort()
+		return &proto.GroupCoordinatorResp{
+			CorrelationID:   req.CorrelationID,
+			Err:             lookupErr,
+			CoordinatorID:   1,
+			CoordinatorHost: host,
+			CoordinatorPort: int32(port),
+		}
+	})
+	srv.Handle(OffsetCommitRequest, func(request Serializable) Serializable {
+		req := request.(*proto.OffsetCommitReq)
+		mu.Lock()
+		defer mu.Unlock()
+		var err error
+		if len(commitErrs) != 0 {
+			err, commitErrs = commitErrs[0], commitErrs[1:]
+		}
+		return &proto.OffsetCommitResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.OffsetCommitRespTopic{
+				{
+					Name:       "first-topic",
+					Partitions: []proto.OffsetCommitRespPartition{{ID: 0, Err: err}},
+				},
+			},
+		}
+	})
+	srv.Handle(OffsetFetchRequest, func(request Serializable) Serializable {
+		req := request.(*proto.OffsetFetchReq)
+		mu.Lock()
+		defer mu.Unlock()
+		partition := proto.OffsetFetchRespPartition{ID: 0, Offset: 421}
+		if len(fetchErrs) != 0 {
+			partition.Err, fetchErrs = fetchErrs[0], fetchErrs[1:]
+		}
+		return &proto.OffsetFetchResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.OffsetFetchRespTopic{
+				{
+					Name:       "first-topic",
+					Partitions: []proto.OffsetFetchRespPartition{partition},
+				},
+			},
+		}
+	})
+
+	broker, err := Dial([]string{srv.Address()}, s.newTestBrokerConf("tester"))
+	c.Assert(err, IsNil)
+	defer broker.Close()
+
+	conf := NewOffsetCoordinatorConf("test-group")
+	conf.RetryErrLimit = 3
+	conf.RetryErrWait = time.Millisecond
+	coordinator, err := broker.OffsetCoordinator(conf)
+	c.Assert(err, IsNil)
+
+	// lookup errors are not hidden behind ErrNoCoordinator
+	c.Assert(coordinator.Commit("first-topic", 0, 421), Equals, proto.ErrCoordinatorLoadInProgress)
+
+	mu.Lock()
+	lookupErr = nil
+	lookups = 0
+	commitErrs = []error{proto.ErrNotCoordinator, proto.ErrCoordinatorLoadInProgress}
+	fetchErrs = []error{proto.ErrCoordinatorNotAvailable}
+	mu.Unlock()
+
+	c.Assert(coordinator.Commit("first-topic", 0, 421), IsNil)
+	offset, _, err := coordinator.Offset("first-topic", 0)
+	c.Assert(err, IsNil)
+	c.Assert(offset, Equals, int64(421))
+
+	mu.Lock()
+	// coordinator is looked up again by every attempt
+	c.Assert(lookups, Equals, 5)
+	commitErrs = []error{proto.ErrNotCoordinator, proto.ErrNotCoordinator, proto.ErrNotCoordinator}
+	mu.Unlock()
+	c.Assert(coordinator.Commit("first-topic", 0, 421), Equals, proto.ErrNotCoordinator)
+}
+
 func (s *BrokerSuite) BenchmarkConsumer_10Msgs(c *C)    { s.benchmarkConsumer(c, 10) }
 func (s *BrokerSuite) BenchmarkConsumer_100Msgs(c *C)   { s.benchmarkConsumer(c, 100) }
 func (s *BrokerSuite) BenchmarkConsumer_500Msgs(c *C)   { s.benchmarkConsumer(c, 500) }
@@ -2202,3 +2756,60 @@ func (s *BrokerSuite) benchmarkProducer(c *C, messagesPerReq int64) {
 		c.Assert(err, IsNil)
 	}
 }
+
+func (s *BrokerSuite) TestOffsetDelete(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	srv.Handle(MetadataRequest, NewMetadataHandler(srv, false).Handler())
+	srv.Handle(GroupCoordinatorRequest, func(request Serializable) Serializable {
+		req := request.(*proto.GroupCoordinatorReq)
+		host, port := srv.HostPort()
+		return &proto.GroupCoordinatorResp{
+			CorrelationID:   req.CorrelationID,
+			CoordinatorID:   1,
+			CoordinatorHost: host,
+			CoordinatorPort: int32(port),
+		}
+	})
+	srv.Handle(OffsetDeleteRequest, func(request Serializable) Serializable {
+		req := request.(*proto.OffsetDeleteReq)
+		resp := &proto.OffsetDeleteResp{CorrelationID: req.CorrelationID}
+		if req.ConsumerGroup != "test-group" {
+			resp.Err = proto.ErrGroupIDNotFound
+			return resp
+		}
+		for _, t := range req.Topics {
+			topic := proto.OffsetDeleteRespTopic{Name: t.Name}
+			for _, p := range t.Partitions {
+				var err error
+				if t.Name == "consumed" {
+					err = proto.ErrGroupSubscribedToTopic
+				}
+				topic.Partitions = append(topic.Partitions, proto.OffsetDeleteRespPartition{ID: p, Err: err})
+			}
+			resp.Topics = append(resp.Topics, topic)
+		}
+		return resp
+	})
+
+	broker, err := Dial([]string{srv.Address()}, s.newTestBrokerConf("tester"))
+	c.Assert(err, IsNil)
+	defer broker.Close()
+
+	resp, err := broker.OffsetDelete("test-group", map[string][]int32{
+		"consumed":  {0},
+		"abandoned": {0, 1},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(resp.Topics, DeepEquals, []proto.OffsetDeleteRespTopic{
+		{Name: "abandoned", Partitions: []proto.OffsetDeleteRespPartition{{ID: 0}, {ID: 1}}},
+		{Name: "consumed", Partitions: []proto.OffsetDeleteRespPartition{
+			{ID: 0, Err: proto.ErrGroupSubscribedToTopic},
+		}},
+	})
+
+	_, err = broker.OffsetDelete("other-group", map[string][]int32{"abandoned": {0}})
+	c.Assert(err, Equals, proto.ErrGroupIDNotFound)
+}
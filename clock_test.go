@@ -0,0 +1,87 @@
+package kafka
+
+import (
+	"sync"
+	"time"
+)
+
+// fakeClock is a Clock that only moves when advanced, firing timers whose
+// time has come.
+type fakeClock struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock *fakeClock
+	when  time.Time
+	c     chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	clock := &fakeClock{now: time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)}
+	clock.cond = sync.NewCond(&clock.mu)
+	return clock
+}
+
+func (clock *fakeClock) Now() time.Time {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	return clock.now
+}
+
+func (clock *fakeClock) After(d time.Duration) <-chan time.Time {
+	return clock.NewTimer(d).C()
+}
+
+func (clock *fakeClock) NewTimer(d time.Duration) Timer {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	t := &fakeTimer{clock: clock, when: clock.now.Add(d), c: make(chan time.Time, 1)}
+	clock.timers = append(clock.timers, t)
+	clock.cond.Broadcast()
+	return t
+}
+
+// Advance moves the clock forward, firing all timers that expire meanwhile.
+func (clock *fakeClock) Advance(d time.Duration) {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	clock.now = clock.now.Add(d)
+	pending := clock.timers[:0]
+	for _, t := range clock.timers {
+		if t.when.After(clock.now) {
+			pending = append(pending, t)
+		} else {
+			t.c <- clock.now
+		}
+	}
+	clock.timers = pending
+}
+
+// BlockUntil waits for given number of timers to be pending.
+func (clock *fakeClock) BlockUntil(n int) {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	for len(clock.timers) < n {
+		clock.cond.Wait()
+	}
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	for i, pending := range t.clock.timers {
+		if pending == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
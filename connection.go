@@ -3,12 +3,19 @@ package kafka
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math"
 	"net"
+	"runtime/debug"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/dropbox/kafka/proto"
@@ -17,6 +24,172 @@ import (
 // ErrClosed is returned as result of any request made using closed connection.
 var ErrClosed = errors.New("closed")
 
+// ErrBrokerDisconnected is returned as result of requests made using
+// connection that has been closed by the broker. Unlike other network errors,
+// it does not indicate a fault, and the request can be retried on a new
+// connection.
+var ErrBrokerDisconnected = errors.New("broker closed the connection")
+
+// ErrProtocolDesync is returned as result of requests made using connection
+// that received a response to a request it never sent, which means responses
+// are no longer read correctly. It is only detected by connections with
+// strict correlation ID checking enabled.
+var ErrProtocolDesync = errors.New("response to unknown request, protocol out of sync")
+
+// ErrReadTimeout is returned when the response to a request does not arrive
+// within the read timeout. Connection stays open, and the late response is
+// dropped.
+var ErrReadTimeout = errors.New("read timeout")
+
+// ErrCancelled is returned as result of a request cancelled with
+// CancelRequest. Connection stays open.
+var ErrCancelled = errors.New("request cancelled")
+
+// ErrWriteTimeout is returned when writing a request to the transport does not
+// complete within the write timeout, usually because the broker stopped
+// accepting data. Connection is closed when it happens.
+var ErrWriteTimeout = errors.New("write timeout")
+
+// ErrSocketReadTimeout is returned as result of all requests in flight, when
+// no response arrived from the broker within the socket read timeout.
+// Connection is closed when it happens.
+var ErrSocketReadTimeout = errors.New("socket read timeout")
+
+// ErrPartialWrite is returned as result of requests made using connection
+// that failed writing a request after part of it was already sent. Broker can
+// no longer tell where the following requests start, so the connection is
+// closed.
+var ErrPartialWrite = errors.New("request partially written")
+
+// ErrUnsupportedAPIVersion is returned when a request is not sent, because
+// the broker does not support its API or version.
+var ErrUnsupportedAPIVersion = errors.New("api version not supported by the broker")
+
+// ErrMessageTooLarge is returned when the encoded produce request exceeds
+// MaxRequestSize of the broker configuration. Such request is never sent.
+var ErrMessageTooLarge = errors.New("message too large")
+
+// ErrUnsupportedCompression is returned when a produce request is not sent,
+// because its compression codec is unknown, or cannot be sent with the version
+// of produce requests it is sent with.
+var ErrUnsupportedCompression = errors.New("compression codec not supported")
+
+// ErrAPIKeyForbidden is returned when a request is not sent, because its
+// API key is not allowed by the connection's configuration.
+var ErrAPIKeyForbidden = errors.New("api key not allowed")
+
+// ErrNoController is returned when the broker does not report which node is
+// the cluster controller, either because there is none at the moment, or
+// because it only supports version 0 of metadata requests.
+var ErrNoController = errors.New("broker did not report a controller")
+
+// ErrStaleFetch is set by Fetch, with StaleFetchError policy, as the error of
+// partitions for which the broker returned only messages older than the
+// requested offset. Such partition has no messages, and fetching it again
+// from the same offset gives the same result, so the consumer should reset
+// its offset, for example to LogStartOffset of the partition.
+var ErrStaleFetch = errors.New("fetch returned only messages older than requested")
+
+// StaleFetchPolicy is what Fetch does with partitions for which the broker
+// returned only messages older than the requested offset. Compressed batches
+// are returned whole, and if the records at and above the offset are no
+// longer part of them, for example after log compaction, no message is left
+// once the older ones are dropped.
+type StaleFetchPolicy int
+
+const (
+	// StaleFetchIgnore returns such partitions without messages and without
+	// error, as if no new messages were available.
+	StaleFetchIgnore StaleFetchPolicy = iota
+
+	// StaleFetchError sets the error of such partitions to ErrStaleFetch.
+	StaleFetchError
+)
+
+// compressionMinVersion maps compression codecs to the first version of
+// produce requests able to carry messages compressed with them. LZ4 needs
+// message format v1, first sent by version 2, and zstd needs version 7.
+var compressionMinVersion = map[proto.Compression]int16{
+	proto.CompressionNone:   0,
+	proto.CompressionGzip:   0,
+	proto.CompressionSnappy: 0,
+	proto.CompressionLZ4:    2,
+	proto.CompressionZstd:   7,
+}
+
+// RequestTooLargeError is returned when the encoded request exceeds
+// MaxSocketRequestSize of the broker configuration, the maximum size of a
+// request accepted by the broker. Such request is never sent, as the broker
+// would drop the connection instead of answering it.
+type RequestTooLargeError struct {
+	Size  int
+	Limit int
+}
+
+func (err *RequestTooLargeError) Error() string {
+	return fmt.Sprintf("request of %d bytes exceeds the limit of %d bytes", err.Size, err.Limit)
+}
+
+// CloseReason describes why a connection has been closed.
+type CloseReason int
+
+const (
+	// CloseReasonNone is returned for connections that are still open.
+	CloseReasonNone CloseReason = iota
+
+	// CloseReasonLocal means the connection was closed by the client.
+	CloseReasonLocal
+
+	// CloseReasonReadError means reading a response from the transport
+	// failed.
+	CloseReasonReadError
+
+	// CloseReasonWriteError means writing a request to the transport failed.
+	CloseReasonWriteError
+
+	// CloseReasonTimeout means the transport reported a timeout.
+	CloseReasonTimeout
+
+	// CloseReasonServerDisconnect means the server closed the connection.
+	CloseReasonServerDisconnect
+
+	// CloseReasonProtocolDesync means a response to unknown request was
+	// received, with strict correlation ID checking enabled.
+	CloseReasonProtocolDesync
+)
+
+func (r CloseReason) String() string {
+	switch r {
+	case CloseReasonNone:
+		return "none"
+	case CloseReasonLocal:
+		return "local-close"
+	case CloseReasonReadError:
+		return "read-error"
+	case CloseReasonWriteError:
+		return "write-error"
+	case CloseReasonTimeout:
+		return "timeout"
+	case CloseReasonServerDisconnect:
+		return "server-disconnect"
+	case CloseReasonProtocolDesync:
+		return "protocol-desync"
+	}
+	return fmt.Sprintf("CloseReason(%d)", int(r))
+}
+
+// readCloseReason returns the close reason for an error returned while reading
+// from the transport.
+func readCloseReason(err error) CloseReason {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return CloseReasonServerDisconnect
+	}
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		return CloseReasonTimeout
+	}
+	return CloseReasonReadError
+}
+
 // Low level abstraction over connection to Kafka.
 type connection struct {
 	addr      string
@@ -24,34 +197,281 @@ type connection struct {
 	rw        io.ReadWriteCloser
 	stop      chan struct{}
 	nextID    chan int32
+	// clock measures timeouts and the age of the connection.
+	clock Clock
+
+	// maxRequestSize and maxSocketRequestSize limit the size of produce
+	// requests, as BrokerConf.MaxRequestSize and MaxSocketRequestSize
+	// describe. Zero means no limit.
+	maxRequestSize       int
+	maxSocketRequestSize int
+	// readTimeout limits the time waiting for a response. Fetch requests
+	// wait at least their MaxWaitTime. Zero means no limit.
+	readTimeout time.Duration
+	// writeTimeout limits the time writing a single request to the
+	// transport. Zero means no limit.
+	writeTimeout time.Duration
+	// socketReadTimeout limits the time the transport is read from without
+	// any response arriving, while requests are in flight. Zero means no
+	// limit. It must be accessed atomically.
+	socketReadTimeout int64
+	// deadlineMu serializes updates of the transport read deadline.
+	deadlineMu *sync.Mutex
+	// strictCorrelation makes the connection close with ErrProtocolDesync
+	// on a response to unknown request, instead of dropping it.
+	strictCorrelation bool
+	// compression is applied to produce requests sent without compression.
+	compression proto.Compression
+	// compressionCounters counts compression of produce requests sent and
+	// decompression of fetch responses read.
+	compressionCounters proto.CompressionCounters
+	// clientID is sent in the header of requests sent without client ID.
+	clientID string
+	// allowedAPIKeys limits the API keys of requests written to the
+	// transport. Nil allows all.
+	allowedAPIKeys map[int16]bool
+	// staleFetch is what Fetch does with partitions for which only messages
+	// older than requested were returned.
+	staleFetch StaleFetchPolicy
+	// traceSeparator separates trace IDs embedded in client IDs of requests,
+	// which are logged with their correlation IDs. Empty disables it.
+	traceSeparator string
+	// skipOversized makes the connection skip responses larger than
+	// maxResponseSize, failing only their requests, instead of closing.
+	skipOversized bool
+	// onWire holds the WireHook called with raw requests and responses, if
+	// any. It is accessed with setOnWire and wireHook.
+	onWire atomic.Value
+
+	// waiters holds response waiters of requests in flight, spread over
+	// shards by correlation ID, so that the goroutines sending requests and
+	// the one reading responses rarely contend for the same lock.
+	waiters [waiterShards]waiterShard
+	// inFlight is the number of requests registered in respc and respcb of
+	// all waiter shards, so that it can be read without taking their locks.
+	// It must be accessed atomically, and changed with the lock of the shard
+	// held.
+	inFlight int64
+	// lockContended, lockWait and lockMaxWait count waits for locks of
+	// waiter shards, with wait times in nanoseconds. They must be accessed
+	// atomically.
+	lockContended int64
+	lockWait      int64
+	lockMaxWait   int64
+	// maxResponseSize limits the size of responses read from the broker.
+	// Zero means no limit. It must be accessed atomically.
+	maxResponseSize int32
+	// produceWindow accounts bytes of produce requests waiting for acks,
+	// blocking new ones above its limit.
+	produceWindow *produceWindow
 
 	// mu protects the following members. It must only be accessed by connection methods.
-	mu    *sync.Mutex
-	respc map[int32]chan []byte
+	mu *sync.Mutex
 
 	// stopErr is set if and only if this connection has been closed. If set, it indicates
 	// the error that closed the connection.
 	stopErr error
+	// closeReason is set together with stopErr and describes why the connection
+	// has been closed.
+	closeReason CloseReason
+	// versions pins the version used for requests of given API kinds,
+	// overriding the version set by the caller. It is never modified.
+	versions map[int16]int16
+	// downgradeVersions enables retrying requests rejected by the broker
+	// with proto.ErrUnsupportedVersion, using lower versions.
+	downgradeVersions bool
+
+	// apiVersions contains the versions supported by the broker, by API
+	// kind, as returned by the last ApiVersions request. It is nil if not
+	// known.
+	apiVersions map[int16]proto.APIVersionsRespAPI
+	// nodeID and rack describe the broker this connection is talking to.
+	// They are set by the first metadata response listing a broker with the
+	// connection's address. Until then, nodeID is -1.
+	nodeID int32
+	rack   string
+
+	// sessionMu protects the fetch session and serializes fetch requests
+	// using it, so that session epochs are sent in order.
+	sessionMu *sync.Mutex
+	session   fetchSession
+}
+
+// waiterShards is the number of shards response waiters of a connection are
+// spread over.
+const waiterShards = 16
+
+// waiterShard holds response waiters of requests whose correlation IDs map to
+// it.
+type waiterShard struct {
+	// mu protects the following members.
+	mu    heldMutex
+	respc map[int32]chan response
+	// respcb contains callbacks of asynchronous requests, called with the
+	// response instead of pushing it to a waiter channel.
+	respcb map[int32]func([]byte, error)
+	// sent contains API kinds and versions of requests in flight, by
+	// correlation ID. It is only filled while a WireHook is set.
+	sent map[int32]sentAPI
+	// abandoned contains correlation IDs of requests whose waiters gave up
+	// before the response arrived, so that late responses are expected.
+	abandoned map[int32]struct{}
+	// closed is set once the connection is closed or stopped reading
+	// responses. No waiters can be registered afterwards.
+	closed bool
+}
+
+// response is pushed to the waiter of a request once its response is read.
+// err is set instead of b if the response was skipped.
+type response struct {
+	b   []byte
+	err error
 }
 
-// newConnection returns new, initialized connection or error
+// shardOf returns the shard holding response waiter of given correlation
+// ID.
+func (c *connection) shardOf(correlationID int32) *waiterShard {
+	return &c.waiters[uint32(correlationID)%waiterShards]
+}
+
+// fetchSession holds the state of an incremental fetch session, established
+// with the broker by fetch requests of version 7 and above. Zero value means
+// no session.
+type fetchSession struct {
+	id    int32
+	epoch int32
+
+	// partitions contains fetch parameters last sent for every partition
+	// being part of the session.
+	partitions map[topicPartition]proto.FetchReqPartition
+	// tips contains the last known tip offset of every partition, used to
+	// fill in partitions omitted from incremental fetch responses.
+	tips map[topicPartition]int64
+}
+
+// defaultReadBufferSize is the size of the buffer responses are read through,
+// unless configured otherwise. It is large enough to read big fetch responses
+// without many small reads.
+const defaultReadBufferSize = 64 * 1024
+
+// newTCPConnection returns new, initialized connection or error
 func newTCPConnection(address string, timeout time.Duration) (*connection, error) {
-	conn, err := net.DialTimeout("tcp", address, timeout)
+	return dialConnection(address, timeout, defaultReadBufferSize, 0, nil)
+}
+
+// DialError is returned when none of the addresses metadata is fetched from
+// could be dialed, such as the bootstrap addresses given to Dial. It holds the
+// error of every attempt, in the order the addresses were tried.
+type DialError struct {
+	Addrs []string
+	Errs  []error
+}
+
+func (err *DialError) Error() string {
+	if len(err.Addrs) == 0 {
+		return "no addresses to dial"
+	}
+	msgs := make([]string, len(err.Addrs))
+	for i, addr := range err.Addrs {
+		msgs[i] = fmt.Sprintf("%s: %s", addr, err.Errs[i])
+	}
+	return "cannot dial any address: " + strings.Join(msgs, "; ")
+}
+
+// dialConnection works like newTCPConnection, but reads responses through a
+// buffer of given size and resolves the host name of the address with given
+// function, if any. Zero size means the default size.
+func dialConnection(address string, timeout time.Duration, readBufferSize int, expectedInFlight int, resolve ResolveFunc) (*connection, error) {
+	conn, err := dialTCP(address, timeout, resolve)
+	if err != nil {
+		return nil, err
+	}
+	return newSizedConnection(address, conn, readBufferSize, expectedInFlight), nil
+}
+
+// ResolveFunc returns IP addresses of given host name, in the order they should
+// be dialed.
+type ResolveFunc func(host string) ([]string, error)
+
+// dialTCP dials given address. If resolve is not nil, the host name is
+// resolved with it on every call, and the returned addresses are dialed in
+// order until one accepts the connection, all within the timeout. Addresses
+// with IP instead of host name are dialed directly.
+func dialTCP(address string, timeout time.Duration, resolve ResolveFunc) (net.Conn, error) {
+	if resolve == nil {
+		return net.DialTimeout("tcp", address, timeout)
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return net.DialTimeout("tcp", address, timeout)
+	}
+	ips, err := resolve(host)
 	if err != nil {
 		return nil, err
 	}
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	var dialer net.Dialer
+	if timeout > 0 {
+		dialer.Deadline = time.Now().Add(timeout)
+	}
+	for _, ip := range ips {
+		var conn net.Conn
+		if conn, err = dialer.Dial("tcp", net.JoinHostPort(ip, port)); err == nil {
+			return conn, nil
+		}
+		log.Debugf("cannot dial %s at %s: %s", host, ip, err)
+	}
+	return nil, err
+}
+
+// newConnection returns new, initialized connection using given transport,
+// reading responses through a buffer of given size. Zero size means the
+// default size.
+func newConnection(address string, rw io.ReadWriteCloser, readBufferSize int) *connection {
+	return newSizedConnection(address, rw, readBufferSize, 0)
+}
+
+// newSizedConnection works like newConnection, but sizes the response waiters
+// for given number of requests in flight at once, so that they do not grow
+// under burst load. Zero means no sizing.
+func newSizedConnection(address string, rw io.ReadWriteCloser, readBufferSize int, expectedInFlight int) *connection {
+	if readBufferSize <= 0 {
+		readBufferSize = defaultReadBufferSize
+	}
 	c := &connection{
-		addr:      address,
-		mu:        &sync.Mutex{},
-		stop:      make(chan struct{}),
-		nextID:    make(chan int32),
-		rw:        conn,
-		respc:     make(map[int32]chan []byte),
-		startTime: time.Now(),
+		addr:       address,
+		mu:         &sync.Mutex{},
+		sessionMu:  &sync.Mutex{},
+		deadlineMu: &sync.Mutex{},
+		stop:       make(chan struct{}),
+		nextID:     make(chan int32),
+		rw:         rw,
+		startTime:  RealClock.Now(),
+		clock:      RealClock,
+		nodeID:     -1,
+
+		produceWindow: newProduceWindow(),
+	}
+	// requests are spread evenly over the shards by their correlation ID
+	perShard := 0
+	if expectedInFlight > 0 {
+		perShard = (expectedInFlight + waiterShards - 1) / waiterShards
+	}
+	for i := range c.waiters {
+		c.waiters[i].respc = make(map[int32]chan response, perShard)
+		c.waiters[i].respcb = make(map[int32]func([]byte, error), perShard)
+		c.waiters[i].abandoned = make(map[int32]struct{})
+		c.waiters[i].sent = make(map[int32]sentAPI)
 	}
 	go c.nextIDLoop()
-	go c.readRespLoop()
-	return c, nil
+	go c.readRespLoop(readBufferSize)
+	return c
 }
 
 // nextIDLoop generates correlation IDs, making sure they are always in order
@@ -75,35 +495,143 @@ func (c *connection) nextIDLoop() {
 // readRespLoop constantly reading response messages from the socket and after
 // partial parsing, sends byte representation of the whole message to request
 // sending process.
-func (c *connection) readRespLoop() {
+//
+// Panic while reading or dispatching a response closes the connection with
+// ErrClosed, so that requests in flight and the following ones fail instead of
+// waiting forever for the loop.
+func (c *connection) readRespLoop(bufferSize int) {
 	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf("panic reading responses from %s, closing connection: %v\n%s",
+				c.addr, r, debug.Stack())
+			c.mu.Lock()
+			if c.stopErr == nil {
+				c.stopErr = ErrClosed
+				c.closeReason = CloseReasonReadError
+				close(c.stop)
+			}
+			c.mu.Unlock()
+			_ = c.rw.Close()
+		}
+
+		var callbacks []func([]byte, error)
+		for i := range c.waiters {
+			shard := &c.waiters[i]
+			c.lockShard(shard)
+			shard.closed = true
+			atomic.AddInt64(&c.inFlight, -int64(len(shard.respc)+len(shard.respcb)))
+			for _, cc := range shard.respc {
+				close(cc)
+			}
+			shard.respc = make(map[int32]chan response)
+			for _, cb := range shard.respcb {
+				callbacks = append(callbacks, cb)
+			}
+			shard.respcb = make(map[int32]func([]byte, error))
+			shard.abandoned = make(map[int32]struct{})
+			shard.sent = make(map[int32]sentAPI)
+			shard.mu.Unlock()
+		}
+
+		c.produceWindow.close()
+
 		c.mu.Lock()
-		defer c.mu.Unlock()
+		stopErr := c.stopErr
+		c.mu.Unlock()
 
-		for _, cc := range c.respc {
-			close(cc)
+		// callbacks are called without holding the lock, as they are free
+		// to use the connection
+		for _, cb := range callbacks {
+			cb(nil, stopErr)
 		}
-		c.respc = make(map[int32]chan []byte)
 	}()
 
-	rd := bufio.NewReader(c.rw)
+	rd := bufio.NewReaderSize(c.rw, bufferSize)
 	for {
-		correlationID, b, err := proto.ReadResp(rd)
+		c.updateReadDeadline()
+		// wait for the response to start arriving before checking the
+		// limit, so that it is not read before the connection is configured
+		_, err := rd.Peek(4)
+		var correlationID int32
+		var b []byte
+		if err == nil {
+			maxSize := atomic.LoadInt32(&c.maxResponseSize)
+			correlationID, b, err = proto.ReadRespLimit(rd, maxSize)
+		}
+		// respErr fails the request instead of the whole connection
+		var respErr error
+		if serr, ok := err.(*proto.ResponseSizeError); ok && c.skipOversized && serr.Size >= 4 {
+			respErr = serr
+			if correlationID, err = skipResp(rd, serr.Size); err == nil {
+				log.Warningf("skipped response to request %d from %s: %s",
+					correlationID, c.addr, serr)
+			}
+		}
 		if err != nil {
 			c.mu.Lock()
 			if c.stopErr == nil {
 				c.stopErr = err
+				c.closeReason = readCloseReason(err)
+				switch {
+				case c.closeReason == CloseReasonServerDisconnect:
+					c.stopErr = ErrBrokerDisconnected
+				case c.closeReason == CloseReasonTimeout && atomic.LoadInt64(&c.socketReadTimeout) > 0:
+					log.Errorf("no response from %s in time, closing connection", c.addr)
+					c.stopErr = ErrSocketReadTimeout
+				}
 				close(c.stop)
 			}
+			timedOut := c.stopErr == ErrSocketReadTimeout
 			c.mu.Unlock()
+			if timedOut {
+				_ = c.rw.Close()
+			}
 			return
 		}
 
-		c.mu.Lock()
-		rc, ok := c.respc[correlationID]
-		delete(c.respc, correlationID)
-		c.mu.Unlock()
+		shard := c.shardOf(correlationID)
+		c.lockShard(shard)
+		rc, ok := shard.respc[correlationID]
+		delete(shard.respc, correlationID)
+		cb, async := shard.respcb[correlationID]
+		delete(shard.respcb, correlationID)
+		_, abandoned := shard.abandoned[correlationID]
+		delete(shard.abandoned, correlationID)
+		api, known := shard.sent[correlationID]
+		delete(shard.sent, correlationID)
+		if ok || async {
+			atomic.AddInt64(&c.inFlight, -1)
+		}
+		shard.mu.Unlock()
+		if hook := c.wireHook(); hook != nil && b != nil {
+			apiKey, apiVersion := int32(-1), int32(-1)
+			if known {
+				apiKey, apiVersion = int32(api.kind), int32(api.version)
+			}
+			hook(DirectionReceive, apiKey, apiVersion, correlationID, b)
+		}
+		if async {
+			cb(b, respErr)
+			continue
+		}
 		if !ok {
+			if abandoned {
+				log.Debugf("dropping late response to request %d", correlationID)
+				continue
+			}
+			if c.strictCorrelation {
+				log.Errorf("response to unknown request %d from %s, closing connection",
+					correlationID, c.addr)
+				c.mu.Lock()
+				if c.stopErr == nil {
+					c.stopErr = ErrProtocolDesync
+					c.closeReason = CloseReasonProtocolDesync
+					close(c.stop)
+				}
+				c.mu.Unlock()
+				_ = c.rw.Close()
+				return
+			}
 			log.Warningf("response to unknown request: %d", correlationID)
 			continue
 		}
@@ -113,47 +641,295 @@ func (c *connection) readRespLoop() {
 			c.mu.Lock()
 			if c.stopErr == nil {
 				c.stopErr = ErrClosed
+				c.closeReason = CloseReasonLocal
 			}
 			c.mu.Unlock()
-		case rc <- b:
+		case rc <- response{b: b, err: respErr}:
 		}
 		close(rc)
 	}
 }
 
+// skipResp discards the rest of a response of given size, whose size prefix
+// was already read, and returns its correlation ID.
+func skipResp(r io.Reader, size int32) (int32, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, err
+	}
+	if _, err := io.CopyN(ioutil.Discard, r, int64(size)-4); err != nil {
+		return 0, err
+	}
+	return int32(binary.BigEndian.Uint32(header[:])), nil
+}
+
+// WaiterLockStats describes contention on the locks guarding response waiters
+// of a connection, taken by every request and by the goroutine reading
+// responses.
+type WaiterLockStats struct {
+	// Contended is the number of times a lock was held by someone else
+	// when it was needed. WaitTime is the total time spent waiting for the
+	// locks, and MaxWaitTime the longest single wait.
+	Contended   int64
+	WaitTime    time.Duration
+	MaxWaitTime time.Duration
+}
+
+// WaiterLockStats returns a snapshot of the contention on waiter locks since
+// the connection was created.
+func (c *connection) WaiterLockStats() WaiterLockStats {
+	return WaiterLockStats{
+		Contended:   atomic.LoadInt64(&c.lockContended),
+		WaitTime:    time.Duration(atomic.LoadInt64(&c.lockWait)),
+		MaxWaitTime: time.Duration(atomic.LoadInt64(&c.lockMaxWait)),
+	}
+}
+
+// CompressionStats returns a snapshot of the usage of every supported
+// compression codec by produce requests sent and fetch responses read since
+// the connection was created, keyed by codec name.
+func (c *connection) CompressionStats() map[string]proto.CodecStats {
+	return c.compressionCounters.Stats()
+}
+
+// heldMutex is a mutex that tells whether it is locked, so that waiting for it
+// can be measured without timing every lock.
+type heldMutex struct {
+	mu sync.Mutex
+	// held is set while the mutex is locked. It must be accessed atomically.
+	held int32
+}
+
+func (m *heldMutex) Lock() {
+	m.mu.Lock()
+	atomic.StoreInt32(&m.held, 1)
+}
+
+func (m *heldMutex) Unlock() {
+	atomic.StoreInt32(&m.held, 0)
+	m.mu.Unlock()
+}
+
+// isHeld reports whether the mutex is locked.
+func (m *heldMutex) isHeld() bool {
+	return atomic.LoadInt32(&m.held) != 0
+}
+
+// lockShard locks given waiter shard, measuring the wait if the lock is
+// already held. Uncontended locking is not timed, so that it stays cheap. A
+// lock taken by someone else right after the check is waited for without
+// being measured, so the stats may miss some contention.
+func (c *connection) lockShard(shard *waiterShard) {
+	if !shard.mu.isHeld() {
+		shard.mu.Lock()
+		return
+	}
+	start := time.Now()
+	shard.mu.Lock()
+	wait := int64(time.Since(start))
+
+	atomic.AddInt64(&c.lockContended, 1)
+	atomic.AddInt64(&c.lockWait, wait)
+	for {
+		max := atomic.LoadInt64(&c.lockMaxWait)
+		if wait <= max || atomic.CompareAndSwapInt64(&c.lockMaxWait, max, wait) {
+			return
+		}
+	}
+}
+
 // respWaiter register listener to response message with given correlationID
 // and return channel that single response message will be pushed to once it
 // will arrive.
 // After pushing response message, channel is closed.
 //
 // Upon connection close, all unconsumed channels are closed.
-func (c *connection) respWaiter(correlationID int32) (respc chan []byte, err error) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+func (c *connection) respWaiter(correlationID int32) (respc chan response, err error) {
+	shard := c.shardOf(correlationID)
+	c.lockShard(shard)
+	if shard.closed {
+		shard.mu.Unlock()
+		return nil, c.closedErr()
+	}
+	defer shard.mu.Unlock()
 
-	if c.stopErr != nil {
-		return nil, c.stopErr
+	if _, ok := shard.respc[correlationID]; ok {
+		log.Errorf("correlation conflict: %d", correlationID)
+		return nil, fmt.Errorf("correlation conflict: %d", correlationID)
 	}
-	if _, ok := c.respc[correlationID]; ok {
+	if _, ok := shard.respcb[correlationID]; ok {
 		log.Errorf("correlation conflict: %d", correlationID)
 		return nil, fmt.Errorf("correlation conflict: %d", correlationID)
 	}
-	respc = make(chan []byte)
-	c.respc[correlationID] = respc
+	// buffered, so that the response can be pushed even if the waiter gave
+	// up in the meantime
+	respc = make(chan response, 1)
+	shard.respc[correlationID] = respc
+	atomic.AddInt64(&c.inFlight, 1)
 	return respc, nil
 }
 
+// respCallback registers callback that will be called with response message
+// of given correlationID once it arrives. If the connection is closed before
+// that, callback is called with the error that closed the connection.
+func (c *connection) respCallback(correlationID int32, cb func([]byte, error)) error {
+	shard := c.shardOf(correlationID)
+	c.lockShard(shard)
+	if shard.closed {
+		shard.mu.Unlock()
+		return c.closedErr()
+	}
+	defer shard.mu.Unlock()
+
+	_, waiting := shard.respc[correlationID]
+	if _, ok := shard.respcb[correlationID]; ok || waiting {
+		log.Errorf("correlation conflict: %d", correlationID)
+		return fmt.Errorf("correlation conflict: %d", correlationID)
+	}
+	shard.respcb[correlationID] = cb
+	atomic.AddInt64(&c.inFlight, 1)
+	return nil
+}
+
+// releaseCallback removes callback registered for given correlationID without
+// calling it. Returns false if there was no such callback, which means it has
+// already been called or is about to be.
+func (c *connection) releaseCallback(correlationID int32) bool {
+	shard := c.shardOf(correlationID)
+	c.lockShard(shard)
+	defer shard.mu.Unlock()
+
+	_, ok := shard.respcb[correlationID]
+	if ok {
+		delete(shard.respcb, correlationID)
+		atomic.AddInt64(&c.inFlight, -1)
+	}
+	delete(shard.sent, correlationID)
+	return ok
+}
+
+// withClientID returns given client ID of a request, or the client ID of the
+// connection if it is empty.
+func (c *connection) withClientID(clientID string) string {
+	if clientID == "" {
+		return c.clientID
+	}
+	return clientID
+}
+
 // releaseWaiter removes response channel from waiters pool and close it.
 // Calling this method for unknown correlationID has no effect.
 func (c *connection) releaseWaiter(correlationID int32) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	shard := c.shardOf(correlationID)
+	c.lockShard(shard)
+	defer shard.mu.Unlock()
+
+	rc, ok := shard.respc[correlationID]
+	if ok {
+		delete(shard.respc, correlationID)
+		atomic.AddInt64(&c.inFlight, -1)
+		close(rc)
+	}
+	delete(shard.sent, correlationID)
+}
+
+// waitResponse waits for the response to the request of given correlationID,
+// to be pushed to given channel, for no longer than the timeout. Zero timeout
+// means no limit. If the response does not arrive in time, the waiter is
+// released and ErrReadTimeout returned. If the context is done first, the
+// waiter is released and the error of the context returned.
+func (c *connection) waitResponse(ctx context.Context, correlationID int32, respc chan response, timeout time.Duration) ([]byte, error) {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := c.clock.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C()
+	}
+
+	select {
+	case resp, ok := <-respc:
+		if !ok {
+			return nil, c.stopErr
+		}
+		return resp.b, resp.err
+	case <-expired:
+		c.abandonWaiter(correlationID)
+		return nil, ErrReadTimeout
+	case <-ctx.Done():
+		c.abandonWaiter(correlationID)
+		return nil, ctx.Err()
+	}
+}
+
+// abandonWaiter works like releaseWaiter, but also remembers that the
+// response to the request may still arrive, so that it is dropped quietly.
+func (c *connection) abandonWaiter(correlationID int32) {
+	shard := c.shardOf(correlationID)
+	c.lockShard(shard)
+	defer shard.mu.Unlock()
 
-	rc, ok := c.respc[correlationID]
+	rc, ok := shard.respc[correlationID]
 	if ok {
-		delete(c.respc, correlationID)
+		delete(shard.respc, correlationID)
+		atomic.AddInt64(&c.inFlight, -1)
+		close(rc)
+		shard.abandoned[correlationID] = struct{}{}
+	}
+}
+
+// CancelRequest makes the request of given correlation ID, that is waiting for
+// response, fail with ErrCancelled, without closing the connection. Requests
+// waiting with ProduceAsync have their callback called with ErrCancelled.
+//
+// Broker is not told about the cancellation and still processes the request.
+// Its response, if it arrives later, is dropped. Returns false if no request
+// with given correlation ID is waiting for response.
+func (c *connection) CancelRequest(correlationID int32) bool {
+	shard := c.shardOf(correlationID)
+	c.lockShard(shard)
+	rc, waiting := shard.respc[correlationID]
+	cb, async := shard.respcb[correlationID]
+	if waiting || async {
+		delete(shard.respc, correlationID)
+		delete(shard.respcb, correlationID)
+		atomic.AddInt64(&c.inFlight, -1)
+		shard.abandoned[correlationID] = struct{}{}
+	}
+	if waiting {
+		// buffered, and no longer reachable by the read loop
+		rc <- response{err: ErrCancelled}
 		close(rc)
 	}
+	shard.mu.Unlock()
+
+	if async {
+		cb(nil, ErrCancelled)
+	}
+	return waiting || async
+}
+
+// closedErr returns the error that closed the connection, or nil if it is
+// still open.
+func (c *connection) closedErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.stopErr
+}
+
+// flusher is implemented by transports buffering writes.
+type flusher interface {
+	Flush() error
+}
+
+// Flush writes out any requests buffered by the transport, so that they
+// actually leave the process. It has no effect if the transport does not
+// buffer writes.
+func (c *connection) Flush() error {
+	if f, ok := c.rw.(flusher); ok {
+		return f.Flush()
+	}
+	return nil
 }
 
 // StartTime returns the time the connection was established.
@@ -161,94 +937,602 @@ func (c *connection) StartTime() time.Time {
 	return c.startTime
 }
 
+// Age returns the time passed since the connection was established.
+func (c *connection) Age() time.Duration {
+	return c.clock.Now().Sub(c.startTime)
+}
+
+// setClock makes the connection use given clock, taking the start time from
+// it. It must be called before the connection is used.
+func (c *connection) setClock(clock Clock) {
+	c.clock = clock
+	c.startTime = clock.Now()
+}
+
 // Close close underlying transport connection and cancel all pending response
 // waiters.
 func (c *connection) Close() error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	return c.closeWith(ErrClosed, CloseReasonLocal)
+}
 
+// closeWith closes the connection, unless already closed, so that all
+// requests fail with given error.
+func (c *connection) closeWith(stopErr error, reason CloseReason) error {
+	c.mu.Lock()
 	if c.stopErr == nil {
-		c.stopErr = ErrClosed
+		c.stopErr = stopErr
+		c.closeReason = reason
 		close(c.stop)
 	}
+	c.mu.Unlock()
+
+	// reject new waiters right away, pending ones are released once the
+	// response reading loop stops
+	for i := range c.waiters {
+		shard := &c.waiters[i]
+		c.lockShard(shard)
+		shard.closed = true
+		shard.mu.Unlock()
+	}
+	c.produceWindow.close()
 	return c.rw.Close()
 }
 
-// IsClosed returns whether or not this connection has been stopped/closed.
-func (c *connection) IsClosed() bool {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+// InFlight returns the number of requests sent with this connection, that
+// are still waiting for response. It can be used together with request
+// latency to throttle the client before the broker queue saturates.
+func (c *connection) InFlight() int {
+	return int(atomic.LoadInt64(&c.inFlight))
+}
 
-	return c.stopErr != nil
+// InFlightBytes returns the size of produce requests sent with this
+// connection, that are still waiting for their acks. Produce requests block
+// while it exceeds the limit set by BrokerConf.MaxInFlightProduceBytes.
+func (c *connection) InFlightBytes() int64 {
+	return c.produceWindow.inFlight()
 }
 
-// Metadata sends given metadata request to kafka node and returns related
-// metadata response.
-// Calling this method on closed connection will always return ErrClosed.
-func (c *connection) Metadata(req *proto.MetadataReq) (*proto.MetadataResp, error) {
-	var ok bool
-	if req.CorrelationID, ok = <-c.nextID; !ok {
-		return nil, c.stopErr
+// PendingCorrelationIDs returns sorted correlation IDs of all requests that
+// are still waiting for response, which helps finding out what a stuck
+// connection waits for.
+func (c *connection) PendingCorrelationIDs() []int32 {
+	var ids []int32
+	for i := range c.waiters {
+		shard := &c.waiters[i]
+		c.lockShard(shard)
+		for id := range shard.respc {
+			ids = append(ids, id)
+		}
+		for id := range shard.respcb {
+			ids = append(ids, id)
+		}
+		shard.mu.Unlock()
 	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
 
-	respc, err := c.respWaiter(req.CorrelationID)
-	if err != nil {
-		log.Errorf("failed waiting for response: %s", err)
-		return nil, fmt.Errorf("wait for response: %s", err)
+// checkAPIKey returns ErrAPIKeyForbidden if requests of given API key must
+// not be sent.
+func (c *connection) checkAPIKey(apiKey int16) error {
+	if c.allowedAPIKeys != nil && !c.allowedAPIKeys[apiKey] {
+		return ErrAPIKeyForbidden
 	}
+	return nil
+}
 
-	if _, err := req.WriteTo(c.rw); err != nil {
-		log.Errorf("cannot write: %s", err)
-		c.releaseWaiter(req.CorrelationID)
-		return nil, err
+// write writes given encoded request to the transport.
+func (c *connection) write(b []byte) error {
+	// size followed by api key
+	if len(b) >= 6 {
+		if err := c.checkAPIKey(int16(binary.BigEndian.Uint16(b[4:]))); err != nil {
+			return err
+		}
 	}
-	b, ok := <-respc
-	if !ok {
-		return nil, c.stopErr
+	if hook := c.wireHook(); hook != nil {
+		c.sendOnWire(hook, b)
 	}
-	return proto.ReadMetadataResp(bytes.NewReader(b))
+	c.setWriteDeadline()
+	n, err := c.rw.Write(b)
+	return c.checkWrite(int64(n), err)
 }
 
-// Produce sends given produce request to kafka node and returns related
-// response. Sending request with no ACKs flag will result with returning nil
-// right after sending request, without waiting for response.
-// Calling this method on closed connection will always return ErrClosed.
-func (c *connection) Produce(req *proto.ProduceReq) (*proto.ProduceResp, error) {
-	var ok bool
-	if req.CorrelationID, ok = <-c.nextID; !ok {
-		return nil, c.stopErr
+// writeRequest writes given request to the transport.
+func (c *connection) writeRequest(req io.WriterTo) error {
+	if r, ok := req.(proto.Request); ok {
+		if err := c.checkAPIKey(r.Kind()); err != nil {
+			return err
+		}
+	}
+	if c.wireHook() != nil {
+		// the hook needs the whole request, which is otherwise streamed
+		// to the transport without buffering
+		var buf bytes.Buffer
+		if _, err := req.WriteTo(&buf); err != nil {
+			return err
+		}
+		return c.write(buf.Bytes())
 	}
+	c.setWriteDeadline()
+	return c.checkWrite(req.WriteTo(c.rw))
+}
 
-	if req.RequiredAcks == proto.RequiredAcksNone {
-		_, err := req.WriteTo(c.rw)
+// roundTrip sends given request and waits for its response, for no longer
+// than the read timeout of the connection, or until the context is done.
+func (c *connection) roundTrip(ctx context.Context, req proto.Request) ([]byte, error) {
+	return c.roundTripTimeout(ctx, req, c.readTimeout)
+}
+
+// roundTripTimeout sends given request and waits for its response, for no
+// longer than given timeout, or until the context is done. Zero timeout means
+// no limit. The request is not sent if the context is already done. The
+// request is given a new correlation ID, and the client ID of the connection
+// if it has none.
+func (c *connection) roundTripTimeout(ctx context.Context, req proto.Request, timeout time.Duration) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
+	req.SetClientID(c.withClientID(req.GetClientID()))
+	correlationID, ok := <-c.nextID
+	if !ok {
+		return nil, c.stopErr
+	}
+	req.SetCorrelationID(correlationID)
+	c.traceRequest(req.Kind(), req.GetClientID(), correlationID)
 
-	respc, err := c.respWaiter(req.CorrelationID)
+	respc, err := c.respWaiter(correlationID)
 	if err != nil {
 		log.Errorf("failed waiting for response: %s", err)
 		return nil, fmt.Errorf("wait for response: %s", err)
 	}
-
-	if _, err := req.WriteTo(c.rw); err != nil {
+	if err := c.writeRequest(req); err != nil {
 		log.Errorf("cannot write: %s", err)
-		c.releaseWaiter(req.CorrelationID)
+		c.releaseWaiter(correlationID)
 		return nil, err
 	}
-	b, ok := <-respc
-	if !ok {
-		return nil, c.stopErr
-	}
-	return proto.ReadProduceResp(bytes.NewReader(b))
+	return c.waitResponse(ctx, correlationID, respc, timeout)
 }
 
-// Fetch sends given fetch request to kafka node and returns related response.
+// writeDeadliner and readDeadliner are implemented by transports supporting
+// deadlines, such as net.Conn.
+type writeDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// setWriteDeadline limits the time of the next write to the write timeout.
+func (c *connection) setWriteDeadline() {
+	if c.writeTimeout <= 0 {
+		return
+	}
+	if d, ok := c.rw.(writeDeadliner); ok {
+		_ = d.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+}
+
+// updateReadDeadline sets the transport read deadline to the socket read
+// timeout from now if any request is waiting for response, and clears it
+// otherwise, so that idle connections are not closed.
+func (c *connection) updateReadDeadline() {
+	timeout := time.Duration(atomic.LoadInt64(&c.socketReadTimeout))
+	if timeout <= 0 {
+		return
+	}
+	d, ok := c.rw.(readDeadliner)
+	if !ok {
+		return
+	}
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	if c.InFlight() == 0 {
+		_ = d.SetReadDeadline(time.Time{})
+	} else {
+		_ = d.SetReadDeadline(time.Now().Add(timeout))
+	}
+}
+
+// checkWrite closes the connection with ErrPartialWrite if writing a request
+// failed after n of its bytes were written, as the stream of requests can no
+// longer be recovered, or with ErrWriteTimeout if the write timed out. Any
+// other error of the write is returned unchanged. Successful write of a request
+// waiting for response arms the socket read timeout.
+func (c *connection) checkWrite(n int64, err error) error {
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() && c.writeTimeout > 0 {
+		log.Errorf("writing request to %s timed out after %d bytes, closing connection",
+			c.addr, n)
+		_ = c.closeWith(ErrWriteTimeout, CloseReasonTimeout)
+		return ErrWriteTimeout
+	}
+	if err == nil {
+		c.updateReadDeadline()
+	}
+	if err != nil && n > 0 {
+		log.Errorf("request to %s partially written (%d bytes), closing connection: %s",
+			c.addr, n, err)
+		_ = c.closeWith(ErrPartialWrite, CloseReasonWriteError)
+	}
+	return err
+}
+
+// IsClosed returns whether or not this connection has been stopped/closed.
+func (c *connection) IsClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.stopErr != nil
+}
+
+// CloseReason returns the reason this connection has been closed, or
+// CloseReasonNone if it is still open.
+func (c *connection) CloseReason() CloseReason {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.closeReason
+}
+
+// apiVersion returns the version that should be used for request of given
+// kind, which is the version pinned for this connection, if any, or the
+// requested version.
+func (c *connection) apiVersion(kind int16, version int16) int16 {
+	if pinned, ok := c.versions[kind]; ok {
+		return pinned
+	}
+	return version
+}
+
+// APIVersions asks the broker for the versions it supports of every API. The
+// result is cached and used to reject requests the broker does not support,
+// before they are sent.
 // Calling this method on closed connection will always return ErrClosed.
-func (c *connection) Fetch(req *proto.FetchReq) (*proto.FetchResp, error) {
+func (c *connection) APIVersions(clientID string) (*proto.APIVersionsResp, error) {
+	req := &proto.APIVersionsReq{ClientID: clientID}
+	b, err := c.roundTrip(context.Background(), req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := proto.ReadAPIVersionsResp(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	if resp.Err == nil {
+		versions := make(map[int16]proto.APIVersionsRespAPI, len(resp.APIVersions))
+		for _, api := range resp.APIVersions {
+			versions[api.APIKey] = api
+		}
+		c.mu.Lock()
+		c.apiVersions = versions
+		c.mu.Unlock()
+	}
+	return resp, nil
+}
+
+// SupportsAPI returns whether the broker supports given version of the API of
+// given kind. All APIs are assumed to be supported until the supported
+// versions are fetched with APIVersions.
+func (c *connection) SupportsAPI(apiKey int16, version int16) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.apiVersions == nil {
+		return true
+	}
+	api, ok := c.apiVersions[apiKey]
+	return ok && version >= api.MinVersion && version <= api.MaxVersion
+}
+
+// checkAPI returns ErrUnsupportedAPIVersion if the broker is known not to
+// support given version of the API of given kind.
+func (c *connection) checkAPI(apiKey int16, version int16) error {
+	if !c.SupportsAPI(apiKey, version) {
+		return ErrUnsupportedAPIVersion
+	}
+	return nil
+}
+
+// versionFallback calls send, which sends request of given kind and version
+// and returns proto.ErrUnsupportedVersion if the broker rejected the version.
+// If downgrading versions is enabled and the versions supported by the broker
+// are known, the request is then sent again using lower version.
+func (c *connection) versionFallback(kind int16, version *int16, send func() error) error {
+	for {
+		err := send()
+		if err != proto.ErrUnsupportedVersion {
+			return err
+		}
+		lower, ok := c.lowerVersion(kind, *version)
+		if !ok {
+			return err
+		}
+		log.Debugf("%s v%d not supported by %s, retrying with v%d",
+			proto.RequestKindName(kind), *version, c.addr, lower)
+		*version = lower
+	}
+}
+
+// lowerVersion returns the version to retry request of given kind with,
+// after the broker rejected given version. Lower versions are used only if
+// downgrading is enabled, the version is not pinned and the versions
+// supported by the broker are known.
+func (c *connection) lowerVersion(kind int16, version int16) (int16, bool) {
+	if !c.downgradeVersions {
+		return 0, false
+	}
+	if _, pinned := c.versions[kind]; pinned {
+		return 0, false
+	}
+
+	c.mu.Lock()
+	api, ok := c.apiVersions[kind]
+	c.mu.Unlock()
+	if !ok {
+		return 0, false
+	}
+	lower := version - 1
+	if lower > api.MaxVersion {
+		lower = api.MaxVersion
+	}
+	if lower < api.MinVersion {
+		return 0, false
+	}
+	return lower, true
+}
+
+// setSocketReadTimeout limits the time this connection waits for any response
+// while requests are in flight. Zero means no limit.
+func (c *connection) setSocketReadTimeout(timeout time.Duration) {
+	atomic.StoreInt64(&c.socketReadTimeout, int64(timeout))
+}
+
+// setMaxInFlightBytes limits the size of produce requests waiting for acks,
+// above which new produce requests block. Zero means no limit.
+func (c *connection) setMaxInFlightBytes(size int64) {
+	c.produceWindow.setLimit(size)
+}
+
+// setMaxResponseSize limits the size of responses this connection accepts.
+// Connection is closed with proto.ResponseSizeError once a larger response
+// arrives. Zero means no limit.
+func (c *connection) setMaxResponseSize(size int32) {
+	atomic.StoreInt32(&c.maxResponseSize, size)
+}
+
+// NodeID returns the ID of the broker this connection is talking to, or -1 if
+// it is not known yet. It becomes known once a metadata response lists a
+// broker advertising the address this connection was made to.
+func (c *connection) NodeID() int32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.nodeID
+}
+
+// Rack returns the rack of the broker this connection is talking to. It is
+// empty until the node ID is known, or if the broker has no rack configured.
+func (c *connection) Rack() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.rack
+}
+
+// learnNode records the node ID and rack of the broker this connection is
+// talking to, if given metadata lists it.
+func (c *connection) learnNode(resp *proto.MetadataResp) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.nodeID != -1 {
+		return
+	}
+	for _, broker := range resp.Brokers {
+		if normalizeBrokerAddr(broker.Host, broker.Port) == c.addr {
+			c.nodeID = broker.NodeID
+			c.rack = broker.Rack
+			return
+		}
+	}
+}
+
+// Metadata sends given metadata request to kafka node and returns related
+// metadata response.
+// Calling this method on closed connection will always return ErrClosed.
+func (c *connection) Metadata(req *proto.MetadataReq) (*proto.MetadataResp, error) {
+	return c.MetadataContext(context.Background(), req)
+}
+
+// MetadataContext works like Metadata, but stops waiting for the response
+// once given context is done, returning the error of the context.
+func (c *connection) MetadataContext(ctx context.Context, req *proto.MetadataReq) (*proto.MetadataResp, error) {
+	req.Version = c.apiVersion(proto.MetadataReqKind, req.Version)
+	if err := c.checkAPI(proto.MetadataReqKind, req.Version); err != nil {
+		return nil, err
+	}
+
+	var resp *proto.MetadataResp
+	err := c.versionFallback(proto.MetadataReqKind, &req.Version, func() (err error) {
+		if resp, err = c.metadata(ctx, req); err != nil {
+			return err
+		}
+		for _, topic := range resp.Topics {
+			if topic.Err == proto.ErrUnsupportedVersion {
+				return topic.Err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.learnNode(resp)
+	return resp, nil
+}
+
+// TopicMetadata works like Metadata, but asks for metadata of explicitly
+// selected topics, so that all topics are returned only when asked for with
+// proto.AllTopics.
+func (c *connection) TopicMetadata(clientID string, topics proto.MetadataTopics) (*proto.MetadataResp, error) {
+	return c.Metadata(proto.NewMetadataReq(clientID, topics))
+}
+
+// metadata sends given metadata request and returns related response.
+func (c *connection) metadata(ctx context.Context, req *proto.MetadataReq) (*proto.MetadataResp, error) {
+	b, err := c.roundTrip(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return proto.ReadVersionedMetadataResp(bytes.NewReader(b), req.Version)
+}
+
+// ClusterDescription describes kafka cluster, as returned by DescribeCluster.
+type ClusterDescription struct {
+	ClusterID string
+	// Controller is the broker acting as the cluster controller. It is nil
+	// if the controller is not known.
+	Controller *proto.MetadataRespBroker
+	Brokers    []proto.MetadataRespBroker
+}
+
+// DescribeCluster returns the ID, controller and brokers of the cluster the
+// connected kafka node belongs to, fetched with single metadata request that
+// asks for no topics.
+func (c *connection) DescribeCluster(clientID string) (*ClusterDescription, error) {
+	resp, err := c.Metadata(&proto.MetadataReq{
+		ClientID: clientID,
+		Version:  2,
+		Topics:   []string{},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	desc := &ClusterDescription{
+		ClusterID: resp.ClusterID,
+		Brokers:   resp.Brokers,
+	}
+	for i, broker := range resp.Brokers {
+		if broker.NodeID == resp.ControllerID {
+			desc.Controller = &desc.Brokers[i]
+			break
+		}
+	}
+	return desc, nil
+}
+
+// Controller returns the node ID of the cluster controller, that admin
+// requests have to be sent to. It is fetched with single metadata request
+// that asks for no topics. ErrNoController is returned if the broker does not
+// report the controller, and without sending the request if metadata requests
+// are pinned to, or the broker only supports, version 0, which can neither ask
+// for no topics nor report the controller.
+func (c *connection) Controller(clientID string) (int32, error) {
+	req := &proto.MetadataReq{
+		ClientID: clientID,
+		Version:  1,
+		Topics:   []string{},
+	}
+	if c.apiVersion(proto.MetadataReqKind, req.Version) < 1 || !c.SupportsAPI(proto.MetadataReqKind, 1) {
+		return 0, ErrNoController
+	}
+	resp, err := c.Metadata(req)
+	if err != nil {
+		if req.Version < 1 {
+			// fell back to version 0, which cannot be sent
+			return 0, ErrNoController
+		}
+		return 0, err
+	}
+	if resp.Version < 1 || resp.ControllerID < 0 {
+		return 0, ErrNoController
+	}
+	return resp.ControllerID, nil
+}
+
+// Produce sends given produce request to kafka node and returns related
+// response. Sending request with no ACKs flag will result with returning nil
+// right after sending request, without waiting for response. Such request is
+// flushed before returning, but there is no guarantee that the broker received
+// or wrote it, so messages are lost if the connection breaks. Requests larger
+// than the connection's size limits are rejected with *RequestTooLargeError or
+// ErrMessageTooLarge without being sent. Request sent without compression is
+// compressed with the connection's default codec. Offsets the broker assigned
+// to the written messages are returned by BaseOffset of the response.
+// Calling this method on closed connection will always return ErrClosed.
+func (c *connection) Produce(req *proto.ProduceReq) (*proto.ProduceResp, error) {
+	return c.ProduceContext(context.Background(), req)
+}
+
+// ProduceContext works like Produce, but stops waiting for the response once
+// given context is done, returning the error of the context. The messages may
+// still be written by the broker.
+func (c *connection) ProduceContext(ctx context.Context, req *proto.ProduceReq) (*proto.ProduceResp, error) {
+	req.Version = c.apiVersion(proto.ProduceReqKind, req.Version)
+	if err := c.checkAPI(proto.ProduceReqKind, req.Version); err != nil {
+		return nil, err
+	}
+	send := c.sendProduceReq(req)
+	defer syncProduceReq(req, send)
+
+	var resp *proto.ProduceResp
+	err := c.versionFallback(proto.ProduceReqKind, &send.Version, func() (err error) {
+		// the version may have been lowered since the last try
+		if err := checkCompression(send); err != nil {
+			return err
+		}
+		if resp, err = c.produce(ctx, send); err != nil || resp == nil {
+			return err
+		}
+		for _, topic := range resp.Topics {
+			for _, part := range topic.Partitions {
+				if part.Err == proto.ErrUnsupportedVersion {
+					return part.Err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// produce sends given produce request and returns related response, which is
+// nil if no ACKs were requested.
+func (c *connection) produce(ctx context.Context, req *proto.ProduceReq) (*proto.ProduceResp, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	req.ClientID = c.withClientID(req.ClientID)
 	var ok bool
 	if req.CorrelationID, ok = <-c.nextID; !ok {
 		return nil, c.stopErr
 	}
+	c.traceRequest(req.Kind(), req.ClientID, req.CorrelationID)
+
+	b, err := req.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.checkRequestSize(b); err != nil {
+		return nil, err
+	}
+
+	if req.RequiredAcks == proto.RequiredAcksNone {
+		if err := c.write(b); err != nil {
+			return nil, err
+		}
+		return nil, c.Flush()
+	}
+
+	size := int64(len(b))
+	if !c.produceWindow.acquire(size) {
+		return nil, c.closedErr()
+	}
+	defer c.produceWindow.release(size)
 
 	respc, err := c.respWaiter(req.CorrelationID)
 	if err != nil {
@@ -256,139 +1540,676 @@ func (c *connection) Fetch(req *proto.FetchReq) (*proto.FetchResp, error) {
 		return nil, fmt.Errorf("wait for response: %s", err)
 	}
 
-	if _, err := req.WriteTo(c.rw); err != nil {
+	if err := c.write(b); err != nil {
 		log.Errorf("cannot write: %s", err)
 		c.releaseWaiter(req.CorrelationID)
 		return nil, err
 	}
-	b, ok := <-respc
-	if !ok {
-		return nil, c.stopErr
+	b, err = c.waitResponse(ctx, req.CorrelationID, respc, c.readTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return proto.ReadVersionedProduceResp(bytes.NewReader(b), req.Version)
+}
+
+// sendProduceReq returns a copy of given produce request to be sent, that
+// counts compression in the counters of the connection, and uses its default
+// compression if the request is sent without compression. The request of the
+// caller is left as it is.
+func (c *connection) sendProduceReq(req *proto.ProduceReq) *proto.ProduceReq {
+	send := *req
+	if send.Compression == proto.CompressionNone {
+		send.Compression = c.compression
+	}
+	send.CompressionCounters = &c.compressionCounters
+	return &send
+}
+
+// syncProduceReq copies the fields set while sending the copy made by
+// sendProduceReq back to the request of the caller.
+func syncProduceReq(req, sent *proto.ProduceReq) {
+	req.ClientID = sent.ClientID
+	req.CorrelationID = sent.CorrelationID
+	req.Version = sent.Version
+}
+
+// checkCompression returns ErrUnsupportedCompression if the codec of given
+// produce request cannot be used with the version the request is sent with.
+func checkCompression(req *proto.ProduceReq) error {
+	min, ok := compressionMinVersion[req.Compression]
+	if !ok || req.Version < min {
+		return ErrUnsupportedCompression
+	}
+	return nil
+}
+
+// checkRequestSize returns an error if encoded produce request exceeds the
+// size limits of the connection.
+func (c *connection) checkRequestSize(b []byte) error {
+	if c.maxSocketRequestSize > 0 && len(b) > c.maxSocketRequestSize {
+		return &RequestTooLargeError{Size: len(b), Limit: c.maxSocketRequestSize}
+	}
+	if c.maxRequestSize > 0 && len(b) > c.maxRequestSize {
+		return ErrMessageTooLarge
+	}
+	return nil
+}
+
+// ProduceAsync sends given produce request to kafka node without waiting for
+// the response. Once the response arrives, callback is called with it from the
+// goroutine reading responses of this connection, so it must not block. If the
+// connection is closed before that, callback is called with the closing error.
+// Sending request with no ACKs flag results in calling callback with nil
+// response right after sending and flushing request.
+//
+// Error is returned, and callback is never called, if the request could not be
+// sent. Otherwise callback is called exactly once.
+func (c *connection) ProduceAsync(req *proto.ProduceReq, callback func(*proto.ProduceResp, error)) error {
+	req.Version = c.apiVersion(proto.ProduceReqKind, req.Version)
+	if err := c.checkAPI(proto.ProduceReqKind, req.Version); err != nil {
+		return err
+	}
+	caller := req
+	req = c.sendProduceReq(req)
+	defer syncProduceReq(caller, req)
+	if err := checkCompression(req); err != nil {
+		return err
+	}
+
+	req.ClientID = c.withClientID(req.ClientID)
+	var ok bool
+	if req.CorrelationID, ok = <-c.nextID; !ok {
+		return c.stopErr
+	}
+	c.traceRequest(req.Kind(), req.ClientID, req.CorrelationID)
+
+	b, err := req.Bytes()
+	if err != nil {
+		return err
+	}
+	if err := c.checkRequestSize(b); err != nil {
+		return err
+	}
+
+	if req.RequiredAcks == proto.RequiredAcksNone {
+		if err := c.write(b); err != nil {
+			return err
+		}
+		if err := c.Flush(); err != nil {
+			return err
+		}
+		callback(nil, nil)
+		return nil
+	}
+
+	size := int64(len(b))
+	if !c.produceWindow.acquire(size) {
+		return c.closedErr()
+	}
+	version := req.Version
+	err = c.respCallback(req.CorrelationID, func(b []byte, err error) {
+		c.produceWindow.release(size)
+		if err != nil {
+			callback(nil, err)
+			return
+		}
+		callback(proto.ReadVersionedProduceResp(bytes.NewReader(b), version))
+	})
+	if err != nil {
+		c.produceWindow.release(size)
+		log.Errorf("failed waiting for response: %s", err)
+		return fmt.Errorf("wait for response: %s", err)
+	}
+
+	if err := c.write(b); err != nil {
+		log.Errorf("cannot write: %s", err)
+		if !c.releaseCallback(req.CorrelationID) {
+			// connection died in the meantime and the callback has
+			// already been notified
+			return nil
+		}
+		c.produceWindow.release(size)
+		return err
 	}
-	resp, err := proto.ReadFetchResp(bytes.NewReader(b))
+	return nil
+}
+
+// Fetch sends given fetch request to kafka node and returns related response.
+// Requests of version 7 and above are sent using the connection's incremental
+// fetch session, in which case session ID and epoch of the request are ignored.
+// If the request limits the number of messages per partition, the remaining
+// messages are dropped and the offset to continue from is reported by
+// NextOffset of every partition.
+// Calling this method on closed connection will always return ErrClosed.
+func (c *connection) Fetch(req *proto.FetchReq) (*proto.FetchResp, error) {
+	return c.FetchContext(context.Background(), req)
+}
+
+// FetchContext works like Fetch, but stops waiting for the response once
+// given context is done, returning the error of the context.
+func (c *connection) FetchContext(ctx context.Context, req *proto.FetchReq) (*proto.FetchResp, error) {
+	resp, err := c.sendFetch(ctx, req, false)
 	if err != nil {
 		return nil, err
 	}
 
+	offsets := make(map[topicPartition]int64)
+	for _, topic := range req.Topics {
+		for _, part := range topic.Partitions {
+			offsets[topicPartition{topic.Name, part.ID}] = part.FetchOffset
+		}
+	}
+
 	// Compressed messages are returned in full batches for efficiency
 	// (the broker doesn't need to decompress).
 	// This means that it's possible to get some leading messages
 	// with a smaller offset than requested. Trim those.
 	for ti := range resp.Topics {
 		topic := &resp.Topics[ti]
-		reqTopic := &req.Topics[ti]
 		for pi := range topic.Partitions {
 			partition := &topic.Partitions[pi]
-			reqPartition := &reqTopic.Partitions[pi]
+			fetchOffset := offsets[topicPartition{topic.Name, partition.ID}]
 			i := 0
 			for _, msg := range partition.Messages {
-				if msg.Offset >= reqPartition.FetchOffset {
+				if msg.Offset >= fetchOffset {
 					break
 				}
 				i++
 			}
+			if i > 0 && i == len(partition.Messages) && partition.Err == nil &&
+				c.staleFetch == StaleFetchError {
+				log.Warningf("fetch of %s:%d from offset %d returned only messages up to offset %d",
+					topic.Name, partition.ID, fetchOffset, partition.Messages[i-1].Offset)
+				partition.Err = ErrStaleFetch
+			}
 			partition.Messages = partition.Messages[i:]
+
+			if req.MaxMessagesPerPartition > 0 {
+				partition.NextOffset = fetchOffset
+				if len(partition.Messages) > req.MaxMessagesPerPartition {
+					partition.NextOffset = partition.Messages[req.MaxMessagesPerPartition].Offset
+					partition.Messages = partition.Messages[:req.MaxMessagesPerPartition]
+				} else if n := len(partition.Messages); n > 0 {
+					partition.NextOffset = partition.Messages[n-1].Offset + 1
+				}
+			}
 		}
 	}
 	return resp, nil
 }
 
+// RawFetch works like Fetch, but returns messages exactly as the broker sent
+// them. Compressed batches are returned whole, so messages of a partition may
+// start below the requested offset, which tools mirroring or replicating
+// topics need to preserve batch boundaries. MaxMessagesPerPartition and the
+// connection's StaleFetchPolicy are ignored, and NextOffset is not set.
+// RawMessageSet of every partition is set to the message set as sent, so that
+// it can be produced to another cluster verbatim.
+func (c *connection) RawFetch(req *proto.FetchReq) (*proto.FetchResp, error) {
+	return c.RawFetchContext(context.Background(), req)
+}
+
+// RawFetchContext works like RawFetch, but stops waiting for the response once
+// given context is done, returning the error of the context.
+func (c *connection) RawFetchContext(ctx context.Context, req *proto.FetchReq) (*proto.FetchResp, error) {
+	return c.sendFetch(ctx, req, true)
+}
+
+// sendFetch sends given fetch request, using the fetch session if its version
+// allows, and falls back to lower versions if the broker does not support it.
+// Message sets of the response are kept if raw is set.
+func (c *connection) sendFetch(ctx context.Context, req *proto.FetchReq, raw bool) (*proto.FetchResp, error) {
+	req.Version = c.apiVersion(proto.FetchReqKind, req.Version)
+	if err := c.checkAPI(proto.FetchReqKind, req.Version); err != nil {
+		return nil, err
+	}
+
+	var resp *proto.FetchResp
+	err := c.versionFallback(proto.FetchReqKind, &req.Version, func() (err error) {
+		if req.Version >= 7 {
+			resp, err = c.sessionFetch(ctx, req, raw)
+		} else {
+			resp, err = c.fetch(ctx, req, raw)
+		}
+		if err != nil {
+			return err
+		}
+		if resp.Err == proto.ErrUnsupportedVersion {
+			return resp.Err
+		}
+		for _, topic := range resp.Topics {
+			for _, part := range topic.Partitions {
+				if part.Err == proto.ErrUnsupportedVersion {
+					return part.Err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// fetchDeadlineMargin is the time left for the fetch response to arrive after
+// the broker stops waiting for data, when fetching with a deadline.
+const fetchDeadlineMargin = 20 * time.Millisecond
+
+// FetchDeadline works like Fetch, but limits the time the broker waits for
+// data so that the response arrives before given deadline. If there is no time
+// left to wait, the broker is asked to return immediately, with whatever data
+// is available.
+func (c *connection) FetchDeadline(req *proto.FetchReq, deadline time.Time) (*proto.FetchResp, error) {
+	clampFetchWait(req, deadline.Sub(c.clock.Now()))
+	return c.Fetch(req)
+}
+
+// clampFetchWait limits the MaxWaitTime of given request, so that the broker
+// answers within the time left.
+func clampFetchWait(req *proto.FetchReq, left time.Duration) {
+	left -= fetchDeadlineMargin
+	// wait time is sent in milliseconds, anything shorter means no wait
+	if left < time.Millisecond {
+		req.MaxWaitTime = 0
+		req.MinBytes = 0
+		return
+	}
+	if req.MaxWaitTime > left {
+		req.MaxWaitTime = left
+	}
+}
+
+// fetchReadSlack is the time, on top of MaxWaitTime, that the response to a
+// fetch request is given to arrive.
+const fetchReadSlack = time.Second
+
+// fetchReadTimeout returns the time to wait for the response to given fetch
+// request. The connection's read timeout is extended if it is too short for
+// the broker to wait MaxWaitTime for data, as it would otherwise expire on
+// every long polling fetch.
+func (c *connection) fetchReadTimeout(req *proto.FetchReq) time.Duration {
+	if c.readTimeout <= 0 {
+		return 0
+	}
+	if min := req.MaxWaitTime + fetchReadSlack; c.readTimeout < min {
+		log.Warningf("read timeout %s is too short for fetch waiting up to %s, using %s",
+			c.readTimeout, req.MaxWaitTime, min)
+		return min
+	}
+	return c.readTimeout
+}
+
+// fetch sends given fetch request to kafka node and returns related response.
+// Message sets of the response are kept if raw is set.
+func (c *connection) fetch(ctx context.Context, req *proto.FetchReq, raw bool) (*proto.FetchResp, error) {
+	b, err := c.roundTripTimeout(ctx, req, c.fetchReadTimeout(req))
+	if err != nil {
+		return nil, err
+	}
+	return proto.ReadCountedFetchResp(bytes.NewReader(b), req.Version, raw, &c.compressionCounters)
+}
+
+// sessionFetch sends given fetch request using the connection's incremental
+// fetch session. Only partitions that were added or changed since the last
+// request are sent to the broker, and partitions no longer asked for are sent
+// as forgotten. Partitions omitted by the broker in the response are filled
+// in, so that the caller always gets an answer for every partition it asked
+// for.
+//
+// If the broker no longer recognizes the session, it is reset and the request
+// is retried once as a full fetch.
+func (c *connection) sessionFetch(ctx context.Context, req *proto.FetchReq, raw bool) (*proto.FetchResp, error) {
+	c.sessionMu.Lock()
+	defer c.sessionMu.Unlock()
+
+	for try := 0; ; try++ {
+		resp, err := c.fetch(ctx, c.sessionReq(req), raw)
+		if err != nil {
+			c.session = fetchSession{}
+			return nil, err
+		}
+		switch resp.Err {
+		case nil:
+		case proto.ErrFetchSessionIDNotFound, proto.ErrInvalidFetchSessionEpoch:
+			log.Debugf("fetch session %d reset: %s", c.session.id, resp.Err)
+			c.session = fetchSession{}
+			if try == 0 {
+				continue
+			}
+			return nil, resp.Err
+		default:
+			c.session = fetchSession{}
+			return nil, resp.Err
+		}
+		c.updateSession(req, resp)
+		return resp, nil
+	}
+}
+
+// sessionReq returns the fetch request that should be sent to the broker,
+// given the current state of the fetch session. Must be called with sessionMu
+// held.
+func (c *connection) sessionReq(req *proto.FetchReq) *proto.FetchReq {
+	wire := *req
+	wire.ForgottenTopics = nil
+	if c.session.id == 0 {
+		wire.SessionID = 0
+		wire.SessionEpoch = 0
+		return &wire
+	}
+
+	wire.SessionID = c.session.id
+	wire.SessionEpoch = c.session.epoch
+	wire.ForgottenTopics = c.forgottenTopics(req)
+	wire.Topics = nil
+	for _, topic := range req.Topics {
+		var parts []proto.FetchReqPartition
+		for _, part := range topic.Partitions {
+			if sent, ok := c.session.partitions[topicPartition{topic.Name, part.ID}]; ok && sent == part {
+				continue
+			}
+			parts = append(parts, part)
+		}
+		if len(parts) != 0 {
+			wire.Topics = append(wire.Topics, proto.FetchReqTopic{
+				Name:       topic.Name,
+				Partitions: parts,
+			})
+		}
+	}
+	return &wire
+}
+
+// forgottenTopics returns partitions of the fetch session that are not part of
+// given request, and so have to be removed from the session. Must be called
+// with sessionMu held.
+func (c *connection) forgottenTopics(req *proto.FetchReq) []proto.FetchReqForgottenTopic {
+	requested := make(map[topicPartition]bool)
+	for _, topic := range req.Topics {
+		for _, part := range topic.Partitions {
+			requested[topicPartition{topic.Name, part.ID}] = true
+		}
+	}
+	forgotten := make(map[string][]int32)
+	for tp := range c.session.partitions {
+		if !requested[tp] {
+			forgotten[tp.topic] = append(forgotten[tp.topic], tp.partition)
+		}
+	}
+	if len(forgotten) == 0 {
+		return nil
+	}
+
+	topics := make([]proto.FetchReqForgottenTopic, 0, len(forgotten))
+	for name, partitions := range forgotten {
+		sort.Slice(partitions, func(i, j int) bool { return partitions[i] < partitions[j] })
+		topics = append(topics, proto.FetchReqForgottenTopic{Name: name, Partitions: partitions})
+	}
+	sort.Slice(topics, func(i, j int) bool { return topics[i].Name < topics[j].Name })
+	return topics
+}
+
+// updateSession records the outcome of a successful session fetch and fills in
+// the partitions omitted from the response. Must be called with sessionMu held.
+func (c *connection) updateSession(req *proto.FetchReq, resp *proto.FetchResp) {
+	if resp.SessionID == 0 {
+		// broker did not create a session, keep sending full requests
+		c.session = fetchSession{}
+		return
+	}
+	if resp.SessionID != c.session.id {
+		c.session = fetchSession{
+			id:         resp.SessionID,
+			partitions: make(map[topicPartition]proto.FetchReqPartition),
+			tips:       make(map[topicPartition]int64),
+		}
+	}
+	c.session.epoch++
+	if c.session.epoch <= 0 {
+		c.session.epoch = 1
+	}
+	for _, topic := range c.forgottenTopics(req) {
+		for _, id := range topic.Partitions {
+			delete(c.session.partitions, topicPartition{topic.Name, id})
+			delete(c.session.tips, topicPartition{topic.Name, id})
+		}
+	}
+
+	returned := make(map[topicPartition]bool)
+	for _, topic := range resp.Topics {
+		for _, part := range topic.Partitions {
+			tp := topicPartition{topic.Name, part.ID}
+			returned[tp] = true
+			c.session.tips[tp] = part.TipOffset
+		}
+	}
+	for _, topic := range req.Topics {
+		for _, part := range topic.Partitions {
+			tp := topicPartition{topic.Name, part.ID}
+			c.session.partitions[tp] = part
+			if returned[tp] {
+				continue
+			}
+			respPart := proto.FetchRespPartition{
+				ID:        part.ID,
+				TipOffset: c.session.tips[tp],
+			}
+			found := false
+			for ti := range resp.Topics {
+				if resp.Topics[ti].Name == topic.Name {
+					resp.Topics[ti].Partitions = append(resp.Topics[ti].Partitions, respPart)
+					found = true
+					break
+				}
+			}
+			if !found {
+				resp.Topics = append(resp.Topics, proto.FetchRespTopic{
+					Name:       topic.Name,
+					Partitions: []proto.FetchRespPartition{respPart},
+				})
+			}
+		}
+	}
+}
+
 // Offset sends given offset request to kafka node and returns related response.
 // Calling this method on closed connection will always return ErrClosed.
 func (c *connection) Offset(req *proto.OffsetReq) (*proto.OffsetResp, error) {
-	var ok bool
-	if req.CorrelationID, ok = <-c.nextID; !ok {
-		return nil, c.stopErr
-	}
+	return c.OffsetContext(context.Background(), req)
+}
 
-	respc, err := c.respWaiter(req.CorrelationID)
-	if err != nil {
-		log.Errorf("failed waiting for response: %s", err)
-		return nil, fmt.Errorf("wait for response: %s", err)
+// OffsetContext works like Offset, but stops waiting for the response once
+// given context is done, returning the error of the context.
+func (c *connection) OffsetContext(ctx context.Context, req *proto.OffsetReq) (*proto.OffsetResp, error) {
+	if err := c.checkAPI(proto.OffsetReqKind, 0); err != nil {
+		return nil, err
 	}
 
 	// TODO(husio) documentation is not mentioning this directly, but I assume
 	// -1 is for non node clients
 	req.ReplicaID = -1
-	if _, err := req.WriteTo(c.rw); err != nil {
-		log.Errorf("cannot write: %s", err)
-		c.releaseWaiter(req.CorrelationID)
+	b, err := c.roundTrip(ctx, req)
+	if err != nil {
 		return nil, err
 	}
 
-	b, ok := <-respc
-	if !ok {
-		return nil, c.stopErr
-	}
-
 	return proto.ReadOffsetResp(bytes.NewReader(b))
 }
 
 func (c *connection) GroupCoordinator(req *proto.GroupCoordinatorReq) (*proto.GroupCoordinatorResp, error) {
-	var ok bool
-	if req.CorrelationID, ok = <-c.nextID; !ok {
-		return nil, c.stopErr
+	if err := c.checkAPI(proto.GroupCoordinatorReqKind, 0); err != nil {
+		return nil, err
 	}
-	respc, err := c.respWaiter(req.CorrelationID)
+
+	b, err := c.roundTrip(context.Background(), req)
 	if err != nil {
-		log.Errorf("failed waiting for response: %s", err)
-		return nil, fmt.Errorf("wait for response: %s", err)
+		return nil, err
 	}
+	return proto.ReadGroupCoordinatorResp(bytes.NewReader(b))
+}
 
-	if _, err := req.WriteTo(c.rw); err != nil {
-		log.Errorf("cannot write: %s", err)
-		c.releaseWaiter(req.CorrelationID)
+func (c *connection) OffsetCommit(req *proto.OffsetCommitReq) (*proto.OffsetCommitResp, error) {
+	return c.OffsetCommitContext(context.Background(), req)
+}
+
+// OffsetCommitContext works like OffsetCommit, but stops waiting for the response once
+// given context is done, returning the error of the context.
+func (c *connection) OffsetCommitContext(ctx context.Context, req *proto.OffsetCommitReq) (*proto.OffsetCommitResp, error) {
+	if err := c.checkAPI(proto.OffsetCommitReqKind, 1); err != nil {
 		return nil, err
 	}
-	b, ok := <-respc
-	if !ok {
-		return nil, c.stopErr
+
+	b, err := c.roundTrip(ctx, req)
+	if err != nil {
+		return nil, err
 	}
-	return proto.ReadGroupCoordinatorResp(bytes.NewReader(b))
+	return proto.ReadOffsetCommitResp(bytes.NewReader(b))
 }
 
-func (c *connection) OffsetCommit(req *proto.OffsetCommitReq) (*proto.OffsetCommitResp, error) {
-	var ok bool
-	if req.CorrelationID, ok = <-c.nextID; !ok {
-		return nil, c.stopErr
+// OffsetFetch sends given offset fetch request to kafka node and returns related
+// response. Requests for offsets of all partitions are sent using at least
+// version 2, as older versions do not support it.
+func (c *connection) OffsetFetch(req *proto.OffsetFetchReq) (*proto.OffsetFetchResp, error) {
+	return c.OffsetFetchContext(context.Background(), req)
+}
+
+// OffsetFetchContext works like OffsetFetch, but stops waiting for the response once
+// given context is done, returning the error of the context.
+func (c *connection) OffsetFetchContext(ctx context.Context, req *proto.OffsetFetchReq) (*proto.OffsetFetchResp, error) {
+	req.Version = c.apiVersion(proto.OffsetFetchReqKind, req.Version)
+	if req.AllPartitions && req.Version < 2 {
+		// fetching all partitions is not supported by older versions
+		req.Version = 2
 	}
-	respc, err := c.respWaiter(req.CorrelationID)
+	// versions below 1 are sent as 1
+	version := req.Version
+	if version < 1 {
+		version = 1
+	}
+	if err := c.checkAPI(proto.OffsetFetchReqKind, version); err != nil {
+		return nil, err
+	}
+
+	b, err := c.roundTrip(ctx, req)
 	if err != nil {
-		log.Errorf("failed waiting for response: %s", err)
-		return nil, fmt.Errorf("wait for response: %s", err)
+		return nil, err
 	}
+	resp, err := proto.ReadVersionedOffsetFetchResp(bytes.NewReader(b), req.Version)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Err == proto.ErrUnsupportedVersion {
+		return nil, resp.Err
+	}
+	return resp, nil
+}
 
-	if _, err := req.WriteTo(c.rw); err != nil {
-		log.Errorf("cannot write: %s", err)
-		c.releaseWaiter(req.CorrelationID)
+// Heartbeat sends given heartbeat request to kafka node and returns related
+// response. The request must be sent to the coordinator of the group.
+func (c *connection) Heartbeat(req *proto.HeartbeatReq) (*proto.HeartbeatResp, error) {
+	if err := c.checkAPI(proto.HeartbeatReqKind, 0); err != nil {
 		return nil, err
 	}
-	b, ok := <-respc
-	if !ok {
-		return nil, c.stopErr
+
+	b, err := c.roundTrip(context.Background(), req)
+	if err != nil {
+		return nil, err
 	}
-	return proto.ReadOffsetCommitResp(bytes.NewReader(b))
+	return proto.ReadHeartbeatResp(bytes.NewReader(b))
 }
 
-func (c *connection) OffsetFetch(req *proto.OffsetFetchReq) (*proto.OffsetFetchResp, error) {
-	var ok bool
-	if req.CorrelationID, ok = <-c.nextID; !ok {
-		return nil, c.stopErr
+// DeleteGroups sends given delete groups request to kafka node and returns
+// related response. The request must be sent to the coordinator of the
+// groups. Every group is reported with its own error, with ErrNonEmptyGroup
+// returned for groups that still have active members.
+func (c *connection) DeleteGroups(req *proto.DeleteGroupsReq) (*proto.DeleteGroupsResp, error) {
+	if err := c.checkAPI(proto.DeleteGroupsReqKind, 0); err != nil {
+		return nil, err
 	}
-	respc, err := c.respWaiter(req.CorrelationID)
+
+	b, err := c.roundTrip(context.Background(), req)
 	if err != nil {
-		log.Errorf("failed waiting for response: %s", err)
-		return nil, fmt.Errorf("wait for response: %s", err)
+		return nil, err
 	}
+	return proto.ReadDeleteGroupsResp(bytes.NewReader(b))
+}
 
-	if _, err := req.WriteTo(c.rw); err != nil {
-		log.Errorf("cannot write: %s", err)
-		c.releaseWaiter(req.CorrelationID)
+// OffsetDelete sends given offset delete request to kafka node and returns
+// related response. The request must be sent to the coordinator of the
+// group. Every partition is reported with its own error, unless the request
+// failed as a whole.
+func (c *connection) OffsetDelete(req *proto.OffsetDeleteReq) (*proto.OffsetDeleteResp, error) {
+	if err := c.checkAPI(proto.OffsetDeleteReqKind, 0); err != nil {
 		return nil, err
 	}
-	b, ok := <-respc
-	if !ok {
-		return nil, c.stopErr
+
+	b, err := c.roundTrip(context.Background(), req)
+	if err != nil {
+		return nil, err
+	}
+	return proto.ReadOffsetDeleteResp(bytes.NewReader(b))
+}
+
+// WriteTxnMarkers sends given write transaction markers request to kafka node
+// and returns related response. The request must be sent to the leader of all
+// listed partitions. Every partition is reported with its own error.
+func (c *connection) WriteTxnMarkers(req *proto.WriteTxnMarkersReq) (*proto.WriteTxnMarkersResp, error) {
+	if err := c.checkAPI(proto.WriteTxnMarkersReqKind, 0); err != nil {
+		return nil, err
+	}
+
+	b, err := c.roundTrip(context.Background(), req)
+	if err != nil {
+		return nil, err
+	}
+	return proto.ReadWriteTxnMarkersResp(bytes.NewReader(b))
+}
+
+// Envelope sends given request wrapped in an envelope request, on behalf of
+// the client with given serialized principal and IP address, and returns the
+// response to the embedded request. The response is returned with the message
+// size prepended, as read by the response decoding functions of the proto
+// package, such as proto.ReadMetadataResp. Correlation ID of the embedded
+// request is sent as is.
+func (c *connection) Envelope(embedded io.WriterTo, principal, clientAddr []byte) ([]byte, error) {
+	if err := c.checkAPI(proto.EnvelopeReqKind, 0); err != nil {
+		return nil, err
+	}
+
+	var data bytes.Buffer
+	if _, err := embedded.WriteTo(&data); err != nil {
+		return nil, err
+	}
+	if data.Len() < 6 {
+		return nil, errors.New("embedded request is too short")
+	}
+	// the envelope must not be a way around the allowed API keys
+	if err := c.checkAPIKey(int16(binary.BigEndian.Uint16(data.Bytes()[4:]))); err != nil {
+		return nil, err
+	}
+	req := &proto.EnvelopeReq{
+		RequestData:       data.Bytes()[4:],
+		RequestPrincipal:  principal,
+		ClientHostAddress: clientAddr,
+	}
+
+	b, err := c.roundTrip(context.Background(), req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := proto.ReadEnvelopeResp(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	if resp.Err != nil {
+		return nil, resp.Err
+	}
+	if resp.ResponseData == nil {
+		return nil, errors.New("envelope response carries no data")
 	}
-	return proto.ReadOffsetFetchResp(bytes.NewReader(b))
+	framed := make([]byte, 4+len(resp.ResponseData))
+	binary.BigEndian.PutUint32(framed, uint32(len(resp.ResponseData)))
+	copy(framed[4:], resp.ResponseData)
+	return framed, nil
 }
@@ -85,7 +85,7 @@ func (b *backend) debugHitMaxConnections() {
 		b.counter, len(b.conns), b.debugNumHitMax)
 	for idx, conn := range b.conns {
 		log.Debugf("DEBUG: connection %d: addr=%s, closed=%v, age=%s",
-			idx, conn.addr, conn.IsClosed(), now.Sub(conn.StartTime()))
+			idx, conn.addr, conn.IsClosed(), conn.Age())
 	}
 }
 
@@ -121,12 +121,55 @@ func (b *backend) getNewConnection() (*connection, error) {
 		b.counter = len(newConns)
 	}
 
-	conn, err := newTCPConnection(b.addr, b.conf.DialTimeout)
-	if err == nil {
-		b.counter++
-		b.conns = append(b.conns, conn)
+	conn, err := dialBrokerConnection(b.addr, b.conf)
+	if err != nil {
+		return nil, err
 	}
-	return conn, err
+	b.counter++
+	b.conns = append(b.conns, conn)
+	return conn, nil
+}
+
+// dialBrokerConnection dials a new connection to given address, configured
+// as given broker configuration asks for.
+func dialBrokerConnection(addr string, conf BrokerConf) (*connection, error) {
+	conn, err := dialConnection(addr, conf.DialTimeout, conf.ReadBufferSize, conf.ExpectedInFlight, conf.Resolve)
+	if err != nil {
+		return nil, err
+	}
+	conn.maxRequestSize = conf.MaxRequestSize
+	conn.maxSocketRequestSize = conf.MaxSocketRequestSize
+	conn.readTimeout = conf.ReadTimeout
+	conn.writeTimeout = conf.WriteTimeout
+	conn.setSocketReadTimeout(conf.SocketReadTimeout)
+	conn.strictCorrelation = conf.StrictCorrelationIDs
+	conn.compression = conf.Compression
+	conn.clientID = conf.ClientID
+	conn.allowedAPIKeys = conf.AllowedAPIKeys
+	conn.staleFetch = conf.StaleFetch
+	conn.traceSeparator = conf.TraceSeparator
+	if conf.Clock != nil {
+		conn.setClock(conf.Clock)
+	}
+	conn.versions = conf.APIVersions
+	conn.downgradeVersions = conf.DowngradeVersions
+	conn.setMaxResponseSize(conf.MaxResponseSize)
+	conn.setMaxInFlightBytes(conf.MaxInFlightProduceBytes)
+	conn.skipOversized = conf.SkipOversizedResponses
+	conn.setOnWire(conf.OnWire)
+	if conf.SASL != nil {
+		if err := conn.authenticate(conf.SASL, conf.ClientID, conf.DialTimeout); err != nil {
+			return nil, err
+		}
+	}
+	if conf.DowngradeVersions {
+		if _, err := conn.APIVersions(conf.ClientID); err != nil {
+			log.Warningf("cannot fetch api versions from %s: %s", addr, err)
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
 }
 
 // removeConnection removes the given connection from our tracking. It also decrements the
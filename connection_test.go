@@ -1,9 +1,20 @@
 package kafka
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"math"
 	"net"
 	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
 	"time"
 
 	. "gopkg.in/check.v1"
@@ -15,6 +26,10 @@ var _ = Suite(&ConnectionSuite{})
 
 type ConnectionSuite struct{}
 
+func (s *ConnectionSuite) SetUpTest(c *C) {
+	ResetTestLogger(c)
+}
+
 type serializableMessage interface {
 	Bytes() ([]byte, error)
 }
@@ -159,6 +174,119 @@ func (s *ConnectionSuite) TestConnectionMetadata(c *C) {
 	}
 }
 
+func (s *ConnectionSuite) TestConnectionDescribeCluster(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	srv.Handle(MetadataRequest, func(request Serializable) Serializable {
+		req := request.(*proto.MetadataReq)
+		if req.Version < 2 || req.Topics == nil || len(req.Topics) != 0 {
+			c.Errorf("expected metadata request for no topics, got %#v", req)
+		}
+		return &proto.MetadataResp{
+			CorrelationID: req.CorrelationID,
+			Version:       req.Version,
+			ClusterID:     "cluster",
+			ControllerID:  2,
+			Brokers: []proto.MetadataRespBroker{
+				{NodeID: 1, Host: "host", Port: 9092},
+				{NodeID: 2, Host: "host", Port: 9093},
+			},
+			Topics: []proto.MetadataRespTopic{},
+		}
+	})
+
+	conn, err := newTCPConnection(srv.Address(), time.Second)
+	if err != nil {
+		c.Fatalf("could not conect to test server: %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	desc, err := conn.DescribeCluster("tester")
+	if err != nil {
+		c.Fatalf("could not describe cluster: %s", err)
+	}
+	if desc.ClusterID != "cluster" {
+		c.Fatalf("expected cluster ID, got %q", desc.ClusterID)
+	}
+	if len(desc.Brokers) != 2 {
+		c.Fatalf("expected 2 brokers, got %#v", desc.Brokers)
+	}
+	if desc.Controller == nil || desc.Controller.NodeID != 2 || desc.Controller.Port != 9093 {
+		c.Fatalf("expected broker 2 as controller, got %#v", desc.Controller)
+	}
+}
+
+func (s *ConnectionSuite) TestConnectionController(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	controllerID := int32(3)
+	srv.Handle(MetadataRequest, func(request Serializable) Serializable {
+		req := request.(*proto.MetadataReq)
+		if req.Version < 1 || req.Topics == nil || len(req.Topics) != 0 {
+			c.Errorf("expected metadata request for no topics, got %#v", req)
+		}
+		return &proto.MetadataResp{
+			CorrelationID: req.CorrelationID,
+			Version:       req.Version,
+			ControllerID:  atomic.LoadInt32(&controllerID),
+			Brokers: []proto.MetadataRespBroker{
+				{NodeID: 3, Host: "host", Port: 9092},
+			},
+			Topics: []proto.MetadataRespTopic{},
+		}
+	})
+
+	conn, err := newTCPConnection(srv.Address(), time.Second)
+	if err != nil {
+		c.Fatalf("could not conect to test server: %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	id, err := conn.Controller("tester")
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, int32(3))
+
+	// no controller elected
+	atomic.StoreInt32(&controllerID, -1)
+	_, err = conn.Controller("tester")
+	c.Assert(err, Equals, ErrNoController)
+
+	// version 0 is not sent
+	conn.versions = map[int16]int16{proto.MetadataReqKind: 0}
+	_, err = conn.Controller("tester")
+	c.Assert(err, Equals, ErrNoController)
+
+	delete(conn.versions, proto.MetadataReqKind)
+	conn.apiVersions = map[int16]proto.APIVersionsRespAPI{
+		proto.MetadataReqKind: {APIKey: proto.MetadataReqKind, MinVersion: 0, MaxVersion: 0},
+	}
+	_, err = conn.Controller("tester")
+	c.Assert(err, Equals, ErrNoController)
+}
+
+func (s *ConnectionSuite) TestConnectionNodeID(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	conn, err := newTCPConnection(srv.Address(), time.Second)
+	if err != nil {
+		c.Fatalf("could not conect to test server: %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	c.Assert(conn.NodeID(), Equals, int32(-1))
+	if _, err := conn.Metadata(&proto.MetadataReq{ClientID: "tester"}); err != nil {
+		c.Fatalf("could not fetch metadata: %s", err)
+	}
+	c.Assert(conn.NodeID(), Equals, int32(1))
+	c.Assert(conn.Rack(), Equals, "")
+}
+
 func (s *ConnectionSuite) TestConnectionProduce(c *C) {
 	resp1 := &proto.ProduceResp{
 		CorrelationID: 1,
@@ -270,6 +398,90 @@ func (s *ConnectionSuite) TestConnectionProduce(c *C) {
 	}
 }
 
+func (s *ConnectionSuite) TestConnectionProduceAsync(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	srv.Handle(ProduceRequest, func(request Serializable) Serializable {
+		req := request.(*proto.ProduceReq)
+		// the stalled request is never answered
+		if req.Topics[0].Name == "stalled" {
+			return nil
+		}
+		return &proto.ProduceResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.ProduceRespTopic{
+				{
+					Name: req.Topics[0].Name,
+					Partitions: []proto.ProduceRespPartition{
+						{ID: 0, Offset: int64(req.CorrelationID)},
+					},
+				},
+			},
+		}
+	})
+
+	conn, err := newTCPConnection(srv.Address(), time.Second)
+	if err != nil {
+		c.Fatalf("could not conect to test server: %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	produce := func(topic string, results chan<- error) {
+		req := &proto.ProduceReq{
+			ClientID:     "tester",
+			RequiredAcks: proto.RequiredAcksAll,
+			Timeout:      time.Second,
+			Topics: []proto.ProduceReqTopic{
+				{
+					Name: topic,
+					Partitions: []proto.ProduceReqPartition{
+						{ID: 0, Messages: []*proto.Message{{Value: []byte("x")}}},
+					},
+				},
+			},
+		}
+		err := conn.ProduceAsync(req, func(resp *proto.ProduceResp, err error) {
+			if err == nil && resp.Topics[0].Partitions[0].Offset != int64(req.CorrelationID) {
+				err = errors.New("response to a different request")
+			}
+			results <- err
+		})
+		c.Assert(err, IsNil)
+	}
+
+	const count = 10
+	results := make(chan error, count+1)
+	for i := 0; i < count; i++ {
+		produce("first", results)
+	}
+	for i := 0; i < count; i++ {
+		select {
+		case err := <-results:
+			c.Assert(err, IsNil)
+		case <-time.After(time.Second):
+			c.Fatalf("expected %d callbacks, got %d", count, i)
+		}
+	}
+
+	// pending callbacks are notified when the connection is closed
+	produce("stalled", results)
+	_ = conn.Close()
+	select {
+	case err := <-results:
+		c.Assert(err, Equals, ErrClosed)
+	case <-time.After(time.Second):
+		c.Fatalf("callback not called after closing the connection")
+	}
+
+	select {
+	case err := <-results:
+		c.Fatalf("unexpected callback call: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
 func (s *ConnectionSuite) TestConnectionFetch(c *C) {
 	messages := []*proto.Message{
 		{Offset: 4, Key: []byte("f"), Value: []byte("first"), TipOffset: 20},
@@ -298,10 +510,11 @@ func (s *ConnectionSuite) TestConnectionFetch(c *C) {
 				Name: "bar",
 				Partitions: []proto.FetchRespPartition{
 					{
-						ID:        6,
-						Err:       proto.ErrUnknownTopicOrPartition,
-						TipOffset: -1,
-						Messages:  []*proto.Message{},
+						ID:            6,
+						Err:           proto.ErrUnknownTopicOrPartition,
+						TipOffset:     -1,
+						Messages:      []*proto.Message{},
+						MessageFormat: proto.MessageFormatUnknown,
 					},
 				},
 			},
@@ -355,17 +568,25 @@ func (s *ConnectionSuite) TestConnectionFetch(c *C) {
 	}
 }
 
-func (s *ConnectionSuite) TestConnectionOffset(c *C) {
-	resp1 := &proto.OffsetResp{
+func (s *ConnectionSuite) TestConnectionFetchMaxMessages(c *C) {
+	messages := []*proto.Message{
+		{Offset: 4, Value: []byte("first"), TipOffset: 20},
+		{Offset: 5, Value: []byte("second"), TipOffset: 20},
+		{Offset: 6, Value: []byte("third"), TipOffset: 20},
+		{Offset: 7, Value: []byte("fourth"), TipOffset: 20},
+	}
+	for _, m := range messages {
+		m.Crc = proto.ComputeCrc(m, proto.CompressionNone)
+	}
+	resp1 := &proto.FetchResp{
 		CorrelationID: 1,
-		Topics: []proto.OffsetRespTopic{
+		Topics: []proto.FetchRespTopic{
 			{
-				Name: "test",
-				Partitions: []proto.OffsetRespPartition{
-					{
-						ID:      0,
-						Offsets: []int64{92, 0},
-					},
+				Name: "foo",
+				Partitions: []proto.FetchRespPartition{
+					{ID: 1, TipOffset: 20, Messages: messages},
+					{ID: 2, TipOffset: 20, Messages: messages[:1]},
+					{ID: 3, TipOffset: 20, Messages: []*proto.Message{}},
 				},
 			},
 		},
@@ -378,17 +599,17 @@ func (s *ConnectionSuite) TestConnectionOffset(c *C) {
 	if err != nil {
 		c.Fatalf("could not conect to test server: %s", err)
 	}
-	resp, err := conn.Offset(&proto.OffsetReq{
-		ClientID: "tester",
-		Topics: []proto.OffsetReqTopic{
+	resp, err := conn.Fetch(&proto.FetchReq{
+		CorrelationID:           1,
+		ClientID:                "tester",
+		MaxMessagesPerPartition: 2,
+		Topics: []proto.FetchReqTopic{
 			{
-				Name: "test",
-				Partitions: []proto.OffsetReqPartition{
-					{
-						ID:         0,
-						TimeMs:     -2,
-						MaxOffsets: 2,
-					},
+				Name: "foo",
+				Partitions: []proto.FetchReqPartition{
+					{ID: 1, FetchOffset: 5},
+					{ID: 2, FetchOffset: 4},
+					{ID: 3, FetchOffset: 20},
 				},
 			},
 		},
@@ -396,186 +617,2361 @@ func (s *ConnectionSuite) TestConnectionOffset(c *C) {
 	if err != nil {
 		c.Fatalf("could not fetch response: %s", err)
 	}
-	if !reflect.DeepEqual(resp, resp1) {
-		c.Fatalf("expected different response %#v", resp)
+
+	parts := resp.Topics[0].Partitions
+	// offset 5 was requested; first message is trimmed and last dropped
+	if len(parts[0].Messages) != 2 || parts[0].Messages[0].Offset != 5 || parts[0].Messages[1].Offset != 6 {
+		c.Fatalf("expected messages 5 and 6, got %#v", parts[0].Messages)
+	}
+	if parts[0].NextOffset != 7 {
+		c.Fatalf("expected next offset 7, got %d", parts[0].NextOffset)
+	}
+	if len(parts[1].Messages) != 1 || parts[1].NextOffset != 5 {
+		c.Fatalf("expected single message and next offset 5, got %d messages and %d",
+			len(parts[1].Messages), parts[1].NextOffset)
+	}
+	if len(parts[2].Messages) != 0 || parts[2].NextOffset != 20 {
+		c.Fatalf("expected no messages and next offset 20, got %d messages and %d",
+			len(parts[2].Messages), parts[2].NextOffset)
 	}
 }
 
-func (s *ConnectionSuite) TestConnectionProduceNoAck(c *C) {
-	ln, err := testServer()
-	if err != nil {
-		c.Fatalf("test server error: %s", err)
+func (s *ConnectionSuite) TestClampFetchWait(c *C) {
+	cases := []struct {
+		maxWait  time.Duration
+		left     time.Duration
+		expected time.Duration
+		minBytes int32
+	}{
+		{time.Second, time.Hour, time.Second, 1},
+		{time.Second, 500 * time.Millisecond, 500*time.Millisecond - fetchDeadlineMargin, 1},
+		{time.Second, fetchDeadlineMargin, 0, 0},
+		{time.Second, -time.Second, 0, 0},
 	}
-	conn, err := newTCPConnection(ln.Addr().String(), time.Second)
-	if err != nil {
-		c.Fatalf("could not conect to test server: %s", err)
+	for _, tc := range cases {
+		req := &proto.FetchReq{MaxWaitTime: tc.maxWait, MinBytes: 1}
+		clampFetchWait(req, tc.left)
+		if req.MaxWaitTime != tc.expected || req.MinBytes != tc.minBytes {
+			c.Errorf("%s left: expected %s wait and %d min bytes, got %s and %d",
+				tc.left, tc.expected, tc.minBytes, req.MaxWaitTime, req.MinBytes)
+		}
 	}
-	resp, err := conn.Produce(&proto.ProduceReq{
-		ClientID:     "tester",
-		Compression:  proto.CompressionNone,
-		RequiredAcks: proto.RequiredAcksNone,
-		Timeout:      time.Second,
-		Topics: []proto.ProduceReqTopic{
-			{
-				Name: "first",
-				Partitions: []proto.ProduceReqPartition{
-					{
-						ID: 0,
-						Messages: []*proto.Message{
-							{Key: []byte("key 1"), Value: []byte("value 1")},
-							{Key: []byte("key 2"), Value: []byte("value 2")},
-						},
-					},
-				},
-			},
-		},
+}
+
+func (s *ConnectionSuite) TestConnectionFetchDeadline(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	waits := make(chan time.Duration, 1)
+	srv.Handle(FetchRequest, func(request Serializable) Serializable {
+		req := request.(*proto.FetchReq)
+		waits <- req.MaxWaitTime
+		return &proto.FetchResp{CorrelationID: req.CorrelationID}
 	})
+
+	conn, err := newTCPConnection(srv.Address(), time.Second)
 	if err != nil {
-		c.Fatalf("could not fetch response: %s", err)
-	}
-	if resp != nil {
-		c.Fatalf("expected no response, got %#v", resp)
+		c.Fatalf("could not conect to test server: %s", err)
 	}
-	if err := conn.Close(); err != nil {
-		c.Fatalf("could not close kafka connection: %s", err)
+	defer func() { _ = conn.Close() }()
+
+	req := &proto.FetchReq{ClientID: "tester", MaxWaitTime: time.Minute, MinBytes: 1}
+	if _, err := conn.FetchDeadline(req, time.Now().Add(time.Second)); err != nil {
+		c.Fatalf("could not fetch: %s", err)
 	}
-	if err := ln.Close(); err != nil {
-		c.Fatalf("could not close test server: %s", err)
+	if wait := <-waits; wait > time.Second-fetchDeadlineMargin || wait < 500*time.Millisecond {
+		c.Fatalf("expected wait time clamped to the deadline, got %s", wait)
 	}
 }
 
-func (s *ConnectionSuite) TestClosedConnectionWriter(c *C) {
-	// create test server with no messages, so that any client connection will
-	// be immediately closed
-	ln, err := testServer()
+func (s *ConnectionSuite) TestConnectionPinnedVersions(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	versions := make(chan int16, 2)
+	srv.Handle(FetchRequest, func(request Serializable) Serializable {
+		req := request.(*proto.FetchReq)
+		versions <- req.Version
+		return &proto.FetchResp{CorrelationID: req.CorrelationID, Version: req.Version}
+	})
+	srv.Handle(MetadataRequest, func(request Serializable) Serializable {
+		req := request.(*proto.MetadataReq)
+		versions <- req.Version
+		return &proto.MetadataResp{CorrelationID: req.CorrelationID, Version: req.Version}
+	})
+
+	conn, err := newTCPConnection(srv.Address(), time.Second)
 	if err != nil {
-		c.Fatalf("test server error: %s", err)
+		c.Fatalf("could not conect to test server: %s", err)
 	}
-	conn, err := newTCPConnection(ln.Addr().String(), time.Second)
+	defer func() { _ = conn.Close() }()
+	conn.versions = map[int16]int16{proto.FetchReqKind: 4}
+
+	resp, err := conn.Fetch(&proto.FetchReq{ClientID: "tester", Version: 5})
 	if err != nil {
-		c.Fatalf("could not conect to test server: %s", err)
+		c.Fatalf("could not fetch: %s", err)
 	}
+	c.Assert(<-versions, Equals, int16(4))
+	c.Assert(resp.Version, Equals, int16(4))
 
-	longBytes := []byte(strings.Repeat("xxxxxxxxxxxxxxxxxxxxxx", 1000))
-	req := proto.ProduceReq{
-		ClientID:     "test-client",
-		Compression:  proto.CompressionNone,
-		RequiredAcks: proto.RequiredAcksAll,
-		Timeout:      100,
-		Topics: []proto.ProduceReqTopic{
-			{
-				Name: "test-topic",
-				Partitions: []proto.ProduceReqPartition{
-					{
-						ID: 0,
-						Messages: []*proto.Message{
-							{Value: longBytes},
-						},
-					},
-				},
-			},
-		},
+	// versions of other APIs are not affected
+	if _, err := conn.Metadata(&proto.MetadataReq{ClientID: "tester", Version: 1}); err != nil {
+		c.Fatalf("could not fetch metadata: %s", err)
 	}
-	for i := 0; i < 10; i++ {
-		if _, err := conn.Produce(&req); err == nil {
-			c.Fatal("message publishing after closing connection should not be possible")
+	c.Assert(<-versions, Equals, int16(1))
+}
+
+func (s *ConnectionSuite) TestConnectionSupportsAPI(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	srv.Handle(APIVersionsRequest, func(request Serializable) Serializable {
+		req := request.(*proto.APIVersionsReq)
+		return &proto.APIVersionsResp{
+			CorrelationID: req.CorrelationID,
+			APIVersions: []proto.APIVersionsRespAPI{
+				{APIKey: proto.MetadataReqKind, MinVersion: 0, MaxVersion: 2},
+				{APIKey: proto.FetchReqKind, MinVersion: 0, MaxVersion: 3},
+			},
 		}
+	})
+	fetched := 0
+	srv.Handle(FetchRequest, func(request Serializable) Serializable {
+		req := request.(*proto.FetchReq)
+		fetched++
+		return &proto.FetchResp{CorrelationID: req.CorrelationID, Version: req.Version}
+	})
+
+	conn, err := newTCPConnection(srv.Address(), time.Second)
+	if err != nil {
+		c.Fatalf("could not conect to test server: %s", err)
 	}
+	defer func() { _ = conn.Close() }()
 
-	// although we produced ten requests, because connection is closed, no
-	// response channel should be registered
-	conn.mu.Lock()
-	defer conn.mu.Unlock()
-	if len(conn.respc) != 0 {
-		c.Fatalf("expected 0 waiting responses, got %d", len(conn.respc))
+	// everything is supported until the versions are known
+	c.Assert(conn.SupportsAPI(proto.DeleteGroupsReqKind, 0), Equals, true)
+
+	if _, err := conn.APIVersions("tester"); err != nil {
+		c.Fatalf("could not fetch api versions: %s", err)
 	}
+	c.Assert(conn.SupportsAPI(proto.MetadataReqKind, 2), Equals, true)
+	c.Assert(conn.SupportsAPI(proto.MetadataReqKind, 3), Equals, false)
+	c.Assert(conn.SupportsAPI(proto.DeleteGroupsReqKind, 0), Equals, false)
+
+	_, err = conn.DeleteGroups(&proto.DeleteGroupsReq{ClientID: "tester", Groups: []string{"a"}})
+	c.Assert(err, Equals, ErrUnsupportedAPIVersion)
+
+	_, err = conn.Fetch(&proto.FetchReq{ClientID: "tester", Version: 4})
+	c.Assert(err, Equals, ErrUnsupportedAPIVersion)
+	c.Assert(fetched, Equals, 0)
+
+	_, err = conn.Fetch(&proto.FetchReq{ClientID: "tester", Version: 3})
+	c.Assert(err, IsNil)
+	c.Assert(fetched, Equals, 1)
 }
 
-func (s *ConnectionSuite) TestClosedConnectionReader(c *C) {
-	// create test server with no messages, so that any client connection will
-	// be immediately closed
-	ln, err := testServer()
-	if err != nil {
-		c.Fatalf("test server error: %s", err)
-	}
-	conn, err := newTCPConnection(ln.Addr().String(), time.Second)
+func (s *ConnectionSuite) TestConnectionDowngradeVersion(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	srv.Handle(APIVersionsRequest, func(request Serializable) Serializable {
+		req := request.(*proto.APIVersionsReq)
+		return &proto.APIVersionsResp{
+			CorrelationID: req.CorrelationID,
+			APIVersions: []proto.APIVersionsRespAPI{
+				{APIKey: proto.FetchReqKind, MinVersion: 2, MaxVersion: 5},
+			},
+		}
+	})
+	// broker claims to support fetch v5, but rejects anything above v3
+	var versions []int16
+	srv.Handle(FetchRequest, func(request Serializable) Serializable {
+		req := request.(*proto.FetchReq)
+		versions = append(versions, req.Version)
+		resp := &proto.FetchResp{
+			CorrelationID: req.CorrelationID,
+			Version:       req.Version,
+			Topics: []proto.FetchRespTopic{
+				{
+					Name:       "test",
+					Partitions: []proto.FetchRespPartition{{ID: 0}},
+				},
+			},
+		}
+		if req.Version > 3 {
+			resp.Topics[0].Partitions[0].Err = proto.ErrUnsupportedVersion
+		}
+		return resp
+	})
+
+	conn, err := newTCPConnection(srv.Address(), time.Second)
 	if err != nil {
 		c.Fatalf("could not conect to test server: %s", err)
 	}
+	defer func() { _ = conn.Close() }()
 
 	req := &proto.FetchReq{
-		ClientID:    "test-client",
-		MaxWaitTime: 100,
-		MinBytes:    0,
+		ClientID: "tester",
+		Version:  5,
 		Topics: []proto.FetchReqTopic{
-			{
-				Name: "my-topic",
-				Partitions: []proto.FetchReqPartition{
-					{
-						ID:          0,
-						FetchOffset: 1,
-						MaxBytes:    100000,
-					},
-				},
-			},
+			{Name: "test", Partitions: []proto.FetchReqPartition{{ID: 0}}},
 		},
 	}
 
-	for i := 0; i < 10; i++ {
-		if _, err := conn.Fetch(req); err == nil {
-			c.Fatal("fetching from closed connection succeeded")
-		}
-	}
+	// versions are not downgraded unless enabled
+	_, err = conn.Fetch(req)
+	c.Assert(err, Equals, proto.ErrUnsupportedVersion)
+	c.Assert(versions, DeepEquals, []int16{5})
 
-	// although we produced ten requests, because connection is closed, no
-	// response channel should be registered
-	conn.mu.Lock()
-	defer conn.mu.Unlock()
-	if len(conn.respc) != 0 {
-		c.Fatalf("expected 0 waiting responses, got %d", len(conn.respc))
+	// nor when the versions supported by the broker are unknown
+	conn.downgradeVersions = true
+	versions = nil
+	_, err = conn.Fetch(req)
+	c.Assert(err, Equals, proto.ErrUnsupportedVersion)
+	c.Assert(versions, DeepEquals, []int16{5})
+
+	if _, err := conn.APIVersions("tester"); err != nil {
+		c.Fatalf("could not fetch api versions: %s", err)
 	}
+	versions = nil
+	resp, err := conn.Fetch(req)
+	c.Assert(err, IsNil)
+	c.Assert(resp.Version, Equals, int16(3))
+	c.Assert(versions, DeepEquals, []int16{5, 4, 3})
 }
 
-func (s *ConnectionSuite) TestConnectionReaderAfterEOF(c *C) {
-	ln, err := testServer3()
-	if err != nil {
-		c.Fatalf("test server error: %s", err)
-	}
-	defer func() {
-		_ = ln.Close()
-	}()
+func (s *ConnectionSuite) TestConnectionEnvelope(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
 
-	conn, err := newTCPConnection(ln.Addr().String(), time.Second)
+	srv.Handle(EnvelopeRequest, func(request Serializable) Serializable {
+		req := request.(*proto.EnvelopeReq)
+		c.Assert(req.RequestPrincipal, DeepEquals, []byte("User:alice"))
+		c.Assert(req.ClientHostAddress, DeepEquals, []byte{10, 0, 0, 1})
+
+		framed := make([]byte, 4+len(req.RequestData))
+		binary.BigEndian.PutUint32(framed, uint32(len(req.RequestData)))
+		copy(framed[4:], req.RequestData)
+		inner, err := proto.ReadMetadataReq(bytes.NewReader(framed))
+		c.Assert(err, IsNil)
+		c.Assert(inner.Topics, DeepEquals, []string{"foo"})
+
+		b, err := (&proto.MetadataResp{
+			CorrelationID: inner.CorrelationID,
+			Brokers:       []proto.MetadataRespBroker{{NodeID: 3, Host: "gateway", Port: 9092}},
+			Topics:        []proto.MetadataRespTopic{},
+		}).Bytes()
+		c.Assert(err, IsNil)
+		return &proto.EnvelopeResp{CorrelationID: req.CorrelationID, ResponseData: b[4:]}
+	})
+
+	conn, err := newTCPConnection(srv.Address(), time.Second)
 	if err != nil {
 		c.Fatalf("could not conect to test server: %s", err)
 	}
+	defer func() { _ = conn.Close() }()
 
-	req := &proto.FetchReq{
-		ClientID:    "test-client",
-		MaxWaitTime: 100,
+	req := &proto.MetadataReq{CorrelationID: 77, ClientID: "tester", Topics: []string{"foo"}}
+	b, err := conn.Envelope(req, []byte("User:alice"), []byte{10, 0, 0, 1})
+	c.Assert(err, IsNil)
+	resp, err := proto.ReadMetadataResp(bytes.NewReader(b))
+	c.Assert(err, IsNil)
+	c.Assert(resp.CorrelationID, Equals, int32(77))
+	c.Assert(resp.Brokers, DeepEquals, []proto.MetadataRespBroker{{NodeID: 3, Host: "gateway", Port: 9092}})
+}
+
+func (s *ConnectionSuite) TestConnectionFetchReadTimeout(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	// broker waits for data as long as allowed
+	srv.Handle(FetchRequest, func(request Serializable) Serializable {
+		req := request.(*proto.FetchReq)
+		time.Sleep(req.MaxWaitTime)
+		return &proto.FetchResp{CorrelationID: req.CorrelationID, Version: req.Version}
+	})
+	srv.Handle(MetadataRequest, func(request Serializable) Serializable {
+		req := request.(*proto.MetadataReq)
+		time.Sleep(300 * time.Millisecond)
+		return &proto.MetadataResp{CorrelationID: req.CorrelationID}
+	})
+
+	conn, err := newTCPConnection(srv.Address(), time.Second)
+	if err != nil {
+		c.Fatalf("could not conect to test server: %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+	conn.readTimeout = 100 * time.Millisecond
+
+	req := &proto.FetchReq{ClientID: "tester", MaxWaitTime: 500 * time.Millisecond}
+	c.Assert(conn.fetchReadTimeout(req), Equals, 500*time.Millisecond+fetchReadSlack)
+	_, err = conn.Fetch(req)
+	c.Assert(err, IsNil)
+
+	// fetch without wait uses the configured timeout
+	c.Assert(conn.fetchReadTimeout(&proto.FetchReq{}), Equals, fetchReadSlack)
+	conn.readTimeout = 2 * time.Second
+	c.Assert(conn.fetchReadTimeout(req), Equals, 2*time.Second)
+
+	conn.readTimeout = 100 * time.Millisecond
+	_, err = conn.Metadata(&proto.MetadataReq{ClientID: "tester"})
+	c.Assert(err, Equals, ErrReadTimeout)
+	c.Assert(conn.IsClosed(), Equals, false)
+}
+
+func (s *ConnectionSuite) TestConnectionClockReadTimeout(c *C) {
+	// broker never answers
+	transport := &streamTransport{start: make(chan struct{}), data: testResponses()}
+	conn := newConnection("fake", transport, 0)
+	defer func() { _ = conn.Close() }()
+	clock := newFakeClock()
+	conn.setClock(clock)
+	conn.readTimeout = time.Hour
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := conn.Metadata(&proto.MetadataReq{ClientID: "tester"})
+		errc <- err
+	}()
+	clock.BlockUntil(1)
+	clock.Advance(time.Hour - time.Second)
+	select {
+	case err := <-errc:
+		c.Fatalf("request finished before timeout: %v", err)
+	default:
+	}
+	clock.Advance(time.Second)
+	c.Assert(<-errc, Equals, ErrReadTimeout)
+	c.Assert(conn.InFlight(), Equals, 0)
+}
+
+func (s *ConnectionSuite) TestConnectionMetadataContext(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	var requests int32
+	srv.Handle(MetadataRequest, func(request Serializable) Serializable {
+		// broker never answers
+		atomic.AddInt32(&requests, 1)
+		return nil
+	})
+
+	conn, err := newTCPConnection(srv.Address(), time.Second)
+	c.Assert(err, IsNil)
+	defer func() { _ = conn.Close() }()
+	conn.readTimeout = time.Minute
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = conn.MetadataContext(ctx, &proto.MetadataReq{ClientID: "tester"})
+	c.Assert(err, Equals, context.DeadlineExceeded)
+	c.Assert(time.Since(start) < conn.readTimeout/2, Equals, true)
+	c.Assert(conn.InFlight(), Equals, 0)
+	c.Assert(conn.IsClosed(), Equals, false)
+	c.Assert(atomic.LoadInt32(&requests), Equals, int32(1))
+
+	// context already done, request is not sent
+	_, err = conn.MetadataContext(ctx, &proto.MetadataReq{ClientID: "tester"})
+	c.Assert(err, Equals, context.DeadlineExceeded)
+	c.Assert(conn.InFlight(), Equals, 0)
+	c.Assert(atomic.LoadInt32(&requests), Equals, int32(1))
+}
+
+func (s *ConnectionSuite) TestConnectionFetchContext(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	answer := make(chan bool, 1)
+	srv.Handle(FetchRequest, func(request Serializable) Serializable {
+		req := request.(*proto.FetchReq)
+		if !<-answer {
+			return nil
+		}
+		return &proto.FetchResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.FetchRespTopic{
+				{
+					Name: "test",
+					Partitions: []proto.FetchRespPartition{
+						{ID: 0, TipOffset: 4},
+					},
+				},
+			},
+		}
+	})
+
+	conn, err := newTCPConnection(srv.Address(), time.Second)
+	c.Assert(err, IsNil)
+	defer func() { _ = conn.Close() }()
+	conn.readTimeout = time.Minute
+
+	fetchReq := func() *proto.FetchReq {
+		return &proto.FetchReq{
+			ClientID: "tester",
+			Topics: []proto.FetchReqTopic{
+				{
+					Name: "test",
+					Partitions: []proto.FetchReqPartition{
+						{ID: 0, FetchOffset: 1, MaxBytes: 1024},
+					},
+				},
+			},
+		}
+	}
+
+	answer <- false
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = conn.FetchContext(ctx, fetchReq())
+	c.Assert(err, Equals, context.DeadlineExceeded)
+	c.Assert(conn.InFlight(), Equals, 0)
+
+	// the connection is still usable, and answered requests are decoded
+	answer <- true
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	resp, err := conn.FetchContext(ctx, fetchReq())
+	c.Assert(err, IsNil)
+	c.Assert(resp.Topics, HasLen, 1)
+	c.Assert(resp.Topics[0].Partitions[0].TipOffset, Equals, int64(4))
+}
+
+func (s *ConnectionSuite) TestConnectionInFlightCount(c *C) {
+	transport := &streamTransport{start: make(chan struct{}), data: testResponses(3)}
+	conn := newConnection("fake", transport, 0)
+	defer func() { _ = conn.Close() }()
+
+	waiters := make(map[int32]chan response)
+	for _, id := range []int32{1, 2, 3, 6} {
+		respc, err := conn.respWaiter(id)
+		c.Assert(err, IsNil)
+		waiters[id] = respc
+	}
+	cbErrs := make(chan error, 1)
+	for _, id := range []int32{4, 5} {
+		c.Assert(conn.respCallback(id, func(b []byte, err error) { cbErrs <- err }), IsNil)
+	}
+	c.Assert(conn.InFlight(), Equals, 6)
+
+	conn.releaseWaiter(1)
+	conn.releaseWaiter(1)
+	c.Assert(conn.InFlight(), Equals, 5)
+	conn.abandonWaiter(2)
+	c.Assert(conn.InFlight(), Equals, 4)
+	c.Assert(conn.releaseCallback(4), Equals, true)
+	c.Assert(conn.releaseCallback(4), Equals, false)
+	c.Assert(conn.InFlight(), Equals, 3)
+	c.Assert(conn.CancelRequest(5), Equals, true)
+	c.Assert(<-cbErrs, Equals, ErrCancelled)
+	c.Assert(conn.InFlight(), Equals, 2)
+
+	// response to 3 is read, then the stream ends and 6 is released
+	close(transport.start)
+	resp := <-waiters[3]
+	c.Assert(resp.err, IsNil)
+	_, ok := <-waiters[6]
+	c.Assert(ok, Equals, false)
+	c.Assert(conn.InFlight(), Equals, 0)
+}
+
+func (s *ConnectionSuite) TestConnectionAge(c *C) {
+	transport := &streamTransport{start: make(chan struct{}), data: testResponses()}
+	conn := newConnection("fake", transport, 0)
+	defer func() { _ = conn.Close() }()
+	clock := newFakeClock()
+	conn.setClock(clock)
+
+	c.Assert(conn.StartTime(), Equals, clock.Now())
+	c.Assert(conn.Age(), Equals, time.Duration(0))
+	clock.Advance(90 * time.Minute)
+	c.Assert(conn.Age(), Equals, 90*time.Minute)
+}
+
+// testResponses returns stream of empty responses to requests of given
+// correlation IDs.
+func testResponses(correlationIDs ...int32) *bytes.Buffer {
+	var stream bytes.Buffer
+	for _, id := range correlationIDs {
+		frame := make([]byte, 8)
+		binary.BigEndian.PutUint32(frame, 4)
+		binary.BigEndian.PutUint32(frame[4:], uint32(id))
+		stream.Write(frame)
+	}
+	return &stream
+}
+
+func (s *ConnectionSuite) TestConnectionInFlight(c *C) {
+	// stream is kept open, so that the connection is not closed after
+	// reading the response
+	pr, pw := io.Pipe()
+	defer func() { _ = pw.Close() }()
+	transport := &streamTransport{start: make(chan struct{}), data: pr}
+	conn := newConnection("fake", transport, 0)
+	defer func() { _ = conn.Close() }()
+
+	c.Assert(conn.InFlight(), Equals, 0)
+	respc, err := conn.respWaiter(1)
+	c.Assert(err, IsNil)
+	_, err = conn.respWaiter(2)
+	c.Assert(err, IsNil)
+	c.Assert(conn.respCallback(3, func([]byte, error) {}), IsNil)
+	c.Assert(conn.InFlight(), Equals, 3)
+
+	conn.releaseWaiter(2)
+	c.Assert(conn.InFlight(), Equals, 2)
+
+	close(transport.start)
+	go func() { _, _ = testResponses(1).WriteTo(pw) }()
+	<-respc
+	c.Assert(conn.InFlight(), Equals, 1)
+}
+
+func (s *ConnectionSuite) TestConnectionCancelRequest(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	release := make(chan struct{})
+	srv.Handle(FetchRequest, func(request Serializable) Serializable {
+		req := request.(*proto.FetchReq)
+		<-release
+		return &proto.FetchResp{CorrelationID: req.CorrelationID}
+	})
+
+	conn, err := newTCPConnection(srv.Address(), time.Second)
+	if err != nil {
+		c.Fatalf("could not conect to test server: %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+	// late response must not be taken for a protocol desync
+	conn.strictCorrelation = true
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := conn.Fetch(&proto.FetchReq{ClientID: "tester"})
+		errc <- err
+	}()
+	var ids []int32
+	for len(ids) == 0 {
+		time.Sleep(time.Millisecond)
+		ids = conn.PendingCorrelationIDs()
+	}
+	c.Assert(conn.CancelRequest(ids[0]), Equals, true)
+	c.Assert(<-errc, Equals, ErrCancelled)
+	c.Assert(conn.CancelRequest(ids[0]), Equals, false)
+	c.Assert(conn.InFlight(), Equals, 0)
+
+	// late response is dropped, the connection keeps working
+	close(release)
+	_, err = conn.Fetch(&proto.FetchReq{ClientID: "tester"})
+	c.Assert(err, IsNil)
+	c.Assert(conn.IsClosed(), Equals, false)
+
+	cbErrs := make(chan error, 1)
+	c.Assert(conn.respCallback(99999, func(b []byte, err error) { cbErrs <- err }), IsNil)
+	c.Assert(conn.CancelRequest(99999), Equals, true)
+	c.Assert(<-cbErrs, Equals, ErrCancelled)
+}
+
+func (s *ConnectionSuite) TestConnectionPendingCorrelationIDs(c *C) {
+	transport := &streamTransport{start: make(chan struct{}), data: testResponses()}
+	conn := newConnection("fake", transport, 0)
+	defer func() { _ = conn.Close() }()
+
+	c.Assert(conn.PendingCorrelationIDs(), HasLen, 0)
+	_, err := conn.respWaiter(17)
+	c.Assert(err, IsNil)
+	_, err = conn.respWaiter(3)
+	c.Assert(err, IsNil)
+	c.Assert(conn.respCallback(9, func([]byte, error) {}), IsNil)
+	c.Assert(conn.PendingCorrelationIDs(), DeepEquals, []int32{3, 9, 17})
+
+	c.Assert(conn.releaseCallback(9), Equals, true)
+	c.Assert(conn.PendingCorrelationIDs(), DeepEquals, []int32{3, 17})
+}
+
+func (s *ConnectionSuite) TestConnectionWaiterLockStats(c *C) {
+	transport := &streamTransport{start: make(chan struct{}), data: testResponses()}
+	conn := newConnection("fake", transport, 0)
+	defer func() { _ = conn.Close() }()
+
+	c.Assert(conn.WaiterLockStats(), Equals, WaiterLockStats{})
+	_, err := conn.respWaiter(1)
+	c.Assert(err, IsNil)
+	c.Assert(conn.WaiterLockStats(), Equals, WaiterLockStats{})
+
+	// lock held while the waiter is released
+	shard := conn.shardOf(1)
+	shard.mu.Lock()
+	done := make(chan struct{})
+	go func() {
+		conn.releaseWaiter(1)
+		close(done)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	shard.mu.Unlock()
+	<-done
+
+	stats := conn.WaiterLockStats()
+	c.Assert(stats.Contended, Equals, int64(1))
+	c.Assert(stats.WaitTime >= 10*time.Millisecond, Equals, true)
+	c.Assert(stats.MaxWaitTime, Equals, stats.WaitTime)
+}
+
+func (s *ConnectionSuite) TestConnectionProtocolDesync(c *C) {
+	// by default, responses to unknown requests are dropped
+	transport := &streamTransport{start: make(chan struct{}), data: testResponses(999, 7)}
+	conn := newConnection("fake", transport, 0)
+	respc, err := conn.respWaiter(7)
+	c.Assert(err, IsNil)
+	close(transport.start)
+	_, ok := <-respc
+	c.Assert(ok, Equals, true)
+	_ = conn.Close()
+
+	// strict connection closes instead
+	transport = &streamTransport{start: make(chan struct{}), data: testResponses(999, 7)}
+	conn = newConnection("fake", transport, 0)
+	conn.strictCorrelation = true
+	respc, err = conn.respWaiter(7)
+	c.Assert(err, IsNil)
+	close(transport.start)
+	_, ok = <-respc
+	c.Assert(ok, Equals, false)
+	c.Assert(conn.closedErr(), Equals, ErrProtocolDesync)
+	c.Assert(conn.CloseReason(), Equals, CloseReasonProtocolDesync)
+
+	// unless the response is late
+	transport = &streamTransport{start: make(chan struct{}), data: testResponses(5, 7)}
+	conn = newConnection("fake", transport, 0)
+	conn.strictCorrelation = true
+	_, err = conn.respWaiter(5)
+	c.Assert(err, IsNil)
+	conn.abandonWaiter(5)
+	respc, err = conn.respWaiter(7)
+	c.Assert(err, IsNil)
+	close(transport.start)
+	_, ok = <-respc
+	c.Assert(ok, Equals, true)
+	_ = conn.Close()
+}
+
+func (s *ConnectionSuite) TestConnectionOffset(c *C) {
+	resp1 := &proto.OffsetResp{
+		CorrelationID: 1,
+		Topics: []proto.OffsetRespTopic{
+			{
+				Name: "test",
+				Partitions: []proto.OffsetRespPartition{
+					{
+						ID:      0,
+						Offsets: []int64{92, 0},
+					},
+				},
+			},
+		},
+	}
+	ln, err := testServer(resp1)
+	if err != nil {
+		c.Fatalf("test server error: %s", err)
+	}
+	conn, err := newTCPConnection(ln.Addr().String(), time.Second)
+	if err != nil {
+		c.Fatalf("could not conect to test server: %s", err)
+	}
+	resp, err := conn.Offset(&proto.OffsetReq{
+		ClientID: "tester",
+		Topics: []proto.OffsetReqTopic{
+			{
+				Name: "test",
+				Partitions: []proto.OffsetReqPartition{
+					{
+						ID:         0,
+						TimeMs:     -2,
+						MaxOffsets: 2,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		c.Fatalf("could not fetch response: %s", err)
+	}
+	if !reflect.DeepEqual(resp, resp1) {
+		c.Fatalf("expected different response %#v", resp)
+	}
+}
+
+func (s *ConnectionSuite) TestNormalizeBrokerAddr(c *C) {
+	cases := []struct {
+		host string
+		port int32
+		addr string
+	}{
+		{"127.0.0.1", 9092, "127.0.0.1:9092"},
+		{"kafka-1.example.com", 9093, "kafka-1.example.com:9093"},
+		{"localhost", 0, "localhost:0"},
+		{"::1", 9092, "[::1]:9092"},
+		{"[::1]", 9092, "[::1]:9092"},
+		{"2001:db8::7", 19092, "[2001:db8::7]:19092"},
+		{"fe80::1%eth0", 9092, "[fe80::1%eth0]:9092"},
+	}
+	for _, tc := range cases {
+		addr := normalizeBrokerAddr(tc.host, tc.port)
+		c.Assert(addr, Equals, tc.addr)
+		host, _, err := net.SplitHostPort(addr)
+		c.Assert(err, IsNil)
+		c.Assert(normalizeBrokerAddr(host, tc.port), Equals, tc.addr)
+	}
+}
+
+func (s *ConnectionSuite) TestConnectionResolve(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+	_, port, err := net.SplitHostPort(srv.Address())
+	c.Assert(err, IsNil)
+	address := net.JoinHostPort("broker.test", port)
+
+	// broker moves to a different address between dials, while test server
+	// listens only on 127.0.0.1
+	resolved := [][]string{
+		{"127.0.0.1"},
+		{"127.0.0.2", "127.0.0.1"},
+		{"127.0.0.2"},
+		{},
+	}
+	var hosts []string
+	resolve := func(host string) ([]string, error) {
+		hosts = append(hosts, host)
+		ips := resolved[0]
+		resolved = resolved[1:]
+		return ips, nil
+	}
+
+	for i := 0; i < 2; i++ {
+		conn, err := dialConnection(address, time.Second, 0, 0, resolve)
+		c.Assert(err, IsNil)
+		c.Assert(conn.addr, Equals, address)
+		resp, err := conn.Metadata(&proto.MetadataReq{ClientID: "tester"})
+		c.Assert(err, IsNil)
+		c.Assert(resp.Brokers, HasLen, 1)
+		_ = conn.Close()
+	}
+	_, err = dialConnection(address, time.Second, 0, 0, resolve)
+	c.Assert(err, NotNil)
+	_, err = dialConnection(address, time.Second, 0, 0, resolve)
+	c.Assert(err, ErrorMatches, ".*no such host")
+	c.Assert(hosts, DeepEquals, []string{"broker.test", "broker.test", "broker.test", "broker.test"})
+
+	// addresses with IP are not resolved
+	conn, err := dialConnection(srv.Address(), time.Second, 0, 0, resolve)
+	c.Assert(err, IsNil)
+	_ = conn.Close()
+	c.Assert(hosts, HasLen, 4)
+}
+
+func (s *ConnectionSuite) TestConnectionIPv6(c *C) {
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		c.Skip("ipv6 is not available: " + err.Error())
+	}
+	defer func() { _ = ln.Close() }()
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			_ = conn.Close()
+		}
+	}()
+
+	port := ln.Addr().(*net.TCPAddr).Port
+	conn, err := newTCPConnection(normalizeBrokerAddr("::1", int32(port)), time.Second)
+	c.Assert(err, IsNil)
+	_ = conn.Close()
+}
+
+func (s *ConnectionSuite) TestConnectionProduceNoAck(c *C) {
+	ln, err := testServer()
+	if err != nil {
+		c.Fatalf("test server error: %s", err)
+	}
+	conn, err := newTCPConnection(ln.Addr().String(), time.Second)
+	if err != nil {
+		c.Fatalf("could not conect to test server: %s", err)
+	}
+	resp, err := conn.Produce(&proto.ProduceReq{
+		ClientID:     "tester",
+		Compression:  proto.CompressionNone,
+		RequiredAcks: proto.RequiredAcksNone,
+		Timeout:      time.Second,
+		Topics: []proto.ProduceReqTopic{
+			{
+				Name: "first",
+				Partitions: []proto.ProduceReqPartition{
+					{
+						ID: 0,
+						Messages: []*proto.Message{
+							{Key: []byte("key 1"), Value: []byte("value 1")},
+							{Key: []byte("key 2"), Value: []byte("value 2")},
+						},
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		c.Fatalf("could not fetch response: %s", err)
+	}
+	if resp != nil {
+		c.Fatalf("expected no response, got %#v", resp)
+	}
+	if err := conn.Close(); err != nil {
+		c.Fatalf("could not close kafka connection: %s", err)
+	}
+	if err := ln.Close(); err != nil {
+		c.Fatalf("could not close test server: %s", err)
+	}
+}
+
+// bufferedTransport buffers all writes until flushed. Reads block until the
+// transport is closed.
+type bufferedTransport struct {
+	*bufio.Writer
+	written bytes.Buffer
+	closed  chan struct{}
+}
+
+func newBufferedTransport() *bufferedTransport {
+	t := &bufferedTransport{closed: make(chan struct{})}
+	t.Writer = bufio.NewWriter(&t.written)
+	return t
+}
+
+func (t *bufferedTransport) Read(b []byte) (int, error) {
+	<-t.closed
+	return 0, io.EOF
+}
+func (t *bufferedTransport) Close() error {
+	close(t.closed)
+	return nil
+}
+
+func (s *ConnectionSuite) TestConnectionAllowedAPIKeys(c *C) {
+	transport := newBufferedTransport()
+	conn := newConnection("fake", transport, 0)
+	defer func() { _ = conn.Close() }()
+	conn.allowedAPIKeys = map[int16]bool{proto.ProduceReqKind: true}
+
+	_, err := conn.Fetch(&proto.FetchReq{ClientID: "tester"})
+	c.Assert(err, Equals, ErrAPIKeyForbidden)
+	_, err = conn.Metadata(&proto.MetadataReq{ClientID: "tester"})
+	c.Assert(err, Equals, ErrAPIKeyForbidden)
+	// requests cannot be smuggled in an envelope either
+	_, err = conn.Envelope(&proto.DeleteGroupsReq{ClientID: "tester", Groups: []string{"cg"}}, nil, nil)
+	c.Assert(err, Equals, ErrAPIKeyForbidden)
+	c.Assert(transport.Flush(), IsNil)
+	c.Assert(transport.written.Len(), Equals, 0)
+	c.Assert(conn.InFlight(), Equals, 0)
+
+	req := &proto.ProduceReq{
+		ClientID:     "tester",
+		RequiredAcks: proto.RequiredAcksNone,
+		Topics: []proto.ProduceReqTopic{
+			{
+				Name: "foo",
+				Partitions: []proto.ProduceReqPartition{
+					{ID: 0, Messages: []*proto.Message{{Value: []byte("a")}}},
+				},
+			},
+		},
+	}
+	_, err = conn.Produce(req)
+	c.Assert(err, IsNil)
+	written := transport.written.Len()
+	c.Assert(written > 0, Equals, true)
+
+	conn.allowedAPIKeys = map[int16]bool{}
+	_, err = conn.Produce(req)
+	c.Assert(err, Equals, ErrAPIKeyForbidden)
+	c.Assert(transport.Flush(), IsNil)
+	c.Assert(transport.written.Len(), Equals, written)
+	c.Assert(conn.IsClosed(), Equals, false)
+}
+
+func (s *ConnectionSuite) TestConnectionDefaultCompression(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	var values []string
+	srv.Handle(ProduceRequest, func(request Serializable) Serializable {
+		req := request.(*proto.ProduceReq)
+		for _, m := range req.Topics[0].Partitions[0].Messages {
+			values = append(values, string(m.Value))
+		}
+		return &proto.ProduceResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.ProduceRespTopic{
+				{Name: "foo", Partitions: []proto.ProduceRespPartition{{ID: 0}}},
+			},
+		}
+	})
+
+	conn, err := newTCPConnection(srv.Address(), time.Second)
+	c.Assert(err, IsNil)
+	defer func() { _ = conn.Close() }()
+	conn.compression = proto.CompressionGzip
+
+	newReq := func() *proto.ProduceReq {
+		return &proto.ProduceReq{
+			ClientID:     "tester",
+			RequiredAcks: proto.RequiredAcksAll,
+			Timeout:      time.Second,
+			Topics: []proto.ProduceReqTopic{
+				{
+					Name: "foo",
+					Partitions: []proto.ProduceReqPartition{
+						{ID: 0, Messages: []*proto.Message{{Value: []byte("first")}}},
+					},
+				},
+			},
+		}
+	}
+
+	req := newReq()
+	_, err = conn.Produce(req)
+	c.Assert(err, IsNil)
+	// request of the caller is left as it is
+	c.Assert(req.Compression, Equals, proto.CompressionNone)
+	c.Assert(req.CompressionCounters, IsNil)
+	c.Assert(req.CorrelationID, Not(Equals), int32(0))
+	c.Assert(conn.CompressionStats()["gzip"].Compressed, Equals, int64(1))
+	c.Assert(values, DeepEquals, []string{"first"})
+
+	// explicit codec is kept
+	req = newReq()
+	req.Compression = proto.CompressionSnappy
+	_, err = conn.Produce(req)
+	c.Assert(err, IsNil)
+	c.Assert(req.Compression, Equals, proto.CompressionSnappy)
+	stats := conn.CompressionStats()
+	c.Assert(stats["gzip"].Compressed, Equals, int64(1))
+	c.Assert(stats["snappy"].Compressed, Equals, int64(1))
+
+	// unknown codec is never sent
+	req = newReq()
+	req.Compression = proto.Compression(7)
+	_, err = conn.Produce(req)
+	c.Assert(err, Equals, ErrUnsupportedCompression)
+
+	// codecs are checked against the version the request is sent with
+	conn.versions = map[int16]int16{proto.ProduceReqKind: 1}
+	for _, codec := range []proto.Compression{proto.CompressionLZ4, proto.CompressionZstd} {
+		req = newReq()
+		req.Version = 2
+		req.Compression = codec
+		_, err = conn.Produce(req)
+		c.Assert(err, Equals, ErrUnsupportedCompression)
+		c.Assert(req.Version, Equals, int16(1))
+	}
+	c.Assert(values, HasLen, 2)
+}
+
+func (s *ConnectionSuite) TestConnectionClientID(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	var clientIDs []string
+	srv.Handle(MetadataRequest, func(request Serializable) Serializable {
+		req := request.(*proto.MetadataReq)
+		clientIDs = append(clientIDs, req.ClientID)
+		return &proto.MetadataResp{CorrelationID: req.CorrelationID}
+	})
+
+	conn, err := newTCPConnection(srv.Address(), time.Second)
+	c.Assert(err, IsNil)
+	defer func() { _ = conn.Close() }()
+
+	// no client ID is sent by default
+	_, err = conn.Metadata(&proto.MetadataReq{})
+	c.Assert(err, IsNil)
+
+	conn.clientID = "tracer"
+	_, err = conn.Metadata(&proto.MetadataReq{})
+	c.Assert(err, IsNil)
+
+	// client ID of the request takes precedence
+	_, err = conn.Metadata(&proto.MetadataReq{ClientID: "tester"})
+	c.Assert(err, IsNil)
+
+	c.Assert(clientIDs, DeepEquals, []string{"", "tracer", "tester"})
+}
+
+func (s *ConnectionSuite) TestConnectionTopicMetadata(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	var reqs []*proto.MetadataReq
+	srv.Handle(MetadataRequest, func(request Serializable) Serializable {
+		req := request.(*proto.MetadataReq)
+		reqs = append(reqs, req)
+		return &proto.MetadataResp{CorrelationID: req.CorrelationID, Version: req.Version}
+	})
+
+	conn, err := newTCPConnection(srv.Address(), time.Second)
+	c.Assert(err, IsNil)
+	defer func() { _ = conn.Close() }()
+
+	_, err = conn.TopicMetadata("tester", proto.AllTopics)
+	c.Assert(err, IsNil)
+	_, err = conn.TopicMetadata("tester", proto.TopicNames("foo", "bar"))
+	c.Assert(err, IsNil)
+	_, err = conn.TopicMetadata("tester", proto.TopicNames())
+	c.Assert(err, IsNil)
+
+	c.Assert(reqs, HasLen, 3)
+	c.Assert(reqs[0].Topics, IsNil)
+	c.Assert(reqs[1].Topics, DeepEquals, []string{"foo", "bar"})
+	c.Assert(reqs[2].Version, Equals, int16(1))
+	c.Assert(reqs[2].Topics, DeepEquals, []string{})
+
+	// version 0 cannot ask for no topic, so nothing is sent
+	conn.versions = map[int16]int16{proto.MetadataReqKind: 0}
+	_, err = conn.TopicMetadata("tester", proto.TopicNames())
+	c.Assert(err, NotNil)
+	c.Assert(reqs, HasLen, 3)
+}
+
+func (s *ConnectionSuite) TestConnectionProduceNoAckFlush(c *C) {
+	transport := newBufferedTransport()
+	conn := newConnection("fake", transport, 0)
+	defer func() { _ = conn.Close() }()
+
+	req := &proto.ProduceReq{
+		ClientID:     "tester",
+		RequiredAcks: proto.RequiredAcksNone,
+		Timeout:      time.Second,
+		Topics: []proto.ProduceReqTopic{
+			{
+				Name: "first",
+				Partitions: []proto.ProduceReqPartition{
+					{ID: 0, Messages: []*proto.Message{{Value: []byte("value 1")}}},
+				},
+			},
+		},
+	}
+	resp, err := conn.Produce(req)
+	c.Assert(err, IsNil)
+	c.Assert(resp, IsNil)
+	c.Assert(transport.Buffered(), Equals, 0)
+	b, _ := req.Bytes()
+	c.Assert(transport.written.Bytes(), DeepEquals, b)
+
+	done := make(chan error, 1)
+	err = conn.ProduceAsync(req, func(resp *proto.ProduceResp, err error) {
+		done <- err
+	})
+	c.Assert(err, IsNil)
+	c.Assert(<-done, IsNil)
+	c.Assert(transport.Buffered(), Equals, 0)
+	c.Assert(transport.written.Len(), Equals, 2*len(b))
+
+	// explicit flush writes out requests buffered by other paths
+	_, _ = transport.WriteString("buffered")
+	c.Assert(conn.Flush(), IsNil)
+	c.Assert(transport.Buffered(), Equals, 0)
+}
+
+func (s *ConnectionSuite) TestClosedConnectionWriter(c *C) {
+	// create test server with no messages, so that any client connection will
+	// be immediately closed
+	ln, err := testServer()
+	if err != nil {
+		c.Fatalf("test server error: %s", err)
+	}
+	conn, err := newTCPConnection(ln.Addr().String(), time.Second)
+	if err != nil {
+		c.Fatalf("could not conect to test server: %s", err)
+	}
+
+	longBytes := []byte(strings.Repeat("xxxxxxxxxxxxxxxxxxxxxx", 1000))
+	req := proto.ProduceReq{
+		ClientID:     "test-client",
+		Compression:  proto.CompressionNone,
+		RequiredAcks: proto.RequiredAcksAll,
+		Timeout:      100,
+		Topics: []proto.ProduceReqTopic{
+			{
+				Name: "test-topic",
+				Partitions: []proto.ProduceReqPartition{
+					{
+						ID: 0,
+						Messages: []*proto.Message{
+							{Value: longBytes},
+						},
+					},
+				},
+			},
+		},
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := conn.Produce(&req); err == nil {
+			c.Fatal("message publishing after closing connection should not be possible")
+		}
+	}
+
+	// although we produced ten requests, because connection is closed, no
+	// response channel should be registered
+	if waiting := conn.InFlight(); waiting != 0 {
+		c.Fatalf("expected 0 waiting responses, got %d", waiting)
+	}
+}
+
+func (s *ConnectionSuite) TestClosedConnectionReader(c *C) {
+	// create test server with no messages, so that any client connection will
+	// be immediately closed
+	ln, err := testServer()
+	if err != nil {
+		c.Fatalf("test server error: %s", err)
+	}
+	conn, err := newTCPConnection(ln.Addr().String(), time.Second)
+	if err != nil {
+		c.Fatalf("could not conect to test server: %s", err)
+	}
+
+	req := &proto.FetchReq{
+		ClientID:    "test-client",
+		MaxWaitTime: 100,
+		MinBytes:    0,
+		Topics: []proto.FetchReqTopic{
+			{
+				Name: "my-topic",
+				Partitions: []proto.FetchReqPartition{
+					{
+						ID:          0,
+						FetchOffset: 1,
+						MaxBytes:    100000,
+					},
+				},
+			},
+		},
+	}
+
+	for i := 0; i < 10; i++ {
+		if _, err := conn.Fetch(req); err == nil {
+			c.Fatal("fetching from closed connection succeeded")
+		}
+	}
+
+	// although we produced ten requests, because connection is closed, no
+	// response channel should be registered
+	if waiting := conn.InFlight(); waiting != 0 {
+		c.Fatalf("expected 0 waiting responses, got %d", waiting)
+	}
+}
+
+func (s *ConnectionSuite) TestConnectionCloseUnderLoad(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	srv.Handle(MetadataRequest, func(request Serializable) Serializable {
+		req := request.(*proto.MetadataReq)
+		return &proto.MetadataResp{CorrelationID: req.CorrelationID}
+	})
+	srv.Handle(FetchRequest, func(request Serializable) Serializable {
+		req := request.(*proto.FetchReq)
+		return &proto.FetchResp{CorrelationID: req.CorrelationID}
+	})
+	srv.Handle(ProduceRequest, func(request Serializable) Serializable {
+		req := request.(*proto.ProduceReq)
+		return &proto.ProduceResp{CorrelationID: req.CorrelationID}
+	})
+
+	const workers = 8
+	requests := []func(conn *connection) error{
+		func(conn *connection) error {
+			_, err := conn.Metadata(&proto.MetadataReq{ClientID: "tester"})
+			return err
+		},
+		func(conn *connection) error {
+			_, err := conn.Fetch(&proto.FetchReq{ClientID: "tester"})
+			return err
+		},
+		func(conn *connection) error {
+			_, err := conn.Produce(&proto.ProduceReq{
+				ClientID:     "tester",
+				RequiredAcks: proto.RequiredAcksLocal,
+				Topics: []proto.ProduceReqTopic{
+					{
+						Name: "foo",
+						Partitions: []proto.ProduceReqPartition{
+							{ID: 0, Messages: []*proto.Message{{Value: []byte("a")}}},
+						},
+					},
+				},
+			})
+			return err
+		},
+	}
+
+	for round := 0; round < 20; round++ {
+		conn, err := newTCPConnection(srv.Address(), time.Second)
+		c.Assert(err, IsNil)
+		conn.readTimeout = 5 * time.Second
+
+		var wg sync.WaitGroup
+		failed := make(chan error, workers)
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; ; i++ {
+					err := requests[(w+i)%len(requests)](conn)
+					if err == nil {
+						continue
+					}
+					if err == ErrReadTimeout {
+						// the request was lost instead of failing
+						failed <- err
+					}
+					if conn.IsClosed() {
+						return
+					}
+				}
+			}(w)
+		}
+		// requests are also cancelled, racing with their responses
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !conn.IsClosed() {
+				for _, id := range conn.PendingCorrelationIDs() {
+					conn.CancelRequest(id)
+				}
+				time.Sleep(100 * time.Microsecond)
+			}
+		}()
+		// close while requests are being written, waited for and read
+		time.Sleep(time.Duration(round%5) * time.Millisecond)
+		var closers sync.WaitGroup
+		for i := 0; i < 2; i++ {
+			closers.Add(1)
+			go func() {
+				defer closers.Done()
+				_ = conn.Close()
+			}()
+		}
+		closers.Wait()
+
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(3 * time.Second):
+			c.Fatalf("requests still pending after close: %v", conn.PendingCorrelationIDs())
+		}
+		close(failed)
+		for err := range failed {
+			c.Fatalf("request failed with %s instead of connection error", err)
+		}
+		c.Assert(conn.closedErr(), Equals, ErrClosed)
+		c.Assert(conn.InFlight(), Equals, 0)
+	}
+}
+
+func (s *ConnectionSuite) TestConnectionReaderAfterEOF(c *C) {
+	ln, err := testServer3()
+	if err != nil {
+		c.Fatalf("test server error: %s", err)
+	}
+	defer func() {
+		_ = ln.Close()
+	}()
+
+	conn, err := newTCPConnection(ln.Addr().String(), time.Second)
+	if err != nil {
+		c.Fatalf("could not conect to test server: %s", err)
+	}
+
+	req := &proto.FetchReq{
+		ClientID:    "test-client",
+		MaxWaitTime: 100,
 		MinBytes:    0,
 		Topics: []proto.FetchReqTopic{
 			{
-				Name: "my-topic",
+				Name: "my-topic",
+				Partitions: []proto.FetchReqPartition{
+					{
+						ID:          0,
+						FetchOffset: 1,
+						MaxBytes:    100000,
+					},
+				},
+			},
+		},
+	}
+
+	if _, err := conn.Fetch(req); err == nil {
+		c.Fatal("fetching from closed connection succeeded")
+	}
+
+	// Wait until testServer3 closes connection
+	time.Sleep(time.Millisecond * 50)
+
+	if _, err := conn.Fetch(req); err == nil {
+		c.Fatal("fetching from closed connection succeeded")
+	}
+}
+
+// failingTransport is a transport that returns given error on every read.
+type failingTransport struct {
+	readErr error
+}
+
+func (t *failingTransport) Read(b []byte) (int, error)  { return 0, t.readErr }
+func (t *failingTransport) Write(b []byte) (int, error) { return len(b), nil }
+func (t *failingTransport) Close() error                { return nil }
+
+// panickingTransport is a transport whose reads panic once a request is
+// written, just like a parser would on malformed response.
+type panickingTransport struct {
+	once    sync.Once
+	written chan struct{}
+}
+
+func (t *panickingTransport) Read(b []byte) (int, error) {
+	<-t.written
+	panic("malformed response")
+}
+func (t *panickingTransport) Write(b []byte) (int, error) {
+	t.once.Do(func() { close(t.written) })
+	return len(b), nil
+}
+func (t *panickingTransport) Close() error { return nil }
+
+func (s *ConnectionSuite) TestConnectionReadPanic(c *C) {
+	transport := &panickingTransport{written: make(chan struct{})}
+	conn := newConnection("fake", transport, 0)
+
+	_, err := conn.Metadata(&proto.MetadataReq{ClientID: "tester"})
+	c.Assert(err, Equals, ErrClosed)
+	c.Assert(conn.IsClosed(), Equals, true)
+	c.Assert(conn.CloseReason(), Equals, CloseReasonReadError)
+	c.Assert(conn.InFlight(), Equals, 0)
+
+	_, err = conn.Metadata(&proto.MetadataReq{ClientID: "tester"})
+	c.Assert(err, Equals, ErrClosed)
+}
+
+// halfWritingTransport is a transport that writes only half of the first
+// request, then fails. Reads block until the transport is closed.
+type halfWritingTransport struct {
+	once    sync.Once
+	closed  chan struct{}
+	written int
+}
+
+func (t *halfWritingTransport) Read(b []byte) (int, error) {
+	<-t.closed
+	return 0, io.EOF
+}
+func (t *halfWritingTransport) Write(b []byte) (int, error) {
+	t.written += len(b) / 2
+	return len(b) / 2, io.ErrShortWrite
+}
+func (t *halfWritingTransport) Close() error {
+	t.once.Do(func() { close(t.closed) })
+	return nil
+}
+
+func (s *ConnectionSuite) TestConnectionPartialWrite(c *C) {
+	transport := &halfWritingTransport{closed: make(chan struct{})}
+	conn := newConnection("fake", transport, 0)
+
+	_, err := conn.Metadata(&proto.MetadataReq{ClientID: "tester"})
+	c.Assert(err, Equals, io.ErrShortWrite)
+	c.Assert(transport.written > 0, Equals, true)
+	c.Assert(conn.IsClosed(), Equals, true)
+	c.Assert(conn.CloseReason(), Equals, CloseReasonWriteError)
+	c.Assert(conn.InFlight(), Equals, 0)
+	c.Assert(conn.closedErr(), Equals, ErrPartialWrite)
+}
+
+// silentServer accepts connections, but never reads requests nor writes
+// responses. Accepted connections are closed with the listener.
+func silentServer(c *C) (net.Listener, func()) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	var mu sync.Mutex
+	var conns []net.Conn
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+	}()
+	return ln, func() {
+		_ = ln.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+	}
+}
+
+func (s *ConnectionSuite) TestConnectionSocketReadTimeout(c *C) {
+	ln, closeServer := silentServer(c)
+	defer closeServer()
+
+	conn, err := newTCPConnection(ln.Addr().String(), time.Second)
+	c.Assert(err, IsNil)
+	defer func() { _ = conn.Close() }()
+	conn.setSocketReadTimeout(50 * time.Millisecond)
+
+	// idle connection is not closed
+	time.Sleep(100 * time.Millisecond)
+	c.Assert(conn.IsClosed(), Equals, false)
+
+	errc := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := conn.Metadata(&proto.MetadataReq{ClientID: "tester"})
+			errc <- err
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errc:
+			c.Assert(err, Equals, ErrSocketReadTimeout)
+		case <-time.After(time.Second):
+			c.Fatal("requests in flight not failed after socket read timeout")
+		}
+	}
+	c.Assert(conn.IsClosed(), Equals, true)
+	c.Assert(conn.CloseReason(), Equals, CloseReasonTimeout)
+	c.Assert(conn.InFlight(), Equals, 0)
+}
+
+func (s *ConnectionSuite) TestConnectionWriteTimeout(c *C) {
+	ln, closeServer := silentServer(c)
+	defer closeServer()
+
+	conn, err := newTCPConnection(ln.Addr().String(), time.Second)
+	c.Assert(err, IsNil)
+	defer func() { _ = conn.Close() }()
+	conn.writeTimeout = 50 * time.Millisecond
+
+	// request larger than the socket buffers, never read by the server
+	_, err = conn.Produce(&proto.ProduceReq{
+		ClientID:     "tester",
+		RequiredAcks: proto.RequiredAcksAll,
+		Topics: []proto.ProduceReqTopic{
+			{
+				Name: "test",
+				Partitions: []proto.ProduceReqPartition{
+					{ID: 0, Messages: []*proto.Message{{Value: make([]byte, 64<<20)}}},
+				},
+			},
+		},
+	})
+	c.Assert(err, Equals, ErrWriteTimeout)
+	c.Assert(conn.IsClosed(), Equals, true)
+	c.Assert(conn.CloseReason(), Equals, CloseReasonTimeout)
+}
+
+func (s *ConnectionSuite) TestConnectionCloseReasonReadError(c *C) {
+	conn := newConnection("fake", &failingTransport{readErr: errors.New("boom")}, 0)
+
+	deadline := time.Now().Add(time.Second)
+	for !conn.IsClosed() {
+		if time.Now().After(deadline) {
+			c.Fatal("connection was not closed after read error")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if reason := conn.CloseReason(); reason != CloseReasonReadError {
+		c.Fatalf("expected %s close reason, got %s", CloseReasonReadError, reason)
+	}
+
+	// closing already closed connection must not overwrite the reason
+	_ = conn.Close()
+	if reason := conn.CloseReason(); reason != CloseReasonReadError {
+		c.Fatalf("expected %s close reason, got %s", CloseReasonReadError, reason)
+	}
+}
+
+// disconnectingTransport is a transport that blocks reads until disconnect
+// is closed, after which it returns data, if any, followed by io.EOF.
+type disconnectingTransport struct {
+	disconnect chan struct{}
+	data       io.Reader
+}
+
+func (t *disconnectingTransport) Read(b []byte) (int, error) {
+	<-t.disconnect
+	if t.data == nil {
+		return 0, io.EOF
+	}
+	return t.data.Read(b)
+}
+func (t *disconnectingTransport) Write(b []byte) (int, error) { return len(b), nil }
+func (t *disconnectingTransport) Close() error                { return nil }
+
+func (s *ConnectionSuite) TestConnectionBrokerDisconnected(c *C) {
+	transport := &disconnectingTransport{disconnect: make(chan struct{})}
+	conn := newConnection("fake", transport, 0)
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := conn.Metadata(&proto.MetadataReq{ClientID: "tester"})
+		errc <- err
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		if conn.InFlight() == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			c.Fatal("request is not waiting for response")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(transport.disconnect)
+
+	select {
+	case err := <-errc:
+		c.Assert(err, Equals, ErrBrokerDisconnected)
+	case <-time.After(time.Second):
+		c.Fatal("pending request not notified about disconnection")
+	}
+	c.Assert(conn.CloseReason(), Equals, CloseReasonServerDisconnect)
+
+	// new requests are rejected with the same error
+	_, err := conn.Metadata(&proto.MetadataReq{ClientID: "tester"})
+	c.Assert(err, Equals, ErrBrokerDisconnected)
+}
+
+func (s *ConnectionSuite) TestConnectionMaxResponseSize(c *C) {
+	// response claiming to be 2GB long
+	transport := &disconnectingTransport{
+		disconnect: make(chan struct{}),
+		data:       bytes.NewReader([]byte{0x7f, 0xff, 0xff, 0xff, 0x0, 0x0, 0x0, 0x1}),
+	}
+	conn := newConnection("fake", transport, 0)
+	conn.setMaxResponseSize(1024)
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := conn.Metadata(&proto.MetadataReq{ClientID: "tester"})
+		errc <- err
+	}()
+	// response must not be read before the request is waiting for it
+	deadline := time.Now().Add(time.Second)
+	for conn.InFlight() != 1 {
+		if time.Now().After(deadline) {
+			c.Fatal("request is not waiting for response")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(transport.disconnect)
+
+	select {
+	case err := <-errc:
+		serr, ok := err.(*proto.ResponseSizeError)
+		if !ok || serr.Size != math.MaxInt32 || serr.Limit != 1024 {
+			c.Fatalf("expected response size error, got %#v", err)
+		}
+	case <-time.After(time.Second):
+		c.Fatal("pending request not notified about invalid response")
+	}
+	c.Assert(conn.IsClosed(), Equals, true)
+}
+
+func (s *ConnectionSuite) TestConnectionSkipOversizedResponse(c *C) {
+	// stream is kept open, so that the connection is not closed after
+	// reading the responses
+	pr, pw := io.Pipe()
+	defer func() { _ = pw.Close() }()
+	transport := &streamTransport{start: make(chan struct{}), data: pr}
+	conn := newConnection("fake", transport, 0)
+	defer func() { _ = conn.Close() }()
+	conn.setMaxResponseSize(64)
+	conn.skipOversized = true
+
+	respc1, err := conn.respWaiter(1)
+	c.Assert(err, IsNil)
+	respc2, err := conn.respWaiter(2)
+	c.Assert(err, IsNil)
+
+	var stream bytes.Buffer
+	frame := make([]byte, 104)
+	binary.BigEndian.PutUint32(frame, 100)
+	binary.BigEndian.PutUint32(frame[4:], 1)
+	stream.Write(frame)
+	_, _ = testResponses(2).WriteTo(&stream)
+	close(transport.start)
+	go func() { _, _ = stream.WriteTo(pw) }()
+
+	_, err = conn.waitResponse(context.Background(), 1, respc1, time.Second)
+	serr, ok := err.(*proto.ResponseSizeError)
+	if !ok || serr.Size != 100 || serr.Limit != 64 {
+		c.Fatalf("expected response size error, got %#v", err)
+	}
+	b, err := conn.waitResponse(context.Background(), 2, respc2, time.Second)
+	c.Assert(err, IsNil)
+	c.Assert(b, DeepEquals, []byte{0, 0, 0, 4, 0, 0, 0, 2})
+	c.Assert(conn.IsClosed(), Equals, false)
+}
+
+func (s *ConnectionSuite) TestConnectionCloseReasonLocal(c *C) {
+	ln, _, err := testServer2()
+	if err != nil {
+		c.Fatalf("test server error: %s", err)
+	}
+	defer func() { _ = ln.Close() }()
+
+	conn, err := newTCPConnection(ln.Addr().String(), time.Second)
+	if err != nil {
+		c.Fatalf("could not conect to test server: %s", err)
+	}
+	if reason := conn.CloseReason(); reason != CloseReasonNone {
+		c.Fatalf("expected %s close reason, got %s", CloseReasonNone, reason)
+	}
+	_ = conn.Close()
+	if reason := conn.CloseReason(); reason != CloseReasonLocal {
+		c.Fatalf("expected %s close reason, got %s", CloseReasonLocal, reason)
+	}
+}
+
+func (s *ConnectionSuite) TestConnectionFetchSession(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	// responses returned by the broker, in order
+	responses := []*proto.FetchResp{
+		{
+			SessionID: 42,
+			Topics: []proto.FetchRespTopic{
+				{
+					Name: "foo",
+					Partitions: []proto.FetchRespPartition{
+						{ID: 0, TipOffset: 10, Messages: []*proto.Message{}},
+						{ID: 1, TipOffset: 20, Messages: []*proto.Message{}},
+					},
+				},
+			},
+		},
+		{SessionID: 42, Topics: []proto.FetchRespTopic{}},
+		{
+			SessionID: 42,
+			Topics: []proto.FetchRespTopic{
+				{
+					Name: "foo",
+					Partitions: []proto.FetchRespPartition{
+						{ID: 1, TipOffset: 21, Messages: []*proto.Message{}},
+					},
+				},
+			},
+		},
+		{Err: proto.ErrFetchSessionIDNotFound, Topics: []proto.FetchRespTopic{}},
+		{SessionID: 43, Topics: []proto.FetchRespTopic{}},
+		{SessionID: 43, Topics: []proto.FetchRespTopic{}},
+	}
+	requests := make(chan *proto.FetchReq, len(responses))
+	handled := 0
+	srv.Handle(FetchRequest, func(request Serializable) Serializable {
+		req := request.(*proto.FetchReq)
+		resp := responses[handled]
+		handled++
+		resp.CorrelationID = req.CorrelationID
+		resp.Version = req.Version
+		requests <- req
+		return resp
+	})
+
+	conn, err := newTCPConnection(srv.Address(), time.Second)
+	if err != nil {
+		c.Fatalf("could not conect to test server: %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	req := &proto.FetchReq{
+		ClientID: "tester",
+		Version:  7,
+		Topics: []proto.FetchReqTopic{
+			{
+				Name: "foo",
 				Partitions: []proto.FetchReqPartition{
-					{
-						ID:          0,
-						FetchOffset: 1,
-						MaxBytes:    100000,
-					},
+					{ID: 0, FetchOffset: 10, MaxBytes: 1024},
+					{ID: 1, FetchOffset: 20, MaxBytes: 1024},
 				},
 			},
 		},
 	}
+	countParts := func(topics []proto.FetchReqTopic) int {
+		n := 0
+		for _, topic := range topics {
+			n += len(topic.Partitions)
+		}
+		return n
+	}
+	tips := func(resp *proto.FetchResp) map[int32]int64 {
+		res := make(map[int32]int64)
+		for _, topic := range resp.Topics {
+			for _, part := range topic.Partitions {
+				res[part.ID] = part.TipOffset
+			}
+		}
+		return res
+	}
 
-	if _, err := conn.Fetch(req); err == nil {
-		c.Fatal("fetching from closed connection succeeded")
+	// first fetch establishes the session
+	resp, err := conn.Fetch(req)
+	if err != nil {
+		c.Fatalf("cannot fetch: %s", err)
+	}
+	sent := <-requests
+	if sent.SessionID != 0 || sent.SessionEpoch != 0 || countParts(sent.Topics) != 2 {
+		c.Fatalf("expected full fetch, got %#v", sent)
+	}
+	if resp.SessionID != 42 {
+		c.Fatalf("expected session 42, got %d", resp.SessionID)
 	}
 
-	// Wait until testServer3 closes connection
-	time.Sleep(time.Millisecond * 50)
+	// nothing changed, so incremental fetch carries no partitions, but
+	// all of them are still returned to the caller
+	resp, err = conn.Fetch(req)
+	if err != nil {
+		c.Fatalf("cannot fetch: %s", err)
+	}
+	sent = <-requests
+	if sent.SessionID != 42 || sent.SessionEpoch != 1 || countParts(sent.Topics) != 0 {
+		c.Fatalf("expected empty incremental fetch, got %#v", sent)
+	}
+	if got := tips(resp); !reflect.DeepEqual(got, map[int32]int64{0: 10, 1: 20}) {
+		c.Fatalf("expected cached partitions, got %v", got)
+	}
 
-	if _, err := conn.Fetch(req); err == nil {
-		c.Fatal("fetching from closed connection succeeded")
+	// only the partition with changed offset is sent
+	req.Topics[0].Partitions[1].FetchOffset = 21
+	resp, err = conn.Fetch(req)
+	if err != nil {
+		c.Fatalf("cannot fetch: %s", err)
+	}
+	sent = <-requests
+	if sent.SessionID != 42 || sent.SessionEpoch != 2 || countParts(sent.Topics) != 1 ||
+		sent.Topics[0].Partitions[0].ID != 1 {
+		c.Fatalf("expected incremental fetch of partition 1, got %#v", sent)
+	}
+	if got := tips(resp); !reflect.DeepEqual(got, map[int32]int64{0: 10, 1: 21}) {
+		c.Fatalf("expected updated partitions, got %v", got)
+	}
+
+	// unknown session is reset with a full fetch
+	resp, err = conn.Fetch(req)
+	if err != nil {
+		c.Fatalf("cannot fetch: %s", err)
+	}
+	sent = <-requests
+	if sent.SessionID != 42 || sent.SessionEpoch != 3 {
+		c.Fatalf("expected incremental fetch, got %#v", sent)
+	}
+	sent = <-requests
+	if sent.SessionID != 0 || sent.SessionEpoch != 0 || countParts(sent.Topics) != 2 {
+		c.Fatalf("expected full fetch after reset, got %#v", sent)
+	}
+	if resp.SessionID != 43 {
+		c.Fatalf("expected session 43, got %d", resp.SessionID)
+	}
+
+	// dropped partition is removed from the session
+	req.Topics[0].Partitions = req.Topics[0].Partitions[1:]
+	resp, err = conn.Fetch(req)
+	if err != nil {
+		c.Fatalf("cannot fetch: %s", err)
+	}
+	sent = <-requests
+	if sent.SessionID != 43 || sent.SessionEpoch != 1 || countParts(sent.Topics) != 0 {
+		c.Fatalf("expected empty incremental fetch, got %#v", sent)
+	}
+	c.Assert(sent.ForgottenTopics, DeepEquals, []proto.FetchReqForgottenTopic{
+		{Name: "foo", Partitions: []int32{0}},
+	})
+	if got := tips(resp); !reflect.DeepEqual(got, map[int32]int64{1: 0}) {
+		c.Fatalf("expected only partition 1, got %v", got)
+	}
+}
+
+func (s *ConnectionSuite) TestConnectionDeleteGroups(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	srv.Handle(DeleteGroupsRequest, func(request Serializable) Serializable {
+		req := request.(*proto.DeleteGroupsReq)
+		resp := &proto.DeleteGroupsResp{CorrelationID: req.CorrelationID}
+		for _, group := range req.Groups {
+			var err error
+			if group == "busy" {
+				err = proto.ErrNonEmptyGroup
+			}
+			resp.Groups = append(resp.Groups, proto.DeleteGroupsRespGroup{Group: group, Err: err})
+		}
+		return resp
+	})
+
+	conn, err := newTCPConnection(srv.Address(), time.Second)
+	if err != nil {
+		c.Fatalf("could not conect to test server: %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	resp, err := conn.DeleteGroups(&proto.DeleteGroupsReq{
+		ClientID: "tester",
+		Groups:   []string{"idle", "busy"},
+	})
+	if err != nil {
+		c.Fatalf("could not delete groups: %s", err)
+	}
+	expected := []proto.DeleteGroupsRespGroup{
+		{Group: "idle"},
+		{Group: "busy", Err: proto.ErrNonEmptyGroup},
+	}
+	if !reflect.DeepEqual(resp.Groups, expected) {
+		c.Fatalf("expected different groups: %#v", resp.Groups)
+	}
+}
+
+func (s *ConnectionSuite) TestConnectionWriteTxnMarkers(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	srv.Handle(WriteTxnMarkersRequest, func(request Serializable) Serializable {
+		req := request.(*proto.WriteTxnMarkersReq)
+		resp := &proto.WriteTxnMarkersResp{CorrelationID: req.CorrelationID}
+		for _, m := range req.Markers {
+			marker := proto.WriteTxnMarkersRespMarker{ProducerID: m.ProducerID}
+			for _, t := range m.Topics {
+				topic := proto.WriteTxnMarkersRespTopic{Name: t.Name}
+				for _, p := range t.Partitions {
+					var err error
+					if m.ProducerEpoch < 3 {
+						err = proto.ErrInvalidProducerEpoch
+					}
+					topic.Partitions = append(topic.Partitions, proto.WriteTxnMarkersRespPartition{ID: p, Err: err})
+				}
+				marker.Topics = append(marker.Topics, topic)
+			}
+			resp.Markers = append(resp.Markers, marker)
+		}
+		return resp
+	})
+
+	conn, err := newTCPConnection(srv.Address(), time.Second)
+	c.Assert(err, IsNil)
+	defer func() { _ = conn.Close() }()
+
+	resp, err := conn.WriteTxnMarkers(&proto.WriteTxnMarkersReq{
+		ClientID: "tester",
+		Markers: []proto.WriteTxnMarkersReqMarker{
+			{
+				ProducerID:    7,
+				ProducerEpoch: 3,
+				Committed:     true,
+				Topics: []proto.WriteTxnMarkersReqTopic{
+					{Name: "foo", Partitions: []int32{0, 2}},
+				},
+				CoordinatorEpoch: 1,
+			},
+			{
+				ProducerID:    8,
+				ProducerEpoch: 1,
+				Topics: []proto.WriteTxnMarkersReqTopic{
+					{Name: "bar", Partitions: []int32{1}},
+				},
+				CoordinatorEpoch: 1,
+			},
+		},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(resp.Markers, DeepEquals, []proto.WriteTxnMarkersRespMarker{
+		{
+			ProducerID: 7,
+			Topics: []proto.WriteTxnMarkersRespTopic{
+				{Name: "foo", Partitions: []proto.WriteTxnMarkersRespPartition{{ID: 0}, {ID: 2}}},
+			},
+		},
+		{
+			ProducerID: 8,
+			Topics: []proto.WriteTxnMarkersRespTopic{
+				{Name: "bar", Partitions: []proto.WriteTxnMarkersRespPartition{
+					{ID: 1, Err: proto.ErrInvalidProducerEpoch},
+				}},
+			},
+		},
+	})
+}
+
+// streamTransport is a transport that, once started, returns data of given
+// stream, counting reads.
+type streamTransport struct {
+	start chan struct{}
+	data  io.Reader
+	reads int64
+}
+
+func (t *streamTransport) Read(b []byte) (int, error) {
+	<-t.start
+	atomic.AddInt64(&t.reads, 1)
+	return t.data.Read(b)
+}
+func (t *streamTransport) Write(b []byte) (int, error) { return len(b), nil }
+func (t *streamTransport) Close() error                { return nil }
+
+func benchmarkReadResp(b *testing.B, bufferSize int, respSize int) {
+	// responses of given size, available at once
+	var stream bytes.Buffer
+	frame := make([]byte, respSize)
+	for i := 1; i <= b.N; i++ {
+		binary.BigEndian.PutUint32(frame, uint32(len(frame)-4))
+		binary.BigEndian.PutUint32(frame[4:], uint32(i))
+		stream.Write(frame)
+	}
+	transport := &streamTransport{start: make(chan struct{}), data: &stream}
+	conn := newConnection("fake", transport, bufferSize)
+	defer func() { _ = conn.Close() }()
+
+	waiters := make([]chan response, b.N)
+	for i := range waiters {
+		respc, err := conn.respWaiter(int32(i + 1))
+		if err != nil {
+			b.Fatalf("cannot wait for response: %s", err)
+		}
+		waiters[i] = respc
+	}
+
+	b.ResetTimer()
+	close(transport.start)
+	for _, respc := range waiters {
+		if _, ok := <-respc; !ok {
+			b.Fatalf("connection closed: %s", conn.stopErr)
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(atomic.LoadInt64(&transport.reads))/float64(b.N), "reads/op")
+}
+
+func BenchmarkReadResp4KB(b *testing.B) {
+	benchmarkReadResp(b, 4*1024, 2048)
+}
+
+func BenchmarkReadResp64KB(b *testing.B) {
+	benchmarkReadResp(b, 64*1024, 2048)
+}
+
+// large responses, as returned by fetch requests for big batches
+
+func BenchmarkReadLargeResp4KB(b *testing.B) {
+	benchmarkReadResp(b, 4*1024, 512*1024)
+}
+
+func BenchmarkReadLargeResp64KB(b *testing.B) {
+	benchmarkReadResp(b, 64*1024, 512*1024)
+}
+
+func BenchmarkReadLargeResp1MB(b *testing.B) {
+	benchmarkReadResp(b, 1024*1024, 512*1024)
+}
+
+// echoTransport answers every request written to it with an empty response
+// carrying the same correlation ID.
+type echoTransport struct {
+	resps   chan []byte
+	pending []byte
+}
+
+func (t *echoTransport) Read(b []byte) (int, error) {
+	if len(t.pending) == 0 {
+		resp, ok := <-t.resps
+		if !ok {
+			return 0, io.EOF
+		}
+		t.pending = resp
+	}
+	n := copy(b, t.pending)
+	t.pending = t.pending[n:]
+	return n, nil
+}
+func (t *echoTransport) Write(b []byte) (int, error) {
+	resp := make([]byte, 8)
+	binary.BigEndian.PutUint32(resp, 4)
+	copy(resp[4:], b[8:12])
+	t.resps <- resp
+	return len(b), nil
+}
+func (t *echoTransport) Close() error {
+	close(t.resps)
+	return nil
+}
+
+// BenchmarkConcurrentRequests measures dispatching responses to many
+// requests in flight at once. Run with -mutexprofile to inspect contention.
+// BenchmarkWaiterLockContention registers and releases waiters from many
+// goroutines at once, reporting the time spent waiting for waiter locks.
+func BenchmarkWaiterLockContention(b *testing.B) {
+	transport := &streamTransport{start: make(chan struct{}), data: testResponses()}
+	conn := newConnection("fake", transport, 0)
+	defer func() { _ = conn.Close() }()
+
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			correlationID := <-conn.nextID
+			if _, err := conn.respWaiter(correlationID); err != nil {
+				b.Fatalf("cannot wait for response: %s", err)
+			}
+			conn.releaseWaiter(correlationID)
+		}
+	})
+	b.StopTimer()
+
+	stats := conn.WaiterLockStats()
+	b.ReportMetric(float64(stats.WaitTime.Nanoseconds())/float64(b.N), "wait-ns/op")
+	b.ReportMetric(float64(stats.Contended)/float64(b.N), "contended/op")
+}
+
+func BenchmarkConcurrentRequests(b *testing.B) {
+	conn := newConnection("fake", &echoTransport{resps: make(chan []byte, 1024)}, 0)
+	defer func() { _ = conn.Close() }()
+
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		req := make([]byte, 12)
+		binary.BigEndian.PutUint32(req, 8)
+		for pb.Next() {
+			correlationID := <-conn.nextID
+			respc, err := conn.respWaiter(correlationID)
+			if err != nil {
+				b.Fatalf("cannot wait for response: %s", err)
+			}
+			binary.BigEndian.PutUint32(req[8:], uint32(correlationID))
+			if _, err := conn.rw.Write(req); err != nil {
+				b.Fatalf("cannot write: %s", err)
+			}
+			if _, ok := <-respc; !ok {
+				b.Fatalf("connection closed: %s", conn.stopErr)
+			}
+		}
+	})
+}
+
+func (s *ConnectionSuite) TestConnectionExpectedInFlight(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	srv.Handle(MetadataRequest, func(request Serializable) Serializable {
+		req := request.(*proto.MetadataReq)
+		return &proto.MetadataResp{CorrelationID: req.CorrelationID}
+	})
+
+	conn, err := dialConnection(srv.Address(), time.Second, 0, 100, nil)
+	c.Assert(err, IsNil)
+	defer func() { _ = conn.Close() }()
+
+	// sizing is only a hint, more requests than expected are still served
+	var wg sync.WaitGroup
+	errc := make(chan error, 200)
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := conn.Metadata(&proto.MetadataReq{})
+			errc <- err
+		}()
+	}
+	wg.Wait()
+	close(errc)
+	for err := range errc {
+		c.Assert(err, IsNil)
+	}
+}
+
+func (s *ConnectionSuite) TestConnectionStaleFetch(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	srv.Handle(FetchRequest, func(request Serializable) Serializable {
+		req := request.(*proto.FetchReq)
+		return &proto.FetchResp{
+			CorrelationID: req.CorrelationID,
+			Version:       req.Version,
+			Topics: []proto.FetchRespTopic{{
+				Name: "foo",
+				Partitions: []proto.FetchRespPartition{{
+					ID:             1,
+					TipOffset:      20,
+					LogStartOffset: 3,
+					// all messages are older than requested
+					Messages: []*proto.Message{
+						{Offset: 3, Value: []byte("first")},
+						{Offset: 4, Value: []byte("second")},
+					},
+				}},
+			}},
+		}
+	})
+
+	conn, err := newTCPConnection(srv.Address(), time.Second)
+	c.Assert(err, IsNil)
+	defer func() { _ = conn.Close() }()
+
+	fetch := func() proto.FetchRespPartition {
+		resp, err := conn.Fetch(&proto.FetchReq{
+			ClientID: "tester",
+			Version:  5,
+			Topics: []proto.FetchReqTopic{{
+				Name:       "foo",
+				Partitions: []proto.FetchReqPartition{{ID: 1, FetchOffset: 7, MaxBytes: 1024}},
+			}},
+		})
+		c.Assert(err, IsNil)
+		return resp.Topics[0].Partitions[0]
+	}
+
+	// ignored by default
+	p := fetch()
+	c.Assert(p.Err, IsNil)
+	c.Assert(p.Messages, HasLen, 0)
+
+	conn.staleFetch = StaleFetchError
+	p = fetch()
+	c.Assert(p.Err, Equals, ErrStaleFetch)
+	c.Assert(p.Messages, HasLen, 0)
+	c.Assert(p.LogStartOffset, Equals, int64(3))
+}
+
+func (s *ConnectionSuite) TestConnectionRawFetch(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	srv.Handle(FetchRequest, func(request Serializable) Serializable {
+		req := request.(*proto.FetchReq)
+		return &proto.FetchResp{
+			CorrelationID: req.CorrelationID,
+			Version:       req.Version,
+			Topics: []proto.FetchRespTopic{{
+				Name: "foo",
+				Partitions: []proto.FetchRespPartition{{
+					ID:        1,
+					TipOffset: 20,
+					// whole batch, starting below the requested offset
+					Messages: []*proto.Message{
+						{Offset: 3, Value: []byte("first")},
+						{Offset: 4, Value: []byte("second")},
+						{Offset: 5, Value: []byte("third")},
+					},
+				}},
+			}},
+		}
+	})
+
+	conn, err := newTCPConnection(srv.Address(), time.Second)
+	c.Assert(err, IsNil)
+	defer func() { _ = conn.Close() }()
+
+	req := func() *proto.FetchReq {
+		return &proto.FetchReq{
+			ClientID: "tester",
+			Version:  4,
+			Topics: []proto.FetchReqTopic{{
+				Name:       "foo",
+				Partitions: []proto.FetchReqPartition{{ID: 1, FetchOffset: 5, MaxBytes: 1024}},
+			}},
+		}
+	}
+
+	resp, err := conn.RawFetch(req())
+	c.Assert(err, IsNil)
+	messages := resp.Topics[0].Partitions[0].Messages
+	c.Assert(messages, HasLen, 3)
+	for i, m := range messages {
+		c.Assert(m.Offset, Equals, int64(3+i))
+	}
+
+	resp, err = conn.Fetch(req())
+	c.Assert(err, IsNil)
+	messages = resp.Topics[0].Partitions[0].Messages
+	c.Assert(messages, HasLen, 1)
+	c.Assert(messages[0].Offset, Equals, int64(5))
+}
+
+// rawResponse is a response encoded by the test itself, for formats the
+// encoders of proto do not implement.
+type rawResponse []byte
+
+func (r rawResponse) Bytes() ([]byte, error) {
+	return r, nil
+}
+
+// testRecordBatch returns uncompressed record batch holding one record, with
+// neither key nor headers, for every value.
+func testRecordBatch(baseOffset int64, values ...string) []byte {
+	var records bytes.Buffer
+	varint := make([]byte, binary.MaxVarintLen64)
+	putVarint := func(w *bytes.Buffer, x int64) {
+		n := binary.PutVarint(varint, x)
+		_, _ = w.Write(varint[:n])
+	}
+	for i, value := range values {
+		var rec bytes.Buffer
+		_ = rec.WriteByte(0)      // attributes
+		putVarint(&rec, 0)        // timestamp delta
+		putVarint(&rec, int64(i)) // offset delta
+		putVarint(&rec, -1)       // null key
+		putVarint(&rec, int64(len(value)))
+		_, _ = rec.WriteString(value)
+		putVarint(&rec, 0) // no headers
+
+		putVarint(&records, int64(rec.Len()))
+		_, _ = records.Write(rec.Bytes())
+	}
+
+	var body bytes.Buffer
+	enc := proto.NewEncoder(&body)
+	enc.EncodeInt16(0) // attributes
+	enc.EncodeInt32(int32(len(values) - 1))
+	enc.EncodeInt64(1500000000000) // first timestamp
+	enc.EncodeInt64(1500000000000) // max timestamp
+	enc.EncodeInt64(-1)            // producer id
+	enc.EncodeInt16(-1)            // producer epoch
+	enc.EncodeInt32(-1)            // base sequence
+	enc.EncodeArrayLen(len(values))
+	_, _ = body.Write(records.Bytes())
+
+	var batch bytes.Buffer
+	enc = proto.NewEncoder(&batch)
+	enc.EncodeInt64(baseOffset)
+	enc.EncodeInt32(int32(4 + 1 + 4 + body.Len()))
+	enc.EncodeInt32(0) // partition leader epoch
+	enc.EncodeInt8(2)  // magic byte
+	enc.EncodeUint32(crc32.Checksum(body.Bytes(), crc32.MakeTable(crc32.Castagnoli)))
+	_, _ = batch.Write(body.Bytes())
+	return batch.Bytes()
+}
+
+func (s *ConnectionSuite) TestConnectionRawFetchForwardRecordBatch(c *C) {
+	var set bytes.Buffer
+	_, _ = set.Write(testRecordBatch(3, "first", "second"))
+	_, _ = set.Write(testRecordBatch(5, "third"))
+
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	srv.Handle(FetchRequest, func(request Serializable) Serializable {
+		req := request.(*proto.FetchReq)
+		var buf bytes.Buffer
+		enc := proto.NewEncoder(&buf)
+		enc.EncodeInt32(0) // size placeholder
+		enc.EncodeInt32(req.CorrelationID)
+		enc.EncodeInt32(0) // throttle time
+		enc.EncodeArrayLen(1)
+		enc.EncodeString("foo")
+		enc.EncodeArrayLen(1)
+		enc.EncodeInt32(1)
+		enc.EncodeInt16(0)
+		enc.EncodeInt64(20)
+		enc.EncodeInt64(20)   // last stable offset
+		enc.EncodeArrayLen(0) // aborted transactions
+		enc.EncodeInt32(int32(set.Len()))
+		_, _ = buf.Write(set.Bytes())
+		b := buf.Bytes()
+		binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+		return rawResponse(b)
+	})
+	produced := make(chan *proto.ProduceReq, 1)
+	srv.Handle(ProduceRequest, func(request Serializable) Serializable {
+		req := request.(*proto.ProduceReq)
+		produced <- req
+		return &proto.ProduceResp{
+			CorrelationID: req.CorrelationID,
+			Version:       req.Version,
+			Topics: []proto.ProduceRespTopic{{
+				Name:       "bar",
+				Partitions: []proto.ProduceRespPartition{{ID: 0, Offset: 100}},
+			}},
+		}
+	})
+
+	conn, err := newTCPConnection(srv.Address(), time.Second)
+	c.Assert(err, IsNil)
+	defer func() { _ = conn.Close() }()
+	var sent []byte
+	conn.setOnWire(func(dir Direction, apiKey, apiVersion, correlationID int32, raw []byte) {
+		if dir == DirectionSend && int16(apiKey) == proto.ProduceReqKind {
+			sent = append([]byte(nil), raw...)
+		}
+	})
+
+	resp, err := conn.RawFetch(&proto.FetchReq{
+		ClientID: "tester",
+		Version:  4,
+		Topics: []proto.FetchReqTopic{{
+			Name:       "foo",
+			Partitions: []proto.FetchReqPartition{{ID: 1, FetchOffset: 4, MaxBytes: 1024}},
+		}},
+	})
+	c.Assert(err, IsNil)
+	part := resp.Topics[0].Partitions[0]
+	c.Assert(part.Messages, HasLen, 3)
+	c.Assert(part.RawMessageSet, DeepEquals, set.Bytes())
+
+	_, err = conn.Produce(&proto.ProduceReq{
+		ClientID:     "tester",
+		RequiredAcks: proto.RequiredAcksAll,
+		Timeout:      time.Second,
+		Version:      3,
+		Topics: []proto.ProduceReqTopic{{
+			Name:       "bar",
+			Partitions: []proto.ProduceReqPartition{{ID: 0, RawMessageSet: part.RawMessageSet}},
+		}},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(bytes.HasSuffix(sent, set.Bytes()), Equals, true)
+	req := <-produced
+	c.Assert(req.Version, Equals, int16(3))
+	messages := req.Topics[0].Partitions[0].Messages
+	c.Assert(messages, HasLen, 3)
+	for i, value := range []string{"first", "second", "third"} {
+		c.Assert(string(messages[i].Value), Equals, value)
+		c.Assert(messages[i].Offset, Equals, int64(3+i))
 	}
 }
@@ -0,0 +1,55 @@
+package kafka
+
+import (
+	"github.com/dropbox/kafka/proto"
+)
+
+// adaptiveFetchSize tunes MaxBytes of fetch requests of single partition to
+// the size of the responses, so that partitions with high throughput are
+// fetched in fewer round trips and those with low throughput do not reserve
+// large buffers on the broker.
+type adaptiveFetchSize struct {
+	size int32
+	min  int32
+	max  int32
+}
+
+// newAdaptiveFetchSize returns fetch size starting at given size, clamped to
+// the bounds.
+func newAdaptiveFetchSize(start, min, max int32) *adaptiveFetchSize {
+	if max < min {
+		max = min
+	}
+	a := &adaptiveFetchSize{min: min, max: max}
+	a.set(int64(start))
+	return a
+}
+
+// update adjusts the fetch size to the estimated size of messages returned
+// by a response to request with the current size. Size is doubled if the
+// response was at least three quarters full, as it was likely limited by the
+// size, and halved if it was less than one eighth full.
+func (a *adaptiveFetchSize) update(messages []*proto.Message) {
+	used := int64(0)
+	for _, m := range messages {
+		used += int64(proto.EstimateMessageSize(m))
+	}
+	size := int64(a.size)
+	switch {
+	case used >= size*3/4:
+		a.set(size * 2)
+	case used < size/8:
+		a.set(size / 2)
+	}
+}
+
+// set sets the fetch size, clamped to the bounds.
+func (a *adaptiveFetchSize) set(size int64) {
+	if size < int64(a.min) {
+		size = int64(a.min)
+	}
+	if size > int64(a.max) {
+		size = int64(a.max)
+	}
+	a.size = int32(size)
+}
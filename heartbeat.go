@@ -0,0 +1,137 @@
+package kafka
+
+import (
+	"sync"
+	"time"
+
+	"github.com/dropbox/kafka/proto"
+)
+
+// HeartbeatConf configures the heartbeat of a consumer group member, as
+// started by Broker.Heartbeat.
+type HeartbeatConf struct {
+	ConsumerGroup string
+
+	// GenerationID and MemberID identify the member, as assigned by the
+	// coordinator when the member joined the group.
+	GenerationID int32
+	MemberID     string
+
+	// Interval is the time between heartbeats. It must be well below the
+	// session timeout the member joined the group with, usually no more than
+	// a third of it.
+	//
+	// Default is 3s.
+	Interval time.Duration
+
+	// RebalanceNeeded is called when the coordinator reports that the group
+	// is rebalancing, with proto.ErrRebalanceInProgress, or that the member
+	// is no longer part of the current generation of the group, with
+	// proto.ErrIllegalGeneration or proto.ErrUnknownMemberID. The member
+	// must then rejoin the group. Heartbeats are stopped before it is
+	// called, so it may call Stop.
+	RebalanceNeeded func(err error)
+}
+
+// NewHeartbeatConf returns default heartbeat configuration for given member
+// of consumer group.
+func NewHeartbeatConf(consumerGroup string, generationID int32, memberID string) HeartbeatConf {
+	return HeartbeatConf{
+		ConsumerGroup: consumerGroup,
+		GenerationID:  generationID,
+		MemberID:      memberID,
+		Interval:      3 * time.Second,
+	}
+}
+
+// GroupHeartbeat sends heartbeats of single consumer group member in the
+// background, until stopped or until the group needs to rebalance.
+type GroupHeartbeat struct {
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// Heartbeat starts sending heartbeats of consumer group member to the
+// coordinator of the group, at the configured interval, keeping the member
+// in the group. Failed heartbeats are logged and retried at the next
+// interval, except for those requiring the member to rejoin the group, which
+// stop the heartbeat and are reported to RebalanceNeeded callback.
+func (b *Broker) Heartbeat(conf HeartbeatConf) *GroupHeartbeat {
+	h := &GroupHeartbeat{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go h.run(b, conf)
+	return h
+}
+
+// Stop stops sending heartbeats and waits for the heartbeat in flight, if
+// any. It is safe to call it more than once, and after the heartbeat stopped
+// on its own.
+func (h *GroupHeartbeat) Stop() {
+	h.stopOnce.Do(func() { close(h.stop) })
+	<-h.done
+}
+
+func (h *GroupHeartbeat) run(b *Broker, conf HeartbeatConf) {
+	err := h.loop(b, conf)
+	close(h.done)
+	if err != nil && conf.RebalanceNeeded != nil {
+		conf.RebalanceNeeded(err)
+	}
+}
+
+// loop sends heartbeats until stopped, returning nil, or until the member
+// must rejoin the group, returning the error reported by the coordinator.
+func (h *GroupHeartbeat) loop(b *Broker, conf HeartbeatConf) error {
+	clock := b.conf.Clock
+	if clock == nil {
+		clock = RealClock
+	}
+	interval := conf.Interval
+	if interval <= 0 {
+		interval = 3 * time.Second
+	}
+
+	for {
+		select {
+		case <-h.stop:
+			return nil
+		case <-clock.After(interval):
+		}
+
+		switch err := b.heartbeat(conf); err {
+		case nil:
+		case proto.ErrRebalanceInProgress, proto.ErrIllegalGeneration, proto.ErrUnknownMemberID:
+			log.Infof("heartbeat of %s member %s: %s", conf.ConsumerGroup, conf.MemberID, err)
+			return err
+		default:
+			log.Warningf("heartbeat of %s member %s failed: %s", conf.ConsumerGroup, conf.MemberID, err)
+		}
+	}
+}
+
+// heartbeat sends single heartbeat of consumer group member to the coordinator
+// of the group.
+func (b *Broker) heartbeat(conf HeartbeatConf) error {
+	conn, err := b.coordinatorConnection(conf.ConsumerGroup)
+	if err != nil {
+		return err
+	}
+	defer func(lconn *connection) { go b.conns.Idle(lconn) }(conn)
+
+	resp, err := conn.Heartbeat(&proto.HeartbeatReq{
+		ClientID:     b.conf.ClientID,
+		GroupID:      conf.ConsumerGroup,
+		GenerationID: conf.GenerationID,
+		MemberID:     conf.MemberID,
+	})
+	if err != nil {
+		if isConnectionError(err) {
+			_ = conn.Close()
+		}
+		return err
+	}
+	return resp.Err
+}
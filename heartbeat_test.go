@@ -0,0 +1,92 @@
+package kafka
+
+import (
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/dropbox/kafka/proto"
+)
+
+func (s *BrokerSuite) TestHeartbeatRebalanceNeeded(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	srv.Handle(MetadataRequest, NewMetadataHandler(srv, false).Handler())
+	srv.Handle(GroupCoordinatorRequest, func(request Serializable) Serializable {
+		req := request.(*proto.GroupCoordinatorReq)
+		host, port := srv.HostPort()
+		return &proto.GroupCoordinatorResp{
+			CorrelationID:   req.CorrelationID,
+			CoordinatorID:   1,
+			CoordinatorHost: host,
+			CoordinatorPort: int32(port),
+		}
+	})
+
+	var mu sync.Mutex
+	var heartbeats []proto.HeartbeatReq
+	srv.Handle(HeartbeatRequest, func(request Serializable) Serializable {
+		req := request.(*proto.HeartbeatReq)
+		mu.Lock()
+		defer mu.Unlock()
+		heartbeats = append(heartbeats, *req)
+		resp := &proto.HeartbeatResp{CorrelationID: req.CorrelationID}
+		// the group starts rebalancing after a few heartbeats
+		if len(heartbeats) >= 3 {
+			resp.Err = proto.ErrRebalanceInProgress
+		}
+		return resp
+	})
+
+	broker, err := Dial([]string{srv.Address()}, s.newTestBrokerConf("tester"))
+	c.Assert(err, IsNil)
+	defer broker.Close()
+
+	rebalance := make(chan error, 1)
+	conf := NewHeartbeatConf("test-group", 7, "member-1")
+	conf.Interval = 10 * time.Millisecond
+	conf.RebalanceNeeded = func(err error) { rebalance <- err }
+	h := broker.Heartbeat(conf)
+	defer h.Stop()
+
+	select {
+	case err := <-rebalance:
+		c.Assert(err, Equals, proto.ErrRebalanceInProgress)
+	case <-time.After(5 * time.Second):
+		c.Fatal("rebalance not reported")
+	}
+
+	// no more heartbeats are sent once the member must rejoin
+	h.Stop()
+	mu.Lock()
+	defer mu.Unlock()
+	c.Assert(heartbeats, HasLen, 3)
+	for _, req := range heartbeats {
+		c.Assert(req.GroupID, Equals, "test-group")
+		c.Assert(req.GenerationID, Equals, int32(7))
+		c.Assert(req.MemberID, Equals, "member-1")
+	}
+}
+
+func (s *BrokerSuite) TestHeartbeatStop(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	srv.Handle(MetadataRequest, NewMetadataHandler(srv, false).Handler())
+
+	broker, err := Dial([]string{srv.Address()}, s.newTestBrokerConf("tester"))
+	c.Assert(err, IsNil)
+	defer broker.Close()
+
+	conf := NewHeartbeatConf("test-group", 1, "member-1")
+	conf.RebalanceNeeded = func(err error) { c.Errorf("unexpected rebalance: %s", err) }
+	h := broker.Heartbeat(conf)
+
+	// stopped before the first heartbeat is due
+	h.Stop()
+	h.Stop()
+}
@@ -370,6 +370,7 @@ func (s *Server) handleProduceRequest(
 	resp := &proto.ProduceResp{
 		CorrelationID: req.CorrelationID,
 		Topics:        make([]proto.ProduceRespTopic, len(req.Topics)),
+		Version:       req.Version,
 	}
 
 	for ti, topic := range req.Topics {
@@ -414,6 +415,7 @@ func (s *Server) handleFetchRequest(
 	resp := &proto.FetchResp{
 		CorrelationID: req.CorrelationID,
 		Topics:        make([]proto.FetchRespTopic, len(req.Topics)),
+		Version:       req.Version,
 	}
 	for ti, topic := range req.Topics {
 		respParts := make([]proto.FetchRespPartition, len(topic.Partitions))
@@ -541,8 +543,13 @@ func (s *Server) handleOffsetFetchRequest(
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if req.AllPartitions {
+		return s.allOffsetsFetchResponse(req)
+	}
+
 	resp := &proto.OffsetFetchResp{
 		CorrelationID: req.CorrelationID,
+		Version:       req.Version,
 		Topics:        make([]proto.OffsetFetchRespTopic, len(req.Topics)),
 	}
 	for ti, topic := range req.Topics {
@@ -561,6 +568,38 @@ func (s *Server) handleOffsetFetchRequest(
 	return resp
 }
 
+// allOffsetsFetchResponse returns offsets committed by the consumer group to
+// any partition. Must be called with the lock held.
+func (s *Server) allOffsetsFetchResponse(req *proto.OffsetFetchReq) response {
+	resp := &proto.OffsetFetchResp{
+		CorrelationID: req.CorrelationID,
+		Version:       req.Version,
+		Topics:        []proto.OffsetFetchRespTopic{},
+	}
+	for topic, pmap := range s.offsets {
+		var parts []proto.OffsetFetchRespPartition
+		for partID, groups := range pmap {
+			toffset, ok := groups[req.ConsumerGroup]
+			if !ok {
+				continue
+			}
+			parts = append(parts, proto.OffsetFetchRespPartition{
+				ID:       partID,
+				Offset:   toffset.offset,
+				Metadata: toffset.metadata,
+			})
+		}
+		if len(parts) != 0 {
+			resp.Topics = append(resp.Topics, proto.OffsetFetchRespTopic{
+				Name:       topic,
+				Partitions: parts,
+			})
+		}
+	}
+	log.Infof("requested committed offsets of all partitions for group %s", req.ConsumerGroup)
+	return resp
+}
+
 func (s *Server) handleOffsetCommitRequest(
 	nodeID int32, conn net.Conn, req *proto.OffsetCommitReq) response {
 
@@ -598,6 +637,7 @@ func (s *Server) handleMetadataRequest(
 
 	resp := &proto.MetadataResp{
 		CorrelationID: req.CorrelationID,
+		Version:       req.Version,
 		Topics:        make([]proto.MetadataRespTopic, 0, len(s.topics)),
 		Brokers:       s.brokers,
 	}
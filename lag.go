@@ -0,0 +1,186 @@
+package kafka
+
+import (
+	"sort"
+
+	"github.com/dropbox/kafka/proto"
+)
+
+// PartitionLag is the lag of a consumer group on single partition, as
+// returned by ConsumerLag.
+type PartitionLag struct {
+	Topic     string
+	Partition int32
+
+	// Committed is the offset committed by the group, or -1 if there is
+	// none.
+	Committed int64
+	// Latest is the offset the next message written to the partition gets.
+	Latest int64
+	// Lag is the number of messages the group has yet to consume. Without
+	// committed offset, it is the number of messages in the partition.
+	Lag int64
+
+	// Err is set if the lag of the partition could not be computed, in
+	// which case the offsets are not valid.
+	Err error
+}
+
+// ConsumerLag returns the lag of given consumer group on every partition of
+// the assignments, sorted by topic and partition. Committed offsets are
+// fetched with single offset fetch request and latest offsets with single
+// offset request, so the connection must be to both the coordinator of the
+// group and the leader of all the partitions. Oldest offsets of partitions
+// without committed offset are fetched with one more offset request.
+//
+// Errors of single partitions are reported with their lag, error is returned
+// only if any of the requests failed as a whole.
+func (c *connection) ConsumerLag(clientID, group string, assignments map[string][]int32) ([]PartitionLag, error) {
+	topics := make([]string, 0, len(assignments))
+	for topic := range assignments {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+
+	fetchReq := &proto.OffsetFetchReq{
+		ClientID:      clientID,
+		ConsumerGroup: group,
+		Topics:        make([]proto.OffsetFetchReqTopic, 0, len(topics)),
+	}
+	for _, topic := range topics {
+		fetchReq.Topics = append(fetchReq.Topics, proto.OffsetFetchReqTopic{
+			Name:       topic,
+			Partitions: assignments[topic],
+		})
+	}
+	fetchResp, err := c.OffsetFetch(fetchReq)
+	if err != nil {
+		return nil, err
+	}
+	if fetchResp.Err != nil {
+		return nil, fetchResp.Err
+	}
+	committed := make(map[topicPartition]proto.OffsetFetchRespPartition)
+	for _, t := range fetchResp.Topics {
+		for _, p := range t.Partitions {
+			committed[topicPartition{t.Name, p.ID}] = p
+		}
+	}
+
+	latest, err := c.partitionOffsets(clientID, topics, assignments, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	var lags []PartitionLag
+	uncommitted := make(map[string][]int32)
+	for _, topic := range topics {
+		for _, partition := range assignments[topic] {
+			tp := topicPartition{topic, partition}
+			lag := PartitionLag{Topic: topic, Partition: partition, Committed: -1}
+			if p, ok := committed[tp]; !ok {
+				lag.Err = proto.ErrUnknownTopicOrPartition
+			} else if p.Err != nil {
+				lag.Err = p.Err
+			} else {
+				lag.Committed = p.Offset
+			}
+			if p, ok := latest[tp]; !ok {
+				lag.Err = proto.ErrUnknownTopicOrPartition
+			} else if lag.Err == nil {
+				lag.Latest, lag.Err = p.offset()
+			}
+			// the lag of partitions without committed offset is counted
+			// from their oldest offset
+			if lag.Err == nil && lag.Committed < 0 {
+				uncommitted[topic] = append(uncommitted[topic], partition)
+			}
+			lags = append(lags, lag)
+		}
+	}
+
+	var oldest map[topicPartition]offsetRespPartition
+	if len(uncommitted) != 0 {
+		oldestTopics := make([]string, 0, len(uncommitted))
+		for topic := range uncommitted {
+			oldestTopics = append(oldestTopics, topic)
+		}
+		sort.Strings(oldestTopics)
+		oldest, err = c.partitionOffsets(clientID, oldestTopics, uncommitted, -2)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for i := range lags {
+		lag := &lags[i]
+		if lag.Err != nil {
+			continue
+		}
+		from := lag.Committed
+		if from < 0 {
+			p, ok := oldest[topicPartition{lag.Topic, lag.Partition}]
+			if !ok {
+				lag.Err = proto.ErrUnknownTopicOrPartition
+				continue
+			}
+			if from, lag.Err = p.offset(); lag.Err != nil {
+				continue
+			}
+		}
+		if lag.Lag = lag.Latest - from; lag.Lag < 0 {
+			// offset committed after the latest offset was fetched
+			lag.Lag = 0
+		}
+	}
+	return lags, nil
+}
+
+// partitionOffsets sends single offset request for given partitions of the
+// topics and returns the partitions of the response. Use timems to specify
+// which offset should be returned.
+func (c *connection) partitionOffsets(clientID string, topics []string, partitions map[string][]int32, timems int64) (map[topicPartition]offsetRespPartition, error) {
+	req := &proto.OffsetReq{
+		ClientID:  clientID,
+		ReplicaID: -1, // any client
+		Topics:    make([]proto.OffsetReqTopic, 0, len(topics)),
+	}
+	for _, topic := range topics {
+		t := proto.OffsetReqTopic{Name: topic}
+		for _, partition := range partitions[topic] {
+			t.Partitions = append(t.Partitions, proto.OffsetReqPartition{
+				ID:         partition,
+				TimeMs:     timems,
+				MaxOffsets: 1,
+			})
+		}
+		req.Topics = append(req.Topics, t)
+	}
+	resp, err := c.Offset(req)
+	if err != nil {
+		return nil, err
+	}
+	offsets := make(map[topicPartition]offsetRespPartition)
+	for _, t := range resp.Topics {
+		for _, p := range t.Partitions {
+			offsets[topicPartition{t.Name, p.ID}] = offsetRespPartition(p)
+		}
+	}
+	return offsets, nil
+}
+
+// offsetRespPartition is a partition of offset response, that was asked for
+// single offset.
+type offsetRespPartition proto.OffsetRespPartition
+
+// offset returns the offset of the partition. Partition without messages
+// has offset 0.
+func (p offsetRespPartition) offset() (int64, error) {
+	if p.Err != nil {
+		return 0, p.Err
+	}
+	if len(p.Offsets) == 0 {
+		return 0, nil
+	}
+	return p.Offsets[0], nil
+}
@@ -0,0 +1,101 @@
+package kafka
+
+import (
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/dropbox/kafka/proto"
+)
+
+func (s *ConnectionSuite) TestConnectionConsumerLag(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	committed := map[topicPartition]int64{
+		{"a", 0}: 40,
+		{"a", 1}: -1, // nothing committed
+		{"a", 2}: 10,
+		{"b", 0}: 120,
+	}
+	latest := map[topicPartition]int64{
+		{"a", 0}: 100,
+		{"a", 1}: 50,
+		{"b", 0}: 100,
+	}
+	oldest := map[topicPartition]int64{
+		{"a", 1}: 10,
+	}
+
+	srv.Handle(OffsetFetchRequest, func(request Serializable) Serializable {
+		req := request.(*proto.OffsetFetchReq)
+		c.Check(req.ConsumerGroup, Equals, "group")
+		resp := &proto.OffsetFetchResp{CorrelationID: req.CorrelationID, Version: req.Version}
+		for _, t := range req.Topics {
+			rt := proto.OffsetFetchRespTopic{Name: t.Name}
+			for _, id := range t.Partitions {
+				rt.Partitions = append(rt.Partitions, proto.OffsetFetchRespPartition{
+					ID:     id,
+					Offset: committed[topicPartition{t.Name, id}],
+				})
+			}
+			resp.Topics = append(resp.Topics, rt)
+		}
+		return resp
+	})
+
+	var mu sync.Mutex
+	var oldestAsked []topicPartition
+	srv.Handle(OffsetRequest, func(request Serializable) Serializable {
+		req := request.(*proto.OffsetReq)
+		resp := &proto.OffsetResp{CorrelationID: req.CorrelationID}
+		for _, t := range req.Topics {
+			rt := proto.OffsetRespTopic{Name: t.Name}
+			for _, p := range t.Partitions {
+				tp := topicPartition{t.Name, p.ID}
+				offsets := latest
+				if p.TimeMs == -2 {
+					offsets = oldest
+					mu.Lock()
+					oldestAsked = append(oldestAsked, tp)
+					mu.Unlock()
+				}
+				rp := proto.OffsetRespPartition{ID: p.ID}
+				if offset, ok := offsets[tp]; ok {
+					rp.Offsets = []int64{offset}
+				} else {
+					rp.Err = proto.ErrNotLeaderForPartition
+				}
+				rt.Partitions = append(rt.Partitions, rp)
+			}
+			resp.Topics = append(resp.Topics, rt)
+		}
+		return resp
+	})
+
+	conn, err := newTCPConnection(srv.Address(), time.Second)
+	if err != nil {
+		c.Fatalf("could not conect to test server: %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	lags, err := conn.ConsumerLag("tester", "group", map[string][]int32{
+		"b": {0},
+		"a": {0, 1, 2},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(lags, DeepEquals, []PartitionLag{
+		{Topic: "a", Partition: 0, Committed: 40, Latest: 100, Lag: 60},
+		// lag of the whole log
+		{Topic: "a", Partition: 1, Committed: -1, Latest: 50, Lag: 40},
+		{Topic: "a", Partition: 2, Committed: 10, Err: proto.ErrNotLeaderForPartition},
+		// committed after the latest offset was fetched
+		{Topic: "b", Partition: 0, Committed: 120, Latest: 100, Lag: 0},
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+	c.Assert(oldestAsked, DeepEquals, []topicPartition{{"a", 1}})
+}
@@ -0,0 +1,154 @@
+package kafka
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dropbox/kafka/proto"
+	"github.com/jpillora/backoff"
+)
+
+// ErrLeaderMoved is returned when a broker refused a request for a partition,
+// because it is no longer its leader. Metadata was already refreshed when it
+// is returned, so that the request can be redirected to the new leader.
+type ErrLeaderMoved struct {
+	Topic     string
+	Partition int32
+
+	// Err is the error returned by the broker for the partition.
+	Err error
+}
+
+func (e *ErrLeaderMoved) Error() string {
+	return fmt.Sprintf("leader of %s:%d moved: %s", e.Topic, e.Partition, e.Err)
+}
+
+func (e *ErrLeaderMoved) Unwrap() error {
+	return e.Err
+}
+
+// isLeaderMoved returns whether given partition error means that the request
+// was routed using stale metadata, so that the leader of the partition has to
+// be looked up again in refreshed metadata before the request is retried.
+// Unknown topic or partition is not included, as it is also returned for
+// topics that do not exist.
+func isLeaderMoved(err error) bool {
+	switch err {
+	case proto.ErrBrokerNotAvailable:
+		return true
+	case proto.ErrUnknownTopicOrPartition:
+		return false
+	}
+	kerr, ok := err.(*proto.KafkaError)
+	return ok && proto.RequiresMetadataRefresh(int16(kerr.Errno()))
+}
+
+// leaderMoved returns ErrLeaderMoved if given partition error means that the
+// partition leadership moved away from the broker, calling refresh first so
+// that the new leader can be found. Any other error is returned unchanged.
+func leaderMoved(topic string, partition int32, err error, refresh func() error) error {
+	if !isLeaderMoved(err) {
+		return err
+	}
+	if refresh != nil {
+		if rerr := refresh(); rerr != nil {
+			log.Debugf("cannot refresh metadata: %s", rerr)
+		}
+	}
+	return &ErrLeaderMoved{Topic: topic, Partition: partition, Err: err}
+}
+
+// leaderRetry sends requests of single partition to the leader of the
+// partition, retrying them against the new leader whenever the leadership
+// moved.
+type leaderRetry struct {
+	// leader returns connection to the current leader of the partition,
+	// which is given back with release once the request is done.
+	leader  func(topic string, partition int32) (*connection, error)
+	release func(conn *connection)
+	// refresh refreshes metadata the leader is looked up in.
+	refresh func() error
+
+	limit int
+	wait  time.Duration
+}
+
+// fetch sends given fetch request of single partition to the leader of the
+// partition. Requests failed because of a broken connection, or because the
+// metadata the leader was found in is stale, are retried up to the limit,
+// with exponential backoff. Metadata is refreshed before retrying in the
+// latter case. Any other partition error is returned in the response.
+func (r *leaderRetry) fetch(req *proto.FetchReq) (*proto.FetchResp, error) {
+	if len(req.Topics) != 1 || len(req.Topics[0].Partitions) != 1 {
+		return nil, errors.New("fetch request must be of single partition")
+	}
+	topic, partition := req.Topics[0].Name, req.Topics[0].Partitions[0].ID
+
+	var resErr error
+	retry := &backoff.Backoff{Min: r.wait, Jitter: true}
+	for try := 0; try < r.limit; try++ {
+		if try != 0 {
+			time.Sleep(retry.Duration())
+		}
+
+		conn, err := r.leader(topic, partition)
+		if err != nil {
+			resErr = err
+			continue
+		}
+		resp, err := conn.Fetch(req)
+		if err != nil {
+			if isConnectionError(err) {
+				log.Debugf("connection died while fetching %s:%d (try %d): %s",
+					topic, partition, try, err)
+				_ = conn.Close()
+				r.release(conn)
+				resErr = err
+				continue
+			}
+			r.release(conn)
+			return nil, err
+		}
+		r.release(conn)
+
+		var perr error
+		found := false
+		for _, t := range resp.Topics {
+			for _, p := range t.Partitions {
+				if t.Name == topic && p.ID == partition {
+					perr, found = p.Err, true
+				}
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("no result for %s:%d in fetch response", topic, partition)
+		}
+		if isLeaderMoved(perr) {
+			log.Debugf("cannot fetch %s:%d (try %d): %s", topic, partition, try, perr)
+			resErr = leaderMoved(topic, partition, perr, r.refresh)
+			continue
+		}
+		return resp, nil
+	}
+	return nil, resErr
+}
+
+// FetchWithRetry sends given fetch request of single partition to the leader
+// of the partition. If the leadership of the partition moved, for example
+// with proto.ErrNotLeaderForPartition or proto.ErrLeaderNotAvailable, or the
+// connection broke, metadata is refreshed and the request is retried against
+// the new leader, up to LeaderRetryLimit times, waiting LeaderRetryWait with
+// exponential backoff between tries. ErrLeaderMoved is returned if the
+// leader could not be reached in the end. Any other partition error is
+// returned in the response.
+func (b *Broker) FetchWithRetry(req *proto.FetchReq) (*proto.FetchResp, error) {
+	r := &leaderRetry{
+		leader:  b.leaderConnection,
+		release: func(conn *connection) { go b.conns.Idle(conn) },
+		refresh: b.metadata.Refresh,
+		limit:   b.conf.LeaderRetryLimit,
+		wait:    b.conf.LeaderRetryWait,
+	}
+	return r.fetch(req)
+}
@@ -0,0 +1,178 @@
+package kafka
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/dropbox/kafka/proto"
+)
+
+func (s *BrokerSuite) TestProducerLeaderMoved(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	var refreshes int32
+	md := NewMetadataHandler(srv, false).Handler()
+	srv.Handle(MetadataRequest, func(request Serializable) Serializable {
+		atomic.AddInt32(&refreshes, 1)
+		return md(request)
+	})
+	srv.Handle(ProduceRequest, func(request Serializable) Serializable {
+		req := request.(*proto.ProduceReq)
+		return &proto.ProduceResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.ProduceRespTopic{{
+				Name:       "test",
+				Partitions: []proto.ProduceRespPartition{{ID: 0, Err: proto.ErrNotLeaderForPartition}},
+			}},
+		}
+	})
+
+	broker, err := Dial([]string{srv.Address()}, s.newTestBrokerConf("tester"))
+	c.Assert(err, IsNil)
+	defer broker.Close()
+	dialRefreshes := atomic.LoadInt32(&refreshes)
+
+	producer := broker.Producer(NewProducerConf())
+	_, err = producer.Produce("test", 0, &proto.Message{Value: []byte("first")})
+	moved, ok := err.(*ErrLeaderMoved)
+	c.Assert(ok, Equals, true)
+	c.Assert(moved.Topic, Equals, "test")
+	c.Assert(moved.Partition, Equals, int32(0))
+	c.Assert(moved.Err, Equals, proto.ErrNotLeaderForPartition)
+	c.Assert(errors.Is(err, proto.ErrNotLeaderForPartition), Equals, true)
+	// metadata is refreshed before returning
+	c.Assert(atomic.LoadInt32(&refreshes) > dialRefreshes, Equals, true)
+}
+
+func (s *BrokerSuite) TestConsumerLeaderMoved(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	var refreshes int32
+	md := NewMetadataHandler(srv, false).Handler()
+	srv.Handle(MetadataRequest, func(request Serializable) Serializable {
+		atomic.AddInt32(&refreshes, 1)
+		return md(request)
+	})
+	var fetches int32
+	srv.Handle(FetchRequest, func(request Serializable) Serializable {
+		atomic.AddInt32(&fetches, 1)
+		req := request.(*proto.FetchReq)
+		return &proto.FetchResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.FetchRespTopic{{
+				Name:       "test",
+				Partitions: []proto.FetchRespPartition{{ID: 0, Err: proto.ErrLeaderNotAvailable, TipOffset: -1}},
+			}},
+		}
+	})
+
+	broker, err := Dial([]string{srv.Address()}, s.newTestBrokerConf("tester"))
+	c.Assert(err, IsNil)
+	defer broker.Close()
+
+	conf := NewConsumerConf("test", 0)
+	conf.StartOffset = 0
+	conf.RetryErrLimit = 3
+	conf.RetryErrWait = time.Millisecond
+	consumer, err := broker.Consumer(conf)
+	c.Assert(err, IsNil)
+	dialRefreshes := atomic.LoadInt32(&refreshes)
+
+	_, err = consumer.Consume()
+	moved, ok := err.(*ErrLeaderMoved)
+	c.Assert(ok, Equals, true)
+	c.Assert(moved.Topic, Equals, "test")
+	c.Assert(moved.Partition, Equals, int32(0))
+	c.Assert(moved.Err, Equals, proto.ErrLeaderNotAvailable)
+	c.Assert(atomic.LoadInt32(&fetches), Equals, int32(3))
+	c.Assert(atomic.LoadInt32(&refreshes)-dialRefreshes, Equals, int32(3))
+}
+
+func (s *ConnectionSuite) TestLeaderRetryFetch(c *C) {
+	oldLeader := NewServer()
+	oldLeader.Start()
+	defer oldLeader.Close()
+	newLeader := NewServer()
+	newLeader.Start()
+	defer newLeader.Close()
+
+	oldLeader.Handle(FetchRequest, func(request Serializable) Serializable {
+		req := request.(*proto.FetchReq)
+		return &proto.FetchResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.FetchRespTopic{{
+				Name:       "test",
+				Partitions: []proto.FetchRespPartition{{ID: 1, Err: proto.ErrNotLeaderForPartition, TipOffset: -1}},
+			}},
+		}
+	})
+	newLeader.Handle(FetchRequest, func(request Serializable) Serializable {
+		req := request.(*proto.FetchReq)
+		p := proto.FetchRespPartition{ID: 1, TipOffset: 5, Messages: []*proto.Message{{Offset: 4, Value: []byte("a")}}}
+		if req.Topics[0].Partitions[0].FetchOffset > 4 {
+			p = proto.FetchRespPartition{ID: 1, Err: proto.ErrOffsetOutOfRange, TipOffset: -1}
+		}
+		return &proto.FetchResp{
+			CorrelationID: req.CorrelationID,
+			Topics:        []proto.FetchRespTopic{{Name: "test", Partitions: []proto.FetchRespPartition{p}}},
+		}
+	})
+
+	leader := oldLeader.Address()
+	var leaders []string
+	refreshes := 0
+	r := &leaderRetry{
+		leader: func(topic string, partition int32) (*connection, error) {
+			leaders = append(leaders, leader)
+			return newTCPConnection(leader, time.Second)
+		},
+		release: func(conn *connection) { _ = conn.Close() },
+		refresh: func() error {
+			refreshes++
+			leader = newLeader.Address()
+			return nil
+		},
+		limit: 3,
+		wait:  time.Millisecond,
+	}
+
+	req := func(offset int64) *proto.FetchReq {
+		return &proto.FetchReq{
+			ClientID: "tester",
+			Topics: []proto.FetchReqTopic{{
+				Name:       "test",
+				Partitions: []proto.FetchReqPartition{{ID: 1, FetchOffset: offset, MaxBytes: 1024}},
+			}},
+		}
+	}
+
+	resp, err := r.fetch(req(4))
+	c.Assert(err, IsNil)
+	c.Assert(resp.Topics[0].Partitions[0].Messages, HasLen, 1)
+	c.Assert(leaders, DeepEquals, []string{oldLeader.Address(), newLeader.Address()})
+	c.Assert(refreshes, Equals, 1)
+
+	// other partition errors are not retried
+	resp, err = r.fetch(req(10))
+	c.Assert(err, IsNil)
+	c.Assert(resp.Topics[0].Partitions[0].Err, Equals, proto.ErrOffsetOutOfRange)
+	c.Assert(refreshes, Equals, 1)
+
+	// leader that cannot be found in the end is reported
+	r.refresh = func() error { return nil }
+	leader = oldLeader.Address()
+	_, err = r.fetch(req(4))
+	moved, ok := err.(*ErrLeaderMoved)
+	c.Assert(ok, Equals, true)
+	c.Assert(moved.Err, Equals, proto.ErrNotLeaderForPartition)
+
+	_, err = r.fetch(&proto.FetchReq{})
+	c.Assert(err, NotNil)
+}
@@ -3,6 +3,9 @@ package kafka
 import (
 	"errors"
 	"fmt"
+	"net"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -10,6 +13,16 @@ import (
 	"github.com/dropbox/kafka/proto"
 )
 
+// normalizeBrokerAddr returns the address to dial broker advertised with given
+// host and port. IPv6 literals are enclosed in brackets, whether or not the
+// broker already advertised them that way.
+func normalizeBrokerAddr(host string, port int32) string {
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		host = host[1 : len(host)-1]
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port)))
+}
+
 type clusterMetadata struct {
 	conns *connectionPool
 	conf  BrokerConf
@@ -74,7 +87,7 @@ func (cm *clusterMetadata) cache(resp *proto.MetadataResp) {
 
 	addrs := make([]string, 0)
 	for _, node := range resp.Brokers {
-		addr := fmt.Sprintf("%s:%d", node.Host, node.Port)
+		addr := normalizeBrokerAddr(node.Host, node.Port)
 		addrs = append(addrs, addr)
 		cm.nodes[node.NodeID] = addr
 	}
@@ -136,7 +149,8 @@ func (cm *clusterMetadata) Refresh() error {
 // Fetch is requesting metadata information from any node and return
 // protocol response if successful. This will attempt to talk to every node at
 // least once until one returns a successful response. We walk the nodes in
-// a random order.
+// a random order. If MetadataFetchBrokers is above one, that many nodes are
+// asked at once and their responses reconciled.
 //
 // If "topics" are specified, only fetch metadata for those topics (can be
 // used to create a topic)
@@ -144,17 +158,22 @@ func (cm *clusterMetadata) Fetch(topics ...string) (*proto.MetadataResp, error)
 	// Get all addresses, then walk the array in permuted random order.
 	addrs := cm.conns.GetAllAddrs()
 	log.Infof("metadata fetch addrs: %s", addrs)
+	req := &proto.MetadataReq{
+		ClientID: cm.conf.ClientID,
+		Topics:   topics,
+	}
+	if cm.conf.MetadataFetchBrokers > 1 {
+		return cm.fetchParallel(addrs, req)
+	}
+	dialErr := &DialError{}
 	for _, idx := range rndPerm(len(addrs)) {
-		// Directly connect, ignoring connection pool limits. This connection must be closed here.
-		conn, err := newTCPConnection(addrs[idx], cm.getTimeout())
+		conn, err := cm.dial(addrs[idx])
 		if err != nil {
-			log.Warningf("metadata fetch failed to connect to node %s: %s", addrs[idx], err)
+			dialErr.Addrs = append(dialErr.Addrs, addrs[idx])
+			dialErr.Errs = append(dialErr.Errs, err)
 			continue
 		}
-		resp, err := conn.Metadata(&proto.MetadataReq{
-			ClientID: cm.conf.ClientID,
-			Topics:   topics,
-		})
+		resp, err := conn.Metadata(req)
 		conn.Close()
 		if err != nil {
 			log.Warningf("cannot fetch metadata from node %s: %s", addrs[idx], err)
@@ -163,9 +182,165 @@ func (cm *clusterMetadata) Fetch(topics ...string) (*proto.MetadataResp, error)
 		return resp, nil
 	}
 
+	if len(dialErr.Addrs) == len(addrs) {
+		return nil, dialErr
+	}
 	return nil, errors.New("cannot fetch metadata")
 }
 
+// fetchParallel works like Fetch, but asks MetadataFetchBrokers nodes at once
+// and reconciles their responses.
+func (cm *clusterMetadata) fetchParallel(addrs []string, req *proto.MetadataReq) (*proto.MetadataResp, error) {
+	var conns []metadataSource
+	for _, idx := range rndPerm(len(addrs)) {
+		if len(conns) == cm.conf.MetadataFetchBrokers {
+			break
+		}
+		conn, err := cm.dial(addrs[idx])
+		if err != nil {
+			continue
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	if len(conns) == 0 {
+		return nil, errors.New("cannot fetch metadata")
+	}
+	return fetchMetadataParallel(conns, req)
+}
+
+// dial returns new connection to given address, to be used for fetching
+// metadata. Connection is made directly, ignoring connection pool limits, so
+// it must be closed by the caller. It is configured like connections of the
+// pool, but dialed within the metadata refresh timeout.
+func (cm *clusterMetadata) dial(addr string) (*connection, error) {
+	conf := cm.conf
+	conf.DialTimeout = cm.getTimeout()
+	conn, err := dialBrokerConnection(addr, conf)
+	if err != nil {
+		log.Warningf("metadata fetch failed to connect to node %s: %s", addr, err)
+		return nil, err
+	}
+	return conn, nil
+}
+
+// metadataSource is a connection metadata can be requested from.
+type metadataSource interface {
+	Metadata(req *proto.MetadataReq) (*proto.MetadataResp, error)
+}
+
+// fetchMetadataParallel sends given metadata request to all connections
+// concurrently and returns their responses reconciled with
+// reconcileMetadata. Error is returned only if no connection answered.
+func fetchMetadataParallel(conns []metadataSource, req *proto.MetadataReq) (*proto.MetadataResp, error) {
+	resps := make([]*proto.MetadataResp, len(conns))
+	errs := make([]error, len(conns))
+	var wg sync.WaitGroup
+	for i, conn := range conns {
+		wg.Add(1)
+		go func(i int, conn metadataSource) {
+			defer wg.Done()
+			// every connection sets its own correlation ID and version
+			r := *req
+			resps[i], errs[i] = conn.Metadata(&r)
+		}(i, conn)
+	}
+	wg.Wait()
+
+	var ok []*proto.MetadataResp
+	for i, resp := range resps {
+		if errs[i] != nil {
+			log.Warningf("cannot fetch metadata: %s", errs[i])
+			continue
+		}
+		ok = append(ok, resp)
+	}
+	if len(ok) == 0 {
+		return nil, errors.New("cannot fetch metadata")
+	}
+	return reconcileMetadata(ok), nil
+}
+
+// reconcileMetadata picks the most trustworthy of given metadata responses
+// of different brokers. Responses reporting a controller that is one of their
+// brokers are preferred, then those whose controller most other responses
+// agree on, then those listing more brokers. Topics missing from the picked
+// response are taken from the others, as a broker may not know about topics
+// created recently, together with the brokers leading their partitions.
+// Partitions of topics are never mixed between responses.
+func reconcileMetadata(resps []*proto.MetadataResp) *proto.MetadataResp {
+	votes := make(map[int32]int)
+	for _, resp := range resps {
+		if hasValidController(resp) {
+			votes[resp.ControllerID]++
+		}
+	}
+	better := func(a, b *proto.MetadataResp) bool {
+		if va, vb := hasValidController(a), hasValidController(b); va != vb {
+			return va
+		}
+		if va, vb := votes[a.ControllerID], votes[b.ControllerID]; va != vb {
+			return va > vb
+		}
+		return len(a.Brokers) > len(b.Brokers)
+	}
+	best := resps[0]
+	for _, resp := range resps[1:] {
+		if better(resp, best) {
+			best = resp
+		}
+	}
+
+	merged := *best
+	merged.Brokers = append([]proto.MetadataRespBroker(nil), best.Brokers...)
+	merged.Topics = append([]proto.MetadataRespTopic(nil), best.Topics...)
+	listed := make(map[int32]bool, len(best.Brokers))
+	for _, b := range best.Brokers {
+		listed[b.NodeID] = true
+	}
+	known := make(map[string]bool, len(best.Topics))
+	for _, topic := range best.Topics {
+		known[topic.Name] = true
+	}
+	for _, resp := range resps {
+		for _, topic := range resp.Topics {
+			if known[topic.Name] || topic.Err != nil {
+				continue
+			}
+			known[topic.Name] = true
+			merged.Topics = append(merged.Topics, topic)
+			// leaders must be listed, otherwise they cannot be connected to
+			for _, part := range topic.Partitions {
+				if part.Leader < 0 || listed[part.Leader] {
+					continue
+				}
+				for _, b := range resp.Brokers {
+					if b.NodeID == part.Leader {
+						listed[b.NodeID] = true
+						merged.Brokers = append(merged.Brokers, b)
+					}
+				}
+			}
+		}
+	}
+	return &merged
+}
+
+// hasValidController returns whether given metadata response reports a
+// controller that is one of the brokers it lists. Responses of version 0 carry
+// no controller, and their ControllerID is always 0.
+func hasValidController(resp *proto.MetadataResp) bool {
+	if resp.Version < 1 || resp.ControllerID < 0 {
+		return false
+	}
+	for _, b := range resp.Brokers {
+		if b.NodeID == resp.ControllerID {
+			return true
+		}
+	}
+	return false
+}
+
 // PartitionCount returns how many partitions a given topic has. If a topic
 // is not known, 0 and an error are returned.
 func (cm *clusterMetadata) PartitionCount(topic string) (int32, error) {
@@ -0,0 +1,122 @@
+package kafka
+
+import (
+	"errors"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/dropbox/kafka/proto"
+)
+
+var _ = Suite(&MetadataSuite{})
+
+type MetadataSuite struct{}
+
+func (s *MetadataSuite) SetUpTest(c *C) {
+	ResetTestLogger(c)
+}
+
+// staticMetadataConn answers every metadata request with the same response.
+type staticMetadataConn struct {
+	resp *proto.MetadataResp
+	err  error
+}
+
+func (c *staticMetadataConn) Metadata(req *proto.MetadataReq) (*proto.MetadataResp, error) {
+	return c.resp, c.err
+}
+
+func (s *MetadataSuite) TestFetchMetadataParallel(c *C) {
+	brokers := []proto.MetadataRespBroker{
+		{NodeID: 1, Host: "localhost", Port: 9092},
+		{NodeID: 2, Host: "localhost", Port: 9093},
+	}
+	// broker that has not caught up with the cluster yet
+	stale := &proto.MetadataResp{
+		Version:      1,
+		Brokers:      brokers[:1],
+		ControllerID: 2,
+		Topics: []proto.MetadataRespTopic{
+			{Name: "a", Partitions: []proto.MetadataRespPartition{{ID: 0, Leader: 2}}},
+			{Name: "old", Partitions: []proto.MetadataRespPartition{{ID: 0, Leader: 1}}},
+		},
+	}
+	consistent := &proto.MetadataResp{
+		Version:      1,
+		Brokers:      brokers,
+		ControllerID: 2,
+		Topics: []proto.MetadataRespTopic{
+			{Name: "a", Partitions: []proto.MetadataRespPartition{{ID: 0, Leader: 1}}},
+		},
+	}
+	conns := []metadataSource{
+		&staticMetadataConn{resp: stale},
+		&staticMetadataConn{err: errors.New("broken")},
+		&staticMetadataConn{resp: consistent},
+	}
+
+	resp, err := fetchMetadataParallel(conns, &proto.MetadataReq{ClientID: "tester"})
+	c.Assert(err, IsNil)
+	c.Assert(resp.Brokers, DeepEquals, brokers)
+	c.Assert(resp.ControllerID, Equals, int32(2))
+	c.Assert(resp.Topics, DeepEquals, []proto.MetadataRespTopic{
+		{Name: "a", Partitions: []proto.MetadataRespPartition{{ID: 0, Leader: 1}}},
+		// only known to the other broker
+		{Name: "old", Partitions: []proto.MetadataRespPartition{{ID: 0, Leader: 1}}},
+	})
+	// responses are not modified
+	c.Assert(consistent.Topics, HasLen, 1)
+
+	_, err = fetchMetadataParallel(conns[1:2], &proto.MetadataReq{ClientID: "tester"})
+	c.Assert(err, NotNil)
+}
+
+func (s *MetadataSuite) TestReconcileMetadataControllerVotes(c *C) {
+	brokers := []proto.MetadataRespBroker{
+		{NodeID: 1, Host: "localhost", Port: 9092},
+		{NodeID: 2, Host: "localhost", Port: 9093},
+		{NodeID: 3, Host: "localhost", Port: 9094},
+	}
+	outvoted := &proto.MetadataResp{Version: 1, Brokers: brokers, ControllerID: 1}
+	agreed := &proto.MetadataResp{Version: 1, Brokers: brokers[1:], ControllerID: 3}
+	resp := reconcileMetadata([]*proto.MetadataResp{
+		outvoted,
+		agreed,
+		{Version: 1, Brokers: brokers, ControllerID: 3},
+		// no controller at all
+		{Version: 1, Brokers: brokers, ControllerID: -1},
+	})
+	c.Assert(resp.ControllerID, Equals, int32(3))
+	c.Assert(resp.Brokers, HasLen, 3)
+}
+
+func (s *MetadataSuite) TestReconcileMetadataV0(c *C) {
+	brokers := []proto.MetadataRespBroker{
+		{NodeID: 0, Host: "localhost", Port: 9092},
+		{NodeID: 1, Host: "localhost", Port: 9093},
+		{NodeID: 2, Host: "localhost", Port: 9094},
+	}
+	// version 0 has no controller, so decoded ControllerID is 0 even though
+	// broker 0 is listed
+	partial := &proto.MetadataResp{
+		Brokers: brokers[:1],
+		Topics: []proto.MetadataRespTopic{
+			{Name: "new", Partitions: []proto.MetadataRespPartition{{ID: 0, Leader: 0}}},
+		},
+	}
+	complete := &proto.MetadataResp{
+		Brokers: brokers[1:],
+		Topics: []proto.MetadataRespTopic{
+			{Name: "a", Partitions: []proto.MetadataRespPartition{{ID: 0, Leader: 1}}},
+		},
+	}
+	resp := reconcileMetadata([]*proto.MetadataResp{partial, complete})
+	c.Assert(resp.Topics, DeepEquals, []proto.MetadataRespTopic{
+		{Name: "a", Partitions: []proto.MetadataRespPartition{{ID: 0, Leader: 1}}},
+		{Name: "new", Partitions: []proto.MetadataRespPartition{{ID: 0, Leader: 0}}},
+	})
+	// leader of the merged topic is listed
+	c.Assert(resp.Brokers, DeepEquals, []proto.MetadataRespBroker{brokers[1], brokers[2], brokers[0]})
+	// responses are not modified
+	c.Assert(complete.Brokers, HasLen, 2)
+}
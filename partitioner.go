@@ -0,0 +1,93 @@
+package kafka
+
+import (
+	"sync/atomic"
+)
+
+// Partitioner chooses the partition a message is produced to.
+type Partitioner interface {
+	// Partition returns the index of the partition, from 0 to partitions-1,
+	// for message with given key. Partitioners choosing by the number of
+	// partitions return 0 if it is not positive.
+	Partition(key []byte, partitions int32) int32
+}
+
+var (
+	_ Partitioner = Murmur2Partitioner{}
+	_ Partitioner = &RoundRobinPartitioner{}
+	_ Partitioner = ManualPartitioner(0)
+)
+
+// Murmur2Partitioner chooses the partition by the murmur2 hash of the key,
+// the same way the default partitioner of the Java client does for messages
+// with a key, so that messages land on the same partitions as those produced
+// by Java producers. Nil key is hashed as empty one.
+type Murmur2Partitioner struct{}
+
+func (Murmur2Partitioner) Partition(key []byte, partitions int32) int32 {
+	if partitions <= 0 {
+		return 0
+	}
+	return int32(murmur2(key)&0x7fffffff) % partitions
+}
+
+// murmur2 returns the murmur2 hash of given data, matching
+// org.apache.kafka.common.utils.Utils.murmur2 of the Java client.
+func murmur2(data []byte) int32 {
+	const (
+		seed = 0x9747b28c
+		m    = 0x5bd1e995
+		r    = 24
+	)
+
+	length := len(data)
+	h := uint32(seed) ^ uint32(length)
+	for i := 0; i+4 <= length; i += 4 {
+		k := uint32(data[i]) | uint32(data[i+1])<<8 | uint32(data[i+2])<<16 | uint32(data[i+3])<<24
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+
+	tail := data[length&^3:]
+	switch len(tail) {
+	case 3:
+		h ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(tail[0])
+		h *= m
+	}
+
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return int32(h)
+}
+
+// RoundRobinPartitioner ignores the key and chooses partitions in turn. It is
+// safe for concurrent use. Zero value is ready to use.
+type RoundRobinPartitioner struct {
+	next uint32
+}
+
+func (p *RoundRobinPartitioner) Partition(key []byte, partitions int32) int32 {
+	if partitions <= 0 {
+		return 0
+	}
+	n := atomic.AddUint32(&p.next, 1) - 1
+	return int32(n % uint32(partitions))
+}
+
+// ManualPartitioner always chooses the partition it is set to, regardless of
+// the key and number of partitions.
+type ManualPartitioner int32
+
+func (p ManualPartitioner) Partition(key []byte, partitions int32) int32 {
+	return int32(p)
+}
@@ -0,0 +1,63 @@
+package kafka
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&PartitionerSuite{})
+
+type PartitionerSuite struct{}
+
+func (s *PartitionerSuite) TestMurmur2(c *C) {
+	// test vectors of org.apache.kafka.common.utils.UtilsTest
+	cases := map[string]int32{
+		"21":                         -973932308,
+		"foobar":                     -790332482,
+		"a-little-bit-long-string":   -985981536,
+		"a-little-bit-longer-string": -1486304829,
+		"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8": -58897971,
+		"abc": 479470107,
+	}
+	for key, hash := range cases {
+		c.Check(murmur2([]byte(key)), Equals, hash, Commentf("key %q", key))
+	}
+}
+
+func (s *PartitionerSuite) TestMurmur2Partitioner(c *C) {
+	var p Murmur2Partitioner
+	for _, key := range []string{"21", "foobar", "a-little-bit-long-string", "abc", ""} {
+		partition := p.Partition([]byte(key), 7)
+		c.Assert(partition, Equals, (murmur2([]byte(key))&0x7fffffff)%7)
+		c.Assert(p.Partition([]byte(key), 7), Equals, partition)
+	}
+	// hash of "foobar" is negative, so the sign bit must be masked:
+	// -790332482 & 0x7fffffff = 1357151166
+	c.Assert(p.Partition([]byte("foobar"), 1000), Equals, int32(166))
+}
+
+func (s *PartitionerSuite) TestPartitionerNoPartitions(c *C) {
+	var murmur Murmur2Partitioner
+	var roundRobin RoundRobinPartitioner
+	for _, partitions := range []int32{0, -1} {
+		c.Assert(murmur.Partition([]byte("foobar"), partitions), Equals, int32(0))
+		c.Assert(roundRobin.Partition([]byte("key"), partitions), Equals, int32(0))
+	}
+	// turns are not taken without partitions
+	c.Assert(roundRobin.Partition([]byte("key"), 3), Equals, int32(0))
+	c.Assert(roundRobin.Partition([]byte("key"), 3), Equals, int32(1))
+}
+
+func (s *PartitionerSuite) TestRoundRobinPartitioner(c *C) {
+	var p RoundRobinPartitioner
+	var partitions []int32
+	for i := 0; i < 7; i++ {
+		partitions = append(partitions, p.Partition([]byte("key"), 3))
+	}
+	c.Assert(partitions, DeepEquals, []int32{0, 1, 2, 0, 1, 2, 0})
+}
+
+func (s *PartitionerSuite) TestManualPartitioner(c *C) {
+	p := ManualPartitioner(4)
+	c.Assert(p.Partition([]byte("key"), 8), Equals, int32(4))
+	c.Assert(p.Partition(nil, 8), Equals, int32(4))
+}
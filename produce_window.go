@@ -0,0 +1,79 @@
+package kafka
+
+import "sync"
+
+// produceWindow accounts the bytes of produce requests sent with a connection
+// that are still waiting for their acks, and blocks new requests once they
+// exceed a limit, until enough of the earlier ones are acked. This gives
+// producers back-pressure without buffering requests elsewhere.
+type produceWindow struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	// limit is the number of unacked bytes above which requests block.
+	// Zero means no limit.
+	limit  int64
+	used   int64
+	closed bool
+}
+
+func newProduceWindow() *produceWindow {
+	w := &produceWindow{}
+	w.cond = sync.NewCond(&w.mu)
+	return w
+}
+
+// setLimit sets the number of unacked bytes above which requests block.
+// Zero means no limit.
+func (w *produceWindow) setLimit(limit int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.limit = limit
+	w.cond.Broadcast()
+}
+
+// acquire reserves n bytes for a request, waiting while they do not fit in
+// the limit. Request larger than the limit is let through once no other
+// request is waiting for acks, so that it does not block forever. It returns
+// false, without reserving anything, if the window is closed.
+func (w *produceWindow) acquire(n int64) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for !w.closed && w.limit > 0 && w.used > 0 && w.used+n > w.limit {
+		w.cond.Wait()
+	}
+	if w.closed {
+		return false
+	}
+	w.used += n
+	return true
+}
+
+// release returns n bytes reserved with acquire, once the request was acked
+// or has failed.
+func (w *produceWindow) release(n int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.used -= n
+	w.cond.Broadcast()
+}
+
+// close wakes all requests waiting for the window and makes them, and the
+// following ones, fail.
+func (w *produceWindow) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.closed = true
+	w.cond.Broadcast()
+}
+
+// inFlight returns the number of bytes reserved by requests.
+func (w *produceWindow) inFlight() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.used
+}
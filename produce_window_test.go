@@ -0,0 +1,135 @@
+package kafka
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/dropbox/kafka/proto"
+)
+
+func (s *ConnectionSuite) TestConnectionProduceBackPressure(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	// requests are handled in order, so holding the response to the first
+	// one holds all of them
+	ack := make(chan struct{})
+	srv.Handle(ProduceRequest, func(request Serializable) Serializable {
+		<-ack
+		req := request.(*proto.ProduceReq)
+		return &proto.ProduceResp{
+			CorrelationID: req.CorrelationID,
+			Topics: []proto.ProduceRespTopic{
+				{Name: "foo", Partitions: []proto.ProduceRespPartition{{ID: 0}}},
+			},
+		}
+	})
+
+	conn, err := newTCPConnection(srv.Address(), time.Second)
+	if err != nil {
+		c.Fatalf("could not conect to test server: %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	newReq := func() *proto.ProduceReq {
+		return &proto.ProduceReq{
+			ClientID:     "tester",
+			RequiredAcks: proto.RequiredAcksAll,
+			Timeout:      time.Second,
+			Topics: []proto.ProduceReqTopic{{
+				Name: "foo",
+				Partitions: []proto.ProduceReqPartition{
+					{ID: 0, Messages: []*proto.Message{{Value: []byte("value")}}},
+				},
+			}},
+		}
+	}
+	b, err := newReq().Bytes()
+	c.Assert(err, IsNil)
+	size := int64(len(b))
+	conn.setMaxInFlightBytes(2 * size)
+
+	acked := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		err := conn.ProduceAsync(newReq(), func(resp *proto.ProduceResp, err error) {
+			acked <- err
+		})
+		c.Assert(err, IsNil)
+	}
+	c.Assert(conn.InFlightBytes(), Equals, 2*size)
+
+	produced := make(chan error, 1)
+	go func() {
+		_, err := conn.Produce(newReq())
+		produced <- err
+	}()
+	select {
+	case err := <-produced:
+		c.Fatalf("produce did not block: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	c.Assert(conn.InFlightBytes(), Equals, 2*size)
+
+	close(ack)
+	for i := 0; i < 2; i++ {
+		c.Assert(<-acked, IsNil)
+	}
+	select {
+	case err := <-produced:
+		c.Assert(err, IsNil)
+	case <-time.After(time.Second):
+		c.Fatalf("produce still blocked once earlier requests were acked")
+	}
+	c.Assert(conn.InFlightBytes(), Equals, int64(0))
+}
+
+func (s *ConnectionSuite) TestConnectionProduceBackPressureClose(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	srv.Handle(ProduceRequest, func(request Serializable) Serializable {
+		return nil
+	})
+
+	conn, err := newTCPConnection(srv.Address(), time.Second)
+	if err != nil {
+		c.Fatalf("could not conect to test server: %s", err)
+	}
+	conn.setMaxInFlightBytes(1)
+
+	req := func() *proto.ProduceReq {
+		return &proto.ProduceReq{
+			ClientID:     "tester",
+			RequiredAcks: proto.RequiredAcksAll,
+			Topics: []proto.ProduceReqTopic{{
+				Name:       "foo",
+				Partitions: []proto.ProduceReqPartition{{ID: 0, Messages: []*proto.Message{{Value: []byte("a")}}}},
+			}},
+		}
+	}
+	// request larger than the limit is sent, since nothing else is in flight
+	failed := make(chan error, 1)
+	err = conn.ProduceAsync(req(), func(resp *proto.ProduceResp, err error) {
+		failed <- err
+	})
+	c.Assert(err, IsNil)
+
+	produced := make(chan error, 1)
+	go func() {
+		_, err := conn.Produce(req())
+		produced <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	_ = conn.Close()
+	select {
+	case err := <-produced:
+		c.Assert(err, Equals, ErrClosed)
+	case <-time.After(time.Second):
+		c.Fatalf("produce still blocked after close")
+	}
+	c.Assert(<-failed, Equals, ErrClosed)
+	c.Assert(conn.InFlightBytes(), Equals, int64(0))
+}
@@ -0,0 +1,150 @@
+package proto
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+/*
+
+Consumer protocol, the format of the metadata that members of consumer groups
+exchange through the coordinator when they join the group with the "consumer"
+protocol type, as described by ConsumerProtocolSubscription.json of Kafka
+
+*/
+
+// ConsumerProtocolType is the protocol type members of consumer groups join
+// the group with.
+const ConsumerProtocolType = "consumer"
+
+// RebalanceProtocol is the way partitions are moved between members of a
+// consumer group when the group rebalances.
+type RebalanceProtocol int8
+
+const (
+	// RebalanceEager revokes all partitions of all members before they are
+	// assigned again, stopping consumption of the whole group until the
+	// rebalance is over.
+	RebalanceEager RebalanceProtocol = 0
+
+	// RebalanceCooperative revokes only partitions moving to another member,
+	// so that members keep consuming the rest while the group rebalances.
+	// Members report the partitions they own in their subscription.
+	RebalanceCooperative RebalanceProtocol = 1
+)
+
+func (p RebalanceProtocol) String() string {
+	switch p {
+	case RebalanceEager:
+		return "eager"
+	case RebalanceCooperative:
+		return "cooperative"
+	default:
+		return fmt.Sprintf("unknown(%d)", int8(p))
+	}
+}
+
+// ConsumerProtocolSubscription is the metadata member of consumer group
+// joins the group with, describing the topics it is subscribed to.
+type ConsumerProtocolSubscription struct {
+	// Version 1 adds partitions owned by the member, which are required by
+	// the cooperative rebalance protocol.
+	Version  int16
+	Topics   []string
+	UserData []byte
+
+	OwnedPartitions []ConsumerProtocolTopicPartitions
+}
+
+type ConsumerProtocolTopicPartitions struct {
+	Topic      string
+	Partitions []int32
+}
+
+// NewConsumerProtocolSubscription returns subscription of given topics of
+// the version required by given rebalance protocol. Partitions owned by the
+// member are kept only by the cooperative protocol, eager protocol revokes
+// them all anyway.
+func NewConsumerProtocolSubscription(protocol RebalanceProtocol, topics []string, userData []byte, owned []ConsumerProtocolTopicPartitions) *ConsumerProtocolSubscription {
+	s := &ConsumerProtocolSubscription{
+		Topics:   topics,
+		UserData: userData,
+	}
+	if protocol == RebalanceCooperative {
+		s.Version = 1
+		s.OwnedPartitions = owned
+	}
+	return s
+}
+
+// ReadConsumerProtocolSubscription decodes subscription from the metadata of
+// a group member. Fields added by versions newer than 1 are ignored.
+func ReadConsumerProtocolSubscription(b []byte) (*ConsumerProtocolSubscription, error) {
+	var s ConsumerProtocolSubscription
+	dec := NewDecoder(bytes.NewReader(b))
+
+	s.Version = dec.DecodeInt16()
+	if s.Version < 0 {
+		return nil, fmt.Errorf("invalid consumer protocol subscription version %d", s.Version)
+	}
+	if n := dec.DecodeNullableArrayLen(); n >= 0 {
+		s.Topics = make([]string, n)
+		for i := range s.Topics {
+			s.Topics[i] = dec.DecodeString()
+		}
+	}
+	s.UserData = dec.DecodeBytes()
+	if s.Version >= 1 {
+		if n := dec.DecodeNullableArrayLen(); n >= 0 {
+			s.OwnedPartitions = make([]ConsumerProtocolTopicPartitions, n)
+			for i := range s.OwnedPartitions {
+				var tp = &s.OwnedPartitions[i]
+				tp.Topic = dec.DecodeString()
+				if n := dec.DecodeNullableArrayLen(); n >= 0 {
+					tp.Partitions = make([]int32, n)
+					for pi := range tp.Partitions {
+						tp.Partitions[pi] = dec.DecodeInt32()
+					}
+				}
+			}
+		}
+	}
+
+	if dec.Err() != nil {
+		return nil, dec.Err()
+	}
+	return &s, nil
+}
+
+// Bytes returns the subscription encoded as the metadata of a group member.
+func (s *ConsumerProtocolSubscription) Bytes() ([]byte, error) {
+	switch {
+	case s.Version < 0 || s.Version > 1:
+		return nil, fmt.Errorf("unsupported consumer protocol subscription version %d", s.Version)
+	case s.Version == 0 && len(s.OwnedPartitions) != 0:
+		return nil, errors.New("consumer protocol subscription v0 cannot carry owned partitions")
+	}
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	enc.Encode(s.Version)
+	enc.EncodeArrayLen(len(s.Topics))
+	for _, topic := range s.Topics {
+		enc.Encode(topic)
+	}
+	enc.EncodeBytes(s.UserData)
+	if s.Version >= 1 {
+		enc.EncodeArrayLen(len(s.OwnedPartitions))
+		for _, tp := range s.OwnedPartitions {
+			enc.Encode(tp.Topic)
+			enc.Encode(tp.Partitions)
+		}
+	}
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,54 @@
+package proto
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&ConsumerProtocolSuite{})
+
+type ConsumerProtocolSuite struct{}
+
+func (s *ConsumerProtocolSuite) TestCooperativeSubscription(c *C) {
+	sub := NewConsumerProtocolSubscription(RebalanceCooperative, []string{"a"}, nil,
+		[]ConsumerProtocolTopicPartitions{{Topic: "a", Partitions: []int32{0, 2}}})
+	c.Assert(sub.Version, Equals, int16(1))
+
+	b, err := sub.Bytes()
+	c.Assert(err, IsNil)
+	c.Assert(b, DeepEquals, []byte{
+		0x0, 0x1, // version
+		0x0, 0x0, 0x0, 0x1, 0x0, 0x1, 0x61, // topics
+		0xff, 0xff, 0xff, 0xff, // no user data
+		0x0, 0x0, 0x0, 0x1, 0x0, 0x1, 0x61, // owned partitions
+		0x0, 0x0, 0x0, 0x2, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x2,
+	})
+
+	read, err := ReadConsumerProtocolSubscription(b)
+	c.Assert(err, IsNil)
+	c.Assert(read, DeepEquals, sub)
+
+	// fields of newer versions are ignored
+	read, err = ReadConsumerProtocolSubscription(append([]byte{0x0, 0x2}, append(b[2:], 0x0, 0x0, 0x0, 0x5)...))
+	c.Assert(err, IsNil)
+	c.Assert(read.Version, Equals, int16(2))
+	c.Assert(read.OwnedPartitions, DeepEquals, sub.OwnedPartitions)
+}
+
+func (s *ConsumerProtocolSuite) TestEagerSubscription(c *C) {
+	sub := NewConsumerProtocolSubscription(RebalanceEager, []string{"a", "b"}, []byte("x"),
+		[]ConsumerProtocolTopicPartitions{{Topic: "a", Partitions: []int32{0}}})
+	c.Assert(sub.Version, Equals, int16(0))
+	c.Assert(sub.OwnedPartitions, IsNil)
+
+	b, err := sub.Bytes()
+	c.Assert(err, IsNil)
+	read, err := ReadConsumerProtocolSubscription(b)
+	c.Assert(err, IsNil)
+	c.Assert(read, DeepEquals, sub)
+
+	sub.OwnedPartitions = []ConsumerProtocolTopicPartitions{{Topic: "a", Partitions: []int32{0}}}
+	_, err = sub.Bytes()
+	c.Assert(err, NotNil)
+
+	c.Assert(RebalanceCooperative.String(), Equals, "cooperative")
+}
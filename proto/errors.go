@@ -35,6 +35,31 @@ var (
 	ErrInvalidCommitOffsetSize                 = &KafkaError{28, "offset data size is not valid"}
 	ErrAuthorizationFailed                     = &KafkaError{29, "not authorized"}
 	ErrRebalanceInProgress                     = &KafkaError{30, "group is rebalancing, rejoin is needed"}
+	ErrUnsupportedSaslMechanism                = &KafkaError{33, "sasl mechanism is not supported by the broker"}
+	ErrIllegalSaslState                        = &KafkaError{34, "request is not valid given the current sasl state"}
+	ErrUnsupportedVersion                      = &KafkaError{35, "version of the request is not supported by the broker"}
+	ErrInvalidProducerEpoch                    = &KafkaError{47, "producer epoch is older than the current one"}
+	ErrInvalidTxnState                         = &KafkaError{48, "operation is not valid in the current transaction state"}
+	ErrTransactionCoordinatorFenced            = &KafkaError{52, "transaction coordinator epoch is older than the current one"}
+	ErrSaslAuthenticationFailed                = &KafkaError{58, "sasl authentication failed"}
+	ErrNonEmptyGroup                           = &KafkaError{68, "group is not empty"}
+	ErrGroupIDNotFound                         = &KafkaError{69, "group id not found"}
+	ErrFetchSessionIDNotFound                  = &KafkaError{70, "fetch session id not found"}
+	ErrInvalidFetchSessionEpoch                = &KafkaError{71, "invalid fetch session epoch"}
+	ErrFencedLeaderEpoch                       = &KafkaError{74, "leader epoch is older than the current one"}
+	ErrUnknownLeaderEpoch                      = &KafkaError{75, "leader epoch is newer than the current one"}
+	ErrGroupSubscribedToTopic                  = &KafkaError{86, "group is subscribed to the topic"}
+
+	// ErrUnknownMemberID is the name newer brokers use for
+	// ErrUnknownConsumerID, returned when committing offsets with member ID
+	// the group coordinator does not know.
+	ErrUnknownMemberID = ErrUnknownConsumerID
+
+	// ErrCoordinatorLoadInProgress and ErrCoordinatorNotAvailable are the
+	// names newer brokers use for ErrOffsetLoadInProgress and
+	// ErrNoCoordinator, returned by both group and transaction coordinators.
+	ErrCoordinatorLoadInProgress = ErrOffsetLoadInProgress
+	ErrCoordinatorNotAvailable   = ErrNoCoordinator
 
 	errnoToErr = map[int16]error{
 		-1: ErrUnknown,
@@ -67,9 +92,99 @@ var (
 		28: ErrInvalidCommitOffsetSize,
 		29: ErrAuthorizationFailed,
 		30: ErrRebalanceInProgress,
+		33: ErrUnsupportedSaslMechanism,
+		34: ErrIllegalSaslState,
+		35: ErrUnsupportedVersion,
+		47: ErrInvalidProducerEpoch,
+		48: ErrInvalidTxnState,
+		52: ErrTransactionCoordinatorFenced,
+		58: ErrSaslAuthenticationFailed,
+		68: ErrNonEmptyGroup,
+		69: ErrGroupIDNotFound,
+		70: ErrFetchSessionIDNotFound,
+		71: ErrInvalidFetchSessionEpoch,
+		74: ErrFencedLeaderEpoch,
+		75: ErrUnknownLeaderEpoch,
+		86: ErrGroupSubscribedToTopic,
+	}
+)
+
+var (
+	// retriableErrnos contains codes of transient errors, after which the
+	// request can be retried, following the classification of the official
+	// client.
+	retriableErrnos = map[int16]bool{
+		2:  true, // corrupt message
+		3:  true, // unknown topic or partition
+		5:  true, // leader not available
+		6:  true, // not leader for partition
+		7:  true, // request timed out
+		9:  true, // replica not available
+		13: true, // network exception
+		14: true, // offsets load in progress
+		15: true, // coordinator not available
+		16: true, // not coordinator
+		19: true, // not enough replicas
+		20: true, // not enough replicas after append
+		56: true, // kafka storage error
+		70: true, // fetch session id not found
+		71: true, // invalid fetch session epoch
+		74: true, // fenced leader epoch
+		75: true, // unknown leader epoch
+	}
+
+	// metadataRefreshErrnos contains codes of errors caused by stale
+	// metadata, which should be refreshed before the request is retried.
+	metadataRefreshErrnos = map[int16]bool{
+		3:  true, // unknown topic or partition
+		5:  true, // leader not available
+		6:  true, // not leader for partition
+		9:  true, // replica not available
+		13: true, // network exception
+		56: true, // kafka storage error
+		74: true, // fenced leader epoch
+		75: true, // unknown leader epoch
+	}
+
+	// coordinatorRefreshErrnos contains codes of errors caused by sending
+	// the request to a node that is not the coordinator of the group or
+	// transaction, which should be looked up again before the request is
+	// retried.
+	coordinatorRefreshErrnos = map[int16]bool{
+		15: true, // coordinator not available
+		16: true, // not coordinator
 	}
 )
 
+// IsRetriable returns whether the error of given code is transient, so that
+// the request failing with it can be retried. Coordinator that is loading or
+// moving, and errors of RequiresCoordinatorRefresh, are all retriable.
+func IsRetriable(errCode int16) bool {
+	return retriableErrnos[errCode]
+}
+
+// isRetriableErr returns whether given error is a kafka error of a retriable
+// kind. Errors of unknown codes are not retriable.
+func isRetriableErr(err error) bool {
+	kerr, ok := err.(*KafkaError)
+	return ok && IsRetriable(kerr.errno)
+}
+
+// RequiresMetadataRefresh returns whether the error of given code means that
+// the cluster metadata used to route the request is stale and should be
+// refreshed before retrying.
+func RequiresMetadataRefresh(errCode int16) bool {
+	return metadataRefreshErrnos[errCode]
+}
+
+// RequiresCoordinatorRefresh returns whether the error of given code means
+// that the coordinator the request was sent to is not, or no longer, the
+// coordinator of the group or transaction, so that it should be looked up
+// again before retrying.
+func RequiresCoordinatorRefresh(errCode int16) bool {
+	return coordinatorRefreshErrnos[errCode]
+}
+
 type KafkaError struct {
 	errno   int16
 	message string
@@ -93,3 +208,68 @@ func errFromNo(errno int16) error {
 	}
 	return err
 }
+
+// RequestVersionError is returned when encoding request of a version the
+// encoder does not implement, which would otherwise be sent malformed.
+type RequestVersionError struct {
+	RequestKind int16
+	Version     int16
+	// MaxVersion is the highest version of the request that can be encoded.
+	MaxVersion int16
+}
+
+func (err *RequestVersionError) Error() string {
+	return fmt.Sprintf("cannot encode %s request v%d, supported versions are 0-%d",
+		RequestKindName(err.RequestKind), err.Version, err.MaxVersion)
+}
+
+// maxRequestVersion maps request kinds to the highest version their encoder
+// implements, for requests whose encoder does not implement all versions
+// accepted by the broker.
+var maxRequestVersion = map[int16]int16{
+	ProduceReqKind:  3,
+	FetchReqKind:    7,
+	MetadataReqKind: 3,
+}
+
+// checkRequestVersion returns *RequestVersionError if request of given kind
+// cannot be encoded using given version.
+func checkRequestVersion(kind, version int16) error {
+	max, ok := maxRequestVersion[kind]
+	if ok && (version < 0 || version > max) {
+		return &RequestVersionError{RequestKind: kind, Version: version, MaxVersion: max}
+	}
+	return nil
+}
+
+// ResponseSizeError is returned when the size prefix of a response is invalid
+// or exceeds the allowed limit, usually because the stream is corrupted. The
+// response is not read, as its size cannot be trusted.
+type ResponseSizeError struct {
+	Size int32
+	// Limit is the maximum allowed size, or 0 if there is no limit.
+	Limit int32
+}
+
+func (err *ResponseSizeError) Error() string {
+	if err.Limit > 0 && err.Size > err.Limit {
+		return fmt.Sprintf("response size %d exceeds the limit of %d bytes", err.Size, err.Limit)
+	}
+	return fmt.Sprintf("invalid response size %d", err.Size)
+}
+
+// ParseError is returned when a response cannot be decoded. It describes
+// which response was being decoded and where the decoding failed.
+type ParseError struct {
+	RequestKind int16
+	Version     int16
+	// Offset is the number of bytes of the response, including its size
+	// prefix, that were consumed before the failure.
+	Offset int64
+	Err    error
+}
+
+func (err *ParseError) Error() string {
+	return fmt.Sprintf("cannot parse %s response v%d at byte %d: %s",
+		RequestKindName(err.RequestKind), err.Version, err.Offset, err.Err)
+}
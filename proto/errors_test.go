@@ -0,0 +1,77 @@
+package proto
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&ErrorsSuite{})
+
+type ErrorsSuite struct{}
+
+func (s *ErrorsSuite) TestErrorClassification(c *C) {
+	cases := []struct {
+		err       error
+		retriable bool
+		refresh   bool
+	}{
+		{ErrUnknown, false, false},
+		{ErrOffsetOutOfRange, false, false},
+		{ErrInvalidMessage, true, false},
+		{ErrUnknownTopicOrPartition, true, true},
+		{ErrInvalidMessageSize, false, false},
+		{ErrLeaderNotAvailable, true, true},
+		{ErrNotLeaderForPartition, true, true},
+		{ErrRequestTimeout, true, false},
+		{ErrBrokerNotAvailable, false, false},
+		{ErrReplicaNotAvailable, true, true},
+		{ErrMessageSizeTooLarge, false, false},
+		{ErrOffsetMetadataTooLarge, false, false},
+		{ErrOffsetLoadInProgress, true, false},
+		{ErrNoCoordinator, true, false},
+		{ErrNotCoordinator, true, false},
+		{ErrInvalidTopic, false, false},
+		{ErrRecordListTooLarge, false, false},
+		{ErrNotEnoughReplicas, true, false},
+		{ErrNotEnoughReplicasAfterAppend, true, false},
+		{ErrInvalidRequiredAcks, false, false},
+		{ErrIllegalGeneration, false, false},
+		{ErrUnknownConsumerID, false, false},
+		{ErrAuthorizationFailed, false, false},
+		{ErrRebalanceInProgress, false, false},
+		{ErrSaslAuthenticationFailed, false, false},
+		{ErrNonEmptyGroup, false, false},
+		{ErrFetchSessionIDNotFound, true, false},
+		{ErrInvalidFetchSessionEpoch, true, false},
+		{ErrFencedLeaderEpoch, true, true},
+		{ErrUnknownLeaderEpoch, true, true},
+	}
+	for _, tc := range cases {
+		errno := int16(tc.err.(*KafkaError).Errno())
+		if got := IsRetriable(errno); got != tc.retriable {
+			c.Errorf("%s: expected retriable %v, got %v", tc.err, tc.retriable, got)
+		}
+		if got := RequiresMetadataRefresh(errno); got != tc.refresh {
+			c.Errorf("%s: expected metadata refresh %v, got %v", tc.err, tc.refresh, got)
+		}
+	}
+
+	// every error requiring metadata refresh is retriable
+	for errno := range metadataRefreshErrnos {
+		if !IsRetriable(errno) {
+			c.Errorf("error %d requires metadata refresh, but is not retriable", errno)
+		}
+	}
+
+	// coordinator that is only loading does not need to be looked up again
+	c.Assert(RequiresCoordinatorRefresh(14), Equals, false)
+	c.Assert(RequiresCoordinatorRefresh(15), Equals, true)
+	c.Assert(RequiresCoordinatorRefresh(16), Equals, true)
+	for errno := range coordinatorRefreshErrnos {
+		if !IsRetriable(errno) {
+			c.Errorf("error %d requires coordinator refresh, but is not retriable", errno)
+		}
+		if RequiresMetadataRefresh(errno) {
+			c.Errorf("error %d requires coordinator refresh, but also metadata refresh", errno)
+		}
+	}
+}
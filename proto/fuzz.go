@@ -0,0 +1,62 @@
+package proto
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// ParseResponse decodes given response of given request kind and version,
+// just like connections decode responses they read. Responses of kinds that
+// cannot be decoded return an error.
+func ParseResponse(requestKind, version int16, b []byte) (interface{}, error) {
+	r := bytes.NewReader(b)
+	switch requestKind {
+	case ProduceReqKind:
+		return ReadVersionedProduceResp(r, version)
+	case FetchReqKind:
+		return ReadVersionedFetchResp(r, version)
+	case OffsetReqKind:
+		return ReadOffsetResp(r)
+	case MetadataReqKind:
+		return ReadVersionedMetadataResp(r, version)
+	case OffsetCommitReqKind:
+		return ReadOffsetCommitResp(r)
+	case OffsetFetchReqKind:
+		return ReadVersionedOffsetFetchResp(r, version)
+	case GroupCoordinatorReqKind:
+		return ReadGroupCoordinatorResp(r)
+	case HeartbeatReqKind:
+		return ReadHeartbeatResp(r)
+	case SaslHandshakeReqKind:
+		return ReadSaslHandshakeResp(r)
+	case APIVersionsReqKind:
+		return ReadAPIVersionsResp(r)
+	case WriteTxnMarkersReqKind:
+		return ReadWriteTxnMarkersResp(r)
+	case SaslAuthenticateReqKind:
+		return ReadSaslAuthenticateResp(r)
+	case DeleteGroupsReqKind:
+		return ReadDeleteGroupsResp(r)
+	case OffsetDeleteReqKind:
+		return ReadOffsetDeleteResp(r)
+	case EnvelopeReqKind:
+		return ReadEnvelopeResp(r)
+	default:
+		return nil, fmt.Errorf("cannot parse response of %s", RequestKindName(requestKind))
+	}
+}
+
+// FuzzParseResponse is the entry point for fuzzing response parsers. The
+// first byte of data selects the request kind, the second one its version
+// and the rest is the response. It returns 1 if the response was parsed and
+// 0 otherwise, as expected by go-fuzz. Malformed responses must fail
+// parsing, never panic or allocate more memory than the response takes.
+func FuzzParseResponse(data []byte) int {
+	if len(data) < 2 {
+		return 0
+	}
+	if _, err := ParseResponse(int16(data[0]), int16(data[1]), data[2:]); err != nil {
+		return 0
+	}
+	return 1
+}
@@ -0,0 +1,80 @@
+package proto
+
+import (
+	"testing"
+	"time"
+)
+
+// FuzzResponse runs FuzzParseResponse on responses of all kinds, seeded with
+// valid responses. Run it with go test -fuzz FuzzResponse.
+func FuzzResponse(f *testing.F) {
+	seeds := []struct {
+		kind    int16
+		version int16
+		resp    interface{ Bytes() ([]byte, error) }
+	}{
+		{ProduceReqKind, 2, &ProduceResp{
+			CorrelationID: 241,
+			Version:       2,
+			Topics: []ProduceRespTopic{{
+				Name:       "foo",
+				Partitions: []ProduceRespPartition{{ID: 0, Offset: 5, Err: ErrNotLeaderForPartition}},
+			}},
+		}},
+		{FetchReqKind, 4, &FetchResp{
+			CorrelationID: 241,
+			Version:       4,
+			Topics: []FetchRespTopic{{
+				Name: "foo",
+				Partitions: []FetchRespPartition{{
+					ID:        0,
+					TipOffset: 20,
+					Messages:  []*Message{{Offset: 10, Key: []byte("k"), Value: []byte("v"), Timestamp: time.Unix(1, 0)}},
+				}},
+			}},
+		}},
+		{FetchReqKind, 0, &FetchResp{
+			CorrelationID: 241,
+			Topics: []FetchRespTopic{{
+				Name: "foo",
+				Partitions: []FetchRespPartition{{
+					ID:        0,
+					TipOffset: 20,
+					Messages:  []*Message{{Offset: 10, Value: []byte("v")}},
+				}},
+			}},
+		}},
+		{MetadataReqKind, 1, &MetadataResp{
+			CorrelationID: 241,
+			Version:       1,
+			Brokers:       []MetadataRespBroker{{NodeID: 1, Host: "localhost", Port: 9092}},
+			Topics: []MetadataRespTopic{{
+				Name:       "foo",
+				Partitions: []MetadataRespPartition{{ID: 0, Leader: 1, Replicas: []int32{1}, Isrs: []int32{1}}},
+			}},
+		}},
+		{OffsetFetchReqKind, 1, &OffsetFetchResp{
+			CorrelationID: 241,
+			Topics: []OffsetFetchRespTopic{{
+				Name:       "foo",
+				Partitions: []OffsetFetchRespPartition{{ID: 0, Offset: 3, Metadata: "m"}},
+			}},
+		}},
+		{APIVersionsReqKind, 0, &APIVersionsResp{
+			CorrelationID: 241,
+			APIVersions:   []APIVersionsRespAPI{{APIKey: FetchReqKind, MaxVersion: 4}},
+		}},
+		{HeartbeatReqKind, 0, &HeartbeatResp{CorrelationID: 241, Err: ErrRebalanceInProgress}},
+	}
+	for _, seed := range seeds {
+		b, err := seed.resp.Bytes()
+		if err != nil {
+			f.Fatalf("cannot serialize %T: %s", seed.resp, err)
+		}
+		f.Add(append([]byte{byte(seed.kind), byte(seed.version)}, b...))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		FuzzParseResponse(data)
+	})
+}
@@ -8,7 +8,10 @@ import (
 	"fmt"
 	"hash/crc32"
 	"io"
-	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang/snappy"
@@ -29,6 +32,14 @@ const (
 	OffsetCommitReqKind     = 8
 	OffsetFetchReqKind      = 9
 	GroupCoordinatorReqKind = 10
+	HeartbeatReqKind        = 12
+	SaslHandshakeReqKind    = 17
+	APIVersionsReqKind      = 18
+	WriteTxnMarkersReqKind  = 27
+	SaslAuthenticateReqKind = 36
+	DeleteGroupsReqKind     = 42
+	OffsetDeleteReqKind     = 47
+	EnvelopeReqKind         = 58
 
 	// receive the latest offset (i.e. the offset of the next coming message)
 	OffsetReqTimeLatest = -1
@@ -50,14 +61,145 @@ const (
 	RequiredAcksLocal = 1
 )
 
+// Request is implemented by all request types. Connection sets the
+// correlation ID of a request right before writing it, and its client ID if
+// the request has none.
+type Request interface {
+	// Kind returns the API key of the request.
+	Kind() int16
+	SetCorrelationID(id int32)
+	GetClientID() string
+	SetClientID(id string)
+	Bytes() ([]byte, error)
+	WriteTo(w io.Writer) (int64, error)
+}
+
 type Compression int8
 
 const (
 	CompressionNone   Compression = 0
 	CompressionGzip   Compression = 1
 	CompressionSnappy Compression = 2
+
+	// CompressionLZ4 and CompressionZstd identify codecs messages may be
+	// compressed with by other clients. This package can neither encode nor
+	// decode them.
+	CompressionLZ4  Compression = 3
+	CompressionZstd Compression = 4
+)
+
+// TimestampType describes the meaning of the message timestamp.
+type TimestampType int8
+
+const (
+	// TimestampCreateTime means the timestamp was set by the producer.
+	TimestampCreateTime TimestampType = 0
+
+	// TimestampLogAppendTime means the timestamp was set by the broker when
+	// the message was appended to the log.
+	TimestampLogAppendTime TimestampType = 1
+)
+
+// MessageFormat is the on-disk and on-wire format of messages, identified by
+// the magic byte of each message or record batch.
+type MessageFormat int8
+
+const (
+	// MessageFormatUnknown is used when the format could not be determined.
+	MessageFormatUnknown MessageFormat = -1
+
+	// MessageFormatV0 is the original message format without timestamps,
+	// used by brokers before 0.10.
+	MessageFormatV0 MessageFormat = 0
+
+	// MessageFormatV1 adds timestamps to messages. It was introduced in
+	// 0.10.0.
+	MessageFormatV1 MessageFormat = 1
+
+	// MessageFormatV2 is the record batch format introduced in 0.11.0.
+	MessageFormatV2 MessageFormat = 2
+)
+
+func (f MessageFormat) String() string {
+	switch f {
+	case MessageFormatUnknown:
+		return "unknown"
+	case MessageFormatV0, MessageFormatV1, MessageFormatV2:
+		return fmt.Sprintf("v%d", int8(f))
+	}
+	return fmt.Sprintf("MessageFormat(%d)", int8(f))
+}
+
+// ParseMessageFormat returns the message format used by brokers configured
+// with given message.format.version, such as "0.10.2" or "2.1-IV2".
+func ParseMessageFormat(version string) (MessageFormat, error) {
+	v := version
+	if i := strings.Index(v, "-"); i >= 0 {
+		// inter-broker protocol suffix, such as "-IV1"
+		v = v[:i]
+	}
+	parts := strings.Split(v, ".")
+	nums := make([]int, 0, len(parts))
+	for _, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return MessageFormatUnknown, fmt.Errorf("invalid message format version %q", version)
+		}
+		nums = append(nums, n)
+	}
+	if len(nums) < 2 {
+		return MessageFormatUnknown, fmt.Errorf("invalid message format version %q", version)
+	}
+	switch major, minor := nums[0], nums[1]; {
+	case major > 0:
+		return MessageFormatV2, nil
+	case minor >= 11:
+		return MessageFormatV2, nil
+	case minor == 10:
+		return MessageFormatV1, nil
+	case minor >= 8:
+		return MessageFormatV0, nil
+	}
+	return MessageFormatUnknown, fmt.Errorf("unsupported message format version %q", version)
+}
+
+const (
+	// magic byte of the message format without timestamps
+	messageMagicV0 = 0
+	// magic byte of the message format carrying a timestamp, used by produce
+	// and fetch requests in version 2 and above
+	messageMagicV1 = 1
+
+	compressionMask   = 0x07
+	timestampTypeMask = 0x08
 )
 
+// messageMagic returns the message format magic byte used by produce and fetch
+// requests of given version.
+func messageMagic(version int16) int8 {
+	if version >= 2 {
+		return messageMagicV1
+	}
+	return messageMagicV0
+}
+
+// encodeTimestamp returns the wire representation of given timestamp. Zero
+// time is sent as -1, which means no timestamp.
+func encodeTimestamp(t time.Time) int64 {
+	if t.IsZero() {
+		return -1
+	}
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// decodeTimestamp returns the time represented by given wire timestamp.
+func decodeTimestamp(ms int64) time.Time {
+	if ms < 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
 // ReadReq returns request kind ID and byte representation of the whole message
 // in wire protocol format.
 func ReadReq(r io.Reader) (requestKind int16, b []byte, err error) {
@@ -82,9 +224,26 @@ func ReadReq(r io.Reader) (requestKind int16, b []byte, err error) {
 // including 4 bytes of message size itself.
 // Byte representation returned by ReadResp can be parsed by all response
 // reeaders to transform it into specialized response structure.
+// Correlation ID is at the same position in all response header versions, so
+// ReadResp can be used for responses of flexible versions as well.
 func ReadResp(r io.Reader) (correlationID int32, b []byte, err error) {
+	return ReadRespLimit(r, 0)
+}
+
+// ReadRespLimit works like ReadResp, but refuses to read responses larger than
+// maxSize bytes, not counting the size prefix, returning ResponseSizeError
+// instead. Zero maxSize means no limit.
+func ReadRespLimit(r io.Reader, maxSize int32) (correlationID int32, b []byte, err error) {
 	dec := NewDecoder(r)
 	msgSize := dec.DecodeInt32()
+	if err := dec.Err(); err != nil {
+		return 0, nil, err
+	}
+	// checked before reading anything more, so that the stream is not
+	// consumed any further
+	if msgSize < 4 || (maxSize > 0 && msgSize > maxSize) {
+		return 0, nil, &ResponseSizeError{Size: msgSize, Limit: maxSize}
+	}
 	correlationID = dec.DecodeInt32()
 	if err := dec.Err(); err != nil {
 		return 0, nil, err
@@ -97,15 +256,147 @@ func ReadResp(r io.Reader) (correlationID int32, b []byte, err error) {
 	return correlationID, b, err
 }
 
+// RequestKindName returns the name of the API of given request kind.
+func RequestKindName(requestKind int16) string {
+	switch requestKind {
+	case ProduceReqKind:
+		return "Produce"
+	case FetchReqKind:
+		return "Fetch"
+	case OffsetReqKind:
+		return "Offset"
+	case MetadataReqKind:
+		return "Metadata"
+	case OffsetCommitReqKind:
+		return "OffsetCommit"
+	case OffsetFetchReqKind:
+		return "OffsetFetch"
+	case GroupCoordinatorReqKind:
+		return "GroupCoordinator"
+	case HeartbeatReqKind:
+		return "Heartbeat"
+	case SaslHandshakeReqKind:
+		return "SaslHandshake"
+	case APIVersionsReqKind:
+		return "ApiVersions"
+	case WriteTxnMarkersReqKind:
+		return "WriteTxnMarkers"
+	case SaslAuthenticateReqKind:
+		return "SaslAuthenticate"
+	case DeleteGroupsReqKind:
+		return "DeleteGroups"
+	case OffsetDeleteReqKind:
+		return "OffsetDelete"
+	case EnvelopeReqKind:
+		return "Envelope"
+	default:
+		return fmt.Sprintf("unknown(%d)", requestKind)
+	}
+}
+
+// parseErr returns error describing failure of decoding response of given kind
+// and version at the current position of the decoder.
+func (d *decoder) parseErr(requestKind, version int16, err error) error {
+	return &ParseError{
+		RequestKind: requestKind,
+		Version:     version,
+		Offset:      d.Offset(),
+		Err:         err,
+	}
+}
+
+// firstFlexibleVersion maps request kind to the first version of the API
+// using flexible encoding, with compact strings and arrays and tagged fields.
+var firstFlexibleVersion = map[int16]int16{
+	ProduceReqKind:          9,
+	FetchReqKind:            12,
+	OffsetReqKind:           6,
+	MetadataReqKind:         9,
+	OffsetCommitReqKind:     8,
+	OffsetFetchReqKind:      6,
+	GroupCoordinatorReqKind: 3,
+	HeartbeatReqKind:        4,
+	WriteTxnMarkersReqKind:  1,
+	SaslAuthenticateReqKind: 2,
+	DeleteGroupsReqKind:     2,
+	EnvelopeReqKind:         0,
+}
+
+// IsFlexibleVersion returns true if given version of the API uses flexible
+// encoding.
+func IsFlexibleVersion(requestKind, version int16) bool {
+	first, ok := firstFlexibleVersion[requestKind]
+	return ok && version >= first
+}
+
+// RespHeaderVersion returns the version of the header of response returned
+// for request of given kind and version. Flexible versions of the APIs use
+// header version 1, which carries tagged fields after the correlation ID.
+func RespHeaderVersion(requestKind, version int16) int16 {
+	if IsFlexibleVersion(requestKind, version) {
+		return 1
+	}
+	return 0
+}
+
+// DecodeRespHeader decodes the message size and response header of given
+// version and returns the correlation ID.
+func (d *decoder) DecodeRespHeader(headerVersion int16) (correlationID int32) {
+	_ = d.DecodeInt32() // total message size
+	correlationID = d.DecodeInt32()
+	if headerVersion >= 1 {
+		d.DecodeTaggedFields()
+	}
+	return correlationID
+}
+
 // Message represents single entity of message set.
 type Message struct {
-	Key       []byte
-	Value     []byte
+	// Key and Value distinguish null from empty content. Nil is sent and
+	// received as null, while empty, non nil slice as zero length content.
+	// Message with null value is a tombstone, deleting the key from a
+	// compacted topic.
+	Key   []byte
+	Value []byte
+
 	Offset    int64  // set when fetching and after successful producing
 	Crc       uint32 // set when fetching, ignored when producing
 	Topic     string // set when fetching, ignored when producing
 	Partition int32  // set when fetching, ignored when producing
 	TipOffset int64  // set when fetching, ignored when processing
+
+	// Timestamp is sent when producing and set when fetching using request
+	// version 2 or above. Zero value means no timestamp.
+	Timestamp time.Time
+	// TimestampType is set when fetching using request version 2 or above,
+	// ignored when producing. Messages are produced with the TimestampType
+	// of their ProduceReqPartition, which is TimestampCreateTime by default,
+	// so producing fetched message again preserves its timestamp, unless the
+	// destination topic uses log append time.
+	TimestampType TimestampType
+	// CreateTimestamp is set when fetching messages with timestamp set by the
+	// broker, if the timestamp originally set by the producer is still known.
+	// It is zero otherwise, and ignored when producing. Tools mirroring
+	// messages between clusters should produce them with CreateTimestamp as
+	// Timestamp, if set, to preserve the original create time.
+	CreateTimestamp time.Time
+
+	// Headers are set when fetching messages stored in record batches,
+	// ignored when producing.
+	Headers []MessageHeader
+
+	// ProducerID and ProducerEpoch identify the idempotent or transactional
+	// producer that wrote the message. They are set when fetching messages
+	// stored in record batches, to -1 if the producer was neither of those,
+	// and ignored when producing.
+	ProducerID    int64
+	ProducerEpoch int16
+}
+
+// MessageHeader is a key value pair attached to a message.
+type MessageHeader struct {
+	Key   string
+	Value []byte
 }
 
 // ComputeCrc returns crc32 hash for given message content.
@@ -122,6 +413,16 @@ func ComputeCrc(m *Message, compression Compression) uint32 {
 // writeMessageSet writes a Message Set into w.
 // It returns the number of bytes written and any error.
 func writeMessageSet(w io.Writer, messages []*Message, compression Compression) (int, error) {
+	return encodeMessageSet(w, messages, compression, gzip.DefaultCompression, messageMagicV0, TimestampCreateTime, nil)
+}
+
+// encodeMessageSet works like writeMessageSet, but allows to specify the
+// compression level used when the message set is compressed with gzip, the
+// message format magic byte and the timestamp type set in attributes of the
+// messages. Level is ignored by other compression methods, and timestamp type
+// by message format v0, which has no timestamps. Compressed message sets are
+// counted in given counters.
+func encodeMessageSet(w io.Writer, messages []*Message, compression Compression, level int, magic int8, tsType TimestampType, counters *CompressionCounters) (int, error) {
 	if len(messages) == 0 {
 		return 0, nil
 	}
@@ -129,48 +430,92 @@ func writeMessageSet(w io.Writer, messages []*Message, compression Compression)
 	// Java client sets the offset of the synthesized message set for a group of
 	// compressed messages to be the offset of the last message in the set.
 	compressOffset := messages[len(messages)-1].Offset
+	var compressTimestamp time.Time
+	if compression != CompressionNone && magic >= messageMagicV1 {
+		// Starting with message format v1, compressed messages are using
+		// offsets relative to the wrapper message, which in turn is using
+		// the absolute offset of the last message. The wrapper timestamp is
+		// the greatest timestamp of all wrapped messages.
+		compressOffset = messages[0].Offset + int64(len(messages)) - 1
+		relative := make([]*Message, len(messages))
+		for i, m := range messages {
+			msg := *m
+			msg.Offset = int64(i)
+			relative[i] = &msg
+			if m.Timestamp.After(compressTimestamp) {
+				compressTimestamp = m.Timestamp
+			}
+		}
+		messages = relative
+	}
 	switch compression {
+	case CompressionNone:
 	case CompressionGzip:
 		var buf bytes.Buffer
-		gz := gzip.NewWriter(&buf)
-		if _, err := writeMessageSet(gz, messages, CompressionNone); err != nil {
+		gz, err := gzip.NewWriterLevel(&buf, level)
+		if err != nil {
+			return 0, err
+		}
+		raw, err := encodeMessageSet(gz, messages, CompressionNone, level, magic, tsType, nil)
+		if err != nil {
 			return 0, err
 		}
 		if err := gz.Close(); err != nil {
 			return 0, err
 		}
+		counters.codec(CompressionGzip).compressed(raw, buf.Len())
 		messages = []*Message{
 			{
-				Value:  buf.Bytes(),
-				Offset: compressOffset,
+				Value:     buf.Bytes(),
+				Offset:    compressOffset,
+				Timestamp: compressTimestamp,
 			},
 		}
 	case CompressionSnappy:
 		var buf bytes.Buffer
-		if _, err := writeMessageSet(&buf, messages, CompressionNone); err != nil {
+		if _, err := encodeMessageSet(&buf, messages, CompressionNone, level, magic, tsType, nil); err != nil {
 			return 0, err
 		}
+		encoded := snappy.Encode(nil, buf.Bytes())
+		counters.codec(CompressionSnappy).compressed(buf.Len(), len(encoded))
 		messages = []*Message{
 			{
-				Value:  snappy.Encode(nil, buf.Bytes()),
-				Offset: compressOffset,
+				Value:     encoded,
+				Offset:    compressOffset,
+				Timestamp: compressTimestamp,
 			},
 		}
+	default:
+		return 0, fmt.Errorf("cannot handle compression method: %d", compression)
+	}
+
+	// size of the message header following the size field: crc32 + magic
+	// byte + attributes, plus timestamp for message format v1
+	headerSize := 4 + 1 + 1
+	attributes := int8(compression)
+	if magic >= messageMagicV1 {
+		headerSize += 8
+		if tsType == TimestampLogAppendTime {
+			attributes |= timestampTypeMask
+		}
 	}
 
 	totalSize := 0
 	b := newSliceWriter(0)
+	enc := NewEncoder(b)
 	for _, message := range messages {
-		bsize := 26 + len(message.Key) + len(message.Value)
+		msize := int32(headerSize + 4 + len(message.Key) + 4 + len(message.Value))
+		bsize := 8 + 4 + int(msize)
 		b.Reset(bsize)
 
-		enc := NewEncoder(b)
 		enc.EncodeInt64(message.Offset)
-		msize := int32(14 + len(message.Key) + len(message.Value))
 		enc.EncodeInt32(msize)
 		enc.EncodeUint32(0) // crc32 placeholder
-		enc.EncodeInt8(0)   // magic byte
-		enc.EncodeInt8(int8(compression))
+		enc.EncodeInt8(magic)
+		enc.EncodeInt8(attributes)
+		if magic >= messageMagicV1 {
+			enc.EncodeInt64(encodeTimestamp(message.Timestamp))
+		}
 		enc.EncodeBytes(message.Key)
 		enc.EncodeBytes(message.Value)
 
@@ -192,6 +537,36 @@ func writeMessageSet(w io.Writer, messages []*Message, compression Compression)
 	return totalSize, nil
 }
 
+// messageSize returns the size of given message encoded using given message
+// format magic byte, without compression, including the offset and size
+// fields preceding it in a message set.
+func messageSize(m *Message, magic int8) int {
+	// offset + message size + crc32 + magic byte + attributes
+	size := 8 + 4 + 4 + 1 + 1
+	if magic >= messageMagicV1 {
+		size += 8 // timestamp
+	}
+	return size + 4 + len(m.Key) + 4 + len(m.Value)
+}
+
+// messageSetSize returns the size of given messages encoded as message set
+// using given message format magic byte, without compression.
+func messageSetSize(messages []*Message, magic int8) int {
+	size := 0
+	for _, m := range messages {
+		size += messageSize(m, magic)
+	}
+	return size
+}
+
+// EstimateMessageSize returns the size given message takes in the message set
+// of a produce request of version 2, the latest one encoding messages, when
+// no compression is used. The size is an upper bound for older versions.
+// Record batches, sent by version 3, are never encoded from messages.
+func EstimateMessageSize(m *Message) int {
+	return messageSize(m, messageMagicV1)
+}
+
 type slicewriter struct {
 	buf  []byte
 	pos  int
@@ -233,26 +608,59 @@ func (w *slicewriter) Slice() []byte {
 // shorter than the header is saying. In such case just ignore the last
 // malformed message from the set and returned earlier data.
 func readMessageSet(r io.Reader, size int32) ([]*Message, error) {
-	rd := io.LimitReader(r, int64(size))
+	set, _, err := readMessageSetInfo(r, size, nil)
+	return set, err
+}
+
+// messageSetInfo describes a message set beyond the messages it contains.
+type messageSetInfo struct {
+	// leaderEpoch is the partition leader epoch of the last record batch
+	// read, including control batches, or -1 if there was none.
+	leaderEpoch int32
+
+	// format is the format of the first message or record batch read, or
+	// MessageFormatUnknown if there was none.
+	format MessageFormat
+
+	// controls are the transaction markers of the control batches read.
+	controls []ControlRecord
+
+	// size is the number of bytes of the entries read, up to the first
+	// partial or corrupted one.
+	size int
+}
+
+// readMessageSetInfo works like readMessageSet, but also returns information
+// about the message set read, and counts decompressed messages in given
+// counters.
+func readMessageSetInfo(r io.Reader, size int32, counters *CompressionCounters) ([]*Message, messageSetInfo, error) {
+	rd := &io.LimitedReader{R: r, N: int64(size)}
 	dec := NewDecoder(rd)
 	set := make([]*Message, 0, 256)
+	info := messageSetInfo{leaderEpoch: -1, format: MessageFormatUnknown}
 
 	var buf []byte
 	for {
 		offset := dec.DecodeInt64()
 		if err := dec.Err(); err != nil {
 			if err == io.EOF || err == io.ErrUnexpectedEOF {
-				return set, nil
+				return set, info, nil
 			}
-			return nil, err
+			return nil, info, err
 		}
 		// single message size
 		size := dec.DecodeInt32()
 		if err := dec.Err(); err != nil {
 			if err == io.EOF || err == io.ErrUnexpectedEOF {
-				return set, nil
+				return set, info, nil
 			}
-			return nil, err
+			return nil, info, err
+		}
+
+		if size < 0 || int64(size) > rd.N {
+			// corrupted or cut off message, handled just like when it
+			// is partially read
+			return set, info, nil
 		}
 
 		// read message to buffer to compute its content crc
@@ -264,9 +672,33 @@ func readMessageSet(r io.Reader, size int32) ([]*Message, error) {
 
 		if _, err := io.ReadFull(rd, msgbuf); err != nil {
 			if err == io.EOF || err == io.ErrUnexpectedEOF {
-				return set, nil
+				return set, info, nil
+			}
+			return nil, info, err
+		}
+		if len(msgbuf) > 4 && info.format == MessageFormatUnknown {
+			info.format = MessageFormat(msgbuf[4])
+		}
+		if len(msgbuf) > 4 && msgbuf[4] == messageMagicV2 {
+			msgs, controls, epoch, err := readRecordBatch(offset, msgbuf, counters)
+			if err != nil {
+				if err == ErrInvalidMessage {
+					// same as with the old message format, stop
+					// processing on the first corrupted batch
+					return set, info, nil
+				}
+				return nil, info, err
 			}
-			return nil, err
+			set = append(set, msgs...)
+			info.controls = append(info.controls, controls...)
+			info.leaderEpoch = epoch
+			info.size += 8 + 4 + int(size)
+			continue
+		}
+
+		if len(msgbuf) < 4+1+1 {
+			// too short for crc32, magic byte and attributes
+			return set, info, nil
 		}
 		msgdec := NewDecoder(bytes.NewBuffer(msgbuf))
 
@@ -278,61 +710,112 @@ func readMessageSet(r io.Reader, size int32) ([]*Message, error) {
 		if msg.Crc != crc32.ChecksumIEEE(msgbuf[4:]) {
 			// ignore this message and because we want to have constant
 			// history, do not process anything more
-			return set, nil
+			return set, info, nil
 		}
 
-		// magic byte
-		_ = msgdec.DecodeInt8()
-
+		magic := msgdec.DecodeInt8()
 		attributes := msgdec.DecodeInt8()
-		switch compression := Compression(attributes & 3); compression {
+		if magic >= messageMagicV1 {
+			msg.TimestampType = TimestampType((attributes & timestampTypeMask) >> 3)
+			msg.Timestamp = decodeTimestamp(msgdec.DecodeInt64())
+		}
+
+		switch compression := Compression(attributes & compressionMask); compression {
 		case CompressionNone:
 			msg.Key = msgdec.DecodeBytes()
 			msg.Value = msgdec.DecodeBytes()
 			if err := msgdec.Err(); err != nil {
-				return nil, fmt.Errorf("cannot decode message: %s", err)
+				return nil, info, fmt.Errorf("cannot decode message: %s", err)
 			}
 			set = append(set, msg)
 		case CompressionGzip, CompressionSnappy:
 			_ = msgdec.DecodeBytes() // ignore key
 			val := msgdec.DecodeBytes()
 			if err := msgdec.Err(); err != nil {
-				return nil, fmt.Errorf("cannot decode message: %s", err)
+				return nil, info, fmt.Errorf("cannot decode message: %s", err)
 			}
-			var decoded []byte
-			switch compression {
-			case CompressionGzip:
-				cr, err := gzip.NewReader(bytes.NewReader(val))
-				if err != nil {
-					return nil, fmt.Errorf("error decoding gzip message: %s", err)
-				}
-				decoded, err = ioutil.ReadAll(cr)
-				if err != nil {
-					return nil, fmt.Errorf("error decoding gzip message: %s", err)
-				}
-				_ = cr.Close()
-			case CompressionSnappy:
-				var err error
-				decoded, err = snappyDecode(val)
-				if err != nil {
-					return nil, fmt.Errorf("error decoding snappy message: %s", err)
-				}
+			decoded, err := decompress(compression, val, counters)
+			if err != nil {
+				return nil, info, err
 			}
-			msgs, err := readMessageSet(bytes.NewReader(decoded), int32(len(decoded)))
+			msgs, _, err := readMessageSetInfo(bytes.NewReader(decoded), int32(len(decoded)), counters)
 			if err != nil {
-				return nil, err
+				return nil, info, err
+			}
+			if magic >= messageMagicV1 && len(msgs) > 0 {
+				// inner offsets are relative, with the wrapper message
+				// holding the absolute offset of the last one
+				base := msg.Offset - msgs[len(msgs)-1].Offset
+				for _, m := range msgs {
+					m.Offset += base
+					if msg.TimestampType == TimestampLogAppendTime {
+						m.CreateTimestamp = m.Timestamp
+						m.Timestamp = msg.Timestamp
+						m.TimestampType = TimestampLogAppendTime
+					}
+				}
 			}
 			set = append(set, msgs...)
 		default:
-			return nil, fmt.Errorf("cannot handle compression method: %d", compression)
+			return nil, info, fmt.Errorf("cannot handle compression method: %d", compression)
 		}
+		info.size += 8 + 4 + int(size)
 	}
 }
 
 type MetadataReq struct {
 	CorrelationID int32
 	ClientID      string
-	Topics        []string
+
+	// Topics to return metadata of. Nil Topics ask for all topics, while
+	// empty, non nil Topics ask for no topic at all, which cannot be sent
+	// with version 0. Use NewMetadataReq to make the choice explicit.
+	Topics []string
+
+	// Version of the metadata request. Responses to version 1 and above
+	// carry the controller ID, version 2 and above the cluster ID, version
+	// 3 and above the throttle time.
+	Version int16
+}
+
+// MetadataTopics selects the topics a metadata request asks for. The zero
+// value selects no topic, so that only brokers and the controller are
+// returned.
+type MetadataTopics struct {
+	all   bool
+	names []string
+}
+
+// AllTopics selects all topics of the cluster. Such requests are expensive on
+// large clusters.
+var AllTopics = MetadataTopics{all: true}
+
+// TopicNames selects given topics only. Without names, no topic is selected.
+func TopicNames(names ...string) MetadataTopics {
+	return MetadataTopics{names: names}
+}
+
+// All reports whether all topics are selected.
+func (t MetadataTopics) All() bool {
+	return t.all
+}
+
+// Names returns the selected topics, or nil if all topics are selected.
+func (t MetadataTopics) Names() []string {
+	return t.names
+}
+
+// NewMetadataReq returns metadata request asking for given topics. Version 0
+// cannot ask for no topic, so such request is created with version 1.
+func NewMetadataReq(clientID string, topics MetadataTopics) *MetadataReq {
+	req := &MetadataReq{ClientID: clientID}
+	if !topics.all {
+		req.Topics = append([]string{}, topics.names...)
+		if len(req.Topics) == 0 {
+			req.Version = 1
+		}
+	}
+	return req
 }
 
 func ReadMetadataReq(r io.Reader) (*MetadataReq, error) {
@@ -341,11 +824,15 @@ func ReadMetadataReq(r io.Reader) (*MetadataReq, error) {
 
 	// total message size
 	_ = dec.DecodeInt32()
-	// api key + api version
-	_ = dec.DecodeInt32()
+	// api key
+	_ = dec.DecodeInt16()
+	req.Version = dec.DecodeInt16()
 	req.CorrelationID = dec.DecodeInt32()
 	req.ClientID = dec.DecodeString()
-	req.Topics = make([]string, dec.DecodeArrayLen())
+	// version 0 asks for all topics with empty array
+	if n := dec.DecodeNullableArrayLen(); n > 0 || (n == 0 && req.Version >= 1) {
+		req.Topics = make([]string, n)
+	}
 	for i := range req.Topics {
 		req.Topics[i] = dec.DecodeString()
 	}
@@ -357,17 +844,30 @@ func ReadMetadataReq(r io.Reader) (*MetadataReq, error) {
 }
 
 func (r *MetadataReq) Bytes() ([]byte, error) {
+	if err := checkRequestVersion(MetadataReqKind, r.Version); err != nil {
+		return nil, err
+	}
+
 	var buf bytes.Buffer
 	enc := NewEncoder(&buf)
 
 	// message size - for now just placeholder
 	enc.Encode(int32(0))
 	enc.Encode(int16(MetadataReqKind))
-	enc.Encode(int16(0))
+	enc.Encode(r.Version)
 	enc.Encode(r.CorrelationID)
 	enc.Encode(r.ClientID)
 
-	enc.EncodeArrayLen(len(r.Topics))
+	if r.Version == 0 && r.Topics != nil && len(r.Topics) == 0 {
+		// empty array would return all topics instead
+		return nil, errors.New("metadata request v0 cannot ask for no topic")
+	}
+	if r.Version >= 1 && r.Topics == nil {
+		// null array requests all topics
+		enc.EncodeArrayLen(-1)
+	} else {
+		enc.EncodeArrayLen(len(r.Topics))
+	}
 	for _, name := range r.Topics {
 		enc.Encode(name)
 	}
@@ -392,22 +892,52 @@ func (r *MetadataReq) WriteTo(w io.Writer) (int64, error) {
 	return int64(n), err
 }
 
+func (r *MetadataReq) Kind() int16 {
+	return MetadataReqKind
+}
+
+func (r *MetadataReq) SetCorrelationID(id int32) {
+	r.CorrelationID = id
+}
+
+func (r *MetadataReq) GetClientID() string {
+	return r.ClientID
+}
+
+func (r *MetadataReq) SetClientID(id string) {
+	r.ClientID = id
+}
+
 type MetadataResp struct {
 	CorrelationID int32
 	Brokers       []MetadataRespBroker
 	Topics        []MetadataRespTopic
+
+	// Version of the request this response was returned for.
+	Version      int16
+	ThrottleTime time.Duration // set for version 3 and above
+	ClusterID    string        // set for version 2 and above
+	ControllerID int32         // set for version 1 and above
 }
 
+// MetadataRespBroker is the endpoint of a broker. Brokers with several
+// listeners advertise only the endpoint of the listener the metadata request
+// was received on, so that it is of the same security protocol as the
+// connection the request was sent through. Endpoints of other listeners are
+// never part of metadata responses; ask a broker listening with the wanted
+// protocol to get them.
 type MetadataRespBroker struct {
 	NodeID int32
 	Host   string
 	Port   int32
+	Rack   string // set for version 1 and above, empty if not configured
 }
 
 type MetadataRespTopic struct {
 	Name       string
 	Err        error
 	Partitions []MetadataRespPartition
+	IsInternal bool // set for version 1 and above
 }
 
 type MetadataRespPartition struct {
@@ -425,16 +955,35 @@ func (r *MetadataResp) Bytes() ([]byte, error) {
 	// message size - for now just placeholder
 	enc.Encode(int32(0))
 	enc.Encode(r.CorrelationID)
+	if r.Version >= 3 {
+		enc.Encode(int32(r.ThrottleTime / time.Millisecond))
+	}
 	enc.EncodeArrayLen(len(r.Brokers))
 	for _, broker := range r.Brokers {
 		enc.Encode(broker.NodeID)
 		enc.Encode(broker.Host)
 		enc.Encode(broker.Port)
+		if r.Version >= 1 {
+			enc.EncodeNullableString(broker.Rack)
+		}
+	}
+	if r.Version >= 2 {
+		enc.EncodeNullableString(r.ClusterID)
+	}
+	if r.Version >= 1 {
+		enc.Encode(r.ControllerID)
 	}
 	enc.EncodeArrayLen(len(r.Topics))
 	for _, topic := range r.Topics {
 		enc.EncodeError(topic.Err)
 		enc.Encode(topic.Name)
+		if r.Version >= 1 {
+			var internal int8
+			if topic.IsInternal {
+				internal = 1
+			}
+			enc.Encode(internal)
+		}
 		enc.EncodeArrayLen(len(topic.Partitions))
 		for _, part := range topic.Partitions {
 			enc.EncodeError(part.Err)
@@ -456,13 +1005,22 @@ func (r *MetadataResp) Bytes() ([]byte, error) {
 	return b, nil
 }
 
+// ReadMetadataResp reads metadata response of version 0.
 func ReadMetadataResp(r io.Reader) (*MetadataResp, error) {
+	return ReadVersionedMetadataResp(r, 0)
+}
+
+// ReadVersionedMetadataResp reads metadata response returned for request of
+// given version.
+func ReadVersionedMetadataResp(r io.Reader, version int16) (*MetadataResp, error) {
 	var resp MetadataResp
 	dec := NewDecoder(r)
 
-	// total message size
-	_ = dec.DecodeInt32()
-	resp.CorrelationID = dec.DecodeInt32()
+	resp.CorrelationID = dec.DecodeRespHeader(RespHeaderVersion(MetadataReqKind, version))
+	resp.Version = version
+	if version >= 3 {
+		resp.ThrottleTime = time.Duration(dec.DecodeInt32()) * time.Millisecond
+	}
 
 	resp.Brokers = make([]MetadataRespBroker, dec.DecodeArrayLen())
 	for i := range resp.Brokers {
@@ -470,6 +1028,15 @@ func ReadMetadataResp(r io.Reader) (*MetadataResp, error) {
 		b.NodeID = dec.DecodeInt32()
 		b.Host = dec.DecodeString()
 		b.Port = dec.DecodeInt32()
+		if version >= 1 {
+			b.Rack = dec.DecodeString()
+		}
+	}
+	if version >= 2 {
+		resp.ClusterID = dec.DecodeString()
+	}
+	if version >= 1 {
+		resp.ControllerID = dec.DecodeInt32()
 	}
 
 	resp.Topics = make([]MetadataRespTopic, dec.DecodeArrayLen())
@@ -477,6 +1044,9 @@ func ReadMetadataResp(r io.Reader) (*MetadataResp, error) {
 		var t = &resp.Topics[ti]
 		t.Err = errFromNo(dec.DecodeInt16())
 		t.Name = dec.DecodeString()
+		if version >= 1 {
+			t.IsInternal = dec.DecodeInt8() != 0
+		}
 		t.Partitions = make([]MetadataRespPartition, dec.DecodeArrayLen())
 		for pi := range t.Partitions {
 			var p = &t.Partitions[pi]
@@ -497,7 +1067,7 @@ func ReadMetadataResp(r io.Reader) (*MetadataResp, error) {
 	}
 
 	if dec.Err() != nil {
-		return nil, dec.Err()
+		return nil, dec.parseErr(MetadataReqKind, version, dec.Err())
 	}
 	return &resp, nil
 }
@@ -508,7 +1078,34 @@ type FetchReq struct {
 	MaxWaitTime   time.Duration
 	MinBytes      int32
 
+	// Version of the fetch request. Responses to version 1 and above carry
+	// the throttle time, version 2 and above return messages with timestamps.
+	Version int16
+
+	// MaxBytes limits the size of the whole response. Sent with version 3
+	// and above, zero means no limit.
+	MaxBytes int32
+
+	// IsolationLevel controls visibility of transactional messages. Sent
+	// with version 4 and above.
+	IsolationLevel int8
+
+	// SessionID and SessionEpoch identify incremental fetch session. Sent
+	// with version 7 and above. Zero session ID and epoch request a full
+	// fetch that creates a new session.
+	SessionID    int32
+	SessionEpoch int32
+
 	Topics []FetchReqTopic
+
+	// ForgottenTopics lists partitions to remove from the incremental fetch
+	// session. Sent with version 7 and above.
+	ForgottenTopics []FetchReqForgottenTopic
+
+	// MaxMessagesPerPartition limits the number of messages returned for
+	// every partition. It is never sent to the broker, the limit is applied
+	// by the client after the response is decoded. Zero means no limit.
+	MaxMessagesPerPartition int
 }
 
 type FetchReqTopic struct {
@@ -522,20 +1119,36 @@ type FetchReqPartition struct {
 	MaxBytes    int32
 }
 
+type FetchReqForgottenTopic struct {
+	Name       string
+	Partitions []int32
+}
+
 func ReadFetchReq(r io.Reader) (*FetchReq, error) {
 	var req FetchReq
 	dec := NewDecoder(r)
 
 	// total message size
 	_ = dec.DecodeInt32()
-	// api key + api version
-	_ = dec.DecodeInt32()
+	// api key
+	_ = dec.DecodeInt16()
+	req.Version = dec.DecodeInt16()
 	req.CorrelationID = dec.DecodeInt32()
 	req.ClientID = dec.DecodeString()
 	// replica id
 	_ = dec.DecodeInt32()
 	req.MaxWaitTime = time.Duration(dec.DecodeInt32()) * time.Millisecond
 	req.MinBytes = dec.DecodeInt32()
+	if req.Version >= 3 {
+		req.MaxBytes = dec.DecodeInt32()
+	}
+	if req.Version >= 4 {
+		req.IsolationLevel = dec.DecodeInt8()
+	}
+	if req.Version >= 7 {
+		req.SessionID = dec.DecodeInt32()
+		req.SessionEpoch = dec.DecodeInt32()
+	}
 	req.Topics = make([]FetchReqTopic, dec.DecodeArrayLen())
 	for ti := range req.Topics {
 		var topic = &req.Topics[ti]
@@ -545,9 +1158,25 @@ func ReadFetchReq(r io.Reader) (*FetchReq, error) {
 			var part = &topic.Partitions[pi]
 			part.ID = dec.DecodeInt32()
 			part.FetchOffset = dec.DecodeInt64()
+			if req.Version >= 5 {
+				_ = dec.DecodeInt64() // log start offset
+			}
 			part.MaxBytes = dec.DecodeInt32()
 		}
 	}
+	if req.Version >= 7 {
+		if n := dec.DecodeArrayLen(); n > 0 {
+			req.ForgottenTopics = make([]FetchReqForgottenTopic, n)
+		}
+		for ti := range req.ForgottenTopics {
+			var topic = &req.ForgottenTopics[ti]
+			topic.Name = dec.DecodeString()
+			topic.Partitions = make([]int32, dec.DecodeArrayLen())
+			for pi := range topic.Partitions {
+				topic.Partitions[pi] = dec.DecodeInt32()
+			}
+		}
+	}
 
 	if dec.Err() != nil {
 		return nil, dec.Err()
@@ -556,13 +1185,17 @@ func ReadFetchReq(r io.Reader) (*FetchReq, error) {
 }
 
 func (r *FetchReq) Bytes() ([]byte, error) {
+	if err := checkRequestVersion(FetchReqKind, r.Version); err != nil {
+		return nil, err
+	}
+
 	var buf bytes.Buffer
 	enc := NewEncoder(&buf)
 
 	// message size - for now just placeholder
 	enc.Encode(int32(0))
 	enc.Encode(int16(FetchReqKind))
-	enc.Encode(int16(0))
+	enc.Encode(r.Version)
 	enc.Encode(r.CorrelationID)
 	enc.Encode(r.ClientID)
 
@@ -570,6 +1203,20 @@ func (r *FetchReq) Bytes() ([]byte, error) {
 	enc.Encode(int32(-1))
 	enc.Encode(int32(r.MaxWaitTime / time.Millisecond))
 	enc.Encode(r.MinBytes)
+	if r.Version >= 3 {
+		maxBytes := r.MaxBytes
+		if maxBytes == 0 {
+			maxBytes = math.MaxInt32
+		}
+		enc.Encode(maxBytes)
+	}
+	if r.Version >= 4 {
+		enc.Encode(r.IsolationLevel)
+	}
+	if r.Version >= 7 {
+		enc.Encode(r.SessionID)
+		enc.Encode(r.SessionEpoch)
+	}
 
 	enc.EncodeArrayLen(len(r.Topics))
 	for _, topic := range r.Topics {
@@ -578,9 +1225,19 @@ func (r *FetchReq) Bytes() ([]byte, error) {
 		for _, part := range topic.Partitions {
 			enc.Encode(part.ID)
 			enc.Encode(part.FetchOffset)
+			if r.Version >= 5 {
+				enc.Encode(int64(-1)) // log start offset
+			}
 			enc.Encode(part.MaxBytes)
 		}
 	}
+	if r.Version >= 7 {
+		enc.EncodeArrayLen(len(r.ForgottenTopics))
+		for _, topic := range r.ForgottenTopics {
+			enc.Encode(topic.Name)
+			enc.Encode(topic.Partitions)
+		}
+	}
 
 	if enc.Err() != nil {
 		return nil, enc.Err()
@@ -602,9 +1259,34 @@ func (r *FetchReq) WriteTo(w io.Writer) (int64, error) {
 	return int64(n), err
 }
 
+func (r *FetchReq) Kind() int16 {
+	return FetchReqKind
+}
+
+func (r *FetchReq) SetCorrelationID(id int32) {
+	r.CorrelationID = id
+}
+
+func (r *FetchReq) GetClientID() string {
+	return r.ClientID
+}
+
+func (r *FetchReq) SetClientID(id string) {
+	r.ClientID = id
+}
+
 type FetchResp struct {
 	CorrelationID int32
 	Topics        []FetchRespTopic
+
+	// Version of the request this response was returned for.
+	Version      int16
+	ThrottleTime time.Duration // set for version 1 and above
+
+	// Err and SessionID are set for version 7 and above. Err reports
+	// failures of the whole request, such as unknown fetch session.
+	Err       error
+	SessionID int32
 }
 
 type FetchRespTopic struct {
@@ -617,6 +1299,45 @@ type FetchRespPartition struct {
 	Err       error
 	TipOffset int64
 	Messages  []*Message
+
+	// LastStableOffset is set for version 4 and above. Messages of
+	// transactions that are still open start at this offset, so consumers
+	// reading only committed messages should compute their lag against it
+	// instead of TipOffset. Brokers return -1 if it is unknown.
+	LastStableOffset int64
+
+	// LogStartOffset is set for version 5 and above to the offset of the
+	// oldest message of the partition. Consumers whose offset is no longer
+	// available can reset to it.
+	LogStartOffset int64
+
+	// LeaderEpoch is set for version 4 and above to the partition leader
+	// epoch of the last record batch returned, or -1 if none was returned.
+	// Consumers track it to detect log truncation after leader changes.
+	// It is not sent when encoding the response.
+	LeaderEpoch int32
+
+	// NextOffset is the offset the next fetch should continue from. It is
+	// not part of the response and only set by the client when the request
+	// had MaxMessagesPerPartition limit set.
+	NextOffset int64
+
+	// MessageFormat is the format of the first message or record batch
+	// returned, which tells the message.format.version the broker stores
+	// the partition in, or MessageFormatUnknown if no data was returned.
+	// It is not sent when encoding the response.
+	MessageFormat MessageFormat
+
+	// ControlRecords are the transaction markers returned along with the
+	// messages, which are needed to track the state of transactions. They
+	// are not sent when encoding the response.
+	ControlRecords []ControlRecord
+
+	// RawMessageSet is the message set as returned by the broker, up to
+	// the first partial or corrupted entry, so that it can be produced
+	// verbatim with ProduceReqPartition.RawMessageSet. It is only set by
+	// ReadRawFetchResp, and not sent when encoding the response.
+	RawMessageSet []byte
 }
 
 func (r *FetchResp) Bytes() ([]byte, error) {
@@ -625,6 +1346,13 @@ func (r *FetchResp) Bytes() ([]byte, error) {
 
 	enc.Encode(int32(0)) // placeholder
 	enc.Encode(r.CorrelationID)
+	if r.Version >= 1 {
+		enc.Encode(int32(r.ThrottleTime / time.Millisecond))
+	}
+	if r.Version >= 7 {
+		enc.EncodeError(r.Err)
+		enc.Encode(r.SessionID)
+	}
 	enc.EncodeArrayLen(len(r.Topics))
 	for _, topic := range r.Topics {
 		enc.Encode(topic.Name)
@@ -633,11 +1361,21 @@ func (r *FetchResp) Bytes() ([]byte, error) {
 			enc.Encode(part.ID)
 			enc.EncodeError(part.Err)
 			enc.Encode(part.TipOffset)
+			if r.Version >= 4 {
+				enc.Encode(part.LastStableOffset)
+			}
+			if r.Version >= 5 {
+				enc.Encode(part.LogStartOffset)
+			}
+			if r.Version >= 4 {
+				enc.EncodeArrayLen(0) // aborted transactions
+			}
 			i := len(buf)
 			enc.Encode(int32(0)) // placeholder
 			// NOTE(caleb): writing compressed fetch response isn't implemented
 			// for now, since that's not needed for clients.
-			n, err := writeMessageSet(&buf, part.Messages, CompressionNone)
+			n, err := encodeMessageSet(&buf, part.Messages, CompressionNone,
+				gzip.DefaultCompression, messageMagic(r.Version), TimestampCreateTime, nil)
 			if err != nil {
 				return nil, err
 			}
@@ -653,15 +1391,45 @@ func (r *FetchResp) Bytes() ([]byte, error) {
 	return []byte(buf), nil
 }
 
+// ReadFetchResp reads fetch response of version 0.
 func ReadFetchResp(r io.Reader) (*FetchResp, error) {
+	return ReadVersionedFetchResp(r, 0)
+}
+
+// ReadVersionedFetchResp reads fetch response returned for request of given
+// version.
+func ReadVersionedFetchResp(r io.Reader, version int16) (*FetchResp, error) {
+	return readFetchResp(r, version, false, nil)
+}
+
+// ReadRawFetchResp works like ReadVersionedFetchResp, but also keeps the
+// message set of every partition in its RawMessageSet.
+func ReadRawFetchResp(r io.Reader, version int16) (*FetchResp, error) {
+	return readFetchResp(r, version, true, nil)
+}
+
+// ReadCountedFetchResp works like ReadVersionedFetchResp, or ReadRawFetchResp
+// if raw is set, but also counts the messages it decompresses in given
+// counters.
+func ReadCountedFetchResp(r io.Reader, version int16, raw bool, counters *CompressionCounters) (*FetchResp, error) {
+	return readFetchResp(r, version, raw, counters)
+}
+
+func readFetchResp(r io.Reader, version int16, raw bool, counters *CompressionCounters) (*FetchResp, error) {
 	var err error
 	var resp FetchResp
 
 	dec := NewDecoder(r)
 
-	// total message size
-	_ = dec.DecodeInt32()
-	resp.CorrelationID = dec.DecodeInt32()
+	resp.CorrelationID = dec.DecodeRespHeader(RespHeaderVersion(FetchReqKind, version))
+	resp.Version = version
+	if version >= 1 {
+		resp.ThrottleTime = time.Duration(dec.DecodeInt32()) * time.Millisecond
+	}
+	if version >= 7 {
+		resp.Err = errFromNo(dec.DecodeInt16())
+		resp.SessionID = dec.DecodeInt32()
+	}
 
 	resp.Topics = make([]FetchRespTopic, dec.DecodeArrayLen())
 	for ti := range resp.Topics {
@@ -673,16 +1441,50 @@ func ReadFetchResp(r io.Reader) (*FetchResp, error) {
 			part.ID = dec.DecodeInt32()
 			part.Err = errFromNo(dec.DecodeInt16())
 			part.TipOffset = dec.DecodeInt64()
+			if version >= 4 {
+				part.LastStableOffset = dec.DecodeInt64()
+			}
+			if version >= 5 {
+				part.LogStartOffset = dec.DecodeInt64()
+			}
+			if version >= 4 {
+				// aborted transactions
+				for i, n := 0, dec.DecodeArrayLen(); i < n; i++ {
+					_ = dec.DecodeInt64() // producer id
+					_ = dec.DecodeInt64() // first offset
+				}
+			}
 			if dec.Err() != nil {
-				return nil, dec.Err()
+				return nil, dec.parseErr(FetchReqKind, version, dec.Err())
 			}
 			msgSetSize := dec.DecodeInt32()
 			if dec.Err() != nil {
-				return nil, dec.Err()
+				return nil, dec.parseErr(FetchReqKind, version, dec.Err())
 			}
-			if part.Messages, err = readMessageSet(r, msgSetSize); err != nil {
-				return nil, err
+			msgSetSize = dec.clampLen(msgSetSize)
+			var set io.Reader = dec.r
+			var rawSet []byte
+			if raw && msgSetSize > 0 {
+				rawSet = make([]byte, msgSetSize)
+				n, err := io.ReadFull(dec.r, rawSet)
+				if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+					return nil, dec.parseErr(FetchReqKind, version, err)
+				}
+				rawSet = rawSet[:n]
+				set = bytes.NewReader(rawSet)
 			}
+			var info messageSetInfo
+			if part.Messages, info, err = readMessageSetInfo(set, msgSetSize, counters); err != nil {
+				return nil, dec.parseErr(FetchReqKind, version, err)
+			}
+			if rawSet != nil {
+				part.RawMessageSet = rawSet[:info.size]
+			}
+			if version >= 4 {
+				part.LeaderEpoch = info.leaderEpoch
+			}
+			part.MessageFormat = info.format
+			part.ControlRecords = info.controls
 			for _, msg := range part.Messages {
 				msg.Topic = topic.Name
 				msg.Partition = part.ID
@@ -692,7 +1494,7 @@ func ReadFetchResp(r io.Reader) (*FetchResp, error) {
 	}
 
 	if dec.Err() != nil {
-		return nil, dec.Err()
+		return nil, dec.parseErr(FetchReqKind, version, dec.Err())
 	}
 	return &resp, nil
 }
@@ -754,6 +1556,22 @@ func (r *GroupCoordinatorReq) WriteTo(w io.Writer) (int64, error) {
 	return int64(n), err
 }
 
+func (r *GroupCoordinatorReq) Kind() int16 {
+	return GroupCoordinatorReqKind
+}
+
+func (r *GroupCoordinatorReq) SetCorrelationID(id int32) {
+	r.CorrelationID = id
+}
+
+func (r *GroupCoordinatorReq) GetClientID() string {
+	return r.ClientID
+}
+
+func (r *GroupCoordinatorReq) SetClientID(id string) {
+	r.ClientID = id
+}
+
 type GroupCoordinatorResp struct {
 	CorrelationID   int32
 	Err             error
@@ -775,7 +1593,7 @@ func ReadGroupCoordinatorResp(r io.Reader) (*GroupCoordinatorResp, error) {
 	resp.CoordinatorPort = dec.DecodeInt32()
 
 	if err := dec.Err(); err != nil {
-		return nil, err
+		return nil, dec.parseErr(GroupCoordinatorReqKind, 0, err)
 	}
 	return &resp, nil
 }
@@ -808,6 +1626,14 @@ type OffsetCommitReq struct {
 	ClientID      string
 	ConsumerGroup string
 	Topics        []OffsetCommitReqTopic
+
+	// GenerationID and MemberID identify the group member committing the
+	// offsets, so that the broker can reject commits of members that are no
+	// longer part of the current group generation with ErrIllegalGeneration
+	// or ErrUnknownMemberID. If MemberID is empty, offsets are committed
+	// with generation -1, without being fenced.
+	GenerationID int32
+	MemberID     string
 }
 
 type OffsetCommitReqTopic struct {
@@ -835,8 +1661,8 @@ func ReadOffsetCommitReq(r io.Reader) (*OffsetCommitReq, error) {
 	req.ClientID = dec.DecodeString()
 	req.ConsumerGroup = dec.DecodeString()
 	if apiVersion == 1 {
-		_ = dec.DecodeInt32()
-		_ = dec.DecodeString()
+		req.GenerationID = dec.DecodeInt32()
+		req.MemberID = dec.DecodeString()
 	}
 	req.Topics = make([]OffsetCommitReqTopic, dec.DecodeArrayLen())
 	for ti := range req.Topics {
@@ -870,8 +1696,12 @@ func (r *OffsetCommitReq) Bytes() ([]byte, error) {
 	enc.Encode(r.ClientID)
 
 	enc.Encode(r.ConsumerGroup)
-	enc.Encode(int32(-1)) // ConsumerGroupGenerationId
-	enc.Encode("")        // ConsumerId
+	if r.MemberID == "" {
+		enc.Encode(int32(-1))
+	} else {
+		enc.Encode(r.GenerationID)
+	}
+	enc.Encode(r.MemberID)
 
 	enc.EncodeArrayLen(len(r.Topics))
 	for _, topic := range r.Topics {
@@ -905,6 +1735,22 @@ func (r *OffsetCommitReq) WriteTo(w io.Writer) (int64, error) {
 	return int64(n), err
 }
 
+func (r *OffsetCommitReq) Kind() int16 {
+	return OffsetCommitReqKind
+}
+
+func (r *OffsetCommitReq) SetCorrelationID(id int32) {
+	r.CorrelationID = id
+}
+
+func (r *OffsetCommitReq) GetClientID() string {
+	return r.ClientID
+}
+
+func (r *OffsetCommitReq) SetClientID(id string) {
+	r.ClientID = id
+}
+
 type OffsetCommitResp struct {
 	CorrelationID int32
 	Topics        []OffsetCommitRespTopic
@@ -920,6 +1766,28 @@ type OffsetCommitRespPartition struct {
 	Err error
 }
 
+// Errors returns errors of partitions whose offsets were not committed, by
+// topic and partition. Nil is returned if all offsets of the request were
+// committed, so that a commit can be checked with a single length check.
+func (r *OffsetCommitResp) Errors() map[string]map[int32]error {
+	var errs map[string]map[int32]error
+	for _, t := range r.Topics {
+		for _, p := range t.Partitions {
+			if p.Err == nil {
+				continue
+			}
+			if errs == nil {
+				errs = make(map[string]map[int32]error)
+			}
+			if errs[t.Name] == nil {
+				errs[t.Name] = make(map[int32]error)
+			}
+			errs[t.Name][p.ID] = p.Err
+		}
+	}
+	return errs
+}
+
 func ReadOffsetCommitResp(r io.Reader) (*OffsetCommitResp, error) {
 	var resp OffsetCommitResp
 	dec := NewDecoder(r)
@@ -940,7 +1808,7 @@ func ReadOffsetCommitResp(r io.Reader) (*OffsetCommitResp, error) {
 	}
 
 	if err := dec.Err(); err != nil {
-		return nil, err
+		return nil, dec.parseErr(OffsetCommitReqKind, 0, err)
 	}
 	return &resp, nil
 }
@@ -979,6 +1847,17 @@ type OffsetFetchReq struct {
 	ClientID      string
 	ConsumerGroup string
 	Topics        []OffsetFetchReqTopic
+
+	// Version of the offset fetch request. Versions below 1 are sent as
+	// version 1, to use offsets committed to kafka instead of zookeeper.
+	// Responses to version 2 and above carry the group error, version 3
+	// and above the throttle time.
+	Version int16
+
+	// AllPartitions requests committed offsets of all partitions of the
+	// consumer group, in which case Topics must be empty. Requires version
+	// 2 or above.
+	AllPartitions bool
 }
 
 type OffsetFetchReqTopic struct {
@@ -992,12 +1871,18 @@ func ReadOffsetFetchReq(r io.Reader) (*OffsetFetchReq, error) {
 
 	// total message size
 	_ = dec.DecodeInt32()
-	// api key + api version
-	_ = dec.DecodeInt32()
+	// api key
+	_ = dec.DecodeInt16()
+	req.Version = dec.DecodeInt16()
 	req.CorrelationID = dec.DecodeInt32()
 	req.ClientID = dec.DecodeString()
 	req.ConsumerGroup = dec.DecodeString()
-	req.Topics = make([]OffsetFetchReqTopic, dec.DecodeArrayLen())
+	topics := dec.DecodeNullableArrayLen()
+	if topics < 0 {
+		req.AllPartitions = true
+		topics = 0
+	}
+	req.Topics = make([]OffsetFetchReqTopic, topics)
 	for ti := range req.Topics {
 		var topic = &req.Topics[ti]
 		topic.Name = dec.DecodeString()
@@ -1020,12 +1905,29 @@ func (r *OffsetFetchReq) Bytes() ([]byte, error) {
 	// message size - for now just placeholder
 	enc.Encode(int32(0))
 	enc.Encode(int16(OffsetFetchReqKind))
-	enc.Encode(int16(1)) // version - must be 1 to use Kafka committed offsets instead of ZK
+	// version must be at least 1 to use Kafka committed offsets instead of ZK
+	version := r.Version
+	if version < 1 {
+		version = 1
+	}
+	if r.AllPartitions {
+		if version < 2 {
+			return nil, errors.New("fetching offsets of all partitions requires version 2")
+		}
+		if len(r.Topics) != 0 {
+			return nil, errors.New("cannot fetch offsets of all partitions and of given topics")
+		}
+	}
+	enc.Encode(version)
 	enc.Encode(r.CorrelationID)
 	enc.Encode(r.ClientID)
 
 	enc.Encode(r.ConsumerGroup)
-	enc.EncodeArrayLen(len(r.Topics))
+	if r.AllPartitions {
+		enc.EncodeArrayLen(-1)
+	} else {
+		enc.EncodeArrayLen(len(r.Topics))
+	}
 	for _, t := range r.Topics {
 		enc.Encode(t.Name)
 		enc.EncodeArrayLen(len(t.Partitions))
@@ -1054,9 +1956,30 @@ func (r *OffsetFetchReq) WriteTo(w io.Writer) (int64, error) {
 	return int64(n), err
 }
 
+func (r *OffsetFetchReq) Kind() int16 {
+	return OffsetFetchReqKind
+}
+
+func (r *OffsetFetchReq) SetCorrelationID(id int32) {
+	r.CorrelationID = id
+}
+
+func (r *OffsetFetchReq) GetClientID() string {
+	return r.ClientID
+}
+
+func (r *OffsetFetchReq) SetClientID(id string) {
+	r.ClientID = id
+}
+
 type OffsetFetchResp struct {
 	CorrelationID int32
 	Topics        []OffsetFetchRespTopic
+
+	// Version of the request this response was returned for.
+	Version      int16
+	ThrottleTime time.Duration // set for version 3 and above
+	Err          error         // set for version 2 and above
 }
 
 type OffsetFetchRespTopic struct {
@@ -1071,13 +1994,22 @@ type OffsetFetchRespPartition struct {
 	Err      error
 }
 
+// ReadOffsetFetchResp reads offset fetch response of version 0 or 1.
 func ReadOffsetFetchResp(r io.Reader) (*OffsetFetchResp, error) {
+	return ReadVersionedOffsetFetchResp(r, 0)
+}
+
+// ReadVersionedOffsetFetchResp reads offset fetch response returned for
+// request of given version.
+func ReadVersionedOffsetFetchResp(r io.Reader, version int16) (*OffsetFetchResp, error) {
 	var resp OffsetFetchResp
 	dec := NewDecoder(r)
 
-	// total message size
-	_ = dec.DecodeInt32()
-	resp.CorrelationID = dec.DecodeInt32()
+	resp.CorrelationID = dec.DecodeRespHeader(RespHeaderVersion(OffsetFetchReqKind, version))
+	resp.Version = version
+	if version >= 3 {
+		resp.ThrottleTime = time.Duration(dec.DecodeInt32()) * time.Millisecond
+	}
 	resp.Topics = make([]OffsetFetchRespTopic, dec.DecodeArrayLen())
 	for ti := range resp.Topics {
 		var t = &resp.Topics[ti]
@@ -1091,9 +2023,12 @@ func ReadOffsetFetchResp(r io.Reader) (*OffsetFetchResp, error) {
 			p.Err = errFromNo(dec.DecodeInt16())
 		}
 	}
+	if version >= 2 {
+		resp.Err = errFromNo(dec.DecodeInt16())
+	}
 
 	if err := dec.Err(); err != nil {
-		return nil, err
+		return nil, dec.parseErr(OffsetFetchReqKind, version, err)
 	}
 	return &resp, nil
 }
@@ -1105,6 +2040,9 @@ func (r *OffsetFetchResp) Bytes() ([]byte, error) {
 	// message size - for now just placeholder
 	enc.Encode(int32(0))
 	enc.Encode(r.CorrelationID)
+	if r.Version >= 3 {
+		enc.Encode(int32(r.ThrottleTime / time.Millisecond))
+	}
 	enc.EncodeArrayLen(len(r.Topics))
 	for _, topic := range r.Topics {
 		enc.Encode(topic.Name)
@@ -1116,6 +2054,9 @@ func (r *OffsetFetchResp) Bytes() ([]byte, error) {
 			enc.EncodeError(part.Err)
 		}
 	}
+	if r.Version >= 2 {
+		enc.EncodeError(r.Err)
+	}
 
 	if enc.Err() != nil {
 		return nil, enc.Err()
@@ -1135,6 +2076,34 @@ type ProduceReq struct {
 	RequiredAcks  int16
 	Timeout       time.Duration
 	Topics        []ProduceReqTopic
+
+	// Version of the produce request. Responses to version 1 and above carry
+	// the throttle time, version 2 and above send messages with timestamps.
+	// Version 3 sends record batches, which cannot be encoded from messages,
+	// so it requires RawMessageSet to be set for every partition.
+	Version int16
+
+	// CompressionLevel is the gzip compression level, from gzip.NoCompression
+	// to gzip.BestCompression. Unless CompressionLevelSet is true, it is
+	// ignored and gzip.DefaultCompression is used. Only used when sending
+	// ProduceReqs compressed with CompressionGzip.
+	CompressionLevel int
+
+	// CompressionLevelSet tells whether CompressionLevel was set, so that
+	// gzip.NoCompression, which is zero, can be told apart from the unset
+	// level.
+	CompressionLevelSet bool
+
+	// MinCompressSize is the smallest uncompressed size of a message set
+	// that is compressed. Smaller message sets are sent without compression,
+	// as compressing them costs more than it saves. Zero means that all
+	// message sets are compressed.
+	MinCompressSize int
+
+	// CompressionCounters, if set, counts the message sets compressed when
+	// sending ProduceReqs. Connections count requests they send in their own
+	// counters instead.
+	CompressionCounters *CompressionCounters
 }
 
 type ProduceReqTopic struct {
@@ -1145,6 +2114,67 @@ type ProduceReqTopic struct {
 type ProduceReqPartition struct {
 	ID       int32
 	Messages []*Message
+
+	// Batches, if set, is used instead of Messages to send messages that
+	// must not be merged together. Every batch is encoded, and compressed,
+	// separately, one after another. Offset returned in the response is the
+	// offset of the first message of the first batch.
+	// When reading requests, all messages are returned in Messages.
+	Batches [][]*Message
+
+	// RawMessageSet, if set, is sent as it is instead of Messages and
+	// Batches. It must be a message set encoded using the message format of
+	// the request version, such as the RawMessageSet of a fetch response
+	// from another cluster when mirroring, so that its compression and timestamps are preserved. It is
+	// checked with ValidateMessageSet when encoding the request, which only
+	// checks the framing of the messages: their CRCs are trusted, neither
+	// checked nor computed again, and the broker fails the partition with
+	// ErrInvalidMessage if any is wrong. Attributes of the messages,
+	// including their compression and timestamp type, are kept, so
+	// Compression, MinCompressSize and TimestampType do not apply to it.
+	// When reading requests, messages are returned in Messages.
+	RawMessageSet []byte
+
+	// TimestampType is set in the attributes of every message of Messages
+	// and Batches, and of their wrapper messages if compressed. It should
+	// match the message.timestamp.type of the topic, so that replayed
+	// messages keep the meaning of their timestamps. Timestamp types other
+	// than TimestampCreateTime require request version 2 or above.
+	// When reading requests, it is set from the first message.
+	TimestampType TimestampType
+}
+
+// ValidateMessageSet checks that given encoded message set can be sent by
+// produce request of given version, that is that sizes of its entries are
+// consistent with its length, and that all of them use the message format
+// of the request version: messages of format v0 or v1 up to version 2, and
+// record batches from version 3. Messages are not decoded, and their CRCs
+// are not checked.
+func ValidateMessageSet(b []byte, version int16) error {
+	magic := messageMagic(version)
+	// crc and magic byte are part of the message
+	minSize := int64(4 + 1)
+	if version >= 3 {
+		magic = messageMagicV2
+		minSize = recordBatchHeaderSize
+	}
+	for pos := 0; pos < len(b); {
+		// offset + size + crc, or partition leader epoch of record
+		// batches, + magic byte, which both formats keep at the same place
+		if len(b)-pos < 8+4+4+1 {
+			return fmt.Errorf("message set truncated at byte %d", pos)
+		}
+		size := int64(int32(binary.BigEndian.Uint32(b[pos+8:])))
+		if size < minSize || size > int64(len(b)-pos-8-4) {
+			return fmt.Errorf("invalid size %d of message at byte %d of message set", size, pos)
+		}
+		if m := int8(b[pos+8+4+4]); m != magic {
+			return fmt.Errorf("message at byte %d of message set has magic byte %d, produce request v%d requires %d",
+				pos, m, version, magic)
+		}
+		pos += 8 + 4 + int(size)
+	}
+	return nil
 }
 
 func ReadProduceReq(r io.Reader) (*ProduceReq, error) {
@@ -1153,10 +2183,14 @@ func ReadProduceReq(r io.Reader) (*ProduceReq, error) {
 
 	// total message size
 	_ = dec.DecodeInt32()
-	// api key + api version
-	_ = dec.DecodeInt32()
+	// api key
+	_ = dec.DecodeInt16()
+	req.Version = dec.DecodeInt16()
 	req.CorrelationID = dec.DecodeInt32()
 	req.ClientID = dec.DecodeString()
+	if req.Version >= 3 {
+		_ = dec.DecodeString() // transactional ID
+	}
 	req.RequiredAcks = dec.DecodeInt16()
 	req.Timeout = time.Duration(dec.DecodeInt32()) * time.Millisecond
 	req.Topics = make([]ProduceReqTopic, dec.DecodeArrayLen())
@@ -1178,6 +2212,9 @@ func ReadProduceReq(r io.Reader) (*ProduceReq, error) {
 			if part.Messages, err = readMessageSet(r, msgSetSize); err != nil {
 				return nil, err
 			}
+			if len(part.Messages) > 0 {
+				part.TimestampType = part.Messages[0].TimestampType
+			}
 		}
 	}
 
@@ -1188,15 +2225,35 @@ func ReadProduceReq(r io.Reader) (*ProduceReq, error) {
 }
 
 func (r *ProduceReq) Bytes() ([]byte, error) {
-	var buf buffer
+	buf, err := r.encode(make(buffer, 0, EstimateProduceSize(r)))
+	if err != nil {
+		return nil, err
+	}
+	return []byte(buf), nil
+}
+
+// encode appends the encoded request to given buffer.
+func (r *ProduceReq) encode(buf buffer) (buffer, error) {
+	if err := checkRequestVersion(ProduceReqKind, r.Version); err != nil {
+		return nil, err
+	}
+
 	enc := NewEncoder(&buf)
 
 	enc.EncodeInt32(0) // placeholder
 	enc.EncodeInt16(ProduceReqKind)
-	enc.EncodeInt16(0)
+	enc.EncodeInt16(r.Version)
 	enc.EncodeInt32(r.CorrelationID)
 	enc.EncodeString(r.ClientID)
 
+	level := gzip.DefaultCompression
+	if r.CompressionLevelSet {
+		level = r.CompressionLevel
+	}
+
+	if r.Version >= 3 {
+		enc.EncodeNullableString("") // transactional ID
+	}
 	enc.EncodeInt16(r.RequiredAcks)
 	enc.EncodeInt32(int32(r.Timeout / time.Millisecond))
 	enc.EncodeArrayLen(len(r.Topics))
@@ -1205,13 +2262,38 @@ func (r *ProduceReq) Bytes() ([]byte, error) {
 		enc.EncodeArrayLen(len(t.Partitions))
 		for _, p := range t.Partitions {
 			enc.EncodeInt32(p.ID)
+			if p.RawMessageSet != nil {
+				if err := ValidateMessageSet(p.RawMessageSet, r.Version); err != nil {
+					return nil, err
+				}
+				enc.EncodeBytes(p.RawMessageSet)
+				continue
+			}
+			if r.Version >= 3 {
+				return nil, fmt.Errorf("produce request v%d can only send RawMessageSet", r.Version)
+			}
+			if p.TimestampType != TimestampCreateTime && messageMagic(r.Version) < messageMagicV1 {
+				return nil, fmt.Errorf("produce request v%d cannot set timestamp type %d", r.Version, p.TimestampType)
+			}
 			i := len(buf)
 			enc.EncodeInt32(0) // placeholder
-			n, err := writeMessageSet(&buf, p.Messages, r.Compression)
-			if err != nil {
-				return nil, err
+			batches := p.Batches
+			if batches == nil {
+				batches = [][]*Message{p.Messages}
 			}
-			binary.BigEndian.PutUint32(buf[i:i+4], uint32(n))
+			size := 0
+			for _, batch := range batches {
+				compression := r.Compression
+				if r.MinCompressSize > 0 && messageSetSize(batch, messageMagic(r.Version)) < r.MinCompressSize {
+					compression = CompressionNone
+				}
+				n, err := encodeMessageSet(&buf, batch, compression, level, messageMagic(r.Version), p.TimestampType, r.CompressionCounters)
+				if err != nil {
+					return nil, err
+				}
+				size += n
+			}
+			binary.BigEndian.PutUint32(buf[i:i+4], uint32(size))
 		}
 	}
 
@@ -1220,21 +2302,88 @@ func (r *ProduceReq) Bytes() ([]byte, error) {
 	}
 
 	binary.BigEndian.PutUint32(buf[0:4], uint32(len(buf)-4))
-	return []byte(buf), nil
+	return buf, nil
+}
+
+// EstimateProduceSize returns the size of given request once encoded, without
+// encoding it. The estimate is exact for requests without compression, of all
+// versions: messages are encoded in the format of the request version, while
+// record batches, sent by version 3, can only be given as RawMessageSet, whose
+// size is known. For compressed requests it is the size the request would
+// have if it was not compressed.
+func EstimateProduceSize(r *ProduceReq) int {
+	// size + api key + version + correlation ID + client ID + required acks
+	// + timeout + topics array length
+	size := 4 + 2 + 2 + 4 + 2 + len(r.ClientID) + 2 + 4 + 4
+	if r.Version >= 3 {
+		// null transactional ID
+		size += 2
+	}
+	magic := messageMagic(r.Version)
+	for _, t := range r.Topics {
+		// name + partitions array length
+		size += 2 + len(t.Name) + 4
+		for _, p := range t.Partitions {
+			// partition ID + message set size
+			size += 4 + 4
+			if p.RawMessageSet != nil {
+				size += len(p.RawMessageSet)
+				continue
+			}
+			batches := p.Batches
+			if batches == nil {
+				batches = [][]*Message{p.Messages}
+			}
+			for _, batch := range batches {
+				size += messageSetSize(batch, magic)
+			}
+		}
+	}
+	return size
 }
 
+// WriteTo encodes the request into a buffer taken from a pool, since the
+// encoded request is not needed once written.
 func (r *ProduceReq) WriteTo(w io.Writer) (int64, error) {
-	b, err := r.Bytes()
+	bp := produceBufPool.Get().(*buffer)
+	defer func() {
+		if cap(*bp) <= maxPooledProduceBuf {
+			produceBufPool.Put(bp)
+		}
+	}()
+
+	buf, err := r.encode((*bp)[:0])
+	*bp = buf
 	if err != nil {
 		return 0, err
 	}
-	n, err := w.Write(b)
+	n, err := w.Write(buf)
 	return int64(n), err
 }
 
+func (r *ProduceReq) Kind() int16 {
+	return ProduceReqKind
+}
+
+func (r *ProduceReq) SetCorrelationID(id int32) {
+	r.CorrelationID = id
+}
+
+func (r *ProduceReq) GetClientID() string {
+	return r.ClientID
+}
+
+func (r *ProduceReq) SetClientID(id string) {
+	r.ClientID = id
+}
+
 type ProduceResp struct {
 	CorrelationID int32
 	Topics        []ProduceRespTopic
+
+	// Version of the request this response was returned for.
+	Version      int16
+	ThrottleTime time.Duration // set for version 1 and above
 }
 
 type ProduceRespTopic struct {
@@ -1243,9 +2392,70 @@ type ProduceRespTopic struct {
 }
 
 type ProduceRespPartition struct {
-	ID     int32
-	Err    error
+	ID  int32
+	Err error
+
+	// Offset is the offset the broker assigned to the first message
+	// written to the partition. Messages of the request occupy successive
+	// offsets from Offset to Offset+count-1. It is -1 if producing failed.
 	Offset int64
+
+	// Timestamp is set for version 2 and above if the topic is using
+	// LogAppendTime, otherwise it is zero.
+	Timestamp time.Time
+}
+
+// Split divides partitions of the response by the outcome of producing to
+// them: those written successfully, those that failed with a retriable error,
+// such as ErrNotEnoughReplicas when producing with RequiredAcksAll, and those
+// that failed permanently. Only the partitions listed as retriable should be
+// produced to again. Topics without partitions of given outcome are omitted.
+func (r *ProduceResp) Split() (succeeded, retriable, failed []ProduceRespTopic) {
+	for _, t := range r.Topics {
+		var ok, retry, fail []ProduceRespPartition
+		for _, p := range t.Partitions {
+			switch {
+			case p.Err == nil:
+				ok = append(ok, p)
+			case isRetriableErr(p.Err):
+				retry = append(retry, p)
+			default:
+				fail = append(fail, p)
+			}
+		}
+		if len(ok) > 0 {
+			succeeded = append(succeeded, ProduceRespTopic{Name: t.Name, Partitions: ok})
+		}
+		if len(retry) > 0 {
+			retriable = append(retriable, ProduceRespTopic{Name: t.Name, Partitions: retry})
+		}
+		if len(fail) > 0 {
+			failed = append(failed, ProduceRespTopic{Name: t.Name, Partitions: fail})
+		}
+	}
+	return succeeded, retriable, failed
+}
+
+// BaseOffset returns the offset the broker assigned to the first message
+// written to given partition, so that the n-th message sent to it, counting
+// from zero, was written at BaseOffset+n. Error of the partition is returned
+// if producing to it failed.
+func (r *ProduceResp) BaseOffset(topic string, partition int32) (int64, error) {
+	for _, t := range r.Topics {
+		if t.Name != topic {
+			continue
+		}
+		for _, p := range t.Partitions {
+			if p.ID != partition {
+				continue
+			}
+			if p.Err != nil {
+				return 0, p.Err
+			}
+			return p.Offset, nil
+		}
+	}
+	return 0, fmt.Errorf("no result for %s:%d in produce response", topic, partition)
 }
 
 func (r *ProduceResp) Bytes() ([]byte, error) {
@@ -1263,8 +2473,14 @@ func (r *ProduceResp) Bytes() ([]byte, error) {
 			enc.Encode(part.ID)
 			enc.EncodeError(part.Err)
 			enc.Encode(part.Offset)
+			if r.Version >= 2 {
+				enc.Encode(encodeTimestamp(part.Timestamp))
+			}
 		}
 	}
+	if r.Version >= 1 {
+		enc.Encode(int32(r.ThrottleTime / time.Millisecond))
+	}
 
 	if enc.Err() != nil {
 		return nil, enc.Err()
@@ -1277,13 +2493,19 @@ func (r *ProduceResp) Bytes() ([]byte, error) {
 	return b, nil
 }
 
+// ReadProduceResp reads produce response of version 0.
 func ReadProduceResp(r io.Reader) (*ProduceResp, error) {
+	return ReadVersionedProduceResp(r, 0)
+}
+
+// ReadVersionedProduceResp reads produce response returned for request of
+// given version.
+func ReadVersionedProduceResp(r io.Reader, version int16) (*ProduceResp, error) {
 	var resp ProduceResp
 	dec := NewDecoder(r)
 
-	// total message size
-	_ = dec.DecodeInt32()
-	resp.CorrelationID = dec.DecodeInt32()
+	resp.CorrelationID = dec.DecodeRespHeader(RespHeaderVersion(ProduceReqKind, version))
+	resp.Version = version
 	resp.Topics = make([]ProduceRespTopic, dec.DecodeArrayLen())
 	for ti := range resp.Topics {
 		var t = &resp.Topics[ti]
@@ -1294,11 +2516,17 @@ func ReadProduceResp(r io.Reader) (*ProduceResp, error) {
 			p.ID = dec.DecodeInt32()
 			p.Err = errFromNo(dec.DecodeInt16())
 			p.Offset = dec.DecodeInt64()
+			if version >= 2 {
+				p.Timestamp = decodeTimestamp(dec.DecodeInt64())
+			}
 		}
 	}
+	if version >= 1 {
+		resp.ThrottleTime = time.Duration(dec.DecodeInt32()) * time.Millisecond
+	}
 
 	if err := dec.Err(); err != nil {
-		return nil, err
+		return nil, dec.parseErr(ProduceReqKind, version, err)
 	}
 	return &resp, nil
 }
@@ -1394,6 +2622,22 @@ func (r *OffsetReq) WriteTo(w io.Writer) (int64, error) {
 	return int64(n), err
 }
 
+func (r *OffsetReq) Kind() int16 {
+	return OffsetReqKind
+}
+
+func (r *OffsetReq) SetCorrelationID(id int32) {
+	r.CorrelationID = id
+}
+
+func (r *OffsetReq) GetClientID() string {
+	return r.ClientID
+}
+
+func (r *OffsetReq) SetClientID(id string) {
+	r.ClientID = id
+}
+
 type OffsetResp struct {
 	CorrelationID int32
 	Topics        []OffsetRespTopic
@@ -1405,8 +2649,11 @@ type OffsetRespTopic struct {
 }
 
 type OffsetRespPartition struct {
-	ID      int32
-	Err     error
+	ID  int32
+	Err error
+	// Offsets contains up to MaxOffsets of the requested partition offsets,
+	// in descending order. Every offset but the latest is the base offset of
+	// a log segment.
 	Offsets []int64
 }
 
@@ -1434,7 +2681,7 @@ func ReadOffsetResp(r io.Reader) (*OffsetResp, error) {
 	}
 
 	if err := dec.Err(); err != nil {
-		return nil, err
+		return nil, dec.parseErr(OffsetReqKind, 0, err)
 	}
 	return &resp, nil
 }
@@ -1471,9 +2718,1180 @@ func (r *OffsetResp) Bytes() ([]byte, error) {
 	return b, nil
 }
 
-type buffer []byte
+type DeleteGroupsReq struct {
+	CorrelationID int32
+	ClientID      string
+	Groups        []string
+}
 
-func (b *buffer) Write(p []byte) (int, error) {
-	*b = append(*b, p...)
-	return len(p), nil
+func ReadDeleteGroupsReq(r io.Reader) (*DeleteGroupsReq, error) {
+	var req DeleteGroupsReq
+	dec := NewDecoder(r)
+
+	// total message size
+	_ = dec.DecodeInt32()
+	// api key + api version
+	_ = dec.DecodeInt32()
+	req.CorrelationID = dec.DecodeInt32()
+	req.ClientID = dec.DecodeString()
+	req.Groups = make([]string, dec.DecodeArrayLen())
+	for i := range req.Groups {
+		req.Groups[i] = dec.DecodeString()
+	}
+
+	if dec.Err() != nil {
+		return nil, dec.Err()
+	}
+	return &req, nil
+}
+
+func (r *DeleteGroupsReq) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.Encode(int32(0))
+	enc.Encode(int16(DeleteGroupsReqKind))
+	enc.Encode(int16(0))
+	enc.Encode(r.CorrelationID)
+	enc.Encode(r.ClientID)
+
+	enc.EncodeArrayLen(len(r.Groups))
+	for _, group := range r.Groups {
+		enc.Encode(group)
+	}
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+func (r *DeleteGroupsReq) WriteTo(w io.Writer) (int64, error) {
+	b, err := r.Bytes()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+func (r *DeleteGroupsReq) Kind() int16 {
+	return DeleteGroupsReqKind
+}
+
+func (r *DeleteGroupsReq) SetCorrelationID(id int32) {
+	r.CorrelationID = id
+}
+
+func (r *DeleteGroupsReq) GetClientID() string {
+	return r.ClientID
+}
+
+func (r *DeleteGroupsReq) SetClientID(id string) {
+	r.ClientID = id
+}
+
+type DeleteGroupsResp struct {
+	CorrelationID int32
+	ThrottleTime  time.Duration
+	Groups        []DeleteGroupsRespGroup
+}
+
+type DeleteGroupsRespGroup struct {
+	Group string
+	// Err is ErrNonEmptyGroup if the group still has active members, which
+	// must be stopped before the group can be deleted.
+	Err error
+}
+
+func ReadDeleteGroupsResp(r io.Reader) (*DeleteGroupsResp, error) {
+	var resp DeleteGroupsResp
+	dec := NewDecoder(r)
+
+	// total message size
+	_ = dec.DecodeInt32()
+	resp.CorrelationID = dec.DecodeInt32()
+	resp.ThrottleTime = time.Duration(dec.DecodeInt32()) * time.Millisecond
+	resp.Groups = make([]DeleteGroupsRespGroup, dec.DecodeArrayLen())
+	for i := range resp.Groups {
+		var g = &resp.Groups[i]
+		g.Group = dec.DecodeString()
+		g.Err = errFromNo(dec.DecodeInt16())
+	}
+
+	if err := dec.Err(); err != nil {
+		return nil, dec.parseErr(DeleteGroupsReqKind, 0, err)
+	}
+	return &resp, nil
+}
+
+func (r *DeleteGroupsResp) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.Encode(int32(0))
+	enc.Encode(r.CorrelationID)
+	enc.Encode(int32(r.ThrottleTime / time.Millisecond))
+	enc.EncodeArrayLen(len(r.Groups))
+	for _, g := range r.Groups {
+		enc.Encode(g.Group)
+		enc.EncodeError(g.Err)
+	}
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+// HeartbeatReq keeps the membership of a consumer group member alive. It must
+// be sent to the coordinator of the group more often than the session timeout
+// of the member, or the member is removed from the group.
+type HeartbeatReq struct {
+	CorrelationID int32
+	ClientID      string
+	GroupID       string
+	GenerationID  int32
+	MemberID      string
+}
+
+func ReadHeartbeatReq(r io.Reader) (*HeartbeatReq, error) {
+	var req HeartbeatReq
+	dec := NewDecoder(r)
+
+	// total message size
+	_ = dec.DecodeInt32()
+	// api key + api version
+	_ = dec.DecodeInt32()
+	req.CorrelationID = dec.DecodeInt32()
+	req.ClientID = dec.DecodeString()
+	req.GroupID = dec.DecodeString()
+	req.GenerationID = dec.DecodeInt32()
+	req.MemberID = dec.DecodeString()
+
+	if dec.Err() != nil {
+		return nil, dec.Err()
+	}
+	return &req, nil
+}
+
+func (r *HeartbeatReq) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.Encode(int32(0))
+	enc.Encode(int16(HeartbeatReqKind))
+	enc.Encode(int16(0))
+	enc.Encode(r.CorrelationID)
+	enc.Encode(r.ClientID)
+
+	enc.Encode(r.GroupID)
+	enc.Encode(r.GenerationID)
+	enc.Encode(r.MemberID)
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+func (r *HeartbeatReq) WriteTo(w io.Writer) (int64, error) {
+	b, err := r.Bytes()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+func (r *HeartbeatReq) Kind() int16 {
+	return HeartbeatReqKind
+}
+
+func (r *HeartbeatReq) SetCorrelationID(id int32) {
+	r.CorrelationID = id
+}
+
+func (r *HeartbeatReq) GetClientID() string {
+	return r.ClientID
+}
+
+func (r *HeartbeatReq) SetClientID(id string) {
+	r.ClientID = id
+}
+
+type HeartbeatResp struct {
+	CorrelationID int32
+	// Err is ErrRebalanceInProgress if the member must rejoin the group, or
+	// ErrIllegalGeneration and ErrUnknownMemberID if it is no longer part of
+	// the current generation of the group.
+	Err error
+}
+
+func ReadHeartbeatResp(r io.Reader) (*HeartbeatResp, error) {
+	var resp HeartbeatResp
+	dec := NewDecoder(r)
+
+	// total message size
+	_ = dec.DecodeInt32()
+	resp.CorrelationID = dec.DecodeInt32()
+	resp.Err = errFromNo(dec.DecodeInt16())
+
+	if err := dec.Err(); err != nil {
+		return nil, dec.parseErr(HeartbeatReqKind, 0, err)
+	}
+	return &resp, nil
+}
+
+func (r *HeartbeatResp) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.Encode(int32(0))
+	enc.Encode(r.CorrelationID)
+	enc.EncodeError(r.Err)
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+// OffsetDeleteReq deletes offsets committed by the consumer group for given
+// partitions. It must be sent to the coordinator of the group.
+type OffsetDeleteReq struct {
+	CorrelationID int32
+	ClientID      string
+	ConsumerGroup string
+	Topics        []OffsetDeleteReqTopic
+}
+
+type OffsetDeleteReqTopic struct {
+	Name       string
+	Partitions []int32
+}
+
+func ReadOffsetDeleteReq(r io.Reader) (*OffsetDeleteReq, error) {
+	var req OffsetDeleteReq
+	dec := NewDecoder(r)
+
+	// total message size
+	_ = dec.DecodeInt32()
+	// api key + api version
+	_ = dec.DecodeInt32()
+	req.CorrelationID = dec.DecodeInt32()
+	req.ClientID = dec.DecodeString()
+	req.ConsumerGroup = dec.DecodeString()
+	req.Topics = make([]OffsetDeleteReqTopic, dec.DecodeArrayLen())
+	for ti := range req.Topics {
+		var topic = &req.Topics[ti]
+		topic.Name = dec.DecodeString()
+		topic.Partitions = make([]int32, dec.DecodeArrayLen())
+		for pi := range topic.Partitions {
+			topic.Partitions[pi] = dec.DecodeInt32()
+		}
+	}
+
+	if dec.Err() != nil {
+		return nil, dec.Err()
+	}
+	return &req, nil
+}
+
+func (r *OffsetDeleteReq) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.Encode(int32(0))
+	enc.Encode(int16(OffsetDeleteReqKind))
+	enc.Encode(int16(0))
+	enc.Encode(r.CorrelationID)
+	enc.Encode(r.ClientID)
+
+	enc.Encode(r.ConsumerGroup)
+	enc.EncodeArrayLen(len(r.Topics))
+	for _, topic := range r.Topics {
+		enc.Encode(topic.Name)
+		enc.Encode(topic.Partitions)
+	}
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+func (r *OffsetDeleteReq) WriteTo(w io.Writer) (int64, error) {
+	b, err := r.Bytes()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+func (r *OffsetDeleteReq) Kind() int16 {
+	return OffsetDeleteReqKind
+}
+
+func (r *OffsetDeleteReq) SetCorrelationID(id int32) {
+	r.CorrelationID = id
+}
+
+func (r *OffsetDeleteReq) GetClientID() string {
+	return r.ClientID
+}
+
+func (r *OffsetDeleteReq) SetClientID(id string) {
+	r.ClientID = id
+}
+
+type OffsetDeleteResp struct {
+	CorrelationID int32
+	// Err is set if the request failed for all partitions, for example
+	// with ErrNotCoordinator or ErrGroupIDNotFound.
+	Err          error
+	ThrottleTime time.Duration
+	Topics       []OffsetDeleteRespTopic
+}
+
+type OffsetDeleteRespTopic struct {
+	Name       string
+	Partitions []OffsetDeleteRespPartition
+}
+
+type OffsetDeleteRespPartition struct {
+	ID int32
+	// Err is ErrGroupSubscribedToTopic if the group still consumes the
+	// topic, in which case the offset is not deleted.
+	Err error
+}
+
+func ReadOffsetDeleteResp(r io.Reader) (*OffsetDeleteResp, error) {
+	var resp OffsetDeleteResp
+	dec := NewDecoder(r)
+
+	// total message size
+	_ = dec.DecodeInt32()
+	resp.CorrelationID = dec.DecodeInt32()
+	resp.Err = errFromNo(dec.DecodeInt16())
+	resp.ThrottleTime = time.Duration(dec.DecodeInt32()) * time.Millisecond
+	resp.Topics = make([]OffsetDeleteRespTopic, dec.DecodeArrayLen())
+	for ti := range resp.Topics {
+		var topic = &resp.Topics[ti]
+		topic.Name = dec.DecodeString()
+		topic.Partitions = make([]OffsetDeleteRespPartition, dec.DecodeArrayLen())
+		for pi := range topic.Partitions {
+			var part = &topic.Partitions[pi]
+			part.ID = dec.DecodeInt32()
+			part.Err = errFromNo(dec.DecodeInt16())
+		}
+	}
+
+	if err := dec.Err(); err != nil {
+		return nil, dec.parseErr(OffsetDeleteReqKind, 0, err)
+	}
+	return &resp, nil
+}
+
+func (r *OffsetDeleteResp) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.Encode(int32(0))
+	enc.Encode(r.CorrelationID)
+	enc.EncodeError(r.Err)
+	enc.Encode(int32(r.ThrottleTime / time.Millisecond))
+	enc.EncodeArrayLen(len(r.Topics))
+	for _, topic := range r.Topics {
+		enc.Encode(topic.Name)
+		enc.EncodeArrayLen(len(topic.Partitions))
+		for _, part := range topic.Partitions {
+			enc.Encode(part.ID)
+			enc.EncodeError(part.Err)
+		}
+	}
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+// APIVersionsReq asks the broker for the range of versions it supports for
+// every API.
+type APIVersionsReq struct {
+	CorrelationID int32
+	ClientID      string
+}
+
+func ReadAPIVersionsReq(r io.Reader) (*APIVersionsReq, error) {
+	var req APIVersionsReq
+	dec := NewDecoder(r)
+
+	// total message size
+	_ = dec.DecodeInt32()
+	// api key + api version
+	_ = dec.DecodeInt32()
+	req.CorrelationID = dec.DecodeInt32()
+	req.ClientID = dec.DecodeString()
+
+	if dec.Err() != nil {
+		return nil, dec.Err()
+	}
+	return &req, nil
+}
+
+func (r *APIVersionsReq) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.Encode(int32(0))
+	enc.Encode(int16(APIVersionsReqKind))
+	enc.Encode(int16(0))
+	enc.Encode(r.CorrelationID)
+	enc.Encode(r.ClientID)
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+func (r *APIVersionsReq) WriteTo(w io.Writer) (int64, error) {
+	b, err := r.Bytes()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+func (r *APIVersionsReq) Kind() int16 {
+	return APIVersionsReqKind
+}
+
+func (r *APIVersionsReq) SetCorrelationID(id int32) {
+	r.CorrelationID = id
+}
+
+func (r *APIVersionsReq) GetClientID() string {
+	return r.ClientID
+}
+
+func (r *APIVersionsReq) SetClientID(id string) {
+	r.ClientID = id
+}
+
+type APIVersionsResp struct {
+	CorrelationID int32
+	Err           error
+	APIVersions   []APIVersionsRespAPI
+}
+
+type APIVersionsRespAPI struct {
+	APIKey     int16
+	MinVersion int16
+	MaxVersion int16
+}
+
+func ReadAPIVersionsResp(r io.Reader) (*APIVersionsResp, error) {
+	var resp APIVersionsResp
+	dec := NewDecoder(r)
+
+	// total message size
+	_ = dec.DecodeInt32()
+	resp.CorrelationID = dec.DecodeInt32()
+	resp.Err = errFromNo(dec.DecodeInt16())
+	resp.APIVersions = make([]APIVersionsRespAPI, dec.DecodeArrayLen())
+	for i := range resp.APIVersions {
+		var api = &resp.APIVersions[i]
+		api.APIKey = dec.DecodeInt16()
+		api.MinVersion = dec.DecodeInt16()
+		api.MaxVersion = dec.DecodeInt16()
+	}
+
+	if err := dec.Err(); err != nil {
+		return nil, dec.parseErr(APIVersionsReqKind, 0, err)
+	}
+	return &resp, nil
+}
+
+func (r *APIVersionsResp) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.Encode(int32(0))
+	enc.Encode(r.CorrelationID)
+	enc.EncodeError(r.Err)
+	enc.EncodeArrayLen(len(r.APIVersions))
+	for _, api := range r.APIVersions {
+		enc.Encode(api.APIKey)
+		enc.Encode(api.MinVersion)
+		enc.Encode(api.MaxVersion)
+	}
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+// SaslHandshakeReq is sent using version 1, after which the authentication
+// continues with SaslAuthenticateReq messages.
+type SaslHandshakeReq struct {
+	CorrelationID int32
+	ClientID      string
+	Mechanism     string
+}
+
+func ReadSaslHandshakeReq(r io.Reader) (*SaslHandshakeReq, error) {
+	var req SaslHandshakeReq
+	dec := NewDecoder(r)
+
+	// total message size
+	_ = dec.DecodeInt32()
+	// api key + api version
+	_ = dec.DecodeInt32()
+	req.CorrelationID = dec.DecodeInt32()
+	req.ClientID = dec.DecodeString()
+	req.Mechanism = dec.DecodeString()
+
+	if dec.Err() != nil {
+		return nil, dec.Err()
+	}
+	return &req, nil
+}
+
+func (r *SaslHandshakeReq) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.Encode(int32(0))
+	enc.Encode(int16(SaslHandshakeReqKind))
+	enc.Encode(int16(1))
+	enc.Encode(r.CorrelationID)
+	enc.Encode(r.ClientID)
+
+	enc.Encode(r.Mechanism)
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+func (r *SaslHandshakeReq) WriteTo(w io.Writer) (int64, error) {
+	b, err := r.Bytes()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+func (r *SaslHandshakeReq) Kind() int16 {
+	return SaslHandshakeReqKind
+}
+
+func (r *SaslHandshakeReq) SetCorrelationID(id int32) {
+	r.CorrelationID = id
+}
+
+func (r *SaslHandshakeReq) GetClientID() string {
+	return r.ClientID
+}
+
+func (r *SaslHandshakeReq) SetClientID(id string) {
+	r.ClientID = id
+}
+
+type SaslHandshakeResp struct {
+	CorrelationID int32
+	Err           error
+	// Mechanisms enabled by the broker.
+	Mechanisms []string
+}
+
+func ReadSaslHandshakeResp(r io.Reader) (*SaslHandshakeResp, error) {
+	var resp SaslHandshakeResp
+	dec := NewDecoder(r)
+
+	// total message size
+	_ = dec.DecodeInt32()
+	resp.CorrelationID = dec.DecodeInt32()
+	resp.Err = errFromNo(dec.DecodeInt16())
+	resp.Mechanisms = make([]string, dec.DecodeArrayLen())
+	for i := range resp.Mechanisms {
+		resp.Mechanisms[i] = dec.DecodeString()
+	}
+
+	if err := dec.Err(); err != nil {
+		return nil, dec.parseErr(SaslHandshakeReqKind, 1, err)
+	}
+	return &resp, nil
+}
+
+func (r *SaslHandshakeResp) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.Encode(int32(0))
+	enc.Encode(r.CorrelationID)
+	enc.EncodeError(r.Err)
+	enc.EncodeArrayLen(len(r.Mechanisms))
+	for _, mechanism := range r.Mechanisms {
+		enc.Encode(mechanism)
+	}
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+// SaslAuthenticateReq carries single round of SASL authentication.
+type SaslAuthenticateReq struct {
+	CorrelationID int32
+	ClientID      string
+	AuthBytes     []byte
+}
+
+func ReadSaslAuthenticateReq(r io.Reader) (*SaslAuthenticateReq, error) {
+	var req SaslAuthenticateReq
+	dec := NewDecoder(r)
+
+	// total message size
+	_ = dec.DecodeInt32()
+	// api key + api version
+	_ = dec.DecodeInt32()
+	req.CorrelationID = dec.DecodeInt32()
+	req.ClientID = dec.DecodeString()
+	req.AuthBytes = dec.DecodeBytes()
+
+	if dec.Err() != nil {
+		return nil, dec.Err()
+	}
+	return &req, nil
+}
+
+func (r *SaslAuthenticateReq) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.Encode(int32(0))
+	enc.Encode(int16(SaslAuthenticateReqKind))
+	enc.Encode(int16(0))
+	enc.Encode(r.CorrelationID)
+	enc.Encode(r.ClientID)
+
+	enc.EncodeBytes(r.AuthBytes)
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+func (r *SaslAuthenticateReq) WriteTo(w io.Writer) (int64, error) {
+	b, err := r.Bytes()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+func (r *SaslAuthenticateReq) Kind() int16 {
+	return SaslAuthenticateReqKind
+}
+
+func (r *SaslAuthenticateReq) SetCorrelationID(id int32) {
+	r.CorrelationID = id
+}
+
+func (r *SaslAuthenticateReq) GetClientID() string {
+	return r.ClientID
+}
+
+func (r *SaslAuthenticateReq) SetClientID(id string) {
+	r.ClientID = id
+}
+
+type SaslAuthenticateResp struct {
+	CorrelationID int32
+	Err           error
+	ErrMessage    string
+	AuthBytes     []byte
+}
+
+func ReadSaslAuthenticateResp(r io.Reader) (*SaslAuthenticateResp, error) {
+	var resp SaslAuthenticateResp
+	dec := NewDecoder(r)
+
+	// total message size
+	_ = dec.DecodeInt32()
+	resp.CorrelationID = dec.DecodeInt32()
+	resp.Err = errFromNo(dec.DecodeInt16())
+	resp.ErrMessage = dec.DecodeString()
+	resp.AuthBytes = dec.DecodeBytes()
+
+	if err := dec.Err(); err != nil {
+		return nil, dec.parseErr(SaslAuthenticateReqKind, 0, err)
+	}
+	return &resp, nil
+}
+
+func (r *SaslAuthenticateResp) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.Encode(int32(0))
+	enc.Encode(r.CorrelationID)
+	enc.EncodeError(r.Err)
+	enc.Encode(r.ErrMessage)
+	enc.EncodeBytes(r.AuthBytes)
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+// EnvelopeReq wraps a request forwarded by a broker on behalf of a client,
+// as described in KIP-590. All versions use flexible encoding.
+type EnvelopeReq struct {
+	CorrelationID int32
+	ClientID      string
+
+	// RequestData is the serialized embedded request, including its header
+	// but without the message size.
+	RequestData []byte
+	// RequestPrincipal is the serialized principal of the client sending
+	// the embedded request. Nil is sent as null.
+	RequestPrincipal []byte
+	// ClientHostAddress is the IP address of the client sending the
+	// embedded request.
+	ClientHostAddress []byte
+}
+
+func ReadEnvelopeReq(r io.Reader) (*EnvelopeReq, error) {
+	var req EnvelopeReq
+	dec := NewDecoder(r)
+
+	// total message size
+	_ = dec.DecodeInt32()
+	// api key + api version
+	_ = dec.DecodeInt32()
+	req.CorrelationID = dec.DecodeInt32()
+	req.ClientID = dec.DecodeString()
+	dec.DecodeTaggedFields()
+
+	req.RequestData = dec.DecodeCompactBytes()
+	req.RequestPrincipal = dec.DecodeCompactBytes()
+	req.ClientHostAddress = dec.DecodeCompactBytes()
+	dec.DecodeTaggedFields()
+
+	if dec.Err() != nil {
+		return nil, dec.Err()
+	}
+	return &req, nil
+}
+
+func (r *EnvelopeReq) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.Encode(int32(0))
+	enc.Encode(int16(EnvelopeReqKind))
+	enc.Encode(int16(0))
+	enc.Encode(r.CorrelationID)
+	enc.Encode(r.ClientID)
+	enc.EncodeEmptyTaggedFields()
+
+	enc.EncodeCompactBytes(r.RequestData)
+	enc.EncodeCompactBytes(r.RequestPrincipal)
+	enc.EncodeCompactBytes(r.ClientHostAddress)
+	enc.EncodeEmptyTaggedFields()
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+func (r *EnvelopeReq) WriteTo(w io.Writer) (int64, error) {
+	b, err := r.Bytes()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+func (r *EnvelopeReq) Kind() int16 {
+	return EnvelopeReqKind
+}
+
+func (r *EnvelopeReq) SetCorrelationID(id int32) {
+	r.CorrelationID = id
+}
+
+func (r *EnvelopeReq) GetClientID() string {
+	return r.ClientID
+}
+
+func (r *EnvelopeReq) SetClientID(id string) {
+	r.ClientID = id
+}
+
+type EnvelopeResp struct {
+	CorrelationID int32
+	// ResponseData is the serialized response to the embedded request,
+	// including its header but without the message size. It is nil if the
+	// envelope itself failed.
+	ResponseData []byte
+	Err          error
+}
+
+func ReadEnvelopeResp(r io.Reader) (*EnvelopeResp, error) {
+	var resp EnvelopeResp
+	dec := NewDecoder(r)
+
+	resp.CorrelationID = dec.DecodeRespHeader(RespHeaderVersion(EnvelopeReqKind, 0))
+	resp.ResponseData = dec.DecodeCompactBytes()
+	resp.Err = errFromNo(dec.DecodeInt16())
+	dec.DecodeTaggedFields()
+
+	if err := dec.Err(); err != nil {
+		return nil, dec.parseErr(EnvelopeReqKind, 0, err)
+	}
+	return &resp, nil
+}
+
+func (r *EnvelopeResp) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.Encode(int32(0))
+	enc.Encode(r.CorrelationID)
+	enc.EncodeEmptyTaggedFields()
+	enc.EncodeCompactBytes(r.ResponseData)
+	enc.EncodeError(r.Err)
+	enc.EncodeEmptyTaggedFields()
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+// WriteTxnMarkersReq asks the leaders of the partitions to write markers
+// completing transactions of the producers. It is sent by the transaction
+// coordinator, but can also be used to complete transactions left hanging by
+// a failed coordinator.
+type WriteTxnMarkersReq struct {
+	CorrelationID int32
+	ClientID      string
+	Markers       []WriteTxnMarkersReqMarker
+}
+
+type WriteTxnMarkersReqMarker struct {
+	ProducerID    int64
+	ProducerEpoch int16
+	// Committed marks the transaction as committed. Otherwise it is aborted.
+	Committed        bool
+	Topics           []WriteTxnMarkersReqTopic
+	CoordinatorEpoch int32
+}
+
+type WriteTxnMarkersReqTopic struct {
+	Name       string
+	Partitions []int32
+}
+
+func ReadWriteTxnMarkersReq(r io.Reader) (*WriteTxnMarkersReq, error) {
+	var req WriteTxnMarkersReq
+	dec := NewDecoder(r)
+
+	// total message size
+	_ = dec.DecodeInt32()
+	// api key + api version
+	_ = dec.DecodeInt32()
+	req.CorrelationID = dec.DecodeInt32()
+	req.ClientID = dec.DecodeString()
+	req.Markers = make([]WriteTxnMarkersReqMarker, dec.DecodeArrayLen())
+	for i := range req.Markers {
+		var m = &req.Markers[i]
+		m.ProducerID = dec.DecodeInt64()
+		m.ProducerEpoch = dec.DecodeInt16()
+		m.Committed = dec.DecodeInt8() != 0
+		m.Topics = make([]WriteTxnMarkersReqTopic, dec.DecodeArrayLen())
+		for ti := range m.Topics {
+			var t = &m.Topics[ti]
+			t.Name = dec.DecodeString()
+			t.Partitions = make([]int32, dec.DecodeArrayLen())
+			for pi := range t.Partitions {
+				t.Partitions[pi] = dec.DecodeInt32()
+			}
+		}
+		m.CoordinatorEpoch = dec.DecodeInt32()
+	}
+
+	if dec.Err() != nil {
+		return nil, dec.Err()
+	}
+	return &req, nil
+}
+
+func (r *WriteTxnMarkersReq) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.Encode(int32(0))
+	enc.Encode(int16(WriteTxnMarkersReqKind))
+	enc.Encode(int16(0))
+	enc.Encode(r.CorrelationID)
+	enc.Encode(r.ClientID)
+
+	enc.EncodeArrayLen(len(r.Markers))
+	for _, m := range r.Markers {
+		enc.Encode(m.ProducerID)
+		enc.Encode(m.ProducerEpoch)
+		if m.Committed {
+			enc.EncodeInt8(1)
+		} else {
+			enc.EncodeInt8(0)
+		}
+		enc.EncodeArrayLen(len(m.Topics))
+		for _, t := range m.Topics {
+			enc.Encode(t.Name)
+			enc.Encode(t.Partitions)
+		}
+		enc.Encode(m.CoordinatorEpoch)
+	}
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+func (r *WriteTxnMarkersReq) WriteTo(w io.Writer) (int64, error) {
+	b, err := r.Bytes()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+func (r *WriteTxnMarkersReq) Kind() int16 {
+	return WriteTxnMarkersReqKind
+}
+
+func (r *WriteTxnMarkersReq) SetCorrelationID(id int32) {
+	r.CorrelationID = id
+}
+
+func (r *WriteTxnMarkersReq) GetClientID() string {
+	return r.ClientID
+}
+
+func (r *WriteTxnMarkersReq) SetClientID(id string) {
+	r.ClientID = id
+}
+
+type WriteTxnMarkersResp struct {
+	CorrelationID int32
+	Markers       []WriteTxnMarkersRespMarker
+}
+
+type WriteTxnMarkersRespMarker struct {
+	ProducerID int64
+	Topics     []WriteTxnMarkersRespTopic
+}
+
+type WriteTxnMarkersRespTopic struct {
+	Name       string
+	Partitions []WriteTxnMarkersRespPartition
+}
+
+type WriteTxnMarkersRespPartition struct {
+	ID  int32
+	Err error
+}
+
+func ReadWriteTxnMarkersResp(r io.Reader) (*WriteTxnMarkersResp, error) {
+	var resp WriteTxnMarkersResp
+	dec := NewDecoder(r)
+
+	// total message size
+	_ = dec.DecodeInt32()
+	resp.CorrelationID = dec.DecodeInt32()
+	resp.Markers = make([]WriteTxnMarkersRespMarker, dec.DecodeArrayLen())
+	for i := range resp.Markers {
+		var m = &resp.Markers[i]
+		m.ProducerID = dec.DecodeInt64()
+		m.Topics = make([]WriteTxnMarkersRespTopic, dec.DecodeArrayLen())
+		for ti := range m.Topics {
+			var t = &m.Topics[ti]
+			t.Name = dec.DecodeString()
+			t.Partitions = make([]WriteTxnMarkersRespPartition, dec.DecodeArrayLen())
+			for pi := range t.Partitions {
+				var p = &t.Partitions[pi]
+				p.ID = dec.DecodeInt32()
+				p.Err = errFromNo(dec.DecodeInt16())
+			}
+		}
+	}
+
+	if err := dec.Err(); err != nil {
+		return nil, dec.parseErr(WriteTxnMarkersReqKind, 0, err)
+	}
+	return &resp, nil
+}
+
+func (r *WriteTxnMarkersResp) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.Encode(int32(0))
+	enc.Encode(r.CorrelationID)
+	enc.EncodeArrayLen(len(r.Markers))
+	for _, m := range r.Markers {
+		enc.Encode(m.ProducerID)
+		enc.EncodeArrayLen(len(m.Topics))
+		for _, t := range m.Topics {
+			enc.Encode(t.Name)
+			enc.EncodeArrayLen(len(t.Partitions))
+			for _, p := range t.Partitions {
+				enc.Encode(p.ID)
+				enc.EncodeError(p.Err)
+			}
+		}
+	}
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+type buffer []byte
+
+// maxPooledProduceBuf is the capacity of the largest buffer kept in the pool
+// once a produce request was written, so that a burst of big requests does
+// not keep memory around.
+const maxPooledProduceBuf = 64 * 1024
+
+// produceBufPool holds buffers produce requests are encoded to when written.
+var produceBufPool = sync.Pool{
+	New: func() interface{} { return new(buffer) },
+}
+
+func (b *buffer) Write(p []byte) (int, error) {
+	*b = append(*b, p...)
+	return len(p), nil
+}
+
+func (b *buffer) WriteString(s string) (int, error) {
+	*b = append(*b, s...)
+	return len(s), nil
 }
@@ -2,8 +2,13 @@ package proto
 
 import (
 	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
 	"io"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -16,11 +21,6 @@ func Test(t *testing.T) { TestingT(t) }
 
 type MessagesSuite struct{}
 
-type Request interface {
-	Bytes() ([]byte, error)
-	WriteTo(w io.Writer) (int64, error)
-}
-
 var _ Request = &MetadataReq{}
 var _ Request = &ProduceReq{}
 var _ Request = &FetchReq{}
@@ -28,6 +28,14 @@ var _ Request = &GroupCoordinatorReq{}
 var _ Request = &OffsetReq{}
 var _ Request = &OffsetCommitReq{}
 var _ Request = &OffsetFetchReq{}
+var _ Request = &DeleteGroupsReq{}
+var _ Request = &HeartbeatReq{}
+var _ Request = &EnvelopeReq{}
+var _ Request = &WriteTxnMarkersReq{}
+var _ Request = &OffsetDeleteReq{}
+var _ Request = &APIVersionsReq{}
+var _ Request = &SaslHandshakeReq{}
+var _ Request = &SaslAuthenticateReq{}
 
 func testRequestSerialization(c *C, r Request) {
 	var buf bytes.Buffer
@@ -45,6 +53,36 @@ func testRequestSerialization(c *C, r Request) {
 	}
 }
 
+func (s *MessagesSuite) TestRequestKind(c *C) {
+	requests := []Request{
+		&MetadataReq{},
+		&ProduceReq{},
+		&FetchReq{},
+		&GroupCoordinatorReq{},
+		&OffsetReq{},
+		&OffsetCommitReq{},
+		&OffsetFetchReq{},
+		&DeleteGroupsReq{},
+		&HeartbeatReq{},
+		&EnvelopeReq{},
+		&WriteTxnMarkersReq{},
+		&OffsetDeleteReq{},
+		&APIVersionsReq{},
+		&SaslHandshakeReq{},
+		&SaslAuthenticateReq{},
+	}
+	for _, req := range requests {
+		req.SetCorrelationID(241)
+		b, err := req.Bytes()
+		c.Assert(err, IsNil)
+		// api key and correlation ID follow the size in all request headers
+		c.Assert(int16(binary.BigEndian.Uint16(b[4:])), Equals, req.Kind(),
+			Commentf("%T", req))
+		c.Assert(int32(binary.BigEndian.Uint32(b[8:])), Equals, int32(241),
+			Commentf("%T", req))
+	}
+}
+
 func (s *MessagesSuite) TestMetadataRequest(c *C) {
 	req1 := &MetadataReq{
 		CorrelationID: 123,
@@ -78,6 +116,48 @@ func (s *MessagesSuite) TestMetadataRequest(c *C) {
 	}
 }
 
+func (s *MessagesSuite) TestMetadataRequestTopicSelection(c *C) {
+	// topics array follows size, api key, version, correlation ID and
+	// client ID "c"
+	const topicsStart = 4 + 2 + 2 + 4 + 3
+	for _, tc := range []struct {
+		topics  MetadataTopics
+		version int16
+		// topics array as encoded, nil if the request cannot be encoded
+		encoded []byte
+	}{
+		{AllTopics, 0, []byte{0x0, 0x0, 0x0, 0x0}},
+		{AllTopics, 1, []byte{0xff, 0xff, 0xff, 0xff}},
+		{AllTopics, 3, []byte{0xff, 0xff, 0xff, 0xff}},
+		{TopicNames("foo"), 0, []byte{0x0, 0x0, 0x0, 0x1, 0x0, 0x3, 0x66, 0x6f, 0x6f}},
+		{TopicNames("foo"), 1, []byte{0x0, 0x0, 0x0, 0x1, 0x0, 0x3, 0x66, 0x6f, 0x6f}},
+		{TopicNames(), 0, nil},
+		{TopicNames(), 1, []byte{0x0, 0x0, 0x0, 0x0}},
+		{MetadataTopics{}, 3, []byte{0x0, 0x0, 0x0, 0x0}},
+	} {
+		comment := Commentf("topics %#v, version %d", tc.topics, tc.version)
+		req := NewMetadataReq("c", tc.topics)
+		req.Version = tc.version
+		b, err := req.Bytes()
+		if tc.encoded == nil {
+			c.Assert(err, NotNil, comment)
+			continue
+		}
+		c.Assert(err, IsNil, comment)
+		c.Assert(b[topicsStart:], DeepEquals, tc.encoded, comment)
+
+		r, err := ReadMetadataReq(bytes.NewBuffer(b))
+		c.Assert(err, IsNil, comment)
+		c.Assert(r.Topics == nil, Equals, tc.topics.All(), comment)
+		c.Assert(len(r.Topics), Equals, len(tc.topics.Names()), comment)
+	}
+
+	// selecting no topic does not default to version 0, which would ask
+	// for all topics instead
+	c.Assert(NewMetadataReq("c", TopicNames()).Version, Equals, int16(1))
+	c.Assert(NewMetadataReq("c", AllTopics).Version, Equals, int16(0))
+}
+
 func (s *MessagesSuite) TestMetadataResponse(c *C) {
 	msgb := []byte{0x0, 0x0, 0x1, 0xc7, 0x0, 0x0, 0x0, 0x7b, 0x0, 0x0, 0x0, 0x4, 0x0, 0x0, 0xc0, 0x10, 0x0, 0xb, 0x31, 0x37, 0x32, 0x2e, 0x31, 0x37, 0x2e, 0x34, 0x32, 0x2e, 0x31, 0x0, 0x0, 0xc0, 0x10, 0x0, 0x0, 0xc0, 0x12, 0x0, 0xb, 0x31, 0x37, 0x32, 0x2e, 0x31, 0x37, 0x2e, 0x34, 0x32, 0x2e, 0x31, 0x0, 0x0, 0xc0, 0x12, 0x0, 0x0, 0xc0, 0x11, 0x0, 0xb, 0x31, 0x37, 0x32, 0x2e, 0x31, 0x37, 0x2e, 0x34, 0x32, 0x2e, 0x31, 0x0, 0x0, 0xc0, 0x11, 0x0, 0x0, 0xc0, 0x13, 0x0, 0xb, 0x31, 0x37, 0x32, 0x2e, 0x31, 0x37, 0x2e, 0x34, 0x32, 0x2e, 0x31, 0x0, 0x0, 0xc0, 0x13, 0x0, 0x0, 0x0, 0x2, 0x0, 0x0, 0x0, 0x3, 0x66, 0x6f, 0x6f, 0x0, 0x0, 0x0, 0x6, 0x0, 0x0, 0x0, 0x0, 0x0, 0x2, 0x0, 0x0, 0xc0, 0x13, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0xc0, 0x13, 0x0, 0x0, 0xc0, 0x10, 0x0, 0x0, 0xc0, 0x11, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0xc0, 0x13, 0x0, 0x0, 0xc0, 0x10, 0x0, 0x0, 0xc0, 0x11, 0x0, 0x0, 0x0, 0x0, 0x0, 0x5, 0x0, 0x0, 0xc0, 0x12, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0xc0, 0x12, 0x0, 0x0, 0xc0, 0x10, 0x0, 0x0, 0xc0, 0x11, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0xc0, 0x12, 0x0, 0x0, 0xc0, 0x10, 0x0, 0x0, 0xc0, 0x11, 0x0, 0x0, 0x0, 0x0, 0x0, 0x4, 0x0, 0x0, 0xc0, 0x11, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0xc0, 0x11, 0x0, 0x0, 0xc0, 0x13, 0x0, 0x0, 0xc0, 0x10, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0xc0, 0x11, 0x0, 0x0, 0xc0, 0x13, 0x0, 0x0, 0xc0, 0x10, 0x0, 0x0, 0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0xc0, 0x12, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0xc0, 0x12, 0x0, 0x0, 0xc0, 0x13, 0x0, 0x0, 0xc0, 0x10, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0xc0, 0x12, 0x0, 0x0, 0xc0, 0x13, 0x0, 0x0, 0xc0, 0x10, 0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0xc0, 0x10, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0xc0, 0x10, 0x0, 0x0, 0xc0, 0x11, 0x0, 0x0, 0xc0, 0x12, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0xc0, 0x10, 0x0, 0x0, 0xc0, 0x11, 0x0, 0x0, 0xc0, 0x12, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0xc0, 0x11, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0xc0, 0x11, 0x0, 0x0, 0xc0, 0x12, 0x0, 0x0, 0xc0, 0x13, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0xc0, 0x11, 0x0, 0x0, 0xc0, 0x12, 0x0, 0x0, 0xc0, 0x13, 0x0, 0x0, 0x0, 0x4, 0x74, 0x65, 0x73, 0x74, 0x0, 0x0, 0x0, 0x2, 0x0, 0x0, 0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0xc0, 0x11, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0xc0, 0x11, 0x0, 0x0, 0xc0, 0x12, 0x0, 0x0, 0xc0, 0x13, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0xc0, 0x11, 0x0, 0x0, 0xc0, 0x12, 0x0, 0x0, 0xc0, 0x13, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0xc0, 0x10, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0xc0, 0x10, 0x0, 0x0, 0xc0, 0x11, 0x0, 0x0, 0xc0, 0x12, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0xc0, 0x10, 0x0, 0x0, 0xc0, 0x11, 0x0, 0x0, 0xc0, 0x12}
 	resp, err := ReadMetadataResp(bytes.NewBuffer(msgb))
@@ -129,6 +209,68 @@ func (s *MessagesSuite) TestMetadataResponse(c *C) {
 	}
 }
 
+func (s *MessagesSuite) TestMetadataResponseV2(c *C) {
+	msgb := []byte{
+		0x0, 0x0, 0x0, 0x47, // size
+		0x0, 0x0, 0x0, 0x7b, // correlation id
+		0x0, 0x0, 0x0, 0x2, // brokers
+		0x0, 0x0, 0x0, 0x1, 0x0, 0x4, 0x68, 0x6f, 0x73, 0x74, 0x0, 0x0, 0x23, 0x84, 0xff, 0xff,
+		0x0, 0x0, 0x0, 0x2, 0x0, 0x4, 0x68, 0x6f, 0x73, 0x74, 0x0, 0x0, 0x23, 0x85, 0x0, 0x2, 0x72, 0x31,
+		0x0, 0x7, 0x63, 0x6c, 0x75, 0x73, 0x74, 0x65, 0x72, // cluster id
+		0x0, 0x0, 0x0, 0x2, // controller id
+		0x0, 0x0, 0x0, 0x1, // topics
+		0x0, 0x0, 0x0, 0x3, 0x66, 0x6f, 0x6f, 0x1, 0x0, 0x0, 0x0, 0x0,
+	}
+	req := &MetadataReq{Version: 2}
+	resp, err := ReadVersionedMetadataResp(bytes.NewBuffer(msgb), req.Version)
+	if err != nil {
+		c.Fatalf("could not read metadata response: %s", err)
+	}
+	expected := &MetadataResp{
+		CorrelationID: 123,
+		Version:       2,
+		ClusterID:     "cluster",
+		ControllerID:  2,
+		Brokers: []MetadataRespBroker{
+			{NodeID: 1, Host: "host", Port: 9092},
+			{NodeID: 2, Host: "host", Port: 9093, Rack: "r1"},
+		},
+		Topics: []MetadataRespTopic{
+			{Name: "foo", IsInternal: true, Partitions: []MetadataRespPartition{}},
+		},
+	}
+	if !reflect.DeepEqual(resp, expected) {
+		c.Fatalf("expected different message: %#v", resp)
+	}
+	if b, err := resp.Bytes(); err != nil {
+		c.Fatalf("cannot serialize response: %s", err)
+	} else if !bytes.Equal(b, msgb) {
+		c.Fatalf("serialized representation different from expected: %#v", b)
+	}
+
+	// version 1 carries racks, but no cluster ID
+	resp.Version = 1
+	b, _ := resp.Bytes()
+	resp, err = ReadVersionedMetadataResp(bytes.NewBuffer(b), 1)
+	if err != nil {
+		c.Fatalf("could not read metadata response: %s", err)
+	}
+	if resp.ClusterID != "" || resp.ControllerID != 2 || resp.Brokers[1].Rack != "r1" {
+		c.Fatalf("expected different v1 message: %#v", resp)
+	}
+
+	// nil topics are sent as null array, requesting all topics
+	b, _ = req.Bytes()
+	if got := b[len(b)-4:]; !bytes.Equal(got, []byte{0xff, 0xff, 0xff, 0xff}) {
+		c.Fatalf("expected null topics array, got %#v", got)
+	}
+	req.Topics = []string{}
+	b, _ = req.Bytes()
+	if got := b[len(b)-4:]; !bytes.Equal(got, []byte{0x0, 0x0, 0x0, 0x0}) {
+		c.Fatalf("expected empty topics array, got %#v", got)
+	}
+}
+
 func (s *MessagesSuite) TestProduceRequest(c *C) {
 	req := &ProduceReq{
 		CorrelationID: 241,
@@ -190,252 +332,2276 @@ func (s *MessagesSuite) TestProduceRequest(c *C) {
 	}
 }
 
-func (s *MessagesSuite) TestProduceResponse(c *C) {
-	msgb1 := []byte{0x0, 0x0, 0x0, 0x22, 0x0, 0x0, 0x0, 0xf1, 0x0, 0x0, 0x0, 0x1, 0x0, 0x6, 0x66, 0x72, 0x75, 0x69, 0x74, 0x73, 0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x5d, 0x0, 0x3, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
-	resp1, err := ReadProduceResp(bytes.NewBuffer(msgb1))
-	if err != nil {
-		c.Fatalf("could not read metadata response: %s", err)
-	}
-	expected1 := &ProduceResp{
+func (s *MessagesSuite) TestProduceRequestGzipLevel(c *C) {
+	req := &ProduceReq{
 		CorrelationID: 241,
-		Topics: []ProduceRespTopic{
+		ClientID:      "test",
+		Compression:   CompressionGzip,
+		RequiredAcks:  RequiredAcksAll,
+		Timeout:       time.Second,
+		Topics: []ProduceReqTopic{
 			{
-				Name: "fruits",
-				Partitions: []ProduceRespPartition{
+				Name: "foo",
+				Partitions: []ProduceReqPartition{
 					{
-						ID:     93,
-						Err:    ErrUnknownTopicOrPartition,
-						Offset: -1,
+						ID: 0,
+						Messages: []*Message{
+							{Offset: 0, Crc: 3099221847, Key: []byte("foo"), Value: []byte("bar")},
+						},
 					},
 				},
 			},
 		},
 	}
-	if !reflect.DeepEqual(resp1, expected1) {
-		c.Fatalf("expected different message: %#v", resp1)
-	}
 
-	if b, err := resp1.Bytes(); err != nil {
-		c.Fatalf("cannot serialize response: %s", err)
-	} else {
-		if !bytes.Equal(b, msgb1) {
-			c.Fatalf("serialized representation different from expected: %#v", b)
+	req.CompressionLevelSet = true
+	for _, level := range []int{gzip.BestSpeed, gzip.BestCompression, gzip.DefaultCompression} {
+		req.CompressionLevel = level
+		b, err := req.Bytes()
+		if err != nil {
+			c.Fatalf("cannot serialize request with level %d: %s", level, err)
+		}
+		r, err := ReadProduceReq(bytes.NewBuffer(b))
+		if err != nil {
+			c.Fatalf("cannot read request with level %d: %s", level, err)
+		}
+		if !reflect.DeepEqual(r.Topics, req.Topics) {
+			c.Fatalf("malformed request with level %d: %#v", level, r)
 		}
 	}
 
-	msgb2 := []byte{0x0, 0x0, 0x0, 0x1f, 0x0, 0x0, 0x0, 0xf1, 0x0, 0x0, 0x0, 0x1, 0x0, 0x3, 0x66, 0x6f, 0x6f, 0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x1}
-	resp2, err := ReadProduceResp(bytes.NewBuffer(msgb2))
-	if err != nil {
-		c.Fatalf("could not read metadata response: %s", err)
-	}
-	expected2 := &ProduceResp{
-		CorrelationID: 241,
-		Topics: []ProduceRespTopic{
-			{
-				Name: "foo",
-				Partitions: []ProduceRespPartition{
-					{
-						ID:     0,
-						Err:    error(nil),
-						Offset: 1,
-					},
-				},
-			},
-		},
-	}
-	if !reflect.DeepEqual(resp2, expected2) {
-		c.Fatalf("expected different message: %#v", resp2)
+	// unset level is the default one, gzip.NoCompression stores messages as
+	// they are
+	req.Topics[0].Partitions[0].Messages[0].Value = bytes.Repeat([]byte("bar"), 100)
+	req.CompressionLevel = 0
+	req.CompressionLevelSet = false
+	unset, err := req.Bytes()
+	c.Assert(err, IsNil)
+	sizes := make(map[int]int)
+	req.CompressionLevelSet = true
+	for _, level := range []int{gzip.DefaultCompression, gzip.NoCompression} {
+		req.CompressionLevel = level
+		b, err := req.Bytes()
+		c.Assert(err, IsNil)
+		sizes[level] = len(b)
 	}
-	if b, err := resp2.Bytes(); err != nil {
-		c.Fatalf("cannot serialize response: %s", err)
-	} else {
-		if !bytes.Equal(b, msgb2) {
-			c.Fatalf("serialized representation different from expected: %#v", b)
-		}
+	c.Assert(len(unset), Equals, sizes[gzip.DefaultCompression])
+	c.Assert(sizes[gzip.NoCompression] > len(unset), Equals, true)
+
+	req.CompressionLevel = 42
+	if _, err := req.Bytes(); err == nil {
+		c.Fatal("expected error for invalid compression level")
 	}
 }
 
-func (s *MessagesSuite) TestFetchRequest(c *C) {
-	req := &FetchReq{
-		CorrelationID: 241,
-		ClientID:      "test",
-		MaxWaitTime:   time.Second * 2,
-		MinBytes:      12454,
-		Topics: []FetchReqTopic{
-			{
-				Name: "foo",
-				Partitions: []FetchReqPartition{
-					{ID: 421, FetchOffset: 529, MaxBytes: 4921},
-					{ID: 0, FetchOffset: 11, MaxBytes: 92},
+func (s *MessagesSuite) TestProduceRequestUnsupportedCompression(c *C) {
+	for _, codec := range []Compression{CompressionLZ4, CompressionZstd} {
+		req := &ProduceReq{
+			ClientID:     "test",
+			Compression:  codec,
+			RequiredAcks: RequiredAcksAll,
+			Version:      2,
+			Topics: []ProduceReqTopic{
+				{
+					Name: "foo",
+					Partitions: []ProduceReqPartition{
+						{ID: 0, Messages: []*Message{{Value: []byte("bar")}}},
+					},
 				},
 			},
-		},
-	}
-	testRequestSerialization(c, req)
-	b, _ := req.Bytes()
-	expected := []byte{0x0, 0x0, 0x0, 0x47, 0x0, 0x1, 0x0, 0x0, 0x0, 0x0, 0x0, 0xf1, 0x0, 0x4, 0x74, 0x65, 0x73, 0x74, 0xff, 0xff, 0xff, 0xff, 0x0, 0x0, 0x7, 0xd0, 0x0, 0x0, 0x30, 0xa6, 0x0, 0x0, 0x0, 0x1, 0x0, 0x3, 0x66, 0x6f, 0x6f, 0x0, 0x0, 0x0, 0x2, 0x0, 0x0, 0x1, 0xa5, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x2, 0x11, 0x0, 0x0, 0x13, 0x39, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0xb, 0x0, 0x0, 0x0, 0x5c}
-
-	if !bytes.Equal(b, expected) {
-		c.Fatalf("expected different bytes representation: %#v", b)
-	}
-
-	r, _ := ReadFetchReq(bytes.NewBuffer(expected))
-	if !reflect.DeepEqual(r, req) {
-		c.Fatalf("malformed request: %#v", r)
+		}
+		// messages must not be sent uncompressed with the codec set
+		_, err := req.Bytes()
+		c.Assert(err, ErrorMatches, "cannot handle compression method: .*")
 	}
 }
 
-func (s *MessagesSuite) TestFetchResponse(c *C) {
-	expected1 := &FetchResp{
+func (s *MessagesSuite) TestProduceRequestBatches(c *C) {
+	req := &ProduceReq{
 		CorrelationID: 241,
-		Topics: []FetchRespTopic{
+		ClientID:      "test",
+		RequiredAcks:  RequiredAcksAll,
+		Timeout:       time.Second,
+		Topics: []ProduceReqTopic{
 			{
 				Name: "foo",
-				Partitions: []FetchRespPartition{
+				Partitions: []ProduceReqPartition{
 					{
-						ID:        0,
-						Err:       error(nil),
-						TipOffset: 4,
-						Messages: []*Message{
-							{Offset: 2, Crc: 0xb8ba5f57, Key: []byte("foo"), Value: []byte("bar"), Topic: "foo", Partition: 0, TipOffset: 4},
-							{Offset: 3, Crc: 0xb8ba5f57, Key: []byte("foo"), Value: []byte("bar"), Topic: "foo", Partition: 0, TipOffset: 4},
+						ID: 0,
+						Batches: [][]*Message{
+							{{Offset: 0, Value: []byte("a")}},
+							{{Offset: 1, Value: []byte("b")}, {Offset: 2, Value: []byte("c")}},
 						},
 					},
-					{
-						ID:        1,
-						Err:       ErrUnknownTopicOrPartition,
-						TipOffset: -1,
-						Messages:  []*Message{},
-					},
 				},
 			},
 		},
 	}
 
-	tests := []struct {
-		Bytes     []byte
-		RoundTrip bool // whether to compare re-serialized version
-		Expected  *FetchResp
-	}{
-		{ // CompressionNone
-			Bytes:     []byte{0x0, 0x0, 0x0, 0x75, 0x0, 0x0, 0x0, 0xf1, 0x0, 0x0, 0x0, 0x1, 0x0, 0x3, 0x66, 0x6f, 0x6f, 0x0, 0x0, 0x0, 0x2, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x4, 0x0, 0x0, 0x0, 0x40, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x2, 0x0, 0x0, 0x0, 0x14, 0xb8, 0xba, 0x5f, 0x57, 0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x66, 0x6f, 0x6f, 0x0, 0x0, 0x0, 0x3, 0x62, 0x61, 0x72, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0x0, 0x14, 0xb8, 0xba, 0x5f, 0x57, 0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x66, 0x6f, 0x6f, 0x0, 0x0, 0x0, 0x3, 0x62, 0x61, 0x72, 0x0, 0x0, 0x0, 0x1, 0x0, 0x3, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x0, 0x0, 0x0, 0x0},
-			RoundTrip: true,
-			Expected:  expected1,
-		},
-		{ // CompressionGzip
-			Bytes:     []byte{0x0, 0x0, 0x0, 0x81, 0x0, 0x0, 0x0, 0xf1, 0x0, 0x0, 0x0, 0x1, 0x0, 0x3, 0x66, 0x6f, 0x6f, 0x0, 0x0, 0x0, 0x2, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x4, 0x0, 0x0, 0x0, 0x4c, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0x0, 0x40, 0x7, 0x3c, 0x17, 0x35, 0x0, 0x1, 0xff, 0xff, 0xff, 0xff, 0x0, 0x0, 0x0, 0x32, 0x1f, 0x8b, 0x8, 0x0, 0x0, 0x9, 0x6e, 0x88, 0x0, 0xff, 0x62, 0x80, 0x0, 0x26, 0x20, 0x16, 0xd9, 0xb1, 0x2b, 0x3e, 0x1c, 0xcc, 0x63, 0x4e, 0xcb, 0xcf, 0x7, 0x51, 0x49, 0x89, 0x45, 0x50, 0x79, 0x66, 0x5c, 0xf2, 0x80, 0x0, 0x0, 0x0, 0xff, 0xff, 0xab, 0xcc, 0x83, 0x80, 0x40, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x1, 0x0, 0x3, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x0, 0x0, 0x0, 0x0},
-			RoundTrip: false,
-			Expected:  expected1,
-		},
-		{ // CompressionSnappy
-			Bytes:     []byte{0x0, 0x0, 0x0, 0x75, 0x0, 0x0, 0x0, 0xf1, 0x0, 0x0, 0x0, 0x1, 0x0, 0x3, 0x66, 0x6f, 0x6f, 0x0, 0x0, 0x0, 0x2, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x4, 0x0, 0x0, 0x0, 0x40, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0x0, 0x34, 0x6, 0x8d, 0xfe, 0xe2, 0x0, 0x2, 0xff, 0xff, 0xff, 0xff, 0x0, 0x0, 0x0, 0x26, 0x40, 0x0, 0x0, 0x9, 0x1, 0x20, 0x2, 0x0, 0x0, 0x0, 0x14, 0xb8, 0xba, 0x5f, 0x57, 0x5, 0xf, 0x28, 0x3, 0x66, 0x6f, 0x6f, 0x0, 0x0, 0x0, 0x3, 0x62, 0x61, 0x72, 0x5, 0x10, 0x8, 0x0, 0x0, 0x3, 0x5e, 0x20, 0x0, 0x0, 0x0, 0x0, 0x1, 0x0, 0x3, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x0, 0x0, 0x0, 0x0},
-			RoundTrip: false,
-			Expected:  expected1,
-		},
+	// without compression, batches are encoded just like a single message set
+	flat := *req
+	flat.Topics = []ProduceReqTopic{
 		{
-			Bytes:     []byte{0x0, 0x0, 0x0, 0x48, 0x0, 0x0, 0x0, 0xf1, 0x0, 0x0, 0x0, 0x1, 0x0, 0x4, 0x74, 0x65, 0x73, 0x74, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x1, 0x0, 0x3, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x8, 0x0, 0x3, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x0, 0x0, 0x0, 0x0},
-			RoundTrip: true,
-			Expected: &FetchResp{
-				CorrelationID: 241,
-				Topics: []FetchRespTopic{
-					{
-						Name: "test",
-						Partitions: []FetchRespPartition{
-							{
-								ID:        0,
-								Err:       ErrUnknownTopicOrPartition,
-								TipOffset: -1,
-								Messages:  []*Message{},
-							},
-							{
-								ID:        1,
-								Err:       ErrUnknownTopicOrPartition,
-								TipOffset: -1,
-								Messages:  []*Message{},
-							},
-							{
-								ID:        8,
-								Err:       ErrUnknownTopicOrPartition,
-								TipOffset: -1,
-								Messages:  []*Message{},
-							},
-						},
+			Name: "foo",
+			Partitions: []ProduceReqPartition{
+				{
+					ID: 0,
+					Messages: []*Message{
+						{Offset: 0, Value: []byte("a")},
+						{Offset: 1, Value: []byte("b")},
+						{Offset: 2, Value: []byte("c")},
 					},
 				},
 			},
 		},
 	}
+	b, _ := req.Bytes()
+	fb, _ := flat.Bytes()
+	if !bytes.Equal(b, fb) {
+		c.Fatalf("expected batches to be encoded as single message set: %#v", b)
+	}
 
-	for _, tt := range tests {
-		resp, err := ReadFetchResp(bytes.NewBuffer(tt.Bytes))
+	for _, compression := range []Compression{CompressionGzip, CompressionSnappy} {
+		req.Compression = compression
+		flat.Compression = compression
+		b, _ := req.Bytes()
+		fb, _ := flat.Bytes()
+		if bytes.Equal(b, fb) {
+			c.Fatalf("expected batches to be compressed separately (compression %d)", compression)
+		}
+
+		r, err := ReadProduceReq(bytes.NewBuffer(b))
 		if err != nil {
-			c.Fatalf("could not read fetch response: %s", err)
+			c.Fatalf("cannot read request (compression %d): %s", compression, err)
 		}
-		if !reflect.DeepEqual(resp, tt.Expected) {
-			c.Fatalf("expected different message: %#v", resp)
+		messages := r.Topics[0].Partitions[0].Messages
+		if len(messages) != 3 {
+			c.Fatalf("expected 3 messages, got %d", len(messages))
 		}
-		if tt.RoundTrip {
-			b, err := resp.Bytes()
-			if err != nil {
-				c.Fatalf("cannot serialize response: %s", err)
-			}
-			if !bytes.Equal(b, tt.Bytes) {
-				c.Fatalf("serialized representation different from expected: %#v", b)
+		for i, m := range messages {
+			if m.Offset != int64(i) || string(m.Value) != []string{"a", "b", "c"}[i] {
+				c.Fatalf("unexpected message %d: %#v", i, m)
 			}
 		}
 	}
 }
 
-func (s *MessagesSuite) TestSerializeEmptyMessageSet(c *C) {
-	var buf bytes.Buffer
-	messages := []*Message{}
-	n, err := writeMessageSet(&buf, messages, CompressionNone)
-	if err != nil {
-		c.Fatalf("cannot serialize messages: %s", err)
-	}
-	if n != 0 {
-		c.Fatalf("got n=%d result from writeMessageSet; want 0", n)
-	}
-	if l := len(buf.Bytes()); l != 0 {
-		c.Fatalf("got len=%d for empty message set; should be 0", l)
+func (s *MessagesSuite) TestProduceRequestMinCompressSize(c *C) {
+	small := []*Message{{Offset: 0, Value: []byte("a")}}
+	large := []*Message{{Offset: 1, Value: bytes.Repeat([]byte("b"), 100)}}
+	req := &ProduceReq{
+		CorrelationID:   241,
+		ClientID:        "test",
+		Compression:     CompressionGzip,
+		MinCompressSize: 64,
+		RequiredAcks:    RequiredAcksAll,
+		Timeout:         time.Second,
+		Topics: []ProduceReqTopic{
+			{
+				Name: "foo",
+				Partitions: []ProduceReqPartition{
+					{ID: 0, Messages: small},
+				},
+			},
+		},
 	}
-}
 
-func (s *MessagesSuite) TestReadIncompleteMessage(c *C) {
-	var buf bytes.Buffer
-	_, err := writeMessageSet(&buf, []*Message{
-		{Value: []byte("111111111111111")},
-		{Value: []byte("222222222222222")},
-		{Value: []byte("333333333333333")},
-	}, CompressionNone)
-	if err != nil {
-		c.Fatalf("cannot serialize messages: %s", err)
+	plain := *req
+	plain.Compression = CompressionNone
+	b, _ := req.Bytes()
+	pb, _ := plain.Bytes()
+	if !bytes.Equal(b, pb) {
+		c.Fatalf("expected small message set to be sent uncompressed: %#v", b)
 	}
 
-	b := buf.Bytes()
-	// cut off the last bytes as kafka can do
-	b = b[:len(b)-4]
-	messages, err := readMessageSet(bytes.NewBuffer(b), int32(len(b)))
+	req.Topics[0].Partitions[0].Messages = nil
+	req.Topics[0].Partitions[0].Batches = [][]*Message{small, large}
+	plain.Topics = []ProduceReqTopic{
+		{
+			Name: "foo",
+			Partitions: []ProduceReqPartition{
+				{ID: 0, Batches: [][]*Message{small, large}},
+			},
+		},
+	}
+	b, _ = req.Bytes()
+	pb, _ = plain.Bytes()
+	if bytes.Equal(b, pb) {
+		c.Fatal("expected large message set to be compressed")
+	}
+	r, err := ReadProduceReq(bytes.NewBuffer(b))
 	if err != nil {
-		c.Fatalf("cannot deserialize messages: %s", err)
+		c.Fatalf("cannot read request: %s", err)
 	}
+	messages := r.Topics[0].Partitions[0].Messages
 	if len(messages) != 2 {
 		c.Fatalf("expected 2 messages, got %d", len(messages))
 	}
-	if messages[0].Value[0] != '1' || messages[1].Value[0] != '2' {
-		c.Fatal("expected different messages content")
+	if string(messages[0].Value) != "a" || !bytes.Equal(messages[1].Value, large[0].Value) {
+		c.Fatalf("unexpected messages: %#v", messages)
 	}
 }
 
-func BenchmarkProduceRequestMarshal(b *testing.B) {
-	messages := make([]*Message, 100)
-	for i := range messages {
-		messages[i] = &Message{
-			Offset: int64(i),
-			Crc:    uint32(i),
-			Key:    nil,
-			Value:  []byte(`Lorem ipsum dolor sit amet, consectetur adipiscing elit. Donec a diam lectus. Sed sit amet ipsum mauris. Maecenas congue ligula ac quam viverra nec consectetur ante hendrerit. Donec et mollis dolor. Praesent et diam eget libero egestas mattis sit amet vitae augue. Nam tincidunt congue enim, ut porta lorem lacinia consectetur.`),
-		}
+func (s *MessagesSuite) TestProduceRequestRawMessageSet(c *C) {
+	messages := []*Message{
+		{Offset: 0, Key: []byte("a"), Value: []byte("first"), Timestamp: time.Unix(1500000000, 0)},
+		{Offset: 1, Value: []byte("second"), Timestamp: time.Unix(1500000001, 0)},
+	}
+	var set bytes.Buffer
+	_, err := encodeMessageSet(&set, messages, CompressionGzip, gzip.DefaultCompression, messageMagicV1, TimestampCreateTime, nil)
+	c.Assert(err, IsNil)
+	raw := set.Bytes()
+
+	req := &ProduceReq{
+		CorrelationID: 241,
+		ClientID:      "test",
+		RequiredAcks:  RequiredAcksAll,
+		Timeout:       time.Second,
+		Version:       2,
+		Topics: []ProduceReqTopic{
+			{
+				Name: "foo",
+				Partitions: []ProduceReqPartition{
+					{ID: 0, RawMessageSet: raw},
+				},
+			},
+		},
+	}
+	b, err := req.Bytes()
+	c.Assert(err, IsNil)
+	c.Assert(len(b), Equals, EstimateProduceSize(req))
+	// size prefix followed by the message set, at the end of the request
+	c.Assert(bytes.HasSuffix(b, raw), Equals, true)
+	size := binary.BigEndian.Uint32(b[len(b)-len(raw)-4:])
+	c.Assert(int(size), Equals, len(raw))
+
+	r, err := ReadProduceReq(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	got := r.Topics[0].Partitions[0].Messages
+	c.Assert(got, HasLen, 2)
+	c.Assert(string(got[1].Value), Equals, "second")
+	c.Assert(got[1].Timestamp.Equal(messages[1].Timestamp), Equals, true)
+
+	// crc is trusted, not computed again
+	corrupted := append([]byte(nil), raw...)
+	corrupted[8+4] ^= 0xff
+	req.Topics[0].Partitions[0].RawMessageSet = corrupted
+	b, err = req.Bytes()
+	c.Assert(err, IsNil)
+	c.Assert(bytes.HasSuffix(b, corrupted), Equals, true)
+	req.Topics[0].Partitions[0].RawMessageSet = raw
+
+	// message format does not match the request version
+	req.Version = 0
+	_, err = req.Bytes()
+	c.Assert(err, ErrorMatches, "message at byte 0 of message set has magic byte 1, produce request v0 requires 0")
+
+	req.Version = 2
+	req.Topics[0].Partitions[0].RawMessageSet = raw[:len(raw)-1]
+	_, err = req.Bytes()
+	c.Assert(err, ErrorMatches, "invalid size .* of message at byte 0 of message set")
+
+	req.Topics[0].Partitions[0].RawMessageSet = raw[:10]
+	_, err = req.Bytes()
+	c.Assert(err, ErrorMatches, "message set truncated at byte 0")
+
+	c.Assert(ValidateMessageSet(nil, 2), IsNil)
+}
+
+func (s *MessagesSuite) TestProduceRequestRawRecordBatch(c *C) {
+	ts := time.Unix(1500000000, 0)
+	var set bytes.Buffer
+	_, _ = set.Write(testRecordBatch(10, 0, ts, "first", "second"))
+	_, _ = set.Write(testRecordBatch(12, 0, ts, "third"))
+	complete := set.Len()
+	// partial batch at the end, as brokers return when hitting max bytes
+	_, _ = set.Write(testRecordBatch(13, 0, ts, "fourth")[:20])
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.EncodeInt32(0) // size placeholder
+	enc.EncodeInt32(241)
+	enc.EncodeInt32(0) // throttle time
+	enc.EncodeArrayLen(1)
+	enc.EncodeString("foo")
+	enc.EncodeArrayLen(1)
+	enc.EncodeInt32(0)
+	enc.EncodeInt16(0)
+	enc.EncodeInt64(13)
+	enc.EncodeInt64(13)   // last stable offset
+	enc.EncodeArrayLen(0) // aborted transactions
+	enc.EncodeInt32(int32(set.Len()))
+	_, _ = buf.Write(set.Bytes())
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	resp, err := ReadVersionedFetchResp(bytes.NewReader(b), 4)
+	c.Assert(err, IsNil)
+	c.Assert(resp.Topics[0].Partitions[0].RawMessageSet, IsNil)
+
+	resp, err = ReadRawFetchResp(bytes.NewReader(b), 4)
+	c.Assert(err, IsNil)
+	part := resp.Topics[0].Partitions[0]
+	c.Assert(part.Messages, HasLen, 3)
+	raw := part.RawMessageSet
+	c.Assert(raw, DeepEquals, set.Bytes()[:complete])
+
+	req := &ProduceReq{
+		CorrelationID: 241,
+		ClientID:      "test",
+		RequiredAcks:  RequiredAcksAll,
+		Timeout:       time.Second,
+		Version:       3,
+		Topics: []ProduceReqTopic{
+			{
+				Name: "foo",
+				Partitions: []ProduceReqPartition{
+					{ID: 0, RawMessageSet: raw},
+				},
+			},
+		},
+	}
+	b, err = req.Bytes()
+	c.Assert(err, IsNil)
+	c.Assert(len(b), Equals, EstimateProduceSize(req))
+	c.Assert(bytes.HasSuffix(b, raw), Equals, true)
+	size := binary.BigEndian.Uint32(b[len(b)-len(raw)-4:])
+	c.Assert(int(size), Equals, len(raw))
+
+	r, err := ReadProduceReq(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	got := r.Topics[0].Partitions[0].Messages
+	c.Assert(got, HasLen, 3)
+	for i, value := range []string{"first", "second", "third"} {
+		c.Assert(string(got[i].Value), Equals, value)
+		c.Assert(got[i].Offset, Equals, int64(10+i))
+	}
+
+	// record batches require version 3, which cannot encode messages
+	req.Version = 2
+	_, err = req.Bytes()
+	c.Assert(err, ErrorMatches, "message at byte 0 of message set has magic byte 2, produce request v2 requires 1")
+	req.Version = 3
+	req.Topics[0].Partitions[0].RawMessageSet = nil
+	req.Topics[0].Partitions[0].Messages = got
+	_, err = req.Bytes()
+	c.Assert(err, ErrorMatches, "produce request v3 can only send RawMessageSet")
+
+	// batch length shorter than the batch header
+	short := append([]byte(nil), raw...)
+	binary.BigEndian.PutUint32(short[8:], recordBatchHeaderSize-1)
+	c.Assert(ValidateMessageSet(short, 3), ErrorMatches, "invalid size 48 of message at byte 0 of message set")
+}
+
+func (s *MessagesSuite) TestEstimateProduceSize(c *C) {
+	messages := []*Message{
+		{Value: []byte("first")},
+		{Key: []byte("key"), Value: []byte("second")},
+		{Key: []byte{}, Value: nil},
+		{Value: bytes.Repeat([]byte("x"), 1000), Timestamp: time.Unix(1500000000, 0)},
+	}
+	req := &ProduceReq{
+		CorrelationID: 241,
+		ClientID:      "test",
+		RequiredAcks:  RequiredAcksAll,
+		Timeout:       time.Second,
+		Topics: []ProduceReqTopic{
+			{
+				Name: "foo",
+				Partitions: []ProduceReqPartition{
+					{ID: 0, Messages: messages},
+					{ID: 1, Batches: [][]*Message{messages[:1], messages[1:]}},
+					{ID: 2},
+				},
+			},
+			{Name: "bar"},
+		},
+	}
+
+	for _, version := range []int16{0, 1, 2} {
+		req.Version = version
+		b, err := req.Bytes()
+		c.Assert(err, IsNil)
+		c.Assert(EstimateProduceSize(req), Equals, len(b), Commentf("version %d", version))
+	}
+
+	// record batches of version 3
+	ts := time.Unix(1500000000, 0)
+	var set bytes.Buffer
+	_, _ = set.Write(testRecordBatch(0, 0, ts, "first", "second"))
+	_, _ = set.Write(testRecordBatch(2, 0, ts, "third"))
+	req.Version = 3
+	req.Topics = []ProduceReqTopic{
+		{
+			Name: "foo",
+			Partitions: []ProduceReqPartition{
+				{ID: 0, RawMessageSet: set.Bytes()},
+				{ID: 1, RawMessageSet: testRecordBatch(0, 0, ts, "fourth")},
+			},
+		},
+		{Name: "bar"},
+	}
+	b, err := req.Bytes()
+	c.Assert(err, IsNil)
+	c.Assert(EstimateProduceSize(req), Equals, len(b))
+
+	for _, m := range messages {
+		var buf bytes.Buffer
+		n, err := encodeMessageSet(&buf, []*Message{m}, CompressionNone, 0, messageMagicV1, TimestampCreateTime, nil)
+		c.Assert(err, IsNil)
+		c.Assert(EstimateMessageSize(m), Equals, n)
+	}
+}
+
+func (s *MessagesSuite) TestProduceRequestTimestamps(c *C) {
+	ts := time.Unix(1500000000, 123*int64(time.Millisecond))
+	req := &ProduceReq{
+		CorrelationID: 241,
+		ClientID:      "test",
+		RequiredAcks:  RequiredAcksAll,
+		Timeout:       time.Second,
+		Version:       2,
+		Topics: []ProduceReqTopic{
+			{
+				Name: "foo",
+				Partitions: []ProduceReqPartition{
+					{
+						ID: 0,
+						Messages: []*Message{
+							{Offset: 0, Key: []byte("foo"), Value: []byte("bar"), Timestamp: ts},
+							{Offset: 1, Key: []byte("foo"), Value: []byte("baz")},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	for _, compression := range []Compression{CompressionNone, CompressionGzip, CompressionSnappy} {
+		req.Compression = compression
+		testRequestSerialization(c, req)
+		b, _ := req.Bytes()
+
+		r, err := ReadProduceReq(bytes.NewBuffer(b))
+		if err != nil {
+			c.Fatalf("cannot read request (compression %d): %s", compression, err)
+		}
+		if r.Version != 2 {
+			c.Fatalf("expected version 2, got %d", r.Version)
+		}
+		messages := r.Topics[0].Partitions[0].Messages
+		if len(messages) != 2 {
+			c.Fatalf("expected 2 messages, got %d", len(messages))
+		}
+		for i, m := range messages {
+			if m.Offset != int64(i) {
+				c.Fatalf("expected offset %d, got %d", i, m.Offset)
+			}
+			if m.TimestampType != TimestampCreateTime {
+				c.Fatalf("expected create time timestamp, got %d", m.TimestampType)
+			}
+		}
+		if !messages[0].Timestamp.Equal(ts) {
+			c.Fatalf("expected timestamp %s, got %s", ts, messages[0].Timestamp)
+		}
+		if !messages[1].Timestamp.IsZero() {
+			c.Fatalf("expected no timestamp, got %s", messages[1].Timestamp)
+		}
+		if string(messages[1].Value) != "baz" {
+			c.Fatalf("expected different message value: %q", messages[1].Value)
+		}
+	}
+}
+
+func (s *MessagesSuite) TestProduceRequestTimestampType(c *C) {
+	req := &ProduceReq{
+		CorrelationID: 241,
+		ClientID:      "test",
+		RequiredAcks:  RequiredAcksAll,
+		Timeout:       time.Second,
+		Version:       2,
+		Topics: []ProduceReqTopic{
+			{
+				Name: "foo",
+				Partitions: []ProduceReqPartition{
+					{
+						ID:       0,
+						Messages: []*Message{{Value: []byte("bar"), Timestamp: time.Unix(1500000000, 0)}},
+					},
+				},
+			},
+		},
+	}
+	// size + api key + version + correlation ID + client ID + required acks +
+	// timeout + topics + topic name + partitions + partition ID + message set
+	// size, followed by offset + message size + crc + magic byte
+	const attrPos = 4 + 2 + 2 + 4 + 2 + 4 + 2 + 4 + 4 + 2 + 3 + 4 + 4 + 4 + 8 + 4 + 4 + 1
+
+	for _, tc := range []struct {
+		compression Compression
+		tsType      TimestampType
+		attributes  byte
+	}{
+		{CompressionNone, TimestampCreateTime, 0x00},
+		{CompressionNone, TimestampLogAppendTime, 0x08},
+		{CompressionGzip, TimestampCreateTime, 0x01},
+		{CompressionGzip, TimestampLogAppendTime, 0x09},
+	} {
+		req.Compression = tc.compression
+		req.Topics[0].Partitions[0].TimestampType = tc.tsType
+		testRequestSerialization(c, req)
+		b, err := req.Bytes()
+		c.Assert(err, IsNil)
+		c.Assert(b[attrPos], Equals, tc.attributes, Commentf("compression %d, timestamp type %d", tc.compression, tc.tsType))
+
+		r, err := ReadProduceReq(bytes.NewBuffer(b))
+		c.Assert(err, IsNil)
+		c.Assert(r.Topics[0].Partitions[0].TimestampType, Equals, tc.tsType)
+	}
+
+	// message format v0 has no timestamps
+	req.Version = 1
+	_, err := req.Bytes()
+	c.Assert(err, ErrorMatches, "produce request v1 cannot set timestamp type 1")
+}
+
+func (s *MessagesSuite) TestFetchResponseLogAppendTime(c *C) {
+	ts := time.Unix(1500000000, 0)
+
+	// message format v1 with LogAppendTime timestamp type attribute
+	var msg bytes.Buffer
+	enc := NewEncoder(&msg)
+	enc.EncodeInt8(1)    // magic byte
+	enc.EncodeInt8(0x08) // attributes
+	enc.EncodeInt64(ts.UnixNano() / int64(time.Millisecond))
+	enc.EncodeBytes([]byte("foo"))
+	enc.EncodeBytes([]byte("bar"))
+	crc := crc32.ChecksumIEEE(msg.Bytes())
+
+	var buf bytes.Buffer
+	enc = NewEncoder(&buf)
+	enc.EncodeInt32(0) // size placeholder
+	enc.EncodeInt32(241)
+	enc.EncodeInt32(100) // throttle time
+	enc.EncodeArrayLen(1)
+	enc.EncodeString("foo")
+	enc.EncodeArrayLen(1)
+	enc.EncodeInt32(0)
+	enc.EncodeInt16(0)
+	enc.EncodeInt64(8)
+	enc.EncodeInt32(int32(8 + 4 + 4 + msg.Len()))
+	enc.EncodeInt64(7)
+	enc.EncodeInt32(int32(4 + msg.Len()))
+	enc.EncodeUint32(crc)
+	_, _ = buf.Write(msg.Bytes())
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	resp, err := ReadVersionedFetchResp(bytes.NewBuffer(b), 2)
+	if err != nil {
+		c.Fatalf("could not read fetch response: %s", err)
+	}
+	expected := &FetchResp{
+		CorrelationID: 241,
+		Version:       2,
+		ThrottleTime:  100 * time.Millisecond,
+		Topics: []FetchRespTopic{
+			{
+				Name: "foo",
+				Partitions: []FetchRespPartition{
+					{
+						ID:            0,
+						TipOffset:     8,
+						MessageFormat: MessageFormatV1,
+						Messages: []*Message{
+							{
+								Offset:        7,
+								Crc:           crc,
+								Key:           []byte("foo"),
+								Value:         []byte("bar"),
+								Topic:         "foo",
+								TipOffset:     8,
+								Timestamp:     ts,
+								TimestampType: TimestampLogAppendTime,
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	if !reflect.DeepEqual(resp, expected) {
+		c.Fatalf("expected different message: %#v", resp)
+	}
+}
+
+func (s *MessagesSuite) TestProduceResponseV2(c *C) {
+	resp := &ProduceResp{
+		CorrelationID: 241,
+		Version:       2,
+		ThrottleTime:  20 * time.Millisecond,
+		Topics: []ProduceRespTopic{
+			{
+				Name: "foo",
+				Partitions: []ProduceRespPartition{
+					{ID: 0, Offset: 1, Timestamp: time.Unix(1500000000, 0)},
+					{ID: 1, Offset: 4},
+				},
+			},
+		},
+	}
+	b, err := resp.Bytes()
+	if err != nil {
+		c.Fatalf("cannot serialize response: %s", err)
+	}
+	expected := []byte{0x0, 0x0, 0x0, 0x41, 0x0, 0x0, 0x0, 0xf1, 0x0, 0x0, 0x0, 0x1, 0x0, 0x3, 0x66, 0x6f, 0x6f, 0x0, 0x0, 0x0, 0x2, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x1, 0x5d, 0x3e, 0xf7, 0x98, 0x0, 0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x4, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x0, 0x0, 0x0, 0x14}
+	if !bytes.Equal(b, expected) {
+		c.Fatalf("expected different bytes representation: %#v", b)
+	}
+	r, err := ReadVersionedProduceResp(bytes.NewBuffer(b), 2)
+	if err != nil {
+		c.Fatalf("could not read produce response: %s", err)
+	}
+	if !reflect.DeepEqual(r, resp) {
+		c.Fatalf("expected different message: %#v", r)
+	}
+}
+
+func (s *MessagesSuite) TestProduceResponseFencedLeaderEpoch(c *C) {
+	resp := &ProduceResp{
+		CorrelationID: 241,
+		Version:       2,
+		Topics: []ProduceRespTopic{
+			{
+				Name: "foo",
+				Partitions: []ProduceRespPartition{
+					{ID: 0, Err: ErrFencedLeaderEpoch, Offset: -1},
+					{ID: 1, Err: ErrUnknownLeaderEpoch, Offset: -1},
+				},
+			},
+		},
+	}
+	b, err := resp.Bytes()
+	c.Assert(err, IsNil)
+	r, err := ReadVersionedProduceResp(bytes.NewBuffer(b), 2)
+	c.Assert(err, IsNil)
+	c.Assert(r.Topics[0].Partitions[0].Err, Equals, ErrFencedLeaderEpoch)
+	c.Assert(r.Topics[0].Partitions[1].Err, Equals, ErrUnknownLeaderEpoch)
+}
+
+func (s *MessagesSuite) TestProduceResponseSplit(c *C) {
+	resp := &ProduceResp{
+		Topics: []ProduceRespTopic{
+			{
+				Name: "foo",
+				Partitions: []ProduceRespPartition{
+					{ID: 0, Offset: 12},
+					{ID: 1, Err: ErrNotEnoughReplicas},
+					{ID: 2, Err: ErrNotEnoughReplicasAfterAppend},
+				},
+			},
+			{
+				Name: "bar",
+				Partitions: []ProduceRespPartition{
+					{ID: 0, Err: ErrMessageSizeTooLarge},
+					{ID: 1, Err: errFromNo(9999)},
+				},
+			},
+		},
+	}
+	succeeded, retriable, failed := resp.Split()
+	c.Assert(succeeded, DeepEquals, []ProduceRespTopic{
+		{Name: "foo", Partitions: []ProduceRespPartition{{ID: 0, Offset: 12}}},
+	})
+	c.Assert(retriable, DeepEquals, []ProduceRespTopic{
+		{Name: "foo", Partitions: []ProduceRespPartition{
+			{ID: 1, Err: ErrNotEnoughReplicas},
+			{ID: 2, Err: ErrNotEnoughReplicasAfterAppend},
+		}},
+	})
+	c.Assert(failed, DeepEquals, []ProduceRespTopic{
+		{Name: "bar", Partitions: resp.Topics[1].Partitions},
+	})
+}
+
+func (s *MessagesSuite) TestProduceResponseBaseOffset(c *C) {
+	resp := &ProduceResp{
+		CorrelationID: 241,
+		Version:       2,
+		Topics: []ProduceRespTopic{
+			{
+				Name: "foo",
+				Partitions: []ProduceRespPartition{
+					{ID: 0, Offset: 1200},
+					{ID: 1, Err: ErrNotLeaderForPartition, Offset: -1},
+				},
+			},
+		},
+	}
+	b, err := resp.Bytes()
+	c.Assert(err, IsNil)
+	r, err := ReadVersionedProduceResp(bytes.NewBuffer(b), 2)
+	c.Assert(err, IsNil)
+
+	offset, err := r.BaseOffset("foo", 0)
+	c.Assert(err, IsNil)
+	c.Assert(offset, Equals, int64(1200))
+	_, err = r.BaseOffset("foo", 1)
+	c.Assert(err, Equals, ErrNotLeaderForPartition)
+	_, err = r.BaseOffset("foo", 2)
+	c.Assert(err, ErrorMatches, "no result for foo:2 in produce response")
+	_, err = r.BaseOffset("bar", 0)
+	c.Assert(err, NotNil)
+}
+
+func (s *MessagesSuite) TestProduceResponse(c *C) {
+	msgb1 := []byte{0x0, 0x0, 0x0, 0x22, 0x0, 0x0, 0x0, 0xf1, 0x0, 0x0, 0x0, 0x1, 0x0, 0x6, 0x66, 0x72, 0x75, 0x69, 0x74, 0x73, 0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x5d, 0x0, 0x3, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	resp1, err := ReadProduceResp(bytes.NewBuffer(msgb1))
+	if err != nil {
+		c.Fatalf("could not read metadata response: %s", err)
+	}
+	expected1 := &ProduceResp{
+		CorrelationID: 241,
+		Topics: []ProduceRespTopic{
+			{
+				Name: "fruits",
+				Partitions: []ProduceRespPartition{
+					{
+						ID:     93,
+						Err:    ErrUnknownTopicOrPartition,
+						Offset: -1,
+					},
+				},
+			},
+		},
+	}
+	if !reflect.DeepEqual(resp1, expected1) {
+		c.Fatalf("expected different message: %#v", resp1)
+	}
+
+	if b, err := resp1.Bytes(); err != nil {
+		c.Fatalf("cannot serialize response: %s", err)
+	} else {
+		if !bytes.Equal(b, msgb1) {
+			c.Fatalf("serialized representation different from expected: %#v", b)
+		}
+	}
+
+	msgb2 := []byte{0x0, 0x0, 0x0, 0x1f, 0x0, 0x0, 0x0, 0xf1, 0x0, 0x0, 0x0, 0x1, 0x0, 0x3, 0x66, 0x6f, 0x6f, 0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x1}
+	resp2, err := ReadProduceResp(bytes.NewBuffer(msgb2))
+	if err != nil {
+		c.Fatalf("could not read metadata response: %s", err)
+	}
+	expected2 := &ProduceResp{
+		CorrelationID: 241,
+		Topics: []ProduceRespTopic{
+			{
+				Name: "foo",
+				Partitions: []ProduceRespPartition{
+					{
+						ID:     0,
+						Err:    error(nil),
+						Offset: 1,
+					},
+				},
+			},
+		},
+	}
+	if !reflect.DeepEqual(resp2, expected2) {
+		c.Fatalf("expected different message: %#v", resp2)
+	}
+	if b, err := resp2.Bytes(); err != nil {
+		c.Fatalf("cannot serialize response: %s", err)
+	} else {
+		if !bytes.Equal(b, msgb2) {
+			c.Fatalf("serialized representation different from expected: %#v", b)
+		}
+	}
+}
+
+func (s *MessagesSuite) TestFetchRequest(c *C) {
+	req := &FetchReq{
+		CorrelationID: 241,
+		ClientID:      "test",
+		MaxWaitTime:   time.Second * 2,
+		MinBytes:      12454,
+		Topics: []FetchReqTopic{
+			{
+				Name: "foo",
+				Partitions: []FetchReqPartition{
+					{ID: 421, FetchOffset: 529, MaxBytes: 4921},
+					{ID: 0, FetchOffset: 11, MaxBytes: 92},
+				},
+			},
+		},
+	}
+	testRequestSerialization(c, req)
+	b, _ := req.Bytes()
+	expected := []byte{0x0, 0x0, 0x0, 0x47, 0x0, 0x1, 0x0, 0x0, 0x0, 0x0, 0x0, 0xf1, 0x0, 0x4, 0x74, 0x65, 0x73, 0x74, 0xff, 0xff, 0xff, 0xff, 0x0, 0x0, 0x7, 0xd0, 0x0, 0x0, 0x30, 0xa6, 0x0, 0x0, 0x0, 0x1, 0x0, 0x3, 0x66, 0x6f, 0x6f, 0x0, 0x0, 0x0, 0x2, 0x0, 0x0, 0x1, 0xa5, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x2, 0x11, 0x0, 0x0, 0x13, 0x39, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0xb, 0x0, 0x0, 0x0, 0x5c}
+
+	if !bytes.Equal(b, expected) {
+		c.Fatalf("expected different bytes representation: %#v", b)
+	}
+
+	r, _ := ReadFetchReq(bytes.NewBuffer(expected))
+	if !reflect.DeepEqual(r, req) {
+		c.Fatalf("malformed request: %#v", r)
+	}
+}
+
+func (s *MessagesSuite) TestFetchResponse(c *C) {
+	expected1 := &FetchResp{
+		CorrelationID: 241,
+		Topics: []FetchRespTopic{
+			{
+				Name: "foo",
+				Partitions: []FetchRespPartition{
+					{
+						ID:        0,
+						Err:       error(nil),
+						TipOffset: 4,
+						Messages: []*Message{
+							{Offset: 2, Crc: 0xb8ba5f57, Key: []byte("foo"), Value: []byte("bar"), Topic: "foo", Partition: 0, TipOffset: 4},
+							{Offset: 3, Crc: 0xb8ba5f57, Key: []byte("foo"), Value: []byte("bar"), Topic: "foo", Partition: 0, TipOffset: 4},
+						},
+					},
+					{
+						ID:            1,
+						Err:           ErrUnknownTopicOrPartition,
+						TipOffset:     -1,
+						Messages:      []*Message{},
+						MessageFormat: MessageFormatUnknown,
+					},
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		Bytes     []byte
+		RoundTrip bool // whether to compare re-serialized version
+		Expected  *FetchResp
+	}{
+		{ // CompressionNone
+			Bytes:     []byte{0x0, 0x0, 0x0, 0x75, 0x0, 0x0, 0x0, 0xf1, 0x0, 0x0, 0x0, 0x1, 0x0, 0x3, 0x66, 0x6f, 0x6f, 0x0, 0x0, 0x0, 0x2, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x4, 0x0, 0x0, 0x0, 0x40, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x2, 0x0, 0x0, 0x0, 0x14, 0xb8, 0xba, 0x5f, 0x57, 0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x66, 0x6f, 0x6f, 0x0, 0x0, 0x0, 0x3, 0x62, 0x61, 0x72, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0x0, 0x14, 0xb8, 0xba, 0x5f, 0x57, 0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x66, 0x6f, 0x6f, 0x0, 0x0, 0x0, 0x3, 0x62, 0x61, 0x72, 0x0, 0x0, 0x0, 0x1, 0x0, 0x3, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x0, 0x0, 0x0, 0x0},
+			RoundTrip: true,
+			Expected:  expected1,
+		},
+		{ // CompressionGzip
+			Bytes:     []byte{0x0, 0x0, 0x0, 0x81, 0x0, 0x0, 0x0, 0xf1, 0x0, 0x0, 0x0, 0x1, 0x0, 0x3, 0x66, 0x6f, 0x6f, 0x0, 0x0, 0x0, 0x2, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x4, 0x0, 0x0, 0x0, 0x4c, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0x0, 0x40, 0x7, 0x3c, 0x17, 0x35, 0x0, 0x1, 0xff, 0xff, 0xff, 0xff, 0x0, 0x0, 0x0, 0x32, 0x1f, 0x8b, 0x8, 0x0, 0x0, 0x9, 0x6e, 0x88, 0x0, 0xff, 0x62, 0x80, 0x0, 0x26, 0x20, 0x16, 0xd9, 0xb1, 0x2b, 0x3e, 0x1c, 0xcc, 0x63, 0x4e, 0xcb, 0xcf, 0x7, 0x51, 0x49, 0x89, 0x45, 0x50, 0x79, 0x66, 0x5c, 0xf2, 0x80, 0x0, 0x0, 0x0, 0xff, 0xff, 0xab, 0xcc, 0x83, 0x80, 0x40, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x1, 0x0, 0x3, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x0, 0x0, 0x0, 0x0},
+			RoundTrip: false,
+			Expected:  expected1,
+		},
+		{ // CompressionSnappy
+			Bytes:     []byte{0x0, 0x0, 0x0, 0x75, 0x0, 0x0, 0x0, 0xf1, 0x0, 0x0, 0x0, 0x1, 0x0, 0x3, 0x66, 0x6f, 0x6f, 0x0, 0x0, 0x0, 0x2, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x4, 0x0, 0x0, 0x0, 0x40, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0x0, 0x34, 0x6, 0x8d, 0xfe, 0xe2, 0x0, 0x2, 0xff, 0xff, 0xff, 0xff, 0x0, 0x0, 0x0, 0x26, 0x40, 0x0, 0x0, 0x9, 0x1, 0x20, 0x2, 0x0, 0x0, 0x0, 0x14, 0xb8, 0xba, 0x5f, 0x57, 0x5, 0xf, 0x28, 0x3, 0x66, 0x6f, 0x6f, 0x0, 0x0, 0x0, 0x3, 0x62, 0x61, 0x72, 0x5, 0x10, 0x8, 0x0, 0x0, 0x3, 0x5e, 0x20, 0x0, 0x0, 0x0, 0x0, 0x1, 0x0, 0x3, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x0, 0x0, 0x0, 0x0},
+			RoundTrip: false,
+			Expected:  expected1,
+		},
+		{
+			Bytes:     []byte{0x0, 0x0, 0x0, 0x48, 0x0, 0x0, 0x0, 0xf1, 0x0, 0x0, 0x0, 0x1, 0x0, 0x4, 0x74, 0x65, 0x73, 0x74, 0x0, 0x0, 0x0, 0x3, 0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x1, 0x0, 0x3, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x8, 0x0, 0x3, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x0, 0x0, 0x0, 0x0},
+			RoundTrip: true,
+			Expected: &FetchResp{
+				CorrelationID: 241,
+				Topics: []FetchRespTopic{
+					{
+						Name: "test",
+						Partitions: []FetchRespPartition{
+							{
+								ID:            0,
+								Err:           ErrUnknownTopicOrPartition,
+								TipOffset:     -1,
+								Messages:      []*Message{},
+								MessageFormat: MessageFormatUnknown,
+							},
+							{
+								ID:            1,
+								Err:           ErrUnknownTopicOrPartition,
+								TipOffset:     -1,
+								Messages:      []*Message{},
+								MessageFormat: MessageFormatUnknown,
+							},
+							{
+								ID:            8,
+								Err:           ErrUnknownTopicOrPartition,
+								TipOffset:     -1,
+								Messages:      []*Message{},
+								MessageFormat: MessageFormatUnknown,
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		resp, err := ReadFetchResp(bytes.NewBuffer(tt.Bytes))
+		if err != nil {
+			c.Fatalf("could not read fetch response: %s", err)
+		}
+		if !reflect.DeepEqual(resp, tt.Expected) {
+			c.Fatalf("expected different message: %#v", resp)
+		}
+		if tt.RoundTrip {
+			b, err := resp.Bytes()
+			if err != nil {
+				c.Fatalf("cannot serialize response: %s", err)
+			}
+			if !bytes.Equal(b, tt.Bytes) {
+				c.Fatalf("serialized representation different from expected: %#v", b)
+			}
+		}
+	}
+}
+
+func (s *MessagesSuite) TestSerializeEmptyMessageSet(c *C) {
+	var buf bytes.Buffer
+	messages := []*Message{}
+	n, err := writeMessageSet(&buf, messages, CompressionNone)
+	if err != nil {
+		c.Fatalf("cannot serialize messages: %s", err)
+	}
+	if n != 0 {
+		c.Fatalf("got n=%d result from writeMessageSet; want 0", n)
+	}
+	if l := len(buf.Bytes()); l != 0 {
+		c.Fatalf("got len=%d for empty message set; should be 0", l)
+	}
+}
+
+func (s *MessagesSuite) TestNullAndEmptyValues(c *C) {
+	for _, compression := range []Compression{CompressionNone, CompressionGzip, CompressionSnappy} {
+		var buf bytes.Buffer
+		_, err := writeMessageSet(&buf, []*Message{
+			{Key: []byte("tombstone"), Value: nil},
+			{Key: []byte{}, Value: []byte{}},
+		}, compression)
+		if err != nil {
+			c.Fatalf("cannot serialize messages: %s", err)
+		}
+
+		b := buf.Bytes()
+		messages, err := readMessageSet(bytes.NewBuffer(b), int32(len(b)))
+		if err != nil {
+			c.Fatalf("cannot deserialize messages: %s", err)
+		}
+		if len(messages) != 2 {
+			c.Fatalf("expected 2 messages, got %d", len(messages))
+		}
+		if messages[0].Value != nil {
+			c.Fatalf("compression %d: expected null value, got %#v", compression, messages[0].Value)
+		}
+		if messages[1].Key == nil || len(messages[1].Key) != 0 {
+			c.Fatalf("compression %d: expected empty key, got %#v", compression, messages[1].Key)
+		}
+		if messages[1].Value == nil || len(messages[1].Value) != 0 {
+			c.Fatalf("compression %d: expected empty value, got %#v", compression, messages[1].Value)
+		}
+	}
+
+	// null value is encoded with -1 length
+	var buf bytes.Buffer
+	if _, err := writeMessageSet(&buf, []*Message{{Key: []byte("k")}}, CompressionNone); err != nil {
+		c.Fatalf("cannot serialize messages: %s", err)
+	}
+	b := buf.Bytes()
+	if got := b[len(b)-4:]; !bytes.Equal(got, []byte{0xff, 0xff, 0xff, 0xff}) {
+		c.Fatalf("expected null value length, got %#v", got)
+	}
+}
+
+func (s *MessagesSuite) TestTombstoneRoundTrip(c *C) {
+	messages := func() []*Message {
+		return []*Message{
+			{Key: []byte("deleted"), Value: nil},
+			{Key: nil, Value: nil},
+			{Key: []byte{}, Value: []byte{}},
+		}
+	}
+	check := func(got []*Message, what string) {
+		c.Assert(got, HasLen, 3, Commentf(what))
+		c.Assert(string(got[0].Key), Equals, "deleted", Commentf(what))
+		c.Assert(got[0].Value, IsNil, Commentf(what))
+		c.Assert(got[1].Key, IsNil, Commentf(what))
+		c.Assert(got[1].Value, IsNil, Commentf(what))
+		c.Assert(got[2].Key, NotNil, Commentf(what))
+		c.Assert(got[2].Key, HasLen, 0, Commentf(what))
+		c.Assert(got[2].Value, NotNil, Commentf(what))
+		c.Assert(got[2].Value, HasLen, 0, Commentf(what))
+	}
+
+	for _, version := range []int16{0, 2} {
+		for _, compression := range []Compression{CompressionNone, CompressionGzip, CompressionSnappy} {
+			what := fmt.Sprintf("version %d, compression %d", version, compression)
+
+			req := &ProduceReq{
+				ClientID:     "test",
+				Compression:  compression,
+				RequiredAcks: RequiredAcksAll,
+				Version:      version,
+				Topics: []ProduceReqTopic{
+					{
+						Name:       "compacted",
+						Partitions: []ProduceReqPartition{{ID: 0, Messages: messages()}},
+					},
+				},
+			}
+			b, err := req.Bytes()
+			c.Assert(err, IsNil)
+			r, err := ReadProduceReq(bytes.NewBuffer(b))
+			c.Assert(err, IsNil)
+			check(r.Topics[0].Partitions[0].Messages, what)
+
+			resp := &FetchResp{
+				Version: version,
+				Topics: []FetchRespTopic{
+					{
+						Name: "compacted",
+						Partitions: []FetchRespPartition{
+							{ID: 0, TipOffset: 3, Messages: r.Topics[0].Partitions[0].Messages},
+						},
+					},
+				},
+			}
+			b, err = resp.Bytes()
+			c.Assert(err, IsNil)
+			fr, err := ReadVersionedFetchResp(bytes.NewBuffer(b), version)
+			c.Assert(err, IsNil)
+			check(fr.Topics[0].Partitions[0].Messages, what)
+		}
+	}
+}
+
+func (s *MessagesSuite) TestReadIncompleteMessage(c *C) {
+	var buf bytes.Buffer
+	_, err := writeMessageSet(&buf, []*Message{
+		{Value: []byte("111111111111111")},
+		{Value: []byte("222222222222222")},
+		{Value: []byte("333333333333333")},
+	}, CompressionNone)
+	if err != nil {
+		c.Fatalf("cannot serialize messages: %s", err)
+	}
+
+	b := buf.Bytes()
+	// cut off the last bytes as kafka can do
+	b = b[:len(b)-4]
+	messages, err := readMessageSet(bytes.NewBuffer(b), int32(len(b)))
+	if err != nil {
+		c.Fatalf("cannot deserialize messages: %s", err)
+	}
+	if len(messages) != 2 {
+		c.Fatalf("expected 2 messages, got %d", len(messages))
+	}
+	if messages[0].Value[0] != '1' || messages[1].Value[0] != '2' {
+		c.Fatal("expected different messages content")
+	}
+}
+
+func (s *MessagesSuite) TestReadMessageSetMalformed(c *C) {
+	var buf bytes.Buffer
+	_, err := writeMessageSet(&buf, []*Message{
+		{Value: []byte("111111111111111")},
+	}, CompressionNone)
+	c.Assert(err, IsNil)
+	valid := buf.Bytes()
+
+	for _, tail := range [][]byte{
+		// negative message size
+		{0, 0, 0, 0, 0, 0, 0, 1, 0xff, 0xff, 0xff, 0xf0, 0, 0, 0, 0},
+		// message too short for crc32
+		{0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 2, 0, 0},
+		// message size above the data left
+		{0, 0, 0, 0, 0, 0, 0, 1, 0x7f, 0xff, 0xff, 0xff, 0, 0},
+	} {
+		b := append(append([]byte{}, valid...), tail...)
+		messages, err := readMessageSet(bytes.NewBuffer(b), int32(len(b)))
+		c.Assert(err, IsNil)
+		c.Assert(messages, HasLen, 1)
+	}
+
+	// message set size above the data left in the response
+	resp, err := (&FetchResp{
+		CorrelationID: 241,
+		Topics: []FetchRespTopic{{
+			Name:       "foo",
+			Partitions: []FetchRespPartition{{ID: 0, TipOffset: 1, Messages: []*Message{{Value: []byte("1")}}}},
+		}},
+	}).Bytes()
+	c.Assert(err, IsNil)
+	// message set size follows the size, correlation ID, topic, partition
+	// ID, error and tip offset
+	sizeAt := 4 + 4 + 4 + 2 + 3 + 4 + 4 + 2 + 8
+	binary.BigEndian.PutUint32(resp[sizeAt:], 0x7fffffff)
+	parsed, err := ReadFetchResp(bytes.NewReader(resp))
+	c.Assert(err, IsNil)
+	c.Assert(parsed.Topics[0].Partitions[0].Messages, HasLen, 1)
+}
+
+func (s *MessagesSuite) TestFetchRequestV7(c *C) {
+	req := &FetchReq{
+		CorrelationID:  241,
+		ClientID:       "test",
+		MaxWaitTime:    time.Second * 2,
+		MinBytes:       12454,
+		Version:        7,
+		MaxBytes:       1 << 20,
+		IsolationLevel: 1,
+		SessionID:      42,
+		SessionEpoch:   3,
+		Topics: []FetchReqTopic{
+			{
+				Name: "foo",
+				Partitions: []FetchReqPartition{
+					{ID: 421, FetchOffset: 529, MaxBytes: 4921},
+				},
+			},
+		},
+	}
+	testRequestSerialization(c, req)
+	b, _ := req.Bytes()
+
+	// header and fields common with version 0 are followed by max bytes,
+	// isolation level, session ID and session epoch
+	expected := []byte{0x0, 0x10, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x2a, 0x0, 0x0, 0x0, 0x3}
+	if got := b[30 : 30+len(expected)]; !bytes.Equal(got, expected) {
+		c.Fatalf("expected different session fields: %#v", got)
+	}
+	// partition fetch offset is followed by unknown log start offset,
+	// request ends with empty forgotten topics array
+	if got := b[len(b)-16:]; !bytes.Equal(got, []byte{
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0x0, 0x0, 0x13, 0x39,
+		0x0, 0x0, 0x0, 0x0}) {
+		c.Fatalf("expected different partition bytes: %#v", got)
+	}
+
+	r, err := ReadFetchReq(bytes.NewBuffer(b))
+	if err != nil {
+		c.Fatalf("could not read fetch request: %s", err)
+	}
+	if !reflect.DeepEqual(r, req) {
+		c.Fatalf("malformed request: %#v", r)
+	}
+}
+
+func (s *MessagesSuite) TestFetchRequestForgottenTopics(c *C) {
+	req := &FetchReq{
+		CorrelationID: 241,
+		ClientID:      "test",
+		Version:       7,
+		MaxBytes:      1 << 20,
+		SessionID:     42,
+		SessionEpoch:  3,
+		Topics:        []FetchReqTopic{},
+		ForgottenTopics: []FetchReqForgottenTopic{
+			{Name: "foo", Partitions: []int32{1, 2}},
+		},
+	}
+	testRequestSerialization(c, req)
+	b, _ := req.Bytes()
+
+	// empty topics array is followed by forgotten topics
+	if got := b[len(b)-25:]; !bytes.Equal(got, []byte{
+		0x0, 0x0, 0x0, 0x0,
+		0x0, 0x0, 0x0, 0x1,
+		0x0, 0x3, 'f', 'o', 'o',
+		0x0, 0x0, 0x0, 0x2,
+		0x0, 0x0, 0x0, 0x1,
+		0x0, 0x0, 0x0, 0x2}) {
+		c.Fatalf("expected different forgotten topics bytes: %#v", got)
+	}
+
+	r, err := ReadFetchReq(bytes.NewBuffer(b))
+	if err != nil {
+		c.Fatalf("could not read fetch request: %s", err)
+	}
+	if !reflect.DeepEqual(r, req) {
+		c.Fatalf("malformed request: %#v", r)
+	}
+}
+
+// testRecordBatch returns record batch of given attributes, holding one record
+// for every value, with offset deltas and timestamp deltas increasing by one.
+func testRecordBatch(baseOffset int64, attributes int16, ts time.Time, values ...string) []byte {
+	var records bytes.Buffer
+	varint := make([]byte, binary.MaxVarintLen64)
+	putVarint := func(w *bytes.Buffer, x int64) {
+		n := binary.PutVarint(varint, x)
+		_, _ = w.Write(varint[:n])
+	}
+	for i, value := range values {
+		var rec bytes.Buffer
+		_ = rec.WriteByte(0)      // attributes
+		putVarint(&rec, int64(i)) // timestamp delta
+		putVarint(&rec, int64(i)) // offset delta
+		putVarint(&rec, -1)       // null key
+		putVarint(&rec, int64(len(value)))
+		_, _ = rec.WriteString(value)
+		putVarint(&rec, 1) // single header
+		putVarint(&rec, 1)
+		_, _ = rec.WriteString("h")
+		putVarint(&rec, -1)
+
+		putVarint(&records, int64(rec.Len()))
+		_, _ = records.Write(rec.Bytes())
+	}
+
+	firstTs := ts.UnixNano() / int64(time.Millisecond)
+	var body bytes.Buffer
+	enc := NewEncoder(&body)
+	enc.EncodeInt16(attributes)
+	enc.EncodeInt32(int32(len(values) - 1))
+	enc.EncodeInt64(firstTs)
+	enc.EncodeInt64(firstTs + int64(len(values)-1))
+	enc.EncodeInt64(-1) // producer id
+	enc.EncodeInt16(-1) // producer epoch
+	enc.EncodeInt32(-1) // base sequence
+	enc.EncodeArrayLen(len(values))
+	_, _ = body.Write(records.Bytes())
+
+	var batch bytes.Buffer
+	enc = NewEncoder(&batch)
+	enc.EncodeInt64(baseOffset)
+	enc.EncodeInt32(int32(4 + 1 + 4 + body.Len()))
+	enc.EncodeInt32(0) // partition leader epoch
+	enc.EncodeInt8(2)  // magic byte
+	enc.EncodeUint32(crc32.Checksum(body.Bytes(), crc32.MakeTable(crc32.Castagnoli)))
+	_, _ = batch.Write(body.Bytes())
+	return batch.Bytes()
+}
+
+// testControlBatch returns a control batch with a single transaction marker of
+// given producer.
+func testControlBatch(offset int64, producerID int64, committed bool) []byte {
+	var rec bytes.Buffer
+	varint := make([]byte, binary.MaxVarintLen64)
+	putVarint := func(x int64) {
+		n := binary.PutVarint(varint, x)
+		_, _ = rec.Write(varint[:n])
+	}
+	markerType := byte(0)
+	if committed {
+		markerType = 1
+	}
+	_ = rec.WriteByte(0) // attributes
+	putVarint(0)         // timestamp delta
+	putVarint(0)         // offset delta
+	putVarint(4)
+	_, _ = rec.Write([]byte{0, 0, 0, markerType})
+	putVarint(6)
+	_, _ = rec.Write([]byte{0, 0, 0, 0, 0, 7}) // coordinator epoch
+	putVarint(0)                               // no headers
+
+	var body bytes.Buffer
+	enc := NewEncoder(&body)
+	enc.EncodeInt16(0x20) // control batch
+	enc.EncodeInt32(0)
+	enc.EncodeInt64(0)
+	enc.EncodeInt64(0)
+	enc.EncodeInt64(producerID)
+	enc.EncodeInt16(1)  // producer epoch
+	enc.EncodeInt32(-1) // base sequence
+	enc.EncodeArrayLen(1)
+	n := binary.PutVarint(varint, int64(rec.Len()))
+	_, _ = body.Write(varint[:n])
+	_, _ = body.Write(rec.Bytes())
+
+	var batch bytes.Buffer
+	enc = NewEncoder(&batch)
+	enc.EncodeInt64(offset)
+	enc.EncodeInt32(int32(4 + 1 + 4 + body.Len()))
+	enc.EncodeInt32(0) // partition leader epoch
+	enc.EncodeInt8(2)  // magic byte
+	enc.EncodeUint32(crc32.Checksum(body.Bytes(), crc32.MakeTable(crc32.Castagnoli)))
+	_, _ = batch.Write(body.Bytes())
+	return batch.Bytes()
+}
+
+func (s *MessagesSuite) TestReadMessageSetControlRecords(c *C) {
+	ts := time.Unix(1500000000, 0)
+	var set bytes.Buffer
+	_, _ = set.Write(testRecordBatch(10, 0, ts, "first", "second"))
+	_, _ = set.Write(testControlBatch(12, 42, true))
+	_, _ = set.Write(testRecordBatch(13, 0, ts, "third"))
+	_, _ = set.Write(testControlBatch(14, 43, false))
+
+	messages, info, err := readMessageSetInfo(&set, int32(set.Len()), nil)
+	c.Assert(err, IsNil)
+	c.Assert(messages, HasLen, 3)
+	for i, value := range []string{"first", "second", "third"} {
+		c.Assert(string(messages[i].Value), Equals, value)
+	}
+	c.Assert(info.controls, DeepEquals, []ControlRecord{
+		{Offset: 12, ProducerID: 42, ProducerEpoch: 1, Committed: true, CoordinatorEpoch: 7},
+		{Offset: 14, ProducerID: 43, ProducerEpoch: 1, Committed: false, CoordinatorEpoch: 7},
+	})
+}
+
+func (s *MessagesSuite) TestFetchResponseV7(c *C) {
+	ts := time.Unix(1500000000, 0)
+	var set bytes.Buffer
+	_, _ = set.Write(testRecordBatch(10, 0, ts, "first", "second"))
+	// control batch carrying transaction marker must be skipped
+	_, _ = set.Write(testRecordBatch(12, 0x20, ts, "marker"))
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.EncodeInt32(0) // size placeholder
+	enc.EncodeInt32(241)
+	enc.EncodeInt32(0)  // throttle time
+	enc.EncodeInt16(0)  // error code
+	enc.EncodeInt32(42) // session id
+	enc.EncodeArrayLen(1)
+	enc.EncodeString("foo")
+	enc.EncodeArrayLen(1)
+	enc.EncodeInt32(0)
+	enc.EncodeInt16(0)
+	enc.EncodeInt64(13)
+	enc.EncodeInt64(13) // last stable offset
+	enc.EncodeInt64(3)  // log start offset
+	enc.EncodeArrayLen(1)
+	enc.EncodeInt64(7) // aborted producer id
+	enc.EncodeInt64(5) // aborted first offset
+	enc.EncodeInt32(int32(set.Len()))
+	_, _ = buf.Write(set.Bytes())
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	resp, err := ReadVersionedFetchResp(bytes.NewBuffer(b), 7)
+	if err != nil {
+		c.Fatalf("could not read fetch response: %s", err)
+	}
+	expected := &FetchResp{
+		CorrelationID: 241,
+		Version:       7,
+		SessionID:     42,
+		Topics: []FetchRespTopic{
+			{
+				Name: "foo",
+				Partitions: []FetchRespPartition{
+					{
+						ID:               0,
+						TipOffset:        13,
+						LastStableOffset: 13,
+						LogStartOffset:   3,
+						MessageFormat:    MessageFormatV2,
+						Messages: []*Message{
+							{
+								Offset:        10,
+								Value:         []byte("first"),
+								Topic:         "foo",
+								TipOffset:     13,
+								Timestamp:     ts,
+								Headers:       []MessageHeader{{Key: "h"}},
+								ProducerID:    -1,
+								ProducerEpoch: -1,
+							},
+							{
+								Offset:        11,
+								Value:         []byte("second"),
+								Topic:         "foo",
+								TipOffset:     13,
+								Timestamp:     ts.Add(time.Millisecond),
+								Headers:       []MessageHeader{{Key: "h"}},
+								ProducerID:    -1,
+								ProducerEpoch: -1,
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	if !reflect.DeepEqual(resp, expected) {
+		c.Fatalf("expected different message: %#v", resp)
+	}
+}
+
+func (s *MessagesSuite) TestFetchResponseLeaderEpoch(c *C) {
+	ts := time.Unix(1500000000, 0)
+	withEpoch := func(batch []byte, epoch int32) []byte {
+		// leader epoch follows base offset and batch length, and is not
+		// covered by the checksum
+		binary.BigEndian.PutUint32(batch[12:], uint32(epoch))
+		return batch
+	}
+
+	for _, tc := range []struct {
+		batches [][]byte
+		epoch   int32
+	}{
+		{nil, -1},
+		{[][]byte{withEpoch(testRecordBatch(10, 0, ts, "first"), 3)}, 3},
+		{[][]byte{
+			withEpoch(testRecordBatch(10, 0, ts, "first"), 3),
+			withEpoch(testRecordBatch(11, 0, ts, "second"), 5),
+		}, 5},
+	} {
+		var set bytes.Buffer
+		for _, batch := range tc.batches {
+			_, _ = set.Write(batch)
+		}
+
+		var buf bytes.Buffer
+		enc := NewEncoder(&buf)
+		enc.EncodeInt32(0) // size placeholder
+		enc.EncodeInt32(241)
+		enc.EncodeInt32(0) // throttle time
+		enc.EncodeArrayLen(1)
+		enc.EncodeString("foo")
+		enc.EncodeArrayLen(1)
+		enc.EncodeInt32(0)
+		enc.EncodeInt16(0)
+		enc.EncodeInt64(12)
+		enc.EncodeInt64(12)   // last stable offset
+		enc.EncodeArrayLen(0) // aborted transactions
+		enc.EncodeInt32(int32(set.Len()))
+		_, _ = buf.Write(set.Bytes())
+		b := buf.Bytes()
+		binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+		resp, err := ReadVersionedFetchResp(bytes.NewBuffer(b), 4)
+		c.Assert(err, IsNil)
+		part := resp.Topics[0].Partitions[0]
+		c.Assert(part.Messages, HasLen, len(tc.batches))
+		c.Assert(part.LeaderEpoch, Equals, tc.epoch)
+		if len(tc.batches) == 0 {
+			c.Assert(part.MessageFormat, Equals, MessageFormatUnknown)
+		} else {
+			c.Assert(part.MessageFormat, Equals, MessageFormatV2)
+		}
+	}
+}
+
+func (s *MessagesSuite) TestReadMessageSetFormat(c *C) {
+	messages := []*Message{
+		{Offset: 1, Value: []byte("first")},
+		{Offset: 2, Value: []byte("second")},
+	}
+	for _, magic := range []int8{messageMagicV0, messageMagicV1} {
+		var buf bytes.Buffer
+		_, err := encodeMessageSet(&buf, messages, CompressionNone, 0, magic, TimestampCreateTime, nil)
+		c.Assert(err, IsNil)
+		set, info, err := readMessageSetInfo(&buf, int32(buf.Len()), nil)
+		c.Assert(err, IsNil)
+		c.Assert(set, HasLen, 2)
+		c.Assert(info.format, Equals, MessageFormat(magic))
+		c.Assert(info.leaderEpoch, Equals, int32(-1))
+	}
+}
+
+func (s *MessagesSuite) TestParseMessageFormat(c *C) {
+	for _, tc := range []struct {
+		version string
+		format  MessageFormat
+	}{
+		{"0.8.2", MessageFormatV0},
+		{"0.9.0", MessageFormatV0},
+		{"0.10.0-IV1", MessageFormatV1},
+		{"0.10.2", MessageFormatV1},
+		{"0.11.0", MessageFormatV2},
+		{"1.0", MessageFormatV2},
+		{"2.1-IV2", MessageFormatV2},
+		{"3.0", MessageFormatV2},
+	} {
+		format, err := ParseMessageFormat(tc.version)
+		c.Assert(err, IsNil, Commentf("version %s", tc.version))
+		c.Assert(format, Equals, tc.format, Commentf("version %s", tc.version))
+	}
+	for _, version := range []string{"", "1", "0.7.0", "x.y", "0.-1"} {
+		format, err := ParseMessageFormat(version)
+		c.Assert(err, NotNil, Commentf("version %q", version))
+		c.Assert(format, Equals, MessageFormatUnknown)
+	}
+	c.Assert(MessageFormatV1.String(), Equals, "v1")
+	c.Assert(MessageFormatUnknown.String(), Equals, "unknown")
+}
+
+func (s *MessagesSuite) TestMirrorRoundTrip(c *C) {
+	ts := time.Unix(1500000000, 0)
+	// batch with timestamps overwritten by the broker
+	batch := testRecordBatch(20, 0x08, ts, "first", "second")
+	fetched, err := readMessageSet(bytes.NewReader(batch), int32(len(batch)))
+	c.Assert(err, IsNil)
+	c.Assert(fetched, HasLen, 2)
+	for i, m := range fetched {
+		c.Assert(m.TimestampType, Equals, TimestampLogAppendTime)
+		c.Assert(m.Timestamp.Equal(ts.Add(time.Millisecond)), Equals, true)
+		c.Assert(m.CreateTimestamp.Equal(ts.Add(time.Duration(i)*time.Millisecond)), Equals, true)
+		c.Assert(m.Headers, DeepEquals, []MessageHeader{{Key: "h"}})
+		c.Assert(m.ProducerID, Equals, int64(-1))
+		c.Assert(m.ProducerEpoch, Equals, int16(-1))
+	}
+
+	mirrored := make([]*Message, len(fetched))
+	for i, m := range fetched {
+		mirrored[i] = &Message{Key: m.Key, Value: m.Value, Timestamp: m.CreateTimestamp}
+	}
+	for _, compression := range []Compression{CompressionNone, CompressionGzip, CompressionSnappy} {
+		req := &ProduceReq{
+			ClientID:     "mirror",
+			Compression:  compression,
+			RequiredAcks: RequiredAcksAll,
+			Version:      2,
+			Topics: []ProduceReqTopic{
+				{Name: "foo", Partitions: []ProduceReqPartition{{ID: 0, Messages: mirrored}}},
+			},
+		}
+		b, err := req.Bytes()
+		c.Assert(err, IsNil)
+		r, err := ReadProduceReq(bytes.NewReader(b))
+		c.Assert(err, IsNil)
+		produced := r.Topics[0].Partitions[0].Messages
+		c.Assert(produced, HasLen, len(fetched))
+		for i, m := range produced {
+			c.Assert(m.Key, IsNil)
+			c.Assert(m.Value, DeepEquals, fetched[i].Value)
+			c.Assert(m.TimestampType, Equals, TimestampCreateTime)
+			c.Assert(m.Timestamp.Equal(fetched[i].CreateTimestamp), Equals, true,
+				Commentf("compression %d, message %d", compression, i))
+		}
+	}
+}
+
+func (s *MessagesSuite) TestFetchResponseLastStableOffset(c *C) {
+	for _, version := range []int16{4, 5} {
+		resp := &FetchResp{
+			CorrelationID: 241,
+			Version:       version,
+			Topics: []FetchRespTopic{
+				{
+					Name: "foo",
+					Partitions: []FetchRespPartition{
+						{ID: 0, TipOffset: 20, LastStableOffset: 14, Messages: []*Message{}},
+					},
+				},
+			},
+		}
+		b, err := resp.Bytes()
+		c.Assert(err, IsNil)
+		r, err := ReadVersionedFetchResp(bytes.NewBuffer(b), version)
+		c.Assert(err, IsNil)
+		c.Assert(r.Topics[0].Partitions[0].LastStableOffset, Equals, int64(14))
+	}
+}
+
+func (s *MessagesSuite) TestFetchResponseSessionError(c *C) {
+	resp := &FetchResp{
+		CorrelationID: 241,
+		Version:       7,
+		Err:           ErrFetchSessionIDNotFound,
+		Topics:        []FetchRespTopic{},
+	}
+	b, err := resp.Bytes()
+	if err != nil {
+		c.Fatalf("cannot serialize response: %s", err)
+	}
+	r, err := ReadVersionedFetchResp(bytes.NewBuffer(b), 7)
+	if err != nil {
+		c.Fatalf("could not read fetch response: %s", err)
+	}
+	if !reflect.DeepEqual(r, resp) {
+		c.Fatalf("expected different response: %#v", r)
+	}
+}
+
+func (s *MessagesSuite) TestFetchResponseEmptyMessageSet(c *C) {
+	// long poll that timed out without new messages
+	b := []byte{
+		0x0, 0x0, 0x0, 0x23, // size
+		0x0, 0x0, 0x0, 0xf1, // correlation id
+		0x0, 0x0, 0x0, 0x1, // topics
+		0x0, 0x3, 0x66, 0x6f, 0x6f, // topic name
+		0x0, 0x0, 0x0, 0x1, // partitions
+		0x0, 0x0, 0x0, 0x2, // partition id
+		0x0, 0x0, // error
+		0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x1, 0xf4, // high watermark
+		0x0, 0x0, 0x0, 0x0, // empty message set
+	}
+	resp, err := ReadFetchResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(resp.Topics, HasLen, 1)
+	c.Assert(resp.Topics[0].Partitions, HasLen, 1)
+	part := resp.Topics[0].Partitions[0]
+	c.Assert(part.Err, IsNil)
+	c.Assert(part.TipOffset, Equals, int64(500))
+	c.Assert(part.Messages, HasLen, 0)
+
+	for version := int16(0); version <= 7; version++ {
+		resp := &FetchResp{
+			CorrelationID: 241,
+			Version:       version,
+			Topics: []FetchRespTopic{{
+				Name:       "foo",
+				Partitions: []FetchRespPartition{{ID: 2, TipOffset: 500, LastStableOffset: 500}},
+			}},
+		}
+		b, err := resp.Bytes()
+		c.Assert(err, IsNil)
+		r, err := ReadVersionedFetchResp(bytes.NewBuffer(b), version)
+		c.Assert(err, IsNil, Commentf("version %d", version))
+		part := r.Topics[0].Partitions[0]
+		c.Assert(part.Err, IsNil)
+		c.Assert(part.TipOffset, Equals, int64(500))
+		c.Assert(part.Messages, HasLen, 0)
+	}
+}
+
+func (s *MessagesSuite) TestRequestVersionNotImplemented(c *C) {
+	for _, req := range []Request{
+		&ProduceReq{Version: 4},
+		&FetchReq{Version: 8},
+		&MetadataReq{Version: 4},
+		&ProduceReq{Version: -1},
+	} {
+		_, err := req.Bytes()
+		c.Assert(err, FitsTypeOf, &RequestVersionError{}, Commentf("%T", req))
+		_, err = req.WriteTo(io.Discard)
+		c.Assert(err, NotNil)
+	}
+
+	_, err := (&ProduceReq{Version: 4}).Bytes()
+	c.Assert(err, ErrorMatches, "cannot encode Produce request v4, supported versions are 0-3")
+}
+
+func (s *MessagesSuite) TestRespHeaderVersion(c *C) {
+	if v := RespHeaderVersion(FetchReqKind, 11); v != 0 {
+		c.Fatalf("expected header version 0, got %d", v)
+	}
+	if v := RespHeaderVersion(FetchReqKind, 12); v != 1 {
+		c.Fatalf("expected header version 1, got %d", v)
+	}
+	if v := RespHeaderVersion(EnvelopeReqKind, 0); v != 1 {
+		c.Fatalf("expected header version 1 for envelope, got %d", v)
+	}
+	if v := RespHeaderVersion(OffsetDeleteReqKind, 0); v != 0 {
+		c.Fatalf("expected header version 0 for api without flexible versions, got %d", v)
+	}
+
+	b := []byte{
+		0x0, 0x0, 0x0, 0x0c, // size
+		0x0, 0x0, 0x0, 0xf1, // correlation id
+		0x01, 0x00, 0x01, 0xff, // single tagged field
+		0x0, 0x0, 0x0, 0x2a,
+	}
+	dec := NewDecoder(bytes.NewBuffer(b))
+	if id := dec.DecodeRespHeader(1); id != 241 {
+		c.Fatalf("expected correlation id 241, got %d", id)
+	}
+	if v := dec.DecodeInt32(); v != 42 || dec.Err() != nil {
+		c.Fatalf("expected body to follow header, got %d, %v", v, dec.Err())
+	}
+
+	id, _, err := ReadResp(bytes.NewBuffer(b))
+	if err != nil || id != 241 {
+		c.Fatalf("expected correlation id 241, got %d, %v", id, err)
+	}
+}
+
+func (s *MessagesSuite) TestReadRespLimit(c *C) {
+	b := []byte{0x0, 0x0, 0x0, 0x8, 0x0, 0x0, 0x0, 0xf1, 0x0, 0x0, 0x0, 0x2a}
+	if id, _, err := ReadRespLimit(bytes.NewBuffer(b), 8); err != nil || id != 241 {
+		c.Fatalf("expected correlation id 241, got %d, %v", id, err)
+	}
+
+	_, _, err := ReadRespLimit(bytes.NewBuffer(b), 7)
+	if serr, ok := err.(*ResponseSizeError); !ok || serr.Size != 8 || serr.Limit != 7 {
+		c.Fatalf("expected response size error, got %#v", err)
+	}
+
+	// size prefix too small to hold the correlation ID
+	_, _, err = ReadResp(bytes.NewBuffer([]byte{0xff, 0xff, 0xff, 0xff, 0x0, 0x0}))
+	if _, ok := err.(*ResponseSizeError); !ok {
+		c.Fatalf("expected response size error, got %#v", err)
+	}
+}
+
+func (s *MessagesSuite) TestReadTruncatedResponse(c *C) {
+	resp := &ProduceResp{
+		CorrelationID: 241,
+		Version:       2,
+		Topics: []ProduceRespTopic{
+			{
+				Name: "foo",
+				Partitions: []ProduceRespPartition{
+					{ID: 0, Offset: 5, Timestamp: time.Unix(1500000000, 0)},
+				},
+			},
+		},
+	}
+	b, err := resp.Bytes()
+	if err != nil {
+		c.Fatalf("cannot serialize response: %s", err)
+	}
+
+	// cut off part of the throttle time
+	b = b[:len(b)-2]
+	_, err = ReadVersionedProduceResp(bytes.NewBuffer(b), 2)
+	perr, ok := err.(*ParseError)
+	if !ok {
+		c.Fatalf("expected parse error, got %#v", err)
+	}
+	if perr.RequestKind != ProduceReqKind || perr.Version != 2 || perr.Offset != int64(len(b)) {
+		c.Fatalf("expected different error context: %#v", perr)
+	}
+	if perr.Err != io.ErrUnexpectedEOF {
+		c.Fatalf("expected unexpected EOF, got %s", perr.Err)
+	}
+	expected := fmt.Sprintf("cannot parse Produce response v2 at byte %d: unexpected EOF", len(b))
+	if err.Error() != expected {
+		c.Fatalf("expected %q, got %q", expected, err.Error())
+	}
+}
+
+func (s *MessagesSuite) TestOffsetFetchRequestAllPartitions(c *C) {
+	req := &OffsetFetchReq{
+		CorrelationID: 241,
+		ClientID:      "test",
+		ConsumerGroup: "cg",
+		Version:       2,
+		AllPartitions: true,
+		Topics:        []OffsetFetchReqTopic{},
+	}
+	testRequestSerialization(c, req)
+	b, _ := req.Bytes()
+	expected := []byte{0x0, 0x0, 0x0, 0x16, 0x0, 0x9, 0x0, 0x2, 0x0, 0x0, 0x0, 0xf1, 0x0, 0x4, 0x74, 0x65, 0x73, 0x74, 0x0, 0x2, 0x63, 0x67, 0xff, 0xff, 0xff, 0xff}
+	if !bytes.Equal(b, expected) {
+		c.Fatalf("expected different bytes representation: %#v", b)
+	}
+
+	r, err := ReadOffsetFetchReq(bytes.NewBuffer(b))
+	if err != nil {
+		c.Fatalf("could not read request: %s", err)
+	}
+	if !reflect.DeepEqual(r, req) {
+		c.Fatalf("malformed request: %#v", r)
+	}
+
+	req.Version = 1
+	if _, err := req.Bytes(); err == nil {
+		c.Fatal("expected error serializing all partitions request of version 1")
+	}
+}
+
+func (s *MessagesSuite) TestOffsetCommitRequestGeneration(c *C) {
+	req := &OffsetCommitReq{
+		CorrelationID: 241,
+		ClientID:      "test",
+		ConsumerGroup: "cg",
+		GenerationID:  7,
+		MemberID:      "member-1",
+		Topics: []OffsetCommitReqTopic{
+			{
+				Name: "foo",
+				Partitions: []OffsetCommitReqPartition{
+					{ID: 2, Offset: 42, TimeStamp: time.Unix(0, 0), Metadata: "meta"},
+				},
+			},
+		},
+	}
+	testRequestSerialization(c, req)
+	b, _ := req.Bytes()
+
+	// generation and member ID follow the consumer group
+	const groupEnd = 22
+	c.Assert(int32(binary.BigEndian.Uint32(b[groupEnd:])), Equals, int32(7))
+	c.Assert(string(b[groupEnd+6:groupEnd+14]), Equals, "member-1")
+
+	r, err := ReadOffsetCommitReq(bytes.NewBuffer(b))
+	if err != nil {
+		c.Fatalf("could not read request: %s", err)
+	}
+	if !reflect.DeepEqual(r, req) {
+		c.Fatalf("malformed request: %#v", r)
+	}
+
+	// commits without member are not fenced
+	req.MemberID = ""
+	b, _ = req.Bytes()
+	c.Assert(int32(binary.BigEndian.Uint32(b[groupEnd:])), Equals, int32(-1))
+	r, err = ReadOffsetCommitReq(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(r.GenerationID, Equals, int32(-1))
+	c.Assert(r.MemberID, Equals, "")
+}
+
+func (s *MessagesSuite) TestOffsetCommitResponseErrors(c *C) {
+	resp := &OffsetCommitResp{
+		CorrelationID: 241,
+		Topics: []OffsetCommitRespTopic{
+			{
+				Name: "foo",
+				Partitions: []OffsetCommitRespPartition{
+					{ID: 0},
+					{ID: 1, Err: ErrRebalanceInProgress},
+				},
+			},
+			{
+				Name:       "bar",
+				Partitions: []OffsetCommitRespPartition{{ID: 3}},
+			},
+			{
+				Name:       "baz",
+				Partitions: []OffsetCommitRespPartition{{ID: 0, Err: ErrOffsetMetadataTooLarge}},
+			},
+		},
+	}
+	b, err := resp.Bytes()
+	c.Assert(err, IsNil)
+	r, err := ReadOffsetCommitResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(r.Errors(), DeepEquals, map[string]map[int32]error{
+		"foo": {1: ErrRebalanceInProgress},
+		"baz": {0: ErrOffsetMetadataTooLarge},
+	})
+
+	r.Topics = r.Topics[1:2]
+	c.Assert(r.Errors(), IsNil)
+}
+
+func (s *MessagesSuite) TestOffsetFetchResponseV3(c *C) {
+	resp := &OffsetFetchResp{
+		CorrelationID: 241,
+		Version:       3,
+		ThrottleTime:  100 * time.Millisecond,
+		Err:           ErrNotCoordinator,
+		Topics: []OffsetFetchRespTopic{
+			{
+				Name: "foo",
+				Partitions: []OffsetFetchRespPartition{
+					{ID: 0, Offset: 12, Metadata: "meta"},
+					{ID: 1, Offset: -1, Err: ErrUnknownTopicOrPartition},
+				},
+			},
+		},
+	}
+	b, err := resp.Bytes()
+	if err != nil {
+		c.Fatalf("cannot serialize response: %s", err)
+	}
+	r, err := ReadVersionedOffsetFetchResp(bytes.NewBuffer(b), 3)
+	if err != nil {
+		c.Fatalf("could not read response: %s", err)
+	}
+	if !reflect.DeepEqual(r, resp) {
+		c.Fatalf("expected different response: %#v", r)
+	}
+}
+
+func (s *MessagesSuite) TestOffsetRequest(c *C) {
+	req := &OffsetReq{
+		CorrelationID: 241,
+		ClientID:      "test",
+		ReplicaID:     -1,
+		Topics: []OffsetReqTopic{
+			{
+				Name: "foo",
+				Partitions: []OffsetReqPartition{
+					{ID: 0, TimeMs: OffsetReqTimeLatest, MaxOffsets: 3},
+				},
+			},
+		},
+	}
+	testRequestSerialization(c, req)
+	b, _ := req.Bytes()
+	r, err := ReadOffsetReq(bytes.NewBuffer(b))
+	if err != nil {
+		c.Fatalf("could not read request: %s", err)
+	}
+	if !reflect.DeepEqual(r, req) {
+		c.Fatalf("malformed request: %#v", r)
+	}
+}
+
+func (s *MessagesSuite) TestOffsetResponseMultipleOffsets(c *C) {
+	msgb := []byte{
+		0x0, 0x0, 0x0, 0x33, // size
+		0x0, 0x0, 0x0, 0xf1, // correlation id
+		0x0, 0x0, 0x0, 0x1, 0x0, 0x3, 0x66, 0x6f, 0x6f, // topics
+		0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, // partitions
+		0x0, 0x0, 0x0, 0x3, // offsets
+		0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x64,
+		0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x32,
+		0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0,
+	}
+	resp, err := ReadOffsetResp(bytes.NewBuffer(msgb))
+	if err != nil {
+		c.Fatalf("could not read response: %s", err)
+	}
+	expected := &OffsetResp{
+		CorrelationID: 241,
+		Topics: []OffsetRespTopic{
+			{
+				Name: "foo",
+				Partitions: []OffsetRespPartition{
+					{ID: 0, Offsets: []int64{100, 50, 0}},
+				},
+			},
+		},
+	}
+	if !reflect.DeepEqual(resp, expected) {
+		c.Fatalf("expected different response: %#v", resp)
+	}
+
+	if b, err := resp.Bytes(); err != nil {
+		c.Fatalf("cannot serialize response: %s", err)
+	} else if !bytes.Equal(b, msgb) {
+		c.Fatalf("serialized representation different from expected: %#v", b)
+	}
+}
+
+func (s *MessagesSuite) TestDeleteGroupsRequest(c *C) {
+	req := &DeleteGroupsReq{
+		CorrelationID: 241,
+		ClientID:      "test",
+		Groups:        []string{"a", "bc"},
+	}
+	testRequestSerialization(c, req)
+	b, _ := req.Bytes()
+	expected := []byte{0x0, 0x0, 0x0, 0x19, 0x0, 0x2a, 0x0, 0x0, 0x0, 0x0, 0x0, 0xf1, 0x0, 0x4, 0x74, 0x65, 0x73, 0x74, 0x0, 0x0, 0x0, 0x2, 0x0, 0x1, 0x61, 0x0, 0x2, 0x62, 0x63}
+	if !bytes.Equal(b, expected) {
+		c.Fatalf("expected different bytes representation: %#v", b)
+	}
+
+	r, err := ReadDeleteGroupsReq(bytes.NewBuffer(expected))
+	if err != nil {
+		c.Fatalf("could not read request: %s", err)
+	}
+	if !reflect.DeepEqual(r, req) {
+		c.Fatalf("malformed request: %#v", r)
+	}
+}
+
+func (s *MessagesSuite) TestDeleteGroupsResponse(c *C) {
+	msgb := []byte{0x0, 0x0, 0x0, 0x17, 0x0, 0x0, 0x0, 0xf1, 0x0, 0x0, 0x0, 0x64, 0x0, 0x0, 0x0, 0x2, 0x0, 0x1, 0x61, 0x0, 0x0, 0x0, 0x2, 0x62, 0x63, 0x0, 0x44}
+	resp, err := ReadDeleteGroupsResp(bytes.NewBuffer(msgb))
+	if err != nil {
+		c.Fatalf("could not read response: %s", err)
+	}
+	expected := &DeleteGroupsResp{
+		CorrelationID: 241,
+		ThrottleTime:  100 * time.Millisecond,
+		Groups: []DeleteGroupsRespGroup{
+			{Group: "a"},
+			{Group: "bc", Err: ErrNonEmptyGroup},
+		},
+	}
+	if !reflect.DeepEqual(resp, expected) {
+		c.Fatalf("expected different response: %#v", resp)
+	}
+
+	if b, err := resp.Bytes(); err != nil {
+		c.Fatalf("cannot serialize response: %s", err)
+	} else if !bytes.Equal(b, msgb) {
+		c.Fatalf("serialized representation different from expected: %#v", b)
+	}
+}
+
+func (s *MessagesSuite) TestHeartbeatMessages(c *C) {
+	req := &HeartbeatReq{
+		CorrelationID: 241,
+		ClientID:      "test",
+		GroupID:       "g",
+		GenerationID:  3,
+		MemberID:      "m1",
+	}
+	testRequestSerialization(c, req)
+	b, _ := req.Bytes()
+	expected := []byte{0x0, 0x0, 0x0, 0x19, 0x0, 0xc, 0x0, 0x0, 0x0, 0x0, 0x0, 0xf1, 0x0, 0x4, 0x74, 0x65, 0x73, 0x74, 0x0, 0x1, 0x67, 0x0, 0x0, 0x0, 0x3, 0x0, 0x2, 0x6d, 0x31}
+	if !bytes.Equal(b, expected) {
+		c.Fatalf("expected different bytes representation: %#v", b)
+	}
+
+	r, err := ReadHeartbeatReq(bytes.NewBuffer(expected))
+	if err != nil {
+		c.Fatalf("could not read request: %s", err)
+	}
+	if !reflect.DeepEqual(r, req) {
+		c.Fatalf("malformed request: %#v", r)
+	}
+
+	msgb := []byte{0x0, 0x0, 0x0, 0x6, 0x0, 0x0, 0x0, 0xf1, 0x0, 0x1e}
+	resp, err := ReadHeartbeatResp(bytes.NewBuffer(msgb))
+	if err != nil {
+		c.Fatalf("could not read response: %s", err)
+	}
+	if !reflect.DeepEqual(resp, &HeartbeatResp{CorrelationID: 241, Err: ErrRebalanceInProgress}) {
+		c.Fatalf("expected different response: %#v", resp)
+	}
+
+	if b, err := resp.Bytes(); err != nil {
+		c.Fatalf("cannot serialize response: %s", err)
+	} else if !bytes.Equal(b, msgb) {
+		c.Fatalf("serialized representation different from expected: %#v", b)
+	}
+}
+
+func (s *MessagesSuite) TestOffsetDeleteMessages(c *C) {
+	req := &OffsetDeleteReq{
+		CorrelationID: 241,
+		ClientID:      "test",
+		ConsumerGroup: "g",
+		Topics: []OffsetDeleteReqTopic{
+			{Name: "a", Partitions: []int32{1, 2}},
+		},
+	}
+	testRequestSerialization(c, req)
+	b, _ := req.Bytes()
+	expected := []byte{0x0, 0x0, 0x0, 0x24, 0x0, 0x2f, 0x0, 0x0, 0x0, 0x0, 0x0, 0xf1, 0x0, 0x4, 0x74, 0x65, 0x73, 0x74,
+		0x0, 0x1, 0x67, 0x0, 0x0, 0x0, 0x1, 0x0, 0x1, 0x61, 0x0, 0x0, 0x0, 0x2, 0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x2}
+	if !bytes.Equal(b, expected) {
+		c.Fatalf("expected different bytes representation: %#v", b)
+	}
+	r, err := ReadOffsetDeleteReq(bytes.NewBuffer(expected))
+	if err != nil {
+		c.Fatalf("could not read request: %s", err)
+	}
+	if !reflect.DeepEqual(r, req) {
+		c.Fatalf("malformed request: %#v", r)
+	}
+
+	resp := &OffsetDeleteResp{
+		CorrelationID: 241,
+		ThrottleTime:  100 * time.Millisecond,
+		Topics: []OffsetDeleteRespTopic{
+			{
+				Name: "a",
+				Partitions: []OffsetDeleteRespPartition{
+					{ID: 1},
+					{ID: 2, Err: ErrGroupSubscribedToTopic},
+				},
+			},
+		},
+	}
+	b, err = resp.Bytes()
+	if err != nil {
+		c.Fatalf("cannot serialize response: %s", err)
+	}
+	expected = []byte{0x0, 0x0, 0x0, 0x21, 0x0, 0x0, 0x0, 0xf1, 0x0, 0x0, 0x0, 0x0, 0x0, 0x64,
+		0x0, 0x0, 0x0, 0x1, 0x0, 0x1, 0x61, 0x0, 0x0, 0x0, 0x2, 0x0, 0x0, 0x0, 0x1, 0x0, 0x0,
+		0x0, 0x0, 0x0, 0x2, 0x0, 0x56}
+	if !bytes.Equal(b, expected) {
+		c.Fatalf("expected different bytes representation: %#v", b)
+	}
+	rr, err := ReadOffsetDeleteResp(bytes.NewBuffer(b))
+	if err != nil {
+		c.Fatalf("could not read response: %s", err)
+	}
+	if !reflect.DeepEqual(rr, resp) {
+		c.Fatalf("malformed response: %#v", rr)
+	}
+}
+
+func (s *MessagesSuite) TestWriteTxnMarkersRequest(c *C) {
+	req := &WriteTxnMarkersReq{
+		CorrelationID: 241,
+		ClientID:      "test",
+		Markers: []WriteTxnMarkersReqMarker{
+			{
+				ProducerID:    5,
+				ProducerEpoch: 2,
+				Committed:     true,
+				Topics: []WriteTxnMarkersReqTopic{
+					{Name: "a", Partitions: []int32{1}},
+				},
+				CoordinatorEpoch: 3,
+			},
+		},
+	}
+	testRequestSerialization(c, req)
+	b, _ := req.Bytes()
+	expected := []byte{0x0, 0x0, 0x0, 0x30, 0x0, 0x1b, 0x0, 0x0, 0x0, 0x0, 0x0, 0xf1, 0x0, 0x4, 0x74, 0x65, 0x73, 0x74,
+		0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x5, 0x0, 0x2, 0x1,
+		0x0, 0x0, 0x0, 0x1, 0x0, 0x1, 0x61, 0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x1,
+		0x0, 0x0, 0x0, 0x3}
+	if !bytes.Equal(b, expected) {
+		c.Fatalf("expected different bytes representation: %#v", b)
+	}
+
+	r, err := ReadWriteTxnMarkersReq(bytes.NewBuffer(expected))
+	if err != nil {
+		c.Fatalf("could not read request: %s", err)
+	}
+	if !reflect.DeepEqual(r, req) {
+		c.Fatalf("malformed request: %#v", r)
+	}
+}
+
+func (s *MessagesSuite) TestWriteTxnMarkersResponse(c *C) {
+	msgb := []byte{0x0, 0x0, 0x0, 0x27, 0x0, 0x0, 0x0, 0xf1,
+		0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x5,
+		0x0, 0x0, 0x0, 0x1, 0x0, 0x1, 0x61,
+		0x0, 0x0, 0x0, 0x2, 0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x0, 0x0, 0x2, 0x0, 0x2f}
+	resp, err := ReadWriteTxnMarkersResp(bytes.NewBuffer(msgb))
+	if err != nil {
+		c.Fatalf("could not read response: %s", err)
+	}
+	expected := &WriteTxnMarkersResp{
+		CorrelationID: 241,
+		Markers: []WriteTxnMarkersRespMarker{
+			{
+				ProducerID: 5,
+				Topics: []WriteTxnMarkersRespTopic{
+					{
+						Name: "a",
+						Partitions: []WriteTxnMarkersRespPartition{
+							{ID: 1},
+							{ID: 2, Err: ErrInvalidProducerEpoch},
+						},
+					},
+				},
+			},
+		},
+	}
+	if !reflect.DeepEqual(resp, expected) {
+		c.Fatalf("expected different response: %#v", resp)
+	}
+
+	if b, err := resp.Bytes(); err != nil {
+		c.Fatalf("cannot serialize response: %s", err)
+	} else if !bytes.Equal(b, msgb) {
+		c.Fatalf("serialized representation different from expected: %#v", b)
+	}
+}
+
+func (s *MessagesSuite) TestAPIVersions(c *C) {
+	req := &APIVersionsReq{CorrelationID: 241, ClientID: "test"}
+	testRequestSerialization(c, req)
+	b, _ := req.Bytes()
+	expected := []byte{0x0, 0x0, 0x0, 0xe, 0x0, 0x12, 0x0, 0x0, 0x0, 0x0, 0x0, 0xf1, 0x0, 0x4, 0x74, 0x65, 0x73, 0x74}
+	if !bytes.Equal(b, expected) {
+		c.Fatalf("expected different bytes representation: %#v", b)
+	}
+
+	msgb := []byte{0x0, 0x0, 0x0, 0x16, 0x0, 0x0, 0x0, 0xf1, 0x0, 0x0, 0x0, 0x0, 0x0, 0x2,
+		0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x3, 0x0, 0x1, 0x0, 0x2}
+	resp, err := ReadAPIVersionsResp(bytes.NewBuffer(msgb))
+	if err != nil {
+		c.Fatalf("could not read response: %s", err)
+	}
+	expectedResp := &APIVersionsResp{
+		CorrelationID: 241,
+		APIVersions: []APIVersionsRespAPI{
+			{APIKey: ProduceReqKind, MinVersion: 0, MaxVersion: 3},
+			{APIKey: MetadataReqKind, MinVersion: 1, MaxVersion: 2},
+		},
+	}
+	if !reflect.DeepEqual(resp, expectedResp) {
+		c.Fatalf("expected different response: %#v", resp)
+	}
+	if b, err := resp.Bytes(); err != nil {
+		c.Fatalf("cannot serialize response: %s", err)
+	} else if !bytes.Equal(b, msgb) {
+		c.Fatalf("serialized representation different from expected: %#v", b)
+	}
+}
+
+func (s *MessagesSuite) TestSaslMessages(c *C) {
+	hreq := &SaslHandshakeReq{
+		CorrelationID: 3,
+		ClientID:      "test",
+		Mechanism:     "PLAIN",
+	}
+	testRequestSerialization(c, hreq)
+	b, _ := hreq.Bytes()
+	if r, err := ReadSaslHandshakeReq(bytes.NewBuffer(b)); err != nil {
+		c.Fatalf("could not read request: %s", err)
+	} else if !reflect.DeepEqual(r, hreq) {
+		c.Fatalf("malformed request: %#v", r)
+	}
+
+	hresp := &SaslHandshakeResp{
+		CorrelationID: 3,
+		Err:           ErrUnsupportedSaslMechanism,
+		Mechanisms:    []string{"SCRAM-SHA-256", "GSSAPI"},
+	}
+	b, _ = hresp.Bytes()
+	if r, err := ReadSaslHandshakeResp(bytes.NewBuffer(b)); err != nil {
+		c.Fatalf("could not read response: %s", err)
+	} else if !reflect.DeepEqual(r, hresp) {
+		c.Fatalf("malformed response: %#v", r)
+	}
+
+	areq := &SaslAuthenticateReq{
+		CorrelationID: 4,
+		ClientID:      "test",
+		AuthBytes:     []byte("\x00user\x00pass"),
+	}
+	testRequestSerialization(c, areq)
+	b, _ = areq.Bytes()
+	if r, err := ReadSaslAuthenticateReq(bytes.NewBuffer(b)); err != nil {
+		c.Fatalf("could not read request: %s", err)
+	} else if !reflect.DeepEqual(r, areq) {
+		c.Fatalf("malformed request: %#v", r)
+	}
+
+	aresp := &SaslAuthenticateResp{
+		CorrelationID: 4,
+		Err:           ErrSaslAuthenticationFailed,
+		ErrMessage:    "invalid credentials",
+		AuthBytes:     []byte{},
+	}
+	b, _ = aresp.Bytes()
+	if r, err := ReadSaslAuthenticateResp(bytes.NewBuffer(b)); err != nil {
+		c.Fatalf("could not read response: %s", err)
+	} else if !reflect.DeepEqual(r, aresp) {
+		c.Fatalf("malformed response: %#v", r)
+	}
+}
+
+func (s *MessagesSuite) TestEnvelopeMessages(c *C) {
+	inner := &MetadataReq{CorrelationID: 9, ClientID: "admin", Topics: []string{"foo"}}
+	b, _ := inner.Bytes()
+	req := &EnvelopeReq{
+		CorrelationID:     3,
+		ClientID:          "gateway",
+		RequestData:       b[4:],
+		RequestPrincipal:  nil,
+		ClientHostAddress: []byte{127, 0, 0, 1},
+	}
+	testRequestSerialization(c, req)
+	b, _ = req.Bytes()
+	r, err := ReadEnvelopeReq(bytes.NewBuffer(b))
+	if err != nil {
+		c.Fatalf("could not read request: %s", err)
+	}
+	if !reflect.DeepEqual(r, req) {
+		c.Fatalf("malformed request: %#v", r)
+	}
+
+	// embedded request is sent as is
+	framed := make([]byte, 4+len(r.RequestData))
+	binary.BigEndian.PutUint32(framed, uint32(len(r.RequestData)))
+	copy(framed[4:], r.RequestData)
+	ir, err := ReadMetadataReq(bytes.NewBuffer(framed))
+	c.Assert(err, IsNil)
+	c.Assert(ir, DeepEquals, inner)
+
+	for _, resp := range []*EnvelopeResp{
+		{CorrelationID: 3, ResponseData: []byte{0, 0, 0, 9, 0, 0, 0, 0}},
+		{CorrelationID: 4, Err: ErrUnsupportedVersion},
+	} {
+		b, _ = resp.Bytes()
+		r, err := ReadEnvelopeResp(bytes.NewBuffer(b))
+		if err != nil {
+			c.Fatalf("could not read response: %s", err)
+		}
+		if !reflect.DeepEqual(r, resp) {
+			c.Fatalf("malformed response: %#v", r)
+		}
+	}
+}
+
+func BenchmarkProduceRequestMarshal(b *testing.B) {
+	messages := make([]*Message, 100)
+	for i := range messages {
+		messages[i] = &Message{
+			Offset: int64(i),
+			Crc:    uint32(i),
+			Key:    nil,
+			Value:  []byte(`Lorem ipsum dolor sit amet, consectetur adipiscing elit. Donec a diam lectus. Sed sit amet ipsum mauris. Maecenas congue ligula ac quam viverra nec consectetur ante hendrerit. Donec et mollis dolor. Praesent et diam eget libero egestas mattis sit amet vitae augue. Nam tincidunt congue enim, ut porta lorem lacinia consectetur.`),
+		}
 
 	}
 	req := &ProduceReq{
@@ -465,6 +2631,90 @@ func BenchmarkProduceRequestMarshal(b *testing.B) {
 	}
 }
 
+// BenchmarkProduceRequestSingleMessage measures the common produce of single
+// small message, written the way connections write requests.
+func BenchmarkProduceRequestSingleMessage(b *testing.B) {
+	req := &ProduceReq{
+		CorrelationID: 241,
+		ClientID:      "test",
+		Version:       2,
+		RequiredAcks:  RequiredAcksAll,
+		Timeout:       time.Second,
+		Topics: []ProduceReqTopic{
+			{
+				Name: "foo",
+				Partitions: []ProduceReqPartition{
+					{
+						ID:       0,
+						Messages: []*Message{{Key: []byte("key"), Value: []byte("Lorem ipsum dolor sit amet")}},
+					},
+				},
+			},
+		},
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := req.WriteTo(io.Discard); err != nil {
+			b.Fatalf("could not write request: %s", err)
+		}
+	}
+}
+
+func BenchmarkProduceRequestMarshalGzipLevel(b *testing.B) {
+	messages := make([]*Message, 100)
+	for i := range messages {
+		messages[i] = &Message{
+			Offset: int64(i),
+			Key:    nil,
+			Value:  []byte(strings.Repeat(`Lorem ipsum dolor sit amet, consectetur adipiscing elit. Donec a diam lectus. `, i%10+1)),
+		}
+	}
+
+	levels := []struct {
+		Name  string
+		Level int
+	}{
+		{"BestSpeed", gzip.BestSpeed},
+		{"Default", gzip.DefaultCompression},
+		{"BestCompression", gzip.BestCompression},
+	}
+	for _, tt := range levels {
+		req := &ProduceReq{
+			CorrelationID:       241,
+			ClientID:            "test",
+			Compression:         CompressionGzip,
+			CompressionLevel:    tt.Level,
+			CompressionLevelSet: true,
+			RequiredAcks:        RequiredAcksAll,
+			Timeout:             time.Second,
+			Topics: []ProduceReqTopic{
+				{
+					Name: "foo",
+					Partitions: []ProduceReqPartition{
+						{
+							ID:       0,
+							Messages: messages,
+						},
+					},
+				},
+			},
+		}
+		b.Run(tt.Name, func(b *testing.B) {
+			var size int
+			for i := 0; i < b.N; i++ {
+				raw, err := req.Bytes()
+				if err != nil {
+					b.Fatalf("could not serialize messages: %s", err)
+				}
+				size = len(raw)
+			}
+			b.ReportMetric(float64(size), "bytes/req")
+		})
+	}
+}
+
 func BenchmarkProduceResponseUnmarshal(b *testing.B) {
 	resp := &ProduceResp{
 		CorrelationID: 241,
@@ -0,0 +1,195 @@
+package proto
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+)
+
+/*
+
+Record batch format, returned by fetch requests of version 4 and above, as
+described in https://kafka.apache.org/documentation/#recordbatch
+
+*/
+
+const (
+	// magic byte of the record batch format
+	messageMagicV2 = 2
+
+	// size of the record batch header following the base offset and batch
+	// length fields, up to and including the records count
+	recordBatchHeaderSize = 49
+
+	controlBatchMask = 0x20
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// decompress returns decoded content of a message or record batch compressed
+// with given method, counting it in given counters.
+func decompress(compression Compression, b []byte, counters *CompressionCounters) ([]byte, error) {
+	switch compression {
+	case CompressionGzip:
+		cr, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, fmt.Errorf("error decoding gzip message: %s", err)
+		}
+		decoded, err := ioutil.ReadAll(cr)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding gzip message: %s", err)
+		}
+		_ = cr.Close()
+		counters.codec(CompressionGzip).decompressed(len(b), len(decoded))
+		return decoded, nil
+	case CompressionSnappy:
+		decoded, err := snappyDecode(b)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding snappy message: %s", err)
+		}
+		counters.codec(CompressionSnappy).decompressed(len(b), len(decoded))
+		return decoded, nil
+	default:
+		return nil, fmt.Errorf("cannot handle compression method: %d", compression)
+	}
+}
+
+// ControlRecord is a transaction marker, written to the partition when a
+// transaction of the producer is committed or aborted. Control records are
+// never returned as messages.
+type ControlRecord struct {
+	Offset        int64
+	ProducerID    int64
+	ProducerEpoch int16
+	// Committed marks the transaction as committed. Otherwise it was
+	// aborted.
+	Committed        bool
+	CoordinatorEpoch int32
+}
+
+// readRecordBatch decodes messages and partition leader epoch from a single
+// record batch. Given buffer must contain the whole batch, following the base
+// offset and batch length fields. Control batches, used to mark transaction
+// boundaries, carry no messages and their records are returned separately.
+// Decompressed records are counted in given counters.
+func readRecordBatch(baseOffset int64, b []byte, counters *CompressionCounters) ([]*Message, []ControlRecord, int32, error) {
+	dec := NewDecoder(bytes.NewReader(b))
+
+	leaderEpoch := dec.DecodeInt32()
+	_ = dec.DecodeInt8() // magic
+	crc := dec.DecodeUint32()
+	if dec.Err() != nil {
+		return nil, nil, 0, dec.Err()
+	}
+	if crc != crc32.Checksum(b[9:], castagnoliTable) {
+		return nil, nil, 0, ErrInvalidMessage
+	}
+
+	attributes := dec.DecodeInt16()
+	_ = dec.DecodeInt32() // last offset delta
+	firstTimestamp := dec.DecodeInt64()
+	maxTimestamp := dec.DecodeInt64()
+	producerID := dec.DecodeInt64()
+	producerEpoch := dec.DecodeInt16()
+	_ = dec.DecodeInt32() // base sequence
+	// compressed records may outnumber the bytes of the batch, so the count
+	// is not checked against them like array lengths are
+	count := int(dec.DecodeInt32())
+	if dec.Err() != nil {
+		return nil, nil, 0, dec.Err()
+	}
+	control := attributes&controlBatchMask != 0
+
+	// everything after the header is the record set, possibly compressed
+	records := b[recordBatchHeaderSize:]
+	if compression := Compression(attributes & compressionMask); compression != CompressionNone {
+		var err error
+		if records, err = decompress(compression, records, counters); err != nil {
+			return nil, nil, 0, err
+		}
+	}
+
+	tsType := TimestampType((attributes & timestampTypeMask) >> 3)
+	dec = NewDecoder(bytes.NewReader(records))
+	var set []*Message
+	var controls []ControlRecord
+	if !control && count > 0 {
+		// every record takes at least seven bytes
+		if max := len(records) / 7; count > max {
+			set = make([]*Message, 0, max)
+		} else {
+			set = make([]*Message, 0, count)
+		}
+	}
+	for i := 0; i < count; i++ {
+		_ = dec.DecodeVarint() // record length
+		_ = dec.DecodeInt8()   // record attributes
+		tsDelta := dec.DecodeVarint()
+		offsetDelta := dec.DecodeVarint()
+		msg := &Message{
+			Offset:        baseOffset + offsetDelta,
+			Key:           dec.DecodeVarintBytes(),
+			Value:         dec.DecodeVarintBytes(),
+			TimestampType: tsType,
+			ProducerID:    producerID,
+			ProducerEpoch: producerEpoch,
+		}
+		if n := dec.DecodeVarint(); n > int64(len(records)) {
+			// every header takes at least two bytes
+			return nil, nil, 0, fmt.Errorf("cannot decode record: invalid header count %d", n)
+		} else if n > 0 {
+			msg.Headers = make([]MessageHeader, n)
+			for h := range msg.Headers {
+				msg.Headers[h].Key = string(dec.DecodeVarintBytes())
+				msg.Headers[h].Value = dec.DecodeVarintBytes()
+			}
+		}
+		if err := dec.Err(); err != nil {
+			return nil, nil, 0, fmt.Errorf("cannot decode record: %s", err)
+		}
+		if control {
+			if rec, ok := readControlRecord(msg); ok {
+				controls = append(controls, rec)
+			}
+			continue
+		}
+		if tsType == TimestampLogAppendTime {
+			msg.Timestamp = decodeTimestamp(maxTimestamp)
+			msg.CreateTimestamp = decodeTimestamp(firstTimestamp + tsDelta)
+		} else {
+			msg.Timestamp = decodeTimestamp(firstTimestamp + tsDelta)
+		}
+		set = append(set, msg)
+	}
+	return set, controls, leaderEpoch, nil
+}
+
+// readControlRecord decodes the transaction marker from the key and value of
+// a record of a control batch. Records of unknown version or type are
+// ignored.
+func readControlRecord(msg *Message) (ControlRecord, bool) {
+	// version and type of the marker
+	if len(msg.Key) < 4 || binary.BigEndian.Uint16(msg.Key) != 0 {
+		return ControlRecord{}, false
+	}
+	rec := ControlRecord{
+		Offset:        msg.Offset,
+		ProducerID:    msg.ProducerID,
+		ProducerEpoch: msg.ProducerEpoch,
+	}
+	// abort and commit markers are the only types
+	switch markerType := binary.BigEndian.Uint16(msg.Key[2:]); markerType {
+	case 0, 1:
+		rec.Committed = markerType == 1
+	default:
+		return ControlRecord{}, false
+	}
+	// version and coordinator epoch
+	if len(msg.Value) >= 6 {
+		rec.CoordinatorEpoch = int32(binary.BigEndian.Uint32(msg.Value[2:]))
+	}
+	return rec, true
+}
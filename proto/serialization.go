@@ -5,23 +5,83 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
 )
 
 var ErrNotEnoughData = errors.New("not enough data")
 
 type decoder struct {
 	buf []byte
-	r   io.Reader
+	r   *countingReader
 	err error
+
+	// size is the number of bytes available to the decoder, or -1 if it is
+	// not known. Declared lengths of arrays that do not fit the data left
+	// fail decoding, instead of allocating memory for them.
+	size int64
+}
+
+// lener is implemented by readers knowing the number of bytes left to read,
+// such as bytes.Reader and bytes.Buffer.
+type lener interface {
+	Len() int
 }
 
 func NewDecoder(r io.Reader) *decoder {
+	size := int64(-1)
+	if l, ok := r.(lener); ok {
+		size = int64(l.Len())
+	}
 	return &decoder{
-		r:   r,
-		buf: make([]byte, 1024),
+		r:    &countingReader{r: r},
+		buf:  make([]byte, 1024),
+		size: size,
 	}
 }
 
+// countingReader keeps track of the number of bytes read, so that decoding
+// errors can point to where they happened.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.n += int64(n)
+	return n, err
+}
+
+// Offset returns the number of bytes consumed by the decoder.
+func (d *decoder) Offset() int64 {
+	return d.r.n
+}
+
+// clampLen returns given declared length of data, such as a message set,
+// limited to the data left. Partially sent message sets are expected, so a
+// length above the data left is no error.
+func (d *decoder) clampLen(n int32) int32 {
+	if d.size >= 0 && int64(n) > d.size-d.r.n {
+		return int32(d.size - d.r.n)
+	}
+	return n
+}
+
+// checkLen fails decoding if given declared length, of elements at least
+// one byte long, is negative or does not fit the data left.
+func (d *decoder) checkLen(n int64) bool {
+	if n < 0 {
+		d.err = fmt.Errorf("invalid length %d", n)
+		return false
+	}
+	if d.size >= 0 && n > d.size-d.r.n {
+		d.err = ErrNotEnoughData
+		return false
+	}
+	return true
+}
+
 func (d *decoder) DecodeInt8() int8 {
 	if d.err != nil {
 		return 0
@@ -137,10 +197,93 @@ func (d *decoder) DecodeString() string {
 	return string(b)
 }
 
+// DecodeArrayLen decodes array length. Null array is returned as empty,
+// use DecodeNullableArrayLen where it has a meaning of its own.
 func (d *decoder) DecodeArrayLen() int {
-	return int(d.DecodeInt32())
+	if n := d.DecodeNullableArrayLen(); n > 0 {
+		return n
+	}
+	return 0
+}
+
+// DecodeNullableArrayLen decodes array length. Null array is returned as -1.
+// Invalid lengths fail decoding and are returned as 0.
+func (d *decoder) DecodeNullableArrayLen() int {
+	n := d.DecodeInt32()
+	if d.err != nil {
+		return 0
+	}
+	if n == -1 {
+		return -1
+	}
+	if !d.checkLen(int64(n)) {
+		return 0
+	}
+	return int(n)
 }
 
+// DecodeUvarint decodes unsigned variable length integer, as used by the
+// record batch format and flexible versions of the protocol.
+func (d *decoder) DecodeUvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	var x uint64
+	b := d.buf[:1]
+	for shift := uint(0); ; shift += 7 {
+		if shift >= 64 {
+			d.err = errors.New("varint overflow")
+			return 0
+		}
+		if _, err := io.ReadFull(d.r, b); err != nil {
+			d.err = err
+			return 0
+		}
+		x |= uint64(b[0]&0x7f) << shift
+		if b[0] < 0x80 {
+			return x
+		}
+	}
+}
+
+// DecodeVarint decodes zig-zag encoded variable length integer, as used by
+// the record batch format.
+func (d *decoder) DecodeVarint() int64 {
+	ux := d.DecodeUvarint()
+	x := int64(ux >> 1)
+	if ux&1 != 0 {
+		x = ^x
+	}
+	return x
+}
+
+// DecodeVarintBytes decodes byte array prefixed with its varint encoded
+// length, as used by the record batch format.
+func (d *decoder) DecodeVarintBytes() []byte {
+	if d.err != nil {
+		return nil
+	}
+	slen := d.DecodeVarint()
+	if d.err != nil {
+		return nil
+	}
+	if slen < 0 {
+		return nil
+	}
+	if !d.checkLen(slen) {
+		return nil
+	}
+
+	b := make([]byte, slen)
+	if _, err := io.ReadFull(d.r, b); err != nil {
+		d.err = err
+		return nil
+	}
+	return b
+}
+
+// DecodeBytes decodes byte array. Null array, encoded with -1 length, is
+// returned as nil, while empty array is returned as empty, non nil slice.
 func (d *decoder) DecodeBytes() []byte {
 	if d.err != nil {
 		return nil
@@ -149,7 +292,13 @@ func (d *decoder) DecodeBytes() []byte {
 	if d.err != nil {
 		return nil
 	}
-	if slen < 1 {
+	if slen < 0 {
+		return nil
+	}
+	if slen == 0 {
+		return []byte{}
+	}
+	if !d.checkLen(int64(slen)) {
 		return nil
 	}
 
@@ -166,6 +315,65 @@ func (d *decoder) DecodeBytes() []byte {
 	return b
 }
 
+// DecodeCompactArrayLen decodes array length of flexible versions of the
+// protocol. Null array is returned as -1. Invalid lengths fail decoding and
+// are returned as 0.
+func (d *decoder) DecodeCompactArrayLen() int {
+	n := d.DecodeUvarint()
+	if d.err != nil {
+		return 0
+	}
+	if n == 0 {
+		return -1
+	}
+	if n > math.MaxInt32 || !d.checkLen(int64(n-1)) {
+		if d.err == nil {
+			d.err = fmt.Errorf("invalid length %d", n-1)
+		}
+		return 0
+	}
+	return int(n - 1)
+}
+
+// DecodeCompactBytes decodes byte array of flexible versions of the protocol.
+// Null array is returned as nil.
+func (d *decoder) DecodeCompactBytes() []byte {
+	slen := d.DecodeCompactArrayLen()
+	if d.err != nil || slen < 0 {
+		return nil
+	}
+
+	b := make([]byte, slen)
+	if _, err := io.ReadFull(d.r, b); err != nil {
+		d.err = err
+		return nil
+	}
+	return b
+}
+
+// DecodeCompactString decodes string of flexible versions of the protocol.
+// Null string is returned as empty string.
+func (d *decoder) DecodeCompactString() string {
+	return string(d.DecodeCompactBytes())
+}
+
+// DecodeTaggedFields reads and discards tagged fields section, that ends
+// every structure of flexible versions of the protocol. None of the tagged
+// fields are currently used.
+func (d *decoder) DecodeTaggedFields() {
+	for n := d.DecodeUvarint(); n > 0 && d.err == nil; n-- {
+		_ = d.DecodeUvarint() // tag
+		size := d.DecodeUvarint()
+		if d.err != nil {
+			return
+		}
+		if _, err := io.CopyN(ioutil.Discard, d.r, int64(size)); err != nil {
+			d.err = err
+			return
+		}
+	}
+}
+
 func (d *decoder) Err() error {
 	return d.err
 }
@@ -249,7 +457,9 @@ func (e *encoder) EncodeInt8(val int8) {
 		return
 	}
 
-	_, e.err = e.w.Write([]byte{byte(val)})
+	buf := e.buf[:1]
+	buf[0] = byte(val)
+	e.err = writeAll(e.w, buf)
 }
 
 func (e *encoder) EncodeInt16(val int16) {
@@ -323,8 +533,19 @@ func (e *encoder) EncodeString(val string) {
 	binary.BigEndian.PutUint16(buf, uint16(len(val)))
 	e.err = writeAll(e.w, buf)
 	if e.err == nil {
-		e.err = writeAll(e.w, []byte(val))
+		e.err = writeAllString(e.w, val)
+	}
+}
+
+// EncodeNullableString encodes given string, or null if it is empty. It is
+// meant for nullable fields, for which the decoder returns empty string for
+// null.
+func (e *encoder) EncodeNullableString(val string) {
+	if val == "" {
+		e.EncodeInt16(-1)
+		return
 	}
+	e.EncodeString(val)
 }
 
 func (e *encoder) EncodeError(err error) {
@@ -348,6 +569,54 @@ func (e *encoder) EncodeArrayLen(length int) {
 	e.EncodeInt32(int32(length))
 }
 
+// EncodeUvarint encodes unsigned variable length integer, as used by flexible
+// versions of the protocol.
+func (e *encoder) EncodeUvarint(val uint64) {
+	if e.err != nil {
+		return
+	}
+
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], val)
+	e.err = writeAll(e.w, buf[:n])
+}
+
+// EncodeCompactArrayLen encodes array length of flexible versions of the
+// protocol. Negative length encodes null array.
+func (e *encoder) EncodeCompactArrayLen(length int) {
+	if length < 0 {
+		e.EncodeUvarint(0)
+		return
+	}
+	e.EncodeUvarint(uint64(length) + 1)
+}
+
+// EncodeCompactBytes encodes byte array of flexible versions of the protocol.
+// Nil is encoded as null.
+func (e *encoder) EncodeCompactBytes(val []byte) {
+	if val == nil {
+		e.EncodeCompactArrayLen(-1)
+		return
+	}
+	e.EncodeCompactArrayLen(len(val))
+	if e.err == nil {
+		e.err = writeAll(e.w, val)
+	}
+}
+
+// EncodeCompactString encodes string of flexible versions of the protocol.
+func (e *encoder) EncodeCompactString(val string) {
+	e.EncodeCompactArrayLen(len(val))
+	if e.err == nil {
+		e.err = writeAll(e.w, []byte(val))
+	}
+}
+
+// EncodeEmptyTaggedFields encodes tagged fields section with no fields.
+func (e *encoder) EncodeEmptyTaggedFields() {
+	e.EncodeUvarint(0)
+}
+
 func (e *encoder) Err() error {
 	return e.err
 }
@@ -362,3 +631,20 @@ func writeAll(w io.Writer, b []byte) error {
 	}
 	return nil
 }
+
+// writeAllString works like writeAll, but avoids copying the string to a
+// byte slice when the writer can write strings.
+func writeAllString(w io.Writer, s string) error {
+	sw, ok := w.(io.StringWriter)
+	if !ok {
+		return writeAll(w, []byte(s))
+	}
+	n, err := sw.WriteString(s)
+	if err != nil {
+		return err
+	}
+	if n != len(s) {
+		return fmt.Errorf("cannot write %d: %d written", len(s), n)
+	}
+	return nil
+}
@@ -2,6 +2,7 @@ package proto
 
 import (
 	"bytes"
+	"io"
 
 	. "gopkg.in/check.v1"
 )
@@ -74,3 +75,115 @@ func (s *SerializationSuite) TestDecoder(c *C) {
 		c.Fatalf("bytes are not the same")
 	}
 }
+
+func (s *SerializationSuite) TestUvarint(c *C) {
+	cases := []struct {
+		val uint64
+		b   []byte
+	}{
+		{0, []byte{0x00}},
+		{1, []byte{0x01}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x80, 0x01}},
+		{300, []byte{0xac, 0x02}},
+		{1 << 32, []byte{0x80, 0x80, 0x80, 0x80, 0x10}},
+	}
+	for _, tc := range cases {
+		e := getTestEncoder()
+		e.EncodeUvarint(tc.val)
+		if !bytes.Equal(b.Bytes(), tc.b) {
+			c.Fatalf("%d: bytes are not the same % x != % x", tc.val, b.Bytes(), tc.b)
+		}
+
+		d := NewDecoder(bytes.NewBuffer(tc.b))
+		if got := d.DecodeUvarint(); got != tc.val || d.Err() != nil {
+			c.Fatalf("%d: uvarint decoding failed: %d, %v", tc.val, got, d.Err())
+		}
+	}
+
+	d := NewDecoder(bytes.NewBuffer([]byte{0x80, 0x80}))
+	d.DecodeUvarint()
+	if d.Err() == nil {
+		c.Fatal("expected error decoding truncated uvarint")
+	}
+}
+
+func (s *SerializationSuite) TestCompactArray(c *C) {
+	e := getTestEncoder()
+	e.EncodeCompactArrayLen(-1)
+	e.EncodeCompactArrayLen(0)
+	e.EncodeCompactArrayLen(3)
+	e.EncodeCompactString("foo")
+	e.EncodeCompactBytes(nil)
+	e.EncodeCompactBytes([]byte{})
+	e.EncodeEmptyTaggedFields()
+	expected := []byte{0x00, 0x01, 0x04, 0x04, 0x66, 0x6f, 0x6f, 0x00, 0x01, 0x00}
+	if !bytes.Equal(b.Bytes(), expected) {
+		c.Fatalf("bytes are not the same % x != % x", b.Bytes(), expected)
+	}
+
+	d := NewDecoder(bytes.NewBuffer(expected))
+	if n := d.DecodeCompactArrayLen(); n != -1 {
+		c.Fatalf("expected null array, got %d", n)
+	}
+	if n := d.DecodeCompactArrayLen(); n != 0 {
+		c.Fatalf("expected empty array, got %d", n)
+	}
+	if n := d.DecodeCompactArrayLen(); n != 3 {
+		c.Fatalf("expected array of 3, got %d", n)
+	}
+	if str := d.DecodeCompactString(); str != "foo" {
+		c.Fatalf("compact string decoding failed: %q", str)
+	}
+	if b := d.DecodeCompactBytes(); b != nil {
+		c.Fatalf("expected null bytes, got %#v", b)
+	}
+	if b := d.DecodeCompactBytes(); b == nil || len(b) != 0 {
+		c.Fatalf("expected empty bytes, got %#v", b)
+	}
+	d.DecodeTaggedFields()
+	if d.Err() != nil {
+		c.Fatalf("decoding failed: %s", d.Err())
+	}
+}
+
+func (s *SerializationSuite) TestTaggedFields(c *C) {
+	// two tagged fields followed by int16
+	in := []byte{0x02, 0x00, 0x02, 0xaa, 0xbb, 0x05, 0x01, 0xcc, 0x00, 0x2a}
+	d := NewDecoder(bytes.NewBuffer(in))
+	d.DecodeTaggedFields()
+	if v := d.DecodeInt16(); v != 42 || d.Err() != nil {
+		c.Fatalf("expected tagged fields to be skipped, got %d, %v", v, d.Err())
+	}
+}
+
+func (s *SerializationSuite) TestDecodeInvalidLengths(c *C) {
+	// null array is empty, unless it has a meaning of its own
+	d := NewDecoder(bytes.NewBuffer([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}))
+	c.Assert(d.DecodeArrayLen(), Equals, 0)
+	c.Assert(d.DecodeNullableArrayLen(), Equals, -1)
+	c.Assert(d.Err(), IsNil)
+
+	for _, b := range [][]byte{
+		{0xff, 0xff, 0xff, 0xfe},       // negative
+		{0x7f, 0xff, 0xff, 0xff},       // more than data left
+		{0x0, 0x0, 0x0, 0x2, 0x0},      // more than data left
+		{0x0, 0x0, 0x0, 0x3, 0x0, 0x0}, // more than data left
+	} {
+		d := NewDecoder(bytes.NewBuffer(b))
+		c.Assert(d.DecodeArrayLen(), Equals, 0)
+		c.Assert(d.Err(), NotNil, Commentf("% x", b))
+	}
+
+	d = NewDecoder(bytes.NewBuffer([]byte{0x7f, 0xff, 0xff, 0xff, 0x0}))
+	c.Assert(d.DecodeBytes(), IsNil)
+	c.Assert(d.Err(), Equals, ErrNotEnoughData)
+
+	d = NewDecoder(bytes.NewBuffer([]byte{0xff, 0xff, 0xff, 0xff, 0x0f}))
+	c.Assert(d.DecodeCompactArrayLen(), Equals, 0)
+	c.Assert(d.Err(), NotNil)
+
+	// declared lengths cannot be checked without knowing the data left
+	d = NewDecoder(io.LimitReader(bytes.NewBuffer([]byte{0x0, 0x0, 0x0, 0x3}), 4))
+	c.Assert(d.DecodeArrayLen(), Equals, 3)
+}
@@ -0,0 +1,111 @@
+package proto
+
+import (
+	"sync/atomic"
+)
+
+// CodecStats describes how a compression codec was used, as counted by
+// CompressionCounters.
+type CodecStats struct {
+	// Compressed is the number of message sets compressed when encoding
+	// requests. CompressedBytesIn and CompressedBytesOut are their sizes
+	// before and after compression.
+	Compressed         int64
+	CompressedBytesIn  int64
+	CompressedBytesOut int64
+
+	// Decompressed is the number of message sets and record batches
+	// decompressed when decoding messages. DecompressedBytesIn and
+	// DecompressedBytesOut are their sizes before and after decompression.
+	Decompressed         int64
+	DecompressedBytesIn  int64
+	DecompressedBytesOut int64
+}
+
+// CompressionRatio returns the ratio of uncompressed to compressed size of all
+// data compressed or decompressed with the codec, or 0 if there was none.
+func (s CodecStats) CompressionRatio() float64 {
+	compressed := s.CompressedBytesOut + s.DecompressedBytesIn
+	if compressed == 0 {
+		return 0
+	}
+	return float64(s.CompressedBytesIn+s.DecompressedBytesOut) / float64(compressed)
+}
+
+// codecCounters holds usage counters of a single codec, updated atomically.
+type codecCounters struct {
+	compressions   int64
+	compressIn     int64
+	compressOut    int64
+	decompressions int64
+	decompressIn   int64
+	decompressOut  int64
+}
+
+func (c *codecCounters) compressed(in, out int) {
+	if c == nil {
+		return
+	}
+	atomic.AddInt64(&c.compressions, 1)
+	atomic.AddInt64(&c.compressIn, int64(in))
+	atomic.AddInt64(&c.compressOut, int64(out))
+}
+
+func (c *codecCounters) decompressed(in, out int) {
+	if c == nil {
+		return
+	}
+	atomic.AddInt64(&c.decompressions, 1)
+	atomic.AddInt64(&c.decompressIn, int64(in))
+	atomic.AddInt64(&c.decompressOut, int64(out))
+}
+
+var codecNames = map[Compression]string{
+	CompressionGzip:   "gzip",
+	CompressionSnappy: "snappy",
+}
+
+// CompressionCounters counts the use of compression codecs when encoding
+// requests and decoding messages, for example by a single connection. Zero
+// value is ready to use, and it is safe for concurrent use. Nil counters
+// count nothing.
+type CompressionCounters struct {
+	gzip   codecCounters
+	snappy codecCounters
+}
+
+// codec returns the counters of given codec, or nil if it is not counted.
+func (c *CompressionCounters) codec(compression Compression) *codecCounters {
+	if c == nil {
+		return nil
+	}
+	switch compression {
+	case CompressionGzip:
+		return &c.gzip
+	case CompressionSnappy:
+		return &c.snappy
+	}
+	return nil
+}
+
+// Stats returns a snapshot of the usage of every supported compression codec,
+// keyed by codec name.
+func (c *CompressionCounters) Stats() map[string]CodecStats {
+	stats := make(map[string]CodecStats, len(codecNames))
+	for compression, name := range codecNames {
+		c := c.codec(compression)
+		if c == nil {
+			stats[name] = CodecStats{}
+			continue
+		}
+		stats[name] = CodecStats{
+			Compressed:           atomic.LoadInt64(&c.compressions),
+			CompressedBytesIn:    atomic.LoadInt64(&c.compressIn),
+			CompressedBytesOut:   atomic.LoadInt64(&c.compressOut),
+			Decompressed:         atomic.LoadInt64(&c.decompressions),
+			DecompressedBytesIn:  atomic.LoadInt64(&c.decompressIn),
+			DecompressedBytesOut: atomic.LoadInt64(&c.decompressOut),
+		}
+	}
+	return stats
+}
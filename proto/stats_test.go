@@ -0,0 +1,55 @@
+package proto
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&StatsSuite{})
+
+type StatsSuite struct{}
+
+func (s *StatsSuite) TestCompressionCounters(c *C) {
+	messages := []*Message{{Value: []byte(strings.Repeat("compressible ", 100))}}
+
+	for _, compression := range []Compression{CompressionGzip, CompressionSnappy} {
+		name := codecNames[compression]
+		var counters CompressionCounters
+
+		var buf bytes.Buffer
+		n, err := encodeMessageSet(&buf, messages, compression, gzip.DefaultCompression, messageMagicV0, TimestampCreateTime, &counters)
+		c.Assert(err, IsNil)
+		if _, _, err := readMessageSetInfo(&buf, int32(n), &counters); err != nil {
+			c.Fatalf("cannot read %s message set: %s", name, err)
+		}
+
+		stats := counters.Stats()[name]
+		c.Assert(stats.Compressed, Equals, int64(1))
+		c.Assert(stats.Decompressed, Equals, int64(1))
+		if stats.CompressedBytesOut <= 0 || stats.CompressedBytesIn <= stats.CompressedBytesOut*4 {
+			c.Fatalf("expected %s to compress well, got %d bytes from %d",
+				name, stats.CompressedBytesOut, stats.CompressedBytesIn)
+		}
+		c.Assert(stats.DecompressedBytesIn, Equals, stats.CompressedBytesOut)
+		c.Assert(stats.DecompressedBytesOut, Equals, stats.CompressedBytesIn)
+		if ratio := stats.CompressionRatio(); ratio <= 1 {
+			c.Fatalf("expected %s compression ratio above 1, got %f", name, ratio)
+		}
+
+		// other codecs are not counted
+		for other, otherStats := range counters.Stats() {
+			if other != name {
+				c.Assert(otherStats, Equals, CodecStats{})
+			}
+		}
+	}
+
+	// nil counters count nothing
+	var counters *CompressionCounters
+	_, err := encodeMessageSet(&bytes.Buffer{}, messages, CompressionGzip, gzip.DefaultCompression, messageMagicV0, TimestampCreateTime, counters)
+	c.Assert(err, IsNil)
+	c.Assert(counters.Stats()["gzip"], Equals, CodecStats{})
+}
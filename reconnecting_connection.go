@@ -0,0 +1,198 @@
+package kafka
+
+import (
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jpillora/backoff"
+
+	"github.com/dropbox/kafka/proto"
+)
+
+const (
+	// reconnectWaitMin and reconnectWaitMax bound the time between two dials
+	// of a reconnecting connection.
+	reconnectWaitMin = 50 * time.Millisecond
+	reconnectWaitMax = 5 * time.Second
+)
+
+// isConnectionError returns whether given error means that the connection
+// the request was sent with is broken.
+func isConnectionError(err error) bool {
+	if _, ok := err.(*net.OpError); ok {
+		return true
+	}
+	switch err {
+	case ErrClosed, ErrBrokerDisconnected, ErrPartialWrite, ErrWriteTimeout,
+		ErrSocketReadTimeout, io.EOF, syscall.EPIPE:
+		return true
+	}
+	return false
+}
+
+// ReconnectingConnection is a connection to a single kafka node, that dials a
+// new connection whenever the current one gets closed. Idempotent requests,
+// that failed because the connection broke, are retried once using a new
+// connection. Dials are spaced with exponential backoff, so that a node that
+// keeps dropping connections is not flooded with new ones.
+//
+// It is meant for talking to a given node directly, bypassing the Broker's
+// leader lookup and connection pool. It is safe for concurrent use.
+type ReconnectingConnection struct {
+	addr string
+	// retryProduce allows retrying produce requests, which may result in
+	// messages being written twice.
+	retryProduce bool
+	dial         func() (*connection, error)
+
+	// mu protects the following members and serializes dials.
+	mu       *sync.Mutex
+	conn     *connection
+	closed   bool
+	retry    *backoff.Backoff
+	nextDial time.Time
+}
+
+// NewReconnectingConnection returns reconnecting connection to given address,
+// whose connections are configured as the connections of a Broker using given
+// configuration. Produce requests are retried only if retryProduce is set, as
+// that may write their messages twice. No connection is made until the first
+// request is sent.
+func NewReconnectingConnection(address string, conf BrokerConf, retryProduce bool) *ReconnectingConnection {
+	return &ReconnectingConnection{
+		addr:         address,
+		retryProduce: retryProduce,
+		dial: func() (*connection, error) {
+			return dialBrokerConnection(address, conf)
+		},
+		mu:    &sync.Mutex{},
+		retry: &backoff.Backoff{Min: reconnectWaitMin, Max: reconnectWaitMax, Jitter: true},
+	}
+}
+
+// get returns the current connection, dialing a new one if there is none or
+// it has been closed. If the last dial was too recent, it first waits for the
+// backoff time to pass, without holding the lock, so that Close and callers
+// finding a working connection are not blocked meanwhile.
+func (rc *ReconnectingConnection) get() (*connection, error) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	for {
+		if rc.closed {
+			return nil, ErrClosed
+		}
+		if rc.conn != nil && !rc.conn.IsClosed() {
+			return rc.conn, nil
+		}
+		wait := time.Until(rc.nextDial)
+		if wait <= 0 {
+			break
+		}
+		// state may change while waiting, so it is checked again
+		rc.mu.Unlock()
+		time.Sleep(wait)
+		rc.mu.Lock()
+	}
+	conn, err := rc.dial()
+	rc.nextDial = time.Now().Add(rc.retry.Duration())
+	if err != nil {
+		log.Warningf("cannot reconnect to %s: %s", rc.addr, err)
+		return nil, err
+	}
+	rc.conn = conn
+	return conn, nil
+}
+
+// succeeded resets the backoff after the connection has proven to work.
+func (rc *ReconnectingConnection) succeeded() {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	rc.retry.Reset()
+	rc.nextDial = time.Time{}
+}
+
+// do calls given function with the current connection. If it fails because
+// the connection broke and retry is allowed, it is called once more using a
+// new connection.
+func (rc *ReconnectingConnection) do(retry bool, fn func(*connection) error) error {
+	conn, err := rc.get()
+	if err != nil {
+		return err
+	}
+	err = fn(conn)
+	if err != nil && retry && isConnectionError(err) {
+		log.Debugf("connection to %s broken, retrying: %s", rc.addr, err)
+		_ = conn.Close()
+		if conn, err = rc.get(); err != nil {
+			return err
+		}
+		err = fn(conn)
+	}
+	if err == nil {
+		rc.succeeded()
+	}
+	return err
+}
+
+// Metadata sends given metadata request, retrying it on a new connection if
+// the current one breaks.
+func (rc *ReconnectingConnection) Metadata(req *proto.MetadataReq) (*proto.MetadataResp, error) {
+	var resp *proto.MetadataResp
+	err := rc.do(true, func(conn *connection) (err error) {
+		resp, err = conn.Metadata(req)
+		return err
+	})
+	return resp, err
+}
+
+// Fetch sends given fetch request, retrying it on a new connection if the
+// current one breaks.
+func (rc *ReconnectingConnection) Fetch(req *proto.FetchReq) (*proto.FetchResp, error) {
+	var resp *proto.FetchResp
+	err := rc.do(true, func(conn *connection) (err error) {
+		resp, err = conn.Fetch(req)
+		return err
+	})
+	return resp, err
+}
+
+// Offset sends given offset request, retrying it on a new connection if the
+// current one breaks.
+func (rc *ReconnectingConnection) Offset(req *proto.OffsetReq) (*proto.OffsetResp, error) {
+	var resp *proto.OffsetResp
+	err := rc.do(true, func(conn *connection) (err error) {
+		resp, err = conn.Offset(req)
+		return err
+	})
+	return resp, err
+}
+
+// Produce sends given produce request. It is retried on a new connection if
+// the current one breaks only if the reconnecting connection was created with
+// produce retries allowed, as the broken request may have been written.
+func (rc *ReconnectingConnection) Produce(req *proto.ProduceReq) (*proto.ProduceResp, error) {
+	var resp *proto.ProduceResp
+	err := rc.do(rc.retryProduce, func(conn *connection) (err error) {
+		resp, err = conn.Produce(req)
+		return err
+	})
+	return resp, err
+}
+
+// Close closes the current connection. No new connection is made afterwards,
+// all requests fail with ErrClosed.
+func (rc *ReconnectingConnection) Close() error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	rc.closed = true
+	if rc.conn == nil {
+		return nil
+	}
+	return rc.conn.Close()
+}
@@ -0,0 +1,150 @@
+package kafka
+
+import (
+	"io"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/dropbox/kafka/proto"
+)
+
+var _ = Suite(&ReconnectingConnectionSuite{})
+
+type ReconnectingConnectionSuite struct{}
+
+func (s *ReconnectingConnectionSuite) SetUpTest(c *C) {
+	ResetTestLogger(c)
+}
+
+// hangupTransport is a transport that returns io.EOF once a request has been
+// written, as if the broker closed the connection instead of answering.
+type hangupTransport struct {
+	written chan struct{}
+}
+
+func (t *hangupTransport) Read(b []byte) (int, error) {
+	<-t.written
+	return 0, io.EOF
+}
+func (t *hangupTransport) Write(b []byte) (int, error) {
+	close(t.written)
+	return len(b), nil
+}
+func (t *hangupTransport) Close() error { return nil }
+
+// newHangupReconnectingConnection returns reconnecting connection to given
+// address, whose first connection is broken.
+func newHangupReconnectingConnection(address string, retryProduce bool) (*ReconnectingConnection, *int) {
+	rc := NewReconnectingConnection(address, NewBrokerConf("tester"), retryProduce)
+	dials := 0
+	rc.dial = func() (*connection, error) {
+		dials++
+		if dials == 1 {
+			return newConnection("fake", &hangupTransport{written: make(chan struct{})}, 0), nil
+		}
+		return newTCPConnection(address, time.Second)
+	}
+	return rc, &dials
+}
+
+func (s *ReconnectingConnectionSuite) TestRetryIdempotent(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	rc, dials := newHangupReconnectingConnection(srv.Address(), false)
+	defer func() { _ = rc.Close() }()
+
+	resp, err := rc.Metadata(&proto.MetadataReq{ClientID: "tester"})
+	c.Assert(err, IsNil)
+	c.Assert(resp.Brokers, HasLen, 1)
+	c.Assert(*dials, Equals, 2)
+
+	// working connection is reused
+	_, err = rc.Metadata(&proto.MetadataReq{ClientID: "tester"})
+	c.Assert(err, IsNil)
+	c.Assert(*dials, Equals, 2)
+
+	_ = rc.Close()
+	_, err = rc.Metadata(&proto.MetadataReq{ClientID: "tester"})
+	c.Assert(err, Equals, ErrClosed)
+}
+
+func (s *ReconnectingConnectionSuite) TestProduceNotRetried(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	req := &proto.ProduceReq{
+		ClientID:     "tester",
+		RequiredAcks: proto.RequiredAcksAll,
+		Topics: []proto.ProduceReqTopic{
+			{
+				Name: "test",
+				Partitions: []proto.ProduceReqPartition{
+					{ID: 0, Messages: []*proto.Message{{Value: []byte("x")}}},
+				},
+			},
+		},
+	}
+
+	rc, dials := newHangupReconnectingConnection(srv.Address(), false)
+	defer func() { _ = rc.Close() }()
+	_, err := rc.Produce(req)
+	c.Assert(err, Equals, ErrBrokerDisconnected)
+	c.Assert(*dials, Equals, 1)
+
+	// next request reconnects
+	_, err = rc.Produce(req)
+	c.Assert(err, IsNil)
+	c.Assert(*dials, Equals, 2)
+
+	rc, dials = newHangupReconnectingConnection(srv.Address(), true)
+	defer func() { _ = rc.Close() }()
+	_, err = rc.Produce(req)
+	c.Assert(err, IsNil)
+	c.Assert(*dials, Equals, 2)
+}
+
+func (s *ReconnectingConnectionSuite) TestReconnectBackoff(c *C) {
+	rc := NewReconnectingConnection("fake", NewBrokerConf("tester"), false)
+	dials := 0
+	rc.dial = func() (*connection, error) {
+		dials++
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		_, err := rc.Metadata(&proto.MetadataReq{ClientID: "tester"})
+		c.Assert(err, Equals, io.ErrUnexpectedEOF)
+	}
+	c.Assert(dials, Equals, 3)
+	if elapsed := time.Since(start); elapsed < reconnectWaitMin {
+		c.Fatalf("expected dials to be spaced, took %s", elapsed)
+	}
+}
+
+func (s *ReconnectingConnectionSuite) TestCloseWhileWaitingForBackoff(c *C) {
+	rc := NewReconnectingConnection("fake", NewBrokerConf("tester"), false)
+	rc.dial = func() (*connection, error) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	rc.nextDial = time.Now().Add(300 * time.Millisecond)
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := rc.Metadata(&proto.MetadataReq{ClientID: "tester"})
+		errc <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	// waiting for the backoff does not hold the lock
+	start := time.Now()
+	c.Assert(rc.Close(), IsNil)
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		c.Fatalf("close blocked by backoff for %s", elapsed)
+	}
+	c.Assert(<-errc, Equals, ErrClosed)
+}
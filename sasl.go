@@ -0,0 +1,138 @@
+package kafka
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/dropbox/kafka/proto"
+)
+
+// ErrAuthTimeout is returned when the broker does not answer a step of the SASL
+// authentication in time. Connection is closed when it happens.
+var ErrAuthTimeout = errors.New("sasl authentication timed out")
+
+// SASLMechanism implements the client side of a SASL authentication mechanism.
+type SASLMechanism interface {
+	// Name returns the name of the mechanism, as sent in the handshake.
+	Name() string
+
+	// Next returns the next message that should be sent to the broker,
+	// given the last message received from it, which is nil in the first
+	// round. Authentication is complete once the message returned with
+	// done flag set is accepted by the broker.
+	Next(challenge []byte) (response []byte, done bool, err error)
+}
+
+type saslPlain struct {
+	user     string
+	password string
+}
+
+// SASLPlain returns SASL mechanism authenticating with given user name and
+// password, sent in plain text.
+func SASLPlain(user, password string) SASLMechanism {
+	return &saslPlain{user: user, password: password}
+}
+
+func (m *saslPlain) Name() string {
+	return "PLAIN"
+}
+
+func (m *saslPlain) Next(challenge []byte) ([]byte, bool, error) {
+	return []byte("\x00" + m.user + "\x00" + m.password), true, nil
+}
+
+// authenticate performs SASL handshake and authentication using given
+// mechanism. Every round trip with the broker is bounded by the timeout, after
+// which ErrAuthTimeout is returned. Connection is closed if the authentication
+// fails for any reason, so that partially authenticated connection is never
+// used.
+func (c *connection) authenticate(mech SASLMechanism, clientID string, timeout time.Duration) (err error) {
+	defer func() {
+		if err != nil {
+			log.Warningf("sasl authentication with %s failed: %s", c.addr, err)
+			_ = c.Close()
+		}
+	}()
+
+	correlationID, ok := <-c.nextID
+	if !ok {
+		return c.stopErr
+	}
+	b, err := c.authRoundTrip(correlationID, &proto.SaslHandshakeReq{
+		CorrelationID: correlationID,
+		ClientID:      clientID,
+		Mechanism:     mech.Name(),
+	}, timeout)
+	if err != nil {
+		return err
+	}
+	hresp, err := proto.ReadSaslHandshakeResp(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	if hresp.Err != nil {
+		return hresp.Err
+	}
+
+	var challenge []byte
+	for {
+		msg, done, err := mech.Next(challenge)
+		if err != nil {
+			return err
+		}
+		if correlationID, ok = <-c.nextID; !ok {
+			return c.stopErr
+		}
+		b, err := c.authRoundTrip(correlationID, &proto.SaslAuthenticateReq{
+			CorrelationID: correlationID,
+			ClientID:      clientID,
+			AuthBytes:     msg,
+		}, timeout)
+		if err != nil {
+			return err
+		}
+		aresp, err := proto.ReadSaslAuthenticateResp(bytes.NewReader(b))
+		if err != nil {
+			return err
+		}
+		if aresp.Err != nil {
+			if aresp.ErrMessage != "" {
+				log.Debugf("sasl authentication with %s rejected: %s", c.addr, aresp.ErrMessage)
+			}
+			return aresp.Err
+		}
+		if done {
+			return nil
+		}
+		challenge = aresp.AuthBytes
+	}
+}
+
+// authRoundTrip sends given authentication request and returns the response,
+// waiting for it no longer than the timeout.
+func (c *connection) authRoundTrip(correlationID int32, req io.WriterTo, timeout time.Duration) ([]byte, error) {
+	respc, err := c.respWaiter(correlationID)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.writeRequest(req); err != nil {
+		c.releaseWaiter(correlationID)
+		return nil, err
+	}
+
+	timer := c.clock.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case resp, ok := <-respc:
+		if !ok {
+			return nil, c.stopErr
+		}
+		return resp.b, resp.err
+	case <-timer.C():
+		c.abandonWaiter(correlationID)
+		return nil, ErrAuthTimeout
+	}
+}
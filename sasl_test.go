@@ -0,0 +1,72 @@
+package kafka
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/dropbox/kafka/proto"
+)
+
+func (s *ConnectionSuite) TestConnectionSASLPlain(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	srv.Handle(SaslHandshakeRequest, func(request Serializable) Serializable {
+		req := request.(*proto.SaslHandshakeReq)
+		c.Assert(req.Mechanism, Equals, "PLAIN")
+		return &proto.SaslHandshakeResp{
+			CorrelationID: req.CorrelationID,
+			Mechanisms:    []string{"PLAIN"},
+		}
+	})
+	srv.Handle(SaslAuthenticateRequest, func(request Serializable) Serializable {
+		req := request.(*proto.SaslAuthenticateReq)
+		resp := &proto.SaslAuthenticateResp{CorrelationID: req.CorrelationID}
+		if string(req.AuthBytes) != "\x00alice\x00secret" {
+			resp.Err = proto.ErrSaslAuthenticationFailed
+			resp.ErrMessage = "invalid credentials"
+		}
+		return resp
+	})
+
+	conn, err := newTCPConnection(srv.Address(), time.Second)
+	c.Assert(err, IsNil)
+	c.Assert(conn.authenticate(SASLPlain("alice", "secret"), "tester", time.Second), IsNil)
+	c.Assert(conn.IsClosed(), Equals, false)
+	_ = conn.Close()
+
+	conn, err = newTCPConnection(srv.Address(), time.Second)
+	c.Assert(err, IsNil)
+	err = conn.authenticate(SASLPlain("alice", "wrong"), "tester", time.Second)
+	c.Assert(err, Equals, proto.ErrSaslAuthenticationFailed)
+	c.Assert(conn.IsClosed(), Equals, true)
+}
+
+func (s *ConnectionSuite) TestConnectionSASLTimeout(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	srv.Handle(SaslHandshakeRequest, func(request Serializable) Serializable {
+		req := request.(*proto.SaslHandshakeReq)
+		return &proto.SaslHandshakeResp{
+			CorrelationID: req.CorrelationID,
+			Mechanisms:    []string{"PLAIN"},
+		}
+	})
+	// broker never answers the authentication request
+	srv.Handle(SaslAuthenticateRequest, func(request Serializable) Serializable {
+		return nil
+	})
+
+	conn, err := newTCPConnection(srv.Address(), time.Second)
+	c.Assert(err, IsNil)
+
+	start := time.Now()
+	err = conn.authenticate(SASLPlain("alice", "secret"), "tester", 100*time.Millisecond)
+	c.Assert(err, Equals, ErrAuthTimeout)
+	c.Assert(time.Since(start) < time.Second, Equals, true)
+	c.Assert(conn.IsClosed(), Equals, true)
+}
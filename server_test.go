@@ -20,6 +20,14 @@ const (
 	OffsetCommitRequest     = 8
 	OffsetFetchRequest      = 9
 	GroupCoordinatorRequest = 10
+	HeartbeatRequest        = 12
+	SaslHandshakeRequest    = 17
+	APIVersionsRequest      = 18
+	WriteTxnMarkersRequest  = 27
+	SaslAuthenticateRequest = 36
+	DeleteGroupsRequest     = 42
+	OffsetDeleteRequest     = 47
+	EnvelopeRequest         = 58
 )
 
 type Serializable interface {
@@ -152,10 +160,26 @@ func (srv *Server) handleClient(c net.Conn) {
 			request, err = proto.ReadMetadataReq(bytes.NewBuffer(b))
 		case GroupCoordinatorRequest:
 			request, err = proto.ReadGroupCoordinatorReq(bytes.NewBuffer(b))
+		case HeartbeatRequest:
+			request, err = proto.ReadHeartbeatReq(bytes.NewBuffer(b))
 		case OffsetCommitRequest:
 			request, err = proto.ReadOffsetCommitReq(bytes.NewBuffer(b))
 		case OffsetFetchRequest:
 			request, err = proto.ReadOffsetFetchReq(bytes.NewBuffer(b))
+		case SaslHandshakeRequest:
+			request, err = proto.ReadSaslHandshakeReq(bytes.NewBuffer(b))
+		case APIVersionsRequest:
+			request, err = proto.ReadAPIVersionsReq(bytes.NewBuffer(b))
+		case WriteTxnMarkersRequest:
+			request, err = proto.ReadWriteTxnMarkersReq(bytes.NewBuffer(b))
+		case SaslAuthenticateRequest:
+			request, err = proto.ReadSaslAuthenticateReq(bytes.NewBuffer(b))
+		case DeleteGroupsRequest:
+			request, err = proto.ReadDeleteGroupsReq(bytes.NewBuffer(b))
+		case OffsetDeleteRequest:
+			request, err = proto.ReadOffsetDeleteReq(bytes.NewBuffer(b))
+		case EnvelopeRequest:
+			request, err = proto.ReadEnvelopeReq(bytes.NewBuffer(b))
 		}
 
 		if err != nil {
@@ -184,6 +208,7 @@ func (srv *Server) defaultRequestHandler(request Serializable) Serializable {
 		resp := &proto.FetchResp{
 			CorrelationID: req.CorrelationID,
 			Topics:        make([]proto.FetchRespTopic, len(req.Topics)),
+			Version:       req.Version,
 		}
 		for ti, topic := range req.Topics {
 			resp.Topics[ti] = proto.FetchRespTopic{
@@ -203,6 +228,7 @@ func (srv *Server) defaultRequestHandler(request Serializable) Serializable {
 	case *proto.ProduceReq:
 		resp := &proto.ProduceResp{
 			CorrelationID: req.CorrelationID,
+			Version:       req.Version,
 		}
 		resp.Topics = make([]proto.ProduceRespTopic, len(req.Topics))
 		for ti, topic := range req.Topics {
@@ -250,6 +276,7 @@ func (srv *Server) defaultRequestHandler(request Serializable) Serializable {
 		}
 		return &proto.MetadataResp{
 			CorrelationID: req.CorrelationID,
+			Version:       req.Version,
 			Brokers: []proto.MetadataRespBroker{
 				{NodeID: 1, Host: host, Port: int32(port)},
 			},
@@ -257,10 +284,26 @@ func (srv *Server) defaultRequestHandler(request Serializable) Serializable {
 		}
 	case *proto.GroupCoordinatorReq:
 		panic("not implemented")
+	case *proto.HeartbeatReq:
+		panic("not implemented")
 	case *proto.OffsetCommitReq:
 		panic("not implemented")
 	case *proto.OffsetFetchReq:
 		panic("not implemented")
+	case *proto.SaslHandshakeReq:
+		panic("not implemented")
+	case *proto.APIVersionsReq:
+		panic("not implemented")
+	case *proto.WriteTxnMarkersReq:
+		panic("not implemented")
+	case *proto.SaslAuthenticateReq:
+		panic("not implemented")
+	case *proto.DeleteGroupsReq:
+		panic("not implemented")
+	case *proto.OffsetDeleteReq:
+		panic("not implemented")
+	case *proto.EnvelopeReq:
+		panic("not implemented")
 	default:
 		panic(fmt.Sprintf("unknown message type: %T", req))
 	}
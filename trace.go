@@ -0,0 +1,47 @@
+package kafka
+
+import (
+	"strings"
+
+	"github.com/dropbox/kafka/proto"
+)
+
+// TraceClientID returns client ID embedding given trace ID, so that requests
+// sent with it can be traced in the logs of both the client and the broker.
+// The trace ID follows the client ID, separated by given separator, for
+// example "myclient-4bf92f35" for separator "-". Trace ID must not contain
+// the separator, otherwise SplitTraceClientID cannot recover it. Empty trace
+// ID or separator leave the client ID unchanged.
+func TraceClientID(clientID, traceID, separator string) string {
+	if traceID == "" || separator == "" {
+		return clientID
+	}
+	return clientID + separator + traceID
+}
+
+// SplitTraceClientID reverses TraceClientID, returning the client ID and the
+// trace ID embedded in it. Trace ID is empty if there is none.
+func SplitTraceClientID(clientID, separator string) (string, string) {
+	if separator == "" {
+		return clientID, ""
+	}
+	i := strings.LastIndex(clientID, separator)
+	if i < 0 {
+		return clientID, ""
+	}
+	return clientID[:i], clientID[i+len(separator):]
+}
+
+// traceRequest logs the trace ID embedded in the client ID of the request of
+// given kind and correlation ID, if any.
+func (c *connection) traceRequest(kind int16, clientID string, correlationID int32) {
+	if c.traceSeparator == "" {
+		return
+	}
+	clientID, traceID := SplitTraceClientID(clientID, c.traceSeparator)
+	if traceID == "" {
+		return
+	}
+	log.Debugf("%s request %d of %s to %s, trace %s",
+		proto.RequestKindName(kind), correlationID, clientID, c.addr, traceID)
+}
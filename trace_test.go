@@ -0,0 +1,59 @@
+package kafka
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/dropbox/kafka/proto"
+)
+
+func (s *ConnectionSuite) TestTraceClientID(c *C) {
+	id := TraceClientID("my-client", "4bf92f35", "/")
+	c.Assert(id, Equals, "my-client/4bf92f35")
+	clientID, traceID := SplitTraceClientID(id, "/")
+	c.Assert(clientID, Equals, "my-client")
+	c.Assert(traceID, Equals, "4bf92f35")
+
+	c.Assert(TraceClientID("my-client", "", "/"), Equals, "my-client")
+	clientID, traceID = SplitTraceClientID("my-client", "/")
+	c.Assert(clientID, Equals, "my-client")
+	c.Assert(traceID, Equals, "")
+}
+
+func (s *ConnectionSuite) TestConnectionTraceRequest(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	clientIDs := make(chan string, 1)
+	srv.Handle(FetchRequest, func(request Serializable) Serializable {
+		req := request.(*proto.FetchReq)
+		clientIDs <- req.ClientID
+		return &proto.FetchResp{CorrelationID: req.CorrelationID}
+	})
+
+	conn, err := newTCPConnection(srv.Address(), time.Second)
+	if err != nil {
+		c.Fatalf("could not conect to test server: %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+	conn.traceSeparator = "/"
+
+	req := &proto.FetchReq{ClientID: TraceClientID("tester", "4bf92f35", "/")}
+	_, err = conn.Fetch(req)
+	c.Assert(err, IsNil)
+
+	// broker receives the trace ID with the client ID
+	received := <-clientIDs
+	c.Assert(received, Equals, "tester/4bf92f35")
+	clientID, traceID := SplitTraceClientID(received, "/")
+	c.Assert(clientID, Equals, "tester")
+	c.Assert(traceID, Equals, "4bf92f35")
+
+	c.Assert(strings.Contains(c.GetTestLog(),
+		fmt.Sprintf("Fetch request %d of tester to %s, trace 4bf92f35", req.CorrelationID, srv.Address())),
+		Equals, true, Commentf("trace not logged"))
+}
@@ -0,0 +1,119 @@
+package kafka
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dropbox/kafka/proto"
+)
+
+// ErrUnknownBrokerVersion is returned by InferBrokerVersion if the API
+// versions reported by the broker match no known Kafka release.
+var ErrUnknownBrokerVersion = errors.New("cannot infer broker version")
+
+// Version is a Kafka release version, such as 0.10.2 or 2.8.0.
+type Version struct {
+	Major int
+	Minor int
+	Patch int
+}
+
+// Well known Kafka releases, that can be told apart by the API versions they
+// support.
+var (
+	V0_10_0 = Version{0, 10, 0}
+	V0_10_1 = Version{0, 10, 1}
+	V0_10_2 = Version{0, 10, 2}
+	V0_11_0 = Version{0, 11, 0}
+	V1_0_0  = Version{1, 0, 0}
+	V1_1_0  = Version{1, 1, 0}
+	V2_0_0  = Version{2, 0, 0}
+	V2_1_0  = Version{2, 1, 0}
+	V2_3_0  = Version{2, 3, 0}
+	V2_4_0  = Version{2, 4, 0}
+	V2_8_0  = Version{2, 8, 0}
+)
+
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// AtLeast returns whether v is the same release as o or a newer one.
+func (v Version) AtLeast(o Version) bool {
+	if v.Major != o.Major {
+		return v.Major > o.Major
+	}
+	if v.Minor != o.Minor {
+		return v.Minor > o.Minor
+	}
+	return v.Patch >= o.Patch
+}
+
+// versionFingerprints maps Kafka releases, newest first, to the highest
+// versions of APIs that were introduced with them.
+var versionFingerprints = []struct {
+	version Version
+	apis    map[int16]int16
+}{
+	{V2_8_0, map[int16]int16{proto.ProduceReqKind: 9, proto.MetadataReqKind: 10}},
+	{V2_4_0, map[int16]int16{proto.ProduceReqKind: 8, proto.MetadataReqKind: 9, proto.APIVersionsReqKind: 3}},
+	{V2_3_0, map[int16]int16{proto.FetchReqKind: 11, proto.MetadataReqKind: 8}},
+	{V2_1_0, map[int16]int16{proto.FetchReqKind: 10, proto.ProduceReqKind: 7, proto.MetadataReqKind: 7}},
+	{V2_0_0, map[int16]int16{proto.FetchReqKind: 8, proto.ProduceReqKind: 6, proto.MetadataReqKind: 6}},
+	{V1_1_0, map[int16]int16{proto.FetchReqKind: 7}},
+	{V1_0_0, map[int16]int16{proto.FetchReqKind: 6, proto.ProduceReqKind: 5, proto.MetadataReqKind: 5}},
+	{V0_11_0, map[int16]int16{proto.FetchReqKind: 5, proto.ProduceReqKind: 3, proto.MetadataReqKind: 4}},
+	{V0_10_2, map[int16]int16{proto.OffsetFetchReqKind: 2}},
+	{V0_10_1, map[int16]int16{proto.FetchReqKind: 3, proto.MetadataReqKind: 2, proto.OffsetReqKind: 1}},
+	{V0_10_0, map[int16]int16{proto.FetchReqKind: 2, proto.ProduceReqKind: 2, proto.MetadataReqKind: 1}},
+}
+
+// inferVersion returns the newest Kafka release, whose newly introduced API
+// versions are all supported according to the API versions reported by a
+// broker.
+func inferVersion(apis []proto.APIVersionsRespAPI) (Version, error) {
+	max := make(map[int16]int16, len(apis))
+	for _, api := range apis {
+		max[api.APIKey] = api.MaxVersion
+	}
+	for _, fp := range versionFingerprints {
+		matches := true
+		for key, version := range fp.apis {
+			if v, ok := max[key]; !ok || v < version {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return fp.version, nil
+		}
+	}
+	return Version{}, ErrUnknownBrokerVersion
+}
+
+// InferBrokerVersion returns the Kafka release the broker runs, as inferred
+// from the API versions it supports, which are fetched unless already known.
+// Releases that added no API versions cannot be told apart, so the oldest
+// release matching the broker is returned. Brokers older than 0.10.0 do not
+// report their API versions at all and fail the request.
+func (c *connection) InferBrokerVersion() (Version, error) {
+	c.mu.Lock()
+	known := c.apiVersions
+	c.mu.Unlock()
+
+	apis := make([]proto.APIVersionsRespAPI, 0, len(known))
+	for _, api := range known {
+		apis = append(apis, api)
+	}
+	if known == nil {
+		resp, err := c.APIVersions("")
+		if err != nil {
+			return Version{}, err
+		}
+		if resp.Err != nil {
+			return Version{}, resp.Err
+		}
+		apis = resp.APIVersions
+	}
+	return inferVersion(apis)
+}
@@ -0,0 +1,99 @@
+package kafka
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/dropbox/kafka/proto"
+)
+
+func (s *ConnectionSuite) TestInferVersion(c *C) {
+	for _, tc := range []struct {
+		apis    []proto.APIVersionsRespAPI
+		version Version
+	}{
+		{
+			// 0.10.0.1
+			[]proto.APIVersionsRespAPI{
+				{APIKey: proto.ProduceReqKind, MaxVersion: 2},
+				{APIKey: proto.FetchReqKind, MaxVersion: 2},
+				{APIKey: proto.OffsetReqKind, MaxVersion: 0},
+				{APIKey: proto.MetadataReqKind, MaxVersion: 1},
+				{APIKey: proto.OffsetFetchReqKind, MaxVersion: 1},
+				{APIKey: proto.APIVersionsReqKind, MaxVersion: 0},
+			},
+			V0_10_0,
+		},
+		{
+			// 0.11.0.3
+			[]proto.APIVersionsRespAPI{
+				{APIKey: proto.ProduceReqKind, MaxVersion: 3},
+				{APIKey: proto.FetchReqKind, MaxVersion: 5},
+				{APIKey: proto.OffsetReqKind, MaxVersion: 2},
+				{APIKey: proto.MetadataReqKind, MaxVersion: 4},
+				{APIKey: proto.OffsetFetchReqKind, MaxVersion: 3},
+				{APIKey: proto.APIVersionsReqKind, MaxVersion: 1},
+			},
+			V0_11_0,
+		},
+		{
+			// 2.8.1
+			[]proto.APIVersionsRespAPI{
+				{APIKey: proto.ProduceReqKind, MaxVersion: 9},
+				{APIKey: proto.FetchReqKind, MaxVersion: 12},
+				{APIKey: proto.OffsetReqKind, MaxVersion: 6},
+				{APIKey: proto.MetadataReqKind, MaxVersion: 11},
+				{APIKey: proto.OffsetFetchReqKind, MaxVersion: 7},
+				{APIKey: proto.APIVersionsReqKind, MaxVersion: 3},
+			},
+			V2_8_0,
+		},
+	} {
+		version, err := inferVersion(tc.apis)
+		c.Assert(err, IsNil)
+		c.Assert(version, Equals, tc.version)
+	}
+
+	_, err := inferVersion([]proto.APIVersionsRespAPI{{APIKey: proto.FetchReqKind, MaxVersion: 1}})
+	c.Assert(err, Equals, ErrUnknownBrokerVersion)
+
+	c.Assert(V2_8_0.String(), Equals, "2.8.0")
+	c.Assert(V2_8_0.AtLeast(V0_11_0), Equals, true)
+	c.Assert(V0_10_1.AtLeast(V0_10_2), Equals, false)
+	c.Assert(V0_10_1.AtLeast(V0_10_1), Equals, true)
+}
+
+func (s *ConnectionSuite) TestConnectionInferBrokerVersion(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	var requests int
+	srv.Handle(APIVersionsRequest, func(request Serializable) Serializable {
+		req := request.(*proto.APIVersionsReq)
+		requests++
+		return &proto.APIVersionsResp{
+			CorrelationID: req.CorrelationID,
+			APIVersions: []proto.APIVersionsRespAPI{
+				{APIKey: proto.ProduceReqKind, MaxVersion: 3},
+				{APIKey: proto.FetchReqKind, MaxVersion: 5},
+				{APIKey: proto.MetadataReqKind, MaxVersion: 4},
+			},
+		}
+	})
+
+	conn, err := newTCPConnection(srv.Address(), time.Second)
+	c.Assert(err, IsNil)
+	defer func() { _ = conn.Close() }()
+
+	version, err := conn.InferBrokerVersion()
+	c.Assert(err, IsNil)
+	c.Assert(version, Equals, V0_11_0)
+
+	// versions already known are not fetched again
+	version, err = conn.InferBrokerVersion()
+	c.Assert(err, IsNil)
+	c.Assert(version, Equals, V0_11_0)
+	c.Assert(requests, Equals, 1)
+}
@@ -0,0 +1,83 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Direction tells whether the bytes passed to WireHook were sent to or
+// received from the broker.
+type Direction int
+
+const (
+	// DirectionSend is used for requests written to the broker.
+	DirectionSend Direction = iota
+
+	// DirectionReceive is used for responses read from the broker.
+	DirectionReceive
+)
+
+func (d Direction) String() string {
+	switch d {
+	case DirectionSend:
+		return "send"
+	case DirectionReceive:
+		return "receive"
+	}
+	return fmt.Sprintf("Direction(%d)", int(d))
+}
+
+// WireHook is called with the raw bytes of every request written to and
+// every response read from a connection, including their size prefix. It is
+// meant for debugging the protocol, for example by dumping the traffic.
+//
+// apiKey and apiVersion of a response are the kind and version of the
+// request it answers, which is the version the response is decoded as, or -1
+// if they are not known. Requests are passed to the hook before they are
+// written. Hook must neither modify nor retain raw.
+type WireHook func(dir Direction, apiKey, apiVersion, correlationID int32, raw []byte)
+
+// sentAPI is the API kind and version of a request sent to the broker.
+type sentAPI struct {
+	kind    int16
+	version int16
+}
+
+// setOnWire sets the hook called with the raw bytes sent and received by the
+// connection. Nil disables it.
+func (c *connection) setOnWire(hook WireHook) {
+	c.onWire.Store(hook)
+}
+
+// wireHook returns the hook set with setOnWire, if any.
+func (c *connection) wireHook() WireHook {
+	hook, _ := c.onWire.Load().(WireHook)
+	return hook
+}
+
+// sendOnWire passes given encoded request to the hook. Kind and version of the
+// request are remembered until its response arrives, if any is expected, so
+// that the response can be reported with them.
+func (c *connection) sendOnWire(hook WireHook, b []byte) {
+	// size, api key, api version and correlation ID
+	if len(b) < 12 {
+		hook(DirectionSend, -1, -1, -1, b)
+		return
+	}
+	kind := int16(binary.BigEndian.Uint16(b[4:]))
+	version := int16(binary.BigEndian.Uint16(b[6:]))
+	correlationID := int32(binary.BigEndian.Uint32(b[8:]))
+
+	shard := c.shardOf(correlationID)
+	c.lockShard(shard)
+	// requests sent without waiting for response, such as produce requests
+	// without acks, are never answered, so their kind is not kept
+	_, waiting := shard.respc[correlationID]
+	_, async := shard.respcb[correlationID]
+	if waiting || async {
+		shard.sent[correlationID] = sentAPI{kind: kind, version: version}
+	}
+	shard.mu.Unlock()
+
+	hook(DirectionSend, int32(kind), int32(version), correlationID, b)
+}
@@ -0,0 +1,118 @@
+package kafka
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/dropbox/kafka/proto"
+)
+
+type wireRecord struct {
+	dir           Direction
+	apiKey        int32
+	apiVersion    int32
+	correlationID int32
+	raw           []byte
+}
+
+func (s *ConnectionSuite) TestConnectionOnWire(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	conn, err := newTCPConnection(srv.Address(), time.Second)
+	if err != nil {
+		c.Fatalf("could not conect to test server: %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	var mu sync.Mutex
+	var records []wireRecord
+	conn.setOnWire(func(dir Direction, apiKey, apiVersion, correlationID int32, raw []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		records = append(records, wireRecord{dir, apiKey, apiVersion, correlationID, append([]byte(nil), raw...)})
+	})
+
+	req := &proto.MetadataReq{ClientID: "tester", Version: 1, Topics: []string{"foo"}}
+	_, err = conn.Metadata(req)
+	c.Assert(err, IsNil)
+
+	// produce without acks is never answered
+	_, err = conn.Produce(&proto.ProduceReq{
+		ClientID:     "tester",
+		RequiredAcks: proto.RequiredAcksNone,
+		Topics: []proto.ProduceReqTopic{
+			{
+				Name: "foo",
+				Partitions: []proto.ProduceReqPartition{
+					{ID: 0, Messages: []*proto.Message{{Value: []byte("a")}}},
+				},
+			},
+		},
+	})
+	c.Assert(err, IsNil)
+
+	mu.Lock()
+	defer mu.Unlock()
+	c.Assert(records, HasLen, 3)
+
+	reqBytes, err := req.Bytes()
+	c.Assert(err, IsNil)
+	c.Assert(records[0].dir, Equals, DirectionSend)
+	c.Assert(records[0].apiKey, Equals, int32(proto.MetadataReqKind))
+	c.Assert(records[0].apiVersion, Equals, int32(1))
+	c.Assert(records[0].correlationID, Equals, req.CorrelationID)
+	c.Assert(records[0].raw, DeepEquals, reqBytes)
+
+	c.Assert(records[1].dir, Equals, DirectionReceive)
+	c.Assert(records[1].apiKey, Equals, int32(proto.MetadataReqKind))
+	c.Assert(records[1].apiVersion, Equals, int32(1))
+	c.Assert(records[1].correlationID, Equals, req.CorrelationID)
+	size := binary.BigEndian.Uint32(records[1].raw)
+	c.Assert(int(size), Equals, len(records[1].raw)-4)
+	c.Assert(bytes.Equal(records[1].raw[4:8], reqBytes[8:12]), Equals, true)
+
+	c.Assert(records[2].dir, Equals, DirectionSend)
+	c.Assert(records[2].apiKey, Equals, int32(proto.ProduceReqKind))
+	for i := range conn.waiters {
+		c.Assert(conn.waiters[i].sent, HasLen, 0)
+	}
+}
+
+func (s *ConnectionSuite) TestConnectionParseErrorVersion(c *C) {
+	srv := NewServer()
+	srv.Start()
+	defer srv.Close()
+
+	// answer with a response that is too short to be a metadata response
+	srv.Handle(MetadataRequest, func(request Serializable) Serializable {
+		req := request.(*proto.MetadataReq)
+		return &proto.HeartbeatResp{CorrelationID: req.CorrelationID}
+	})
+
+	conn, err := newTCPConnection(srv.Address(), time.Second)
+	if err != nil {
+		c.Fatalf("could not conect to test server: %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	var received []int32
+	conn.setOnWire(func(dir Direction, apiKey, apiVersion, correlationID int32, raw []byte) {
+		if dir == DirectionReceive {
+			received = append(received, apiKey, apiVersion)
+		}
+	})
+
+	_, err = conn.Metadata(&proto.MetadataReq{ClientID: "tester", Version: 1})
+	perr, ok := err.(*proto.ParseError)
+	c.Assert(ok, Equals, true, Commentf("unexpected error: %v", err))
+	c.Assert(perr.RequestKind, Equals, int16(proto.MetadataReqKind))
+	c.Assert(perr.Version, Equals, int16(1))
+	c.Assert(err, ErrorMatches, "cannot parse Metadata response v1 at byte .*")
+	c.Assert(received, DeepEquals, []int32{int32(proto.MetadataReqKind), 1})
+}